@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// When a cluster is heavily loaded, its stats requests slow down, and
+// polling it at the configured cadence only adds to the load. With the
+// [adaptive] settings enabled, the collector measures how long each bucket's
+// stats request takes. If it takes longer than latency_threshold of the
+// bucket's configured interval, or times out, the bucket's interval is
+// doubled, up to max_backoff times the configured interval. Once
+// recover_after consecutive requests have taken less than half the threshold,
+// the interval is halved again, until it is back to the configured interval.
+//
+// Each request is limited to timeout seconds (by default the bucket's current
+// interval). A bucket merging the stats of several stat groups that times out
+// split_after times in a row is split into one bucket per stat group, as with
+// fetch_by_statgroup, so that each request asks the cluster for less.
+
+// Defaults for the adaptive interval settings
+const (
+	defaultAdaptiveLatencyThreshold = 0.5
+	defaultAdaptiveMaxBackoff       = 8
+	defaultAdaptiveRecoverAfter     = 3
+	defaultAdaptiveSplitAfter       = 3
+)
+
+// adaptiveConfig defines the adaptive collection interval settings in the config file
+type adaptiveConfig struct {
+	Enabled          bool    `toml:"enabled"`
+	LatencyThreshold float64 `toml:"latency_threshold"` // fraction of the configured interval a request may take before the interval is backed off
+	MaxBackoff       int     `toml:"max_backoff"`       // maximum multiple of the configured interval
+	RecoverAfter     int     `toml:"recover_after"`     // consecutive fast requests before the interval is halved
+	Timeout          int     `toml:"timeout"`           // seconds allowed for each request (0 = the bucket's current interval)
+	SplitAfter       int     `toml:"split_after"`       // consecutive timeouts before a bucket is fetched by stat group (0 = never)
+}
+
+var (
+	intervalBackoff = promauto.With(selfRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "collection",
+		Name:      "interval_backoff",
+		Help:      "Multiple of the configured interval that a stat bucket is currently collected at.",
+	}, []string{"cluster", "bucket"})
+	bucketSplits = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "collection",
+		Name:      "bucket_splits_total",
+		Help:      "Number of stat buckets split by stat group because they repeatedly timed out.",
+	}, []string{"cluster"})
+)
+
+// validateAdaptive checks the [adaptive] settings
+func validateAdaptive(ac adaptiveConfig) error {
+	var errs []error
+	if ac.LatencyThreshold <= 0 {
+		errs = append(errs, errors.New("[adaptive] latency_threshold must be positive"))
+	}
+	if ac.MaxBackoff < 1 {
+		errs = append(errs, errors.New("[adaptive] max_backoff must be at least 1"))
+	}
+	if ac.RecoverAfter < 1 {
+		errs = append(errs, errors.New("[adaptive] recover_after must be at least 1"))
+	}
+	if ac.Timeout < 0 {
+		errs = append(errs, errors.New("[adaptive] timeout must not be negative"))
+	}
+	if ac.SplitAfter < 0 {
+		errs = append(errs, errors.New("[adaptive] split_after must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// bucketLoad is the adaptive state of a stat bucket
+type bucketLoad struct {
+	backoff  int // current multiple of the configured interval
+	fast     int // consecutive requests faster than the recovery latency
+	timeouts int // consecutive timed out requests
+}
+
+// adaptiveIntervals adapts the collection intervals of a cluster's stat
+// buckets to the cluster's response times
+type adaptiveIntervals struct {
+	label   string // cluster name for logs and metrics
+	conf    adaptiveConfig
+	buckets map[*Item]*bucketLoad
+}
+
+// newAdaptiveIntervals returns the adaptive interval state for the cluster
+func newAdaptiveIntervals(clusterName string, conf adaptiveConfig) *adaptiveIntervals {
+	return &adaptiveIntervals{label: clusterName, conf: conf, buckets: make(map[*Item]*bucketLoad)}
+}
+
+// loadOf returns the adaptive state of the bucket
+func (a *adaptiveIntervals) loadOf(item *Item) *bucketLoad {
+	bl, ok := a.buckets[item]
+	if !ok {
+		bl = &bucketLoad{backoff: 1}
+		a.buckets[item] = bl
+	}
+	return bl
+}
+
+// interval returns the bucket's current collection interval
+func (a *adaptiveIntervals) interval(item *Item) time.Duration {
+	if !a.conf.Enabled {
+		return item.value.sts.interval
+	}
+	return item.value.sts.interval * time.Duration(a.loadOf(item).backoff)
+}
+
+// requestContext returns the context for a stats request of the bucket,
+// limited to the request timeout
+func (a *adaptiveIntervals) requestContext(ctx context.Context, item *Item) (context.Context, context.CancelFunc) {
+	if !a.conf.Enabled {
+		return ctx, func() {}
+	}
+	timeout := time.Duration(a.conf.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = a.interval(item)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// isTimeout reports whether a request failed because it timed out, rather
+// than because ctx was cancelled
+func isTimeout(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
+
+// observe records a stats request of the bucket that took latency and failed
+// with err (or nil), adjusting the bucket's interval. It reports whether the
+// interval changed.
+func (a *adaptiveIntervals) observe(ctx context.Context, item *Item, latency time.Duration, err error) bool {
+	if !a.conf.Enabled {
+		return false
+	}
+	bl := a.loadOf(item)
+	threshold := time.Duration(a.conf.LatencyThreshold * float64(item.value.sts.interval))
+	switch {
+	case err != nil && isTimeout(ctx, err):
+		bl.timeouts++
+		return a.backOff(item, bl, latency)
+	case err != nil:
+		// other failures are retried as before
+		return false
+	case latency > threshold:
+		bl.timeouts = 0
+		return a.backOff(item, bl, latency)
+	case latency < threshold/2:
+		bl.timeouts = 0
+		bl.fast++
+		if bl.fast < a.conf.RecoverAfter || bl.backoff == 1 {
+			return false
+		}
+		bl.fast = 0
+		bl.backoff /= 2
+		intervalBackoff.WithLabelValues(a.label, itemName(item)).Set(float64(bl.backoff))
+		log.Log(ctx, LevelNotice, "cluster response time recovered, restoring collection interval",
+			slog.String("cluster", a.label), slog.String("bucket", itemName(item)),
+			slog.Duration("latency", latency), slog.Duration("interval", a.interval(item)))
+		return true
+	default:
+		bl.timeouts = 0
+		bl.fast = 0
+		return false
+	}
+}
+
+// backOff doubles the bucket's interval, up to the maximum backoff
+func (a *adaptiveIntervals) backOff(item *Item, bl *bucketLoad, latency time.Duration) bool {
+	bl.fast = 0
+	if bl.backoff >= a.conf.MaxBackoff {
+		return false
+	}
+	bl.backoff = min(bl.backoff*2, a.conf.MaxBackoff)
+	intervalBackoff.WithLabelValues(a.label, itemName(item)).Set(float64(bl.backoff))
+	log.Warn("cluster is slow to respond, backing off collection interval",
+		slog.String("cluster", a.label), slog.String("bucket", itemName(item)),
+		slog.Duration("latency", latency), slog.Duration("interval", a.interval(item)))
+	return true
+}
+
+// shouldSplit reports whether the bucket has timed out often enough to be
+// fetched by stat group
+func (a *adaptiveIntervals) shouldSplit(item *Item) bool {
+	if !a.conf.Enabled || a.conf.SplitAfter == 0 || item.value.sts.groupName != "" {
+		return false
+	}
+	return a.loadOf(item).timeouts >= a.conf.SplitAfter
+}
+
+// split replaces the bucket with one item per stat group, which keep its
+// schedule and backoff. If the bucket's stats all come from one group, it is
+// only labelled with the group and no new items are returned.
+func (a *adaptiveIntervals) split(item *Item, sg map[string]statGroup) []*Item {
+	parts := splitBucket(*item.value.sts, sg)
+	if len(parts) < 2 {
+		if len(parts) == 1 {
+			intervalBackoff.DeleteLabelValues(a.label, itemName(item))
+			item.value.sts.groupName = parts[0].groupName
+			if bl := a.loadOf(item); bl.backoff > 1 {
+				intervalBackoff.WithLabelValues(a.label, itemName(item)).Set(float64(bl.backoff))
+			}
+		}
+		return nil
+	}
+	bl := a.loadOf(item)
+	delete(a.buckets, item)
+	intervalBackoff.DeleteLabelValues(a.label, itemName(item))
+	bucketSplits.WithLabelValues(a.label).Inc()
+	items := make([]*Item, len(parts))
+	groups := make([]string, len(parts))
+	for i := range parts {
+		items[i] = &Item{value: PqValue{StatTypeRegularStat, &parts[i]}, priority: item.priority, due: item.due}
+		a.buckets[items[i]] = &bucketLoad{backoff: bl.backoff}
+		if bl.backoff > 1 {
+			intervalBackoff.WithLabelValues(a.label, itemName(items[i])).Set(float64(bl.backoff))
+		}
+		groups[i] = parts[i].groupName
+	}
+	log.Warn("stat bucket repeatedly timed out, fetching it by stat group",
+		slog.String("cluster", a.label), slog.String("bucket", itemName(item)),
+		slog.Int("timeouts", bl.timeouts), slog.Any("groups", groups))
+	return items
+}
+
+// splitBucket divides the bucket's stats by the stat group they belong to.
+// A stat in several groups goes to the first of them by name.
+func splitBucket(sts statTimeSet, sg map[string]statGroup) []statTimeSet {
+	remaining := make(map[string]bool, len(sts.stats))
+	for _, stat := range sts.stats {
+		remaining[stat] = true
+	}
+	var parts []statTimeSet
+	for _, group := range slices.Sorted(maps.Keys(sg)) {
+		var stats []string
+		for _, stat := range sg[group].stats {
+			if remaining[stat] {
+				stats = append(stats, stat)
+				delete(remaining, stat)
+			}
+		}
+		if len(stats) > 0 {
+			parts = append(parts, statTimeSet{interval: sts.interval, stats: stats, groupName: group})
+		}
+	}
+	if len(remaining) > 0 {
+		// not expected, but keep any stats not found in a group
+		stats := slices.DeleteFunc(slices.Clone(sts.stats), func(s string) bool { return !remaining[s] })
+		parts = append(parts, statTimeSet{interval: sts.interval, stats: stats, groupName: fmt.Sprintf("ungrouped/%v", sts.interval)})
+	}
+	return parts
+}
+
+// currentShortestInterval returns the shortest current collection interval
+// of the queue items, not counting self metrics
+func currentShortestInterval(items []*Item, intervalOf func(*Item) time.Duration) time.Duration {
+	var shortest time.Duration
+	for _, item := range items {
+		if item.value.stattype == StatTypeSelfMetrics {
+			continue
+		}
+		if d := intervalOf(item); shortest == 0 || d < shortest {
+			shortest = d
+		}
+	}
+	return shortest
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newAdaptiveItem(interval time.Duration, stats ...string) *Item {
+	return &Item{value: PqValue{StatTypeRegularStat, &statTimeSet{interval: interval, stats: stats}}}
+}
+
+func TestAdaptiveIntervals_Backoff(t *testing.T) {
+	setMemoryBackend()
+	conf := defaultConfig().Adaptive
+	interval := 10 * time.Second
+	item := newAdaptiveItem(interval, "node.cpu.user.avg")
+
+	a := newAdaptiveIntervals("cluster1", conf)
+	if a.observe(t.Context(), item, 9*time.Second, nil) || a.interval(item) != interval {
+		t.Errorf("expected no backoff when adaptive intervals are disabled, got %v", a.interval(item))
+	}
+
+	conf.Enabled = true
+	a = newAdaptiveIntervals("cluster1", conf)
+	// slow requests double the interval up to the maximum backoff
+	for i, want := range []time.Duration{20, 40, 80, 80} {
+		a.observe(t.Context(), item, 6*time.Second, nil)
+		if got := a.interval(item); got != want*time.Second {
+			t.Errorf("slow request %d: expected interval %v, got %v", i+1, want*time.Second, got)
+		}
+	}
+	// requests between the recovery latency and the threshold keep the interval
+	for range 5 {
+		a.observe(t.Context(), item, 3*time.Second, nil)
+	}
+	if got := a.interval(item); got != 80*time.Second {
+		t.Errorf("expected the interval to be kept, got %v", got)
+	}
+	// every recover_after fast requests halve the interval
+	for i := 1; i <= 3*conf.RecoverAfter+1; i++ {
+		changed := a.observe(t.Context(), item, time.Second, nil)
+		if changed != (i%conf.RecoverAfter == 0 && i <= 3*conf.RecoverAfter) {
+			t.Errorf("fast request %d: unexpected change %v", i, changed)
+		}
+	}
+	if got := a.interval(item); got != interval {
+		t.Errorf("expected the configured interval to be restored, got %v", got)
+	}
+	// other failures do not change the interval
+	if a.observe(t.Context(), item, 9*time.Second, errors.New("connection reset")) {
+		t.Errorf("expected a failed request not to change the interval")
+	}
+}
+
+func TestAdaptiveIntervals_Timeout(t *testing.T) {
+	setMemoryBackend()
+	conf := defaultConfig().Adaptive
+	conf.Enabled = true
+	conf.Timeout = 0
+	interval := 10 * time.Millisecond
+	item := newAdaptiveItem(interval, "ifs.bytes.used", "node.cpu.user.avg")
+	a := newAdaptiveIntervals("cluster1", conf)
+
+	// a request is limited to the bucket's current interval
+	reqCtx, cancel := a.requestContext(t.Context(), item)
+	<-reqCtx.Done()
+	cancel()
+	err := fmt.Errorf("request failed: %w", reqCtx.Err())
+	if !isTimeout(t.Context(), err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	cancelled, cancel := context.WithCancel(t.Context())
+	cancel()
+	if isTimeout(cancelled, err) {
+		t.Errorf("expected no timeout once the collection is cancelled")
+	}
+
+	for i := 1; i <= conf.SplitAfter; i++ {
+		if a.shouldSplit(item) {
+			t.Fatalf("unexpected split after %d timeouts", i-1)
+		}
+		a.observe(t.Context(), item, interval, err)
+	}
+	if !a.shouldSplit(item) {
+		t.Fatalf("expected a split after %d timeouts", conf.SplitAfter)
+	}
+	if got := a.interval(item); got != 8*interval {
+		t.Errorf("expected timeouts to back off the interval, got %v", got)
+	}
+
+	item.due = time.Unix(1700000000, 0)
+	item.priority = item.due.Add(time.Second)
+	sg := map[string]statGroup{
+		"ifs": {stats: []string{"ifs.bytes.used"}},
+		"cpu": {stats: []string{"node.cpu.user.avg", "node.cpu.sys.avg"}},
+	}
+	items := a.split(item, sg)
+	if len(items) != 2 {
+		t.Fatalf("expected a bucket per stat group, got %d", len(items))
+	}
+	for _, it := range items {
+		if !it.due.Equal(item.due) || !it.priority.Equal(item.priority) {
+			t.Errorf("%s: expected the schedule to be kept", itemName(it))
+		}
+		if a.interval(it) != 8*interval || a.shouldSplit(it) {
+			t.Errorf("%s: expected the backoff to be kept and no further split", itemName(it))
+		}
+	}
+	if _, ok := a.buckets[item]; ok {
+		t.Errorf("expected the split bucket to be forgotten")
+	}
+
+	// a bucket from a single group is only labelled with it
+	single := newAdaptiveItem(interval, "node.cpu.user.avg")
+	if items := a.split(single, sg); items != nil || single.value.sts.groupName != "cpu" {
+		t.Errorf("expected the bucket to be labelled with its group, got %d items, group %q", len(items), single.value.sts.groupName)
+	}
+}
+
+func TestSplitBucket(t *testing.T) {
+	sg := map[string]statGroup{
+		"b": {stats: []string{"s1", "s3"}},
+		"a": {stats: []string{"s1", "s2"}},
+	}
+	parts := splitBucket(statTimeSet{interval: time.Minute, stats: []string{"s1", "s2", "s3", "s4"}}, sg)
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %+v", parts)
+	}
+	want := [][]string{{"s1", "s2"}, {"s3"}, {"s4"}}
+	for i, p := range parts {
+		if !slices.Equal(p.stats, want[i]) || p.interval != time.Minute || p.groupName == "" {
+			t.Errorf("part %d: expected %v, got %+v", i, want[i], p)
+		}
+	}
+}
+
+func TestValidateAdaptive(t *testing.T) {
+	if err := validateAdaptive(defaultConfig().Adaptive); err != nil {
+		t.Errorf("unexpected error for the default settings: %v", err)
+	}
+	err := validateAdaptive(adaptiveConfig{Enabled: true, Timeout: -1, SplitAfter: -1})
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 5 {
+		t.Errorf("expected 5 errors, got %v", err)
+	}
+}
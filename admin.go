@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The admin HTTP server provides health and readiness endpoints, e.g. for
+// Kubernetes liveness and readiness probes:
+//
+//	/healthz  200 if every cluster is collecting (or starting up), else 503
+//	/readyz   200 once every enabled cluster has connected, fetched its stat
+//	          details and initialized its back end, else 503
+//
+// Both return a JSON body with the status of each cluster.
+//
+// If an API token is configured, the server also provides a control API.
+// Requests must carry an "Authorization: Bearer <token>" header:
+//
+//	POST /api/v1/reload                      reload the config file
+//	GET  /api/v1/clusters                    list the running clusters
+//	POST /api/v1/clusters/{cluster}/pause    pause collection for the cluster
+//	POST /api/v1/clusters/{cluster}/resume   resume collection for the cluster
+//	POST /api/v1/clusters/{cluster}/collect  collect immediately; ?group=<name>
+//	                                         collects only the given stat group
+//	GET  /api/v1/clusters/{cluster}/schedule dump the collection schedule
+//	GET  /api/v1/loglevel                    return the current log level
+//	PUT  /api/v1/loglevel                    set the log level, e.g. {"level":"DEBUG"}
+//
+// Clusters may be identified by cluster name or by configured hostname.
+
+// The bearer token is sent with every control request, so the control API is
+// only served over TLS (tls_cert and tls_key) or on a loopback address.
+
+// adminCommandTimeout bounds how long a control request waits for a busy
+// collection loop
+const adminCommandTimeout = 30 * time.Second
+
+// healthResponse is the JSON body returned by the health endpoints
+type healthResponse struct {
+	Status   string          `json:"status"`
+	Clusters []clusterHealth `json:"clusters"`
+}
+
+// clusterInfo is the JSON description of a running cluster
+type clusterInfo struct {
+	Hostname string `json:"hostname"`
+	Cluster  string `json:"cluster"`
+	Paused   bool   `json:"paused"`
+}
+
+// logLevelRequest is the JSON body of the log level endpoint
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// newAdminMux returns the handler for the admin HTTP server. The control API
+// is only served if token is non-empty.
+func newAdminMux(token string, reload chan<- struct{}) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		clusters, _, healthy := health.status()
+		writeHealth(w, healthy, "ok", "unhealthy", clusters)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		clusters, ready, _ := health.status()
+		writeHealth(w, ready, "ready", "not ready", clusters)
+	})
+	if token == "" {
+		return mux
+	}
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, requireToken(token, h))
+	}
+	handle("POST /api/v1/reload", func(w http.ResponseWriter, _ *http.Request) {
+		log.Log(context.Background(), LevelNotice, "reload requested via admin API")
+		select {
+		case reload <- struct{}{}:
+		default: // reload already pending
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "reload requested"})
+	})
+	handle("GET /api/v1/clusters", func(w http.ResponseWriter, _ *http.Request) {
+		infos := []clusterInfo{}
+		for _, ctl := range controls.list() {
+			infos = append(infos, clusterInfo{Hostname: ctl.hostname, Cluster: ctl.cluster, Paused: ctl.paused.Load()})
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+	handle("POST /api/v1/clusters/{cluster}/pause", withCluster(func(w http.ResponseWriter, _ *http.Request, ctl *clusterControl) {
+		log.Info("pausing collection via admin API", slog.String("cluster", ctl.cluster))
+		ctl.setPaused(true)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "paused"})
+	}))
+	handle("POST /api/v1/clusters/{cluster}/resume", withCluster(func(w http.ResponseWriter, _ *http.Request, ctl *clusterControl) {
+		log.Info("resuming collection via admin API", slog.String("cluster", ctl.cluster))
+		ctl.setPaused(false)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "collecting"})
+	}))
+	handle("POST /api/v1/clusters/{cluster}/collect", withCluster(func(w http.ResponseWriter, r *http.Request, ctl *clusterControl) {
+		ctx, cancel := context.WithTimeout(r.Context(), adminCommandTimeout)
+		defer cancel()
+		reply := ctl.send(ctx, clusterCommand{kind: clusterCmdCollect, group: r.URL.Query().Get("group")})
+		if reply.err != nil {
+			writeError(w, http.StatusBadRequest, reply.err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "collected"})
+	}))
+	handle("GET /api/v1/clusters/{cluster}/schedule", withCluster(func(w http.ResponseWriter, r *http.Request, ctl *clusterControl) {
+		ctx, cancel := context.WithTimeout(r.Context(), adminCommandTimeout)
+		defer cancel()
+		reply := ctl.send(ctx, clusterCommand{kind: clusterCmdSchedule})
+		if reply.err != nil {
+			writeError(w, http.StatusServiceUnavailable, reply.err)
+			return
+		}
+		writeJSON(w, http.StatusOK, reply.schedule)
+	}))
+	handle("GET /api/v1/loglevel", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, logLevelRequest{Level: levelName(runtimeLogLevel.Level())})
+	})
+	handle("PUT /api/v1/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		var req logLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+		level, err := ParseLevel(req.Level)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		runtimeLogLevel.Set(level)
+		log.Log(context.Background(), LevelNotice, "log level changed via admin API", slog.String("level", levelName(level)))
+		writeJSON(w, http.StatusOK, logLevelRequest{Level: levelName(level)})
+	})
+	return mux
+}
+
+// requireToken rejects requests which do not carry the admin API bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid admin API token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCluster resolves the {cluster} path parameter to a running collection loop
+func withCluster(h func(http.ResponseWriter, *http.Request, *clusterControl)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctl := controls.lookup(r.PathValue("cluster"))
+		if ctl == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no running collection for cluster %q", r.PathValue("cluster")))
+			return
+		}
+		h(w, r, ctl)
+	}
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// writeHealth writes a health endpoint response
+func writeHealth(w http.ResponseWriter, ok bool, okStatus string, failStatus string, clusters []clusterHealth) {
+	resp := healthResponse{Status: okStatus, Clusters: clusters}
+	code := http.StatusOK
+	if !ok {
+		resp.Status = failStatus
+		code = http.StatusServiceUnavailable
+	}
+	if resp.Clusters == nil {
+		resp.Clusters = []clusterHealth{}
+	}
+	writeJSON(w, code, resp)
+}
+
+// validateAdmin checks the [admin] settings
+func validateAdmin(ac adminConfig) error {
+	if (ac.TLSCert == "") != (ac.TLSKey == "") {
+		return errors.New("[admin] tls_cert and tls_key must be set together")
+	}
+	if ac.ListenAddr != "" && ac.APIToken != "" && ac.TLSCert == "" && !isLoopbackAddr(ac.ListenAddr) {
+		return errors.New("[admin] api_token requires tls_cert and tls_key, or a loopback listen_addr (e.g. \"127.0.0.1:8081\"), so that the token is not sent in clear text")
+	}
+	return nil
+}
+
+// isLoopbackAddr reports whether the listen address only accepts local connections
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// startAdminListener serves the admin API until the context is cancelled.
+// It is started once at startup and keeps running across config reloads so
+// that probes do not fail while collection restarts.
+func startAdminListener(ctx context.Context, ac adminConfig, reload chan<- struct{}) error {
+	token, err := secretFromEnv(ac.APIToken)
+	if err != nil {
+		return fmt.Errorf("unable to resolve admin API token: %w", err)
+	}
+	if token == "" {
+		log.Info("admin API token not set, control API disabled")
+	}
+	listener, err := createListener(ctx, ac.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("error creating listener for admin API: %w", err)
+	}
+	log.Info("Starting admin API listener", slog.String("address", ac.ListenAddr))
+	server := &http.Server{Handler: newAdminMux(token, reload), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		var err error
+		if ac.TLSCert != "" {
+			err = server.ServeTLS(listener, ac.TLSCert, ac.TLSKey)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("admin API listener exited with error", slog.String("error", err.Error()))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log/slog"
 	"maps"
+	"math"
 	"strconv"
 	"time"
 )
@@ -19,6 +20,7 @@ type Point struct {
 	time   int64
 	fields []ptFields
 	tags   []ptTags
+	origin string // name of the stat before a relabel rule renamed it
 }
 
 // ptFields maps the fields for a given instance of a metric to their values
@@ -29,8 +31,8 @@ type ptTags map[string]string
 
 // decodeProtocolSummaryStat takes a SummaryStatsProtocolItem and decodes it into
 // fields and tags usable by the back end writers.
-func decodeProtocolSummaryStat(cluster string, pss SummaryStatsProtocolItem) (ptFields, ptTags) {
-	tags := ptTags{"cluster": cluster}
+func decodeProtocolSummaryStat(cluster string, extra ptTags, pss SummaryStatsProtocolItem) (ptFields, ptTags) {
+	tags := baseTags(cluster, extra)
 	fields := make(ptFields)
 	if pss.Node != nil {
 		tags["node"] = strconv.FormatInt(*pss.Node, 10)
@@ -60,8 +62,8 @@ func decodeProtocolSummaryStat(cluster string, pss SummaryStatsProtocolItem) (pt
 
 // decodeClientSummaryStat takes a SummaryStatsClientItem and decodes it into
 // fields and tags usable by the back end writers.
-func decodeClientSummaryStat(cluster string, css SummaryStatsClientItem) (ptFields, ptTags) {
-	tags := ptTags{"cluster": cluster}
+func decodeClientSummaryStat(cluster string, extra ptTags, css SummaryStatsClientItem) (ptFields, ptTags) {
+	tags := baseTags(cluster, extra)
 	fields := make(ptFields)
 	if css.Node != nil {
 		tags["node"] = strconv.FormatInt(*css.Node, 10)
@@ -96,8 +98,8 @@ func decodeClientSummaryStat(cluster string, css SummaryStatsClientItem) (ptFiel
 
 // decodeDriveSummaryStat takes a SummaryStatsDriveItem and decodes it into
 // fields and tags usable by the back end writers.
-func decodeDriveSummaryStat(cluster string, dss SummaryStatsDriveItem) (ptFields, ptTags) {
-	tags := ptTags{"cluster": cluster}
+func decodeDriveSummaryStat(cluster string, extra ptTags, dss SummaryStatsDriveItem) (ptFields, ptTags) {
+	tags := baseTags(cluster, extra)
 	fields := make(ptFields)
 	tags["drive_id"] = dss.DriveID
 	tags["type"] = dss.Type
@@ -118,12 +120,53 @@ func decodeDriveSummaryStat(cluster string, dss SummaryStatsDriveItem) (ptFields
 	return fields, tags
 }
 
+// collectSummaryStats fetches one set of summary stats of the given type and
+// decodes them into points
+func (c *Cluster) collectSummaryStats(ctx context.Context, st StatType) ([]Point, error) {
+	var points []Point
+	add := func(name string, t int64, fields ptFields, tags ptTags) {
+		points = append(points, Point{name: summaryStatsBasename + name, time: t, fields: []ptFields{fields}, tags: []ptTags{tags}})
+	}
+	switch st {
+	case StatTypeSummaryStatProtocol:
+		ssp, err := c.GetSummaryProtocolStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, stat := range ssp {
+			fields, tags := decodeProtocolSummaryStat(c.ClusterName, c.tags, stat)
+			add("protocol", stat.Time, fields, tags)
+		}
+	case StatTypeSummaryStatClient:
+		ssc, err := c.GetSummaryClientStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, stat := range ssc {
+			fields, tags := decodeClientSummaryStat(c.ClusterName, c.tags, stat)
+			add("client", stat.Time, fields, tags)
+		}
+	case StatTypeSummaryStatDrive:
+		ssd, err := c.GetSummaryDriveStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, stat := range ssd {
+			fields, tags := decodeDriveSummaryStat(c.ClusterName, c.tags, stat)
+			add("drive", stat.Time, fields, tags)
+		}
+	default:
+		return nil, fmt.Errorf("not a summary stat type: %d", st)
+	}
+	return points, nil
+}
+
 // decodeStat takes the JSON result from the OneFS statistics API and breaks it
 // out into fields and tags usable by the back end writers.
-func decodeStat(cluster string, stat StatResult, includeDegraded bool, degraded bool) ([]ptFields, []ptTags, error) {
+func decodeStat(cluster string, extra ptTags, stat StatResult, includeDegraded bool, degraded bool) ([]ptFields, []ptTags, error) {
 	var initialTags ptTags
-	clusterStatTags := ptTags{"cluster": cluster}
-	nodeStatTags := ptTags{"cluster": cluster}
+	clusterStatTags := baseTags(cluster, extra)
+	nodeStatTags := baseTags(cluster, extra)
 	if includeDegraded {
 		clusterStatTags["degraded"] = strconv.FormatBool(degraded)
 		nodeStatTags["degraded"] = strconv.FormatBool(degraded)
@@ -233,12 +276,8 @@ func decodeValue(statname string, fieldname string, v any, baseTags ptTags, dept
 		if simple {
 			// We had a simple map with no sub-arrays, so just return the single set of fields and tags
 			log.Debug("decoded simple map", "fields", fields, "tags", tags)
-			if isInvalidStat(tags) {
-				log.Debug("dropping broken change_notify stat", slog.String("cluster", baseTags["cluster"]))
-			} else {
-				mfa = append(mfa, fields)
-				mta = append(mta, tags)
-			}
+			mfa = append(mfa, fields)
+			mta = append(mta, tags)
 		} else {
 			// We had a sub-array, so we need to combine the base fields and tags with each of the sub ones
 			log.Debug("decoded complex map", slog.Int("field count", len(subfields)), slog.Int("tag count", len(subtags)))
@@ -250,12 +289,8 @@ func decodeValue(statname string, fieldname string, v any, baseTags ptTags, dept
 				// merge the base fields and tags into the sub ones
 				maps.Copy(f, subfields[i])
 				maps.Copy(t, subtags[i])
-				if isInvalidStat(t) {
-					log.Debug("dropping broken change_notify stat", slog.String("cluster", baseTags["cluster"]))
-				} else {
-					mfa = append(mfa, f)
-					mta = append(mta, t)
-				}
+				mfa = append(mfa, f)
+				mta = append(mta, t)
 			}
 		}
 	default:
@@ -265,20 +300,18 @@ func decodeValue(statname string, fieldname string, v any, baseTags ptTags, dept
 	return mfa, mta, nil
 }
 
-// isInvalidStat checks the supplied tags and returns a boolean which, if true, specifies that
-// this statistic should be dropped.
-//
-// Some statistics (specifically, SMB change notify) have unusual semantics that can result in
-// misleadingly large latency values.
-func isInvalidStat(tags ptTags) bool {
-	if tags["op_name"] == "change_notify" || tags["op_name"] == "read_directory_change" {
-		return true
+// WriteStats takes an array of StatResults and writes them to the requested backend database
+func (c *Cluster) WriteStats(ctx context.Context, gc globalConfig, ss DBWriter, rp retryPolicy, stats []StatResult) error {
+	points, err := c.decodeStats(gc, stats)
+	if err != nil {
+		return err
 	}
-	return false
+	return writeWithRetry(ctx, ss, rp, points)
 }
 
-// WriteStats takes an array of StatResults and writes them to the requested backend database
-func (c *Cluster) WriteStats(ctx context.Context, gc globalConfig, ss DBWriter, stats []StatResult) error {
+// decodeStats takes an array of StatResults and converts them into Points,
+// skipping (and logging) any stats that returned an error
+func (c *Cluster) decodeStats(gc globalConfig, stats []StatResult) ([]Point, error) {
 	points := make([]Point, 0, len(stats)) // try to preallocate at least some space here
 	for _, stat := range stats {
 		degraded := false
@@ -296,6 +329,7 @@ func (c *Cluster) WriteStats(ctx context.Context, gc globalConfig, ss DBWriter,
 			}
 			// add it to the set of bad (unavailable) stats
 			c.badStats.Add(stat.Key)
+			unavailableStats.WithLabelValues(c.ClusterName).Set(float64(c.badStats.Cardinality()))
 			continue
 		case StatErrorStale, StatErrorConnTimeout, StatErrorTimeout, StatErrorNoHistory, StatErrorSystem:
 			// just skip over this time
@@ -306,24 +340,96 @@ func (c *Cluster) WriteStats(ctx context.Context, gc globalConfig, ss DBWriter,
 			log.Error("Stat returned unknown error code - skipping", slog.String("cluster", c.ClusterName), slog.String("stat", stat.Key), slog.Int("error_code", stat.ErrorCode), slog.String("error", stat.ErrorString))
 			continue
 		}
-		fa, ta, err := decodeStat(c.ClusterName, stat, gc.IncludeDegraded, degraded)
+		fa, ta, err := decodeStat(c.ClusterName, c.tags, stat, gc.IncludeDegraded, degraded)
 		if err != nil {
-			return fmt.Errorf("failed to decode stat %s: %w", stat.Key, err)
+			return nil, fmt.Errorf("failed to decode stat %s: %w", stat.Key, err)
 		}
 		point := Point{name: stat.Key, time: stat.UnixTime, fields: fa, tags: ta}
 		points = append(points, point)
 	}
-	// write the points to the database, retrying up to the limit
+	return points, nil
+}
+
+// retryPolicy controls how writes to a back end are retried
+type retryPolicy struct {
+	maxRetries int           // maximum number of write attempts
+	retryIntvl time.Duration // initial retry interval, doubled after each failure
+	spool      *diskSpool    // if non-nil, batches are spooled here once retries are exhausted
+	cluster    string        // self-metrics labels; metrics are not recorded if backend is empty
+	backend    string
+}
+
+// recordWrite updates the back end self-metrics for a write of n points
+func (rp retryPolicy) recordWrite(n int, err error) {
+	if rp.backend == "" {
+		return
+	}
+	if err != nil {
+		backendPointsDropped.WithLabelValues(rp.cluster, rp.backend).Add(float64(n))
+		return
+	}
+	backendPointsWritten.WithLabelValues(rp.cluster, rp.backend).Add(float64(n))
+}
+
+// processorRetryPolicy returns the write retry policy for the named back end.
+// Settings in the [stats_processor_retry.<name>] stanza override the global
+// stats_processor_max_retries and stats_processor_retry_interval values.
+func processorRetryPolicy(config *tomlConfig, name string) retryPolicy {
+	gc := config.Global
+	rp := retryPolicy{
+		maxRetries: gc.ProcessorMaxRetries,
+		retryIntvl: time.Second * time.Duration(gc.ProcessorRetryIntvl),
+	}
+	if prc, ok := config.ProcessorRetry[name]; ok {
+		if prc.MaxRetries != nil {
+			rp.maxRetries = *prc.MaxRetries
+			// as for the global setting, 0 or negative means retry forever
+			if rp.maxRetries <= 0 {
+				rp.maxRetries = math.MaxInt
+			}
+		}
+		if prc.RetryIntvl != nil {
+			rp.retryIntvl = time.Second * time.Duration(*prc.RetryIntvl)
+		}
+	}
+	return rp
+}
+
+// writeWithRetry writes the points to the database, retrying with exponential
+// backoff up to the limit set by the retry policy.
+//
+// If the policy has a spool, any previously spooled batches are written first
+// so that ordering is preserved. While the back end remains unavailable, new
+// batches are added to the spool rather than returning an error.
+func writeWithRetry(ctx context.Context, ss DBWriter, rp retryPolicy, points []Point) error {
+	if rp.spool != nil && rp.spool.Len() > 0 {
+		if err := rp.spool.drain(ctx, ss); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Debug("spool not drained, spooling batch", slog.String("error", err.Error()))
+			if err = rp.spool.append(points); err != nil {
+				rp.recordWrite(countFieldSets(points), err)
+			}
+			return err
+		}
+	}
 	const maxRetryTime = time.Second * 1280
-	retryTime := time.Second * time.Duration(gc.ProcessorRetryIntvl)
+	retryTime := rp.retryIntvl
 	var err error
-	for i := 1; i <= gc.ProcessorMaxRetries; i++ {
+	for i := 1; i <= rp.maxRetries; i++ {
 		err = ss.WritePoints(ctx, points)
 		if err == nil {
 			break
 		}
 		if !errors.Is(err, context.Canceled) {
 			log.Error("failed writing to back end database", slog.String("error", err.Error()), slog.Int("retry count", i), slog.Duration("retry time", retryTime))
+			if rp.backend != "" {
+				backendWriteErrors.WithLabelValues(rp.cluster, rp.backend).Inc()
+			}
+		}
+		if i == rp.maxRetries {
+			break
 		}
 		select {
 		case <-time.After(retryTime):
@@ -335,8 +441,20 @@ func (c *Cluster) WriteStats(ctx context.Context, gc globalConfig, ss DBWriter,
 		}
 	}
 	if err != nil {
+		if rp.spool != nil && ctx.Err() == nil {
+			log.Warn("ProcessorMaxRetries exceeded, spooling stats to disk", slog.String("cluster", rp.spool.cluster),
+				slog.String("backend", rp.spool.backend), slog.String("error", err.Error()))
+			if err = rp.spool.append(points); err != nil {
+				rp.recordWrite(countFieldSets(points), err)
+			}
+			return err
+		}
 		log.Error("ProcessorMaxRetries exceeded, failed to write stats to database", slog.String("error", err.Error()))
+		if ctx.Err() == nil {
+			rp.recordWrite(countFieldSets(points), err)
+		}
 		return err
 	}
+	rp.recordWrite(countFieldSets(points), nil)
 	return nil
 }
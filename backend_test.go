@@ -17,8 +17,8 @@ func setMemoryBackend() {
 // For single-valued stats, there will be one field map and one tag map
 // For multi-valued stats, there will be multiple field maps and multiple tag maps
 // The length of the field and tag arrays will be the same
-// decodeStat has special logic to remove certain stats that are not useful
-// (e.g. change_notify and read_directory_change) - these are tested in TestIsInvalidStat
+// Certain stats that are not useful (e.g. change_notify and read_directory_change)
+// are dropped after decoding by the default relabel rules
 
 // Test decodeStat with float64 value
 func TestDecodeStat_Float64(t *testing.T) {
@@ -28,7 +28,7 @@ func TestDecodeStat_Float64(t *testing.T) {
 		Devid: 0,
 		Value: float64(88920.0),
 	}
-	fa, ta, err := decodeStat("clusterA", stat, true, true)
+	fa, ta, err := decodeStat("clusterA", nil, stat, true, true)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -58,7 +58,7 @@ func TestDecodeStat_String(t *testing.T) {
 		Devid: 1,
 		Value: "someval",
 	}
-	_, _, err := decodeStat("clusterB", stat, false, false)
+	_, _, err := decodeStat("clusterB", nil, stat, false, false)
 	if err == nil {
 		t.Fatalf("expected error but got none")
 	}
@@ -80,7 +80,7 @@ func TestDecodeStat_ShortArrayOfMaps(t *testing.T) {
 			map[string]any{"op_rate": float64(131.6551361083984), "path": "SYSTEM (0x0)"},
 		},
 	}
-	fa, ta, err := decodeStat("clusterC", stat, true, false)
+	fa, ta, err := decodeStat("clusterC", nil, stat, true, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -112,7 +112,7 @@ func TestDecodeStat_EmptyArray(t *testing.T) {
 		Devid: 0,
 		Value: []any{},
 	}
-	fa, ta, err := decodeStat("clusterE", stat, false, false)
+	fa, ta, err := decodeStat("clusterE", nil, stat, false, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -133,7 +133,7 @@ func TestDecodeStat_ArrayOfMaps(t *testing.T) {
 			map[string]any{"op_rate": float64(60.76391220092773), "path": "/ifs/"},
 		},
 	}
-	fa, ta, err := decodeStat("clusterC", stat, true, false)
+	fa, ta, err := decodeStat("clusterC", nil, stat, true, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -184,7 +184,7 @@ func TestDecodeStat_ArrayOfMaps_with_Array(t *testing.T) {
 			},
 		},
 	}
-	fa, ta, err := decodeStat("clusterC", stat, true, false)
+	fa, ta, err := decodeStat("clusterC", nil, stat, true, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -225,7 +225,7 @@ func TestDecodeStat_SimpleMap(t *testing.T) {
 		Node:  intPtr(5),
 		Value: map[string]any{"hits": 5191200, "misses": 414440},
 	}
-	fa, ta, err := decodeStat("clusterD", stat, true, false)
+	fa, ta, err := decodeStat("clusterD", nil, stat, true, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -260,7 +260,7 @@ func TestDecodeStat_Map_with_Array_of_Maps(t *testing.T) {
 			},
 		},
 	}
-	fa, ta, err := decodeStat("clusterG", stat, true, false)
+	fa, ta, err := decodeStat("clusterG", nil, stat, true, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -284,7 +284,7 @@ func TestDecodeStat_Map_with_Array_of_Maps(t *testing.T) {
 	}
 }
 
-// Test elision of certain stats (change_notify and read_directory_change)
+// Test elision of certain stats (change_notify and read_directory_change) by the default relabel rules
 func TestDecodeStat_SMB_Elision(t *testing.T) {
 	setMemoryBackend()
 	stat := StatResult{
@@ -296,10 +296,11 @@ func TestDecodeStat_SMB_Elision(t *testing.T) {
 			map[string]any{"op_name": "write", "op_rate": 789.2},
 		},
 	}
-	fa, ta, err := decodeStat("clusterH", stat, true, false)
+	fa, ta, err := decodeStat("clusterH", nil, stat, true, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
+	fa, ta = relabelDefaults(t, stat.Key, fa, ta)
 	if len(fa) != 2 || len(ta) != 2 {
 		t.Logf("expected 2 sets of fields and tags, got %d/%d", len(fa), len(ta))
 		t.Fatalf("tags: %#v", ta)
@@ -318,7 +319,7 @@ func TestDecodeStat_SMB_Elision(t *testing.T) {
 	}
 }
 
-// Test elision of certain stats (change_notify and read_directory_change)
+// Test elision of certain stats (change_notify and read_directory_change) by the default relabel rules
 func TestDecodeStat_IRP_Elision(t *testing.T) {
 	setMemoryBackend()
 	stat := StatResult{
@@ -330,10 +331,11 @@ func TestDecodeStat_IRP_Elision(t *testing.T) {
 			map[string]any{"op_name": "write", "op_rate": 789.2},
 		},
 	}
-	fa, ta, err := decodeStat("clusterI", stat, true, false)
+	fa, ta, err := decodeStat("clusterI", nil, stat, true, false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
+	fa, ta = relabelDefaults(t, stat.Key, fa, ta)
 	if len(fa) != 2 || len(ta) != 2 {
 		t.Logf("expected 2 sets of fields and tags, got %d/%d", len(fa), len(ta))
 		t.Fatalf("tags: %#v", ta)
@@ -360,7 +362,7 @@ func TestDecodeStat_NilValue(t *testing.T) {
 		Devid: 0,
 		Value: nil,
 	}
-	_, _, err := decodeStat("clusterE", stat, false, false)
+	_, _, err := decodeStat("clusterE", nil, stat, false, false)
 	if err == nil {
 		t.Errorf("expected error for nil value")
 	}
@@ -374,25 +376,8 @@ func TestDecodeStat_UnknownType(t *testing.T) {
 		Devid: 0,
 		Value: errors.New("bad type"),
 	}
-	_, _, err := decodeStat("clusterF", stat, true, false)
+	_, _, err := decodeStat("clusterF", nil, stat, true, false)
 	if err == nil {
 		t.Errorf("expected error for unknown value type")
 	}
 }
-
-// Test isInvalidStat for change_notify and read_directory_change
-func TestIsInvalidStat(t *testing.T) {
-	setMemoryBackend()
-	tags := ptTags{"op_name": "change_notify"}
-	if !isInvalidStat(tags) {
-		t.Errorf("expected true for change_notify")
-	}
-	tags = ptTags{"op_name": "read_directory_change"}
-	if !isInvalidStat(tags) {
-		t.Errorf("expected true for read_directory_change")
-	}
-	tags = ptTags{"op_name": "other"}
-	if isInvalidStat(tags) {
-		t.Errorf("expected false for other")
-	}
-}
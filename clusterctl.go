@@ -0,0 +1,244 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Runtime control of the collection loops via the admin API. Each running
+// statsloop registers a clusterControl. Pausing is a flag checked by the loop,
+// and is remembered by cluster hostname so that a paused cluster stays paused
+// when a config reload restarts its loop; other operations are sent as commands to the loop goroutine, which owns the
+// collection schedule, and are handled between collections.
+
+// Cluster command kinds
+const (
+	clusterCmdCollect  = "collect"
+	clusterCmdSchedule = "schedule"
+)
+
+// clusterCommand is a request sent to a cluster's collection loop
+type clusterCommand struct {
+	kind  string
+	group string // stat group to collect; empty collects everything
+	reply chan clusterCommandReply
+}
+
+// clusterCommandReply is the collection loop's response to a command
+type clusterCommandReply struct {
+	schedule []scheduleEntry
+	err      error
+}
+
+// scheduleEntry describes one entry in a cluster's collection schedule
+type scheduleEntry struct {
+	Type     string    `json:"type"`
+	Group    string    `json:"group,omitempty"`
+	Interval float64   `json:"interval_seconds"`
+	Next     time.Time `json:"next"`
+	Stats    int       `json:"stats,omitempty"`
+}
+
+// clusterControl is the control handle for a single cluster's collection loop
+type clusterControl struct {
+	hostname string
+	cluster  string
+	paused   atomic.Bool
+	cmds     chan clusterCommand
+	registry *controlRegistry
+}
+
+// controlRegistry holds the control handles of the running collection loops
+type controlRegistry struct {
+	sync.Mutex
+	clusters []*clusterControl
+	paused   map[string]bool // hostnames of the paused clusters
+}
+
+var controls = &controlRegistry{}
+
+// register adds a control handle for a collection loop
+// for a cluster paused before a reload, the handle starts out paused
+func (r *controlRegistry) register(hostname string, cluster string) *clusterControl {
+	ctl := &clusterControl{hostname: hostname, cluster: cluster, cmds: make(chan clusterCommand), registry: r}
+	r.Lock()
+	defer r.Unlock()
+	ctl.paused.Store(r.paused[hostname])
+	r.clusters = append(r.clusters, ctl)
+	return ctl
+}
+
+// unregister removes a collection loop's control handle
+func (r *controlRegistry) unregister(ctl *clusterControl) {
+	r.Lock()
+	defer r.Unlock()
+	r.clusters = slices.DeleteFunc(r.clusters, func(c *clusterControl) bool { return c == ctl })
+}
+
+// lookup returns the control handle for a cluster by cluster name or hostname
+func (r *controlRegistry) lookup(name string) *clusterControl {
+	r.Lock()
+	defer r.Unlock()
+	for _, ctl := range r.clusters {
+		if ctl.cluster == name || ctl.hostname == name {
+			return ctl
+		}
+	}
+	return nil
+}
+
+// list returns the control handles of all running collection loops
+func (r *controlRegistry) list() []*clusterControl {
+	r.Lock()
+	defer r.Unlock()
+	return slices.Clone(r.clusters)
+}
+
+// setPaused pauses or resumes collection for the cluster
+func (ctl *clusterControl) setPaused(paused bool) {
+	if r := ctl.registry; r != nil {
+		r.Lock()
+		if r.paused == nil {
+			r.paused = make(map[string]bool)
+		}
+		if paused {
+			r.paused[ctl.hostname] = true
+		} else {
+			delete(r.paused, ctl.hostname)
+		}
+		r.Unlock()
+	}
+	ctl.paused.Store(paused)
+	if paused {
+		health.setState(ctl.hostname, clusterStatePaused)
+	} else {
+		health.resumed(ctl.hostname)
+	}
+}
+
+// send sends a command to the collection loop and waits for the reply
+func (ctl *clusterControl) send(ctx context.Context, cmd clusterCommand) clusterCommandReply {
+	cmd.reply = make(chan clusterCommandReply, 1)
+	select {
+	case ctl.cmds <- cmd:
+	case <-ctx.Done():
+		return clusterCommandReply{err: fmt.Errorf("collection loop for %s is busy: %w", ctl.cluster, ctx.Err())}
+	}
+	select {
+	case reply := <-cmd.reply:
+		return reply
+	case <-ctx.Done():
+		return clusterCommandReply{err: fmt.Errorf("no reply from collection loop for %s: %w", ctl.cluster, ctx.Err())}
+	}
+}
+
+// statTypeName returns the schedule entry type for a priority queue item
+func statTypeName(st StatType) string {
+	switch st {
+	case StatTypeRegularStat:
+		return "stats"
+	case StatTypeSummaryStatProtocol:
+		return "summary_protocol"
+	case StatTypeSummaryStatClient:
+		return "summary_client"
+	case StatTypeSummaryStatDrive:
+		return "summary_drive"
+	case StatTypeSelfMetrics:
+		return "self_metrics"
+	}
+	return "unknown"
+}
+
+// scheduleOf returns the collection schedule in the order items are due
+func scheduleOf(pq PriorityQueue, intervalOf func(*Item) time.Duration) []scheduleEntry {
+	entries := make([]scheduleEntry, 0, len(pq))
+	for _, item := range pq {
+		e := scheduleEntry{
+			Type:     statTypeName(item.value.stattype),
+			Interval: intervalOf(item).Seconds(),
+			Next:     item.priority,
+		}
+		if item.value.sts != nil {
+			e.Group = item.value.sts.groupName
+			e.Stats = len(item.value.sts.stats)
+		}
+		entries = append(entries, e)
+	}
+	slices.SortStableFunc(entries, func(a, b scheduleEntry) int { return a.Next.Compare(b.Next) })
+	return entries
+}
+
+// collectAllNow reschedules every item in the queue to be collected immediately
+func collectAllNow(pq *PriorityQueue, now time.Time) {
+	for _, item := range *pq {
+		if item.priority.After(now) {
+			item.priority = now
+		}
+	}
+	heap.Init(pq)
+}
+
+// groupStats returns the stats of the named group that are being collected
+// for the cluster, i.e., excluding stats the cluster does not support
+func groupStats(pq PriorityQueue, sg map[string]statGroup, group string) ([]string, error) {
+	g, ok := sg[group]
+	if !ok {
+		return nil, fmt.Errorf("unknown or inactive stat group %q", group)
+	}
+	collected := make(map[string]bool)
+	for _, item := range pq {
+		if item.value.sts != nil {
+			for _, stat := range item.value.sts.stats {
+				collected[stat] = true
+			}
+		}
+	}
+	var stats []string
+	for _, stat := range g.stats {
+		if collected[stat] {
+			stats = append(stats, stat)
+		}
+	}
+	if len(stats) == 0 {
+		return nil, fmt.Errorf("stat group %q has no stats available on this cluster", group)
+	}
+	return stats, nil
+}
+
+// runCommand handles a command in the cluster's collection loop goroutine
+func (c *Cluster) runCommand(ctx context.Context, cmd clusterCommand, gc globalConfig, pq *PriorityQueue,
+	sg map[string]statGroup, wq *writeQueue, intervalOf func(*Item) time.Duration,
+	relabel *collectRelabeler, derived *derivedMetrics) clusterCommandReply {
+	switch cmd.kind {
+	case clusterCmdSchedule:
+		return clusterCommandReply{schedule: scheduleOf(*pq, intervalOf)}
+	case clusterCmdCollect:
+		if cmd.group == "" {
+			log.Info("collecting all stats now at admin API request", slog.String("cluster", c.ClusterName))
+			collectAllNow(pq, time.Now())
+			return clusterCommandReply{}
+		}
+		stats, err := groupStats(*pq, sg, cmd.group)
+		if err != nil {
+			return clusterCommandReply{err: err}
+		}
+		log.Info("collecting stat group at admin API request", slog.String("cluster", c.ClusterName), slog.String("group", cmd.group))
+		sr, err := c.GetStats(ctx, stats)
+		if err != nil {
+			return clusterCommandReply{err: fmt.Errorf("failed to retrieve stats: %w", err)}
+		}
+		health.collected(c.Hostname)
+		points, err := c.decodeStats(gc, sr)
+		if err != nil {
+			return clusterCommandReply{err: fmt.Errorf("unable to decode stats: %w", err)}
+		}
+		return clusterCommandReply{err: wq.put(ctx, relabel.applyDerived(derived, points))}
+	}
+	return clusterCommandReply{err: fmt.Errorf("unknown command %q", cmd.kind)}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestQueue(now time.Time) PriorityQueue {
+	pq := PriorityQueue{
+		{value: PqValue{stattype: StatTypeRegularStat, sts: &statTimeSet{groupName: "cluster_cpu", interval: 30 * time.Second, stats: []string{"cpu.user", "cpu.sys"}}}, priority: now.Add(20 * time.Second)},
+		{value: PqValue{stattype: StatTypeSummaryStatProtocol}, priority: now.Add(5 * time.Second)},
+	}
+	heap.Init(&pq)
+	return pq
+}
+
+func testIntervalOf(item *Item) time.Duration {
+	if item.value.sts != nil {
+		return item.value.sts.interval
+	}
+	return summaryStatsInterval
+}
+
+func TestScheduleOf(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sched := scheduleOf(newTestQueue(now), testIntervalOf)
+	if len(sched) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", sched)
+	}
+	if sched[0].Type != "summary_protocol" || sched[0].Interval != 5 {
+		t.Errorf("expected summary stats first, got %+v", sched[0])
+	}
+	if sched[1].Group != "cluster_cpu" || sched[1].Stats != 2 || !sched[1].Next.Equal(now.Add(20*time.Second)) {
+		t.Errorf("unexpected stat group entry %+v", sched[1])
+	}
+}
+
+func TestCollectAllNow(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	pq := newTestQueue(now)
+	collectAllNow(&pq, now)
+	for _, item := range pq {
+		if !item.priority.Equal(now) {
+			t.Errorf("expected every item to be due now, got %v", item.priority)
+		}
+	}
+}
+
+func TestGroupStats(t *testing.T) {
+	pq := newTestQueue(time.Now())
+	sg := map[string]statGroup{"cluster_cpu": {stats: []string{"cpu.user", "cpu.sys", "cpu.unsupported"}}}
+	stats, err := groupStats(pq, sg, "cluster_cpu")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Errorf("expected unsupported stats to be excluded, got %v", stats)
+	}
+	if _, err := groupStats(pq, sg, "nosuch"); err == nil {
+		t.Errorf("expected error for unknown group")
+	}
+}
+
+func TestAdminMux_ControlAPI(t *testing.T) {
+	health.reset([]string{"host1"}, 0)
+	defer health.reset(nil, 0)
+	ctl := controls.register("host1", "cluster1")
+	defer controls.unregister(ctl)
+	reload := make(chan struct{}, 1)
+	srv := httptest.NewServer(newAdminMux("s3cret", reload))
+	defer srv.Close()
+
+	// stand-in for the collection loop
+	go func() {
+		for cmd := range ctl.cmds {
+			cmd.reply <- clusterCommandReply{schedule: []scheduleEntry{{Type: "stats", Group: cmd.group}}}
+		}
+	}()
+	defer close(ctl.cmds)
+
+	do := func(method, path, token, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	if resp := do("POST", "/api/v1/reload", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", resp.StatusCode)
+	}
+	if resp := do("POST", "/api/v1/reload", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 with wrong token, got %d", resp.StatusCode)
+	}
+	if resp := do("POST", "/api/v1/reload", "s3cret", ""); resp.StatusCode != http.StatusAccepted || len(reload) != 1 {
+		t.Errorf("expected reload to be requested, got %d", resp.StatusCode)
+	}
+
+	if resp := do("POST", "/api/v1/clusters/cluster1/pause", "s3cret", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 pausing cluster, got %d", resp.StatusCode)
+	}
+	if !ctl.paused.Load() {
+		t.Errorf("expected cluster to be paused")
+	}
+	if clusters, _, _ := health.status(); clusters[0].State != clusterStatePaused || !clusters[0].Healthy {
+		t.Errorf("expected paused cluster to be reported healthy, got %+v", clusters[0])
+	}
+	do("POST", "/api/v1/clusters/host1/resume", "s3cret", "")
+	if ctl.paused.Load() {
+		t.Errorf("expected cluster to be resumed by hostname")
+	}
+	if resp := do("POST", "/api/v1/clusters/nosuch/pause", "s3cret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown cluster, got %d", resp.StatusCode)
+	}
+
+	resp := do("GET", "/api/v1/clusters/cluster1/schedule", "s3cret", "")
+	var sched []scheduleEntry
+	if err := json.NewDecoder(resp.Body).Decode(&sched); err != nil {
+		t.Fatalf("unable to decode schedule: %v", err)
+	}
+	if len(sched) != 1 || sched[0].Type != "stats" {
+		t.Errorf("unexpected schedule %+v", sched)
+	}
+	if resp := do("POST", "/api/v1/clusters/cluster1/collect?group=cluster_cpu", "s3cret", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 collecting group, got %d", resp.StatusCode)
+	}
+
+	defer runtimeLogLevel.Set(runtimeLogLevel.Level())
+	if resp := do("PUT", "/api/v1/loglevel", "s3cret", `{"level":"bogus"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown level, got %d", resp.StatusCode)
+	}
+	if resp := do("PUT", "/api/v1/loglevel", "s3cret", `{"level":"trace"}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 setting level, got %d", resp.StatusCode)
+	}
+	if runtimeLogLevel.Level() != LevelTrace {
+		t.Errorf("expected TRACE level, got %v", runtimeLogLevel.Level())
+	}
+	resp = do("GET", "/api/v1/loglevel", "s3cret", "")
+	var lr logLevelRequest
+	if err := json.NewDecoder(resp.Body).Decode(&lr); err != nil || lr.Level != levelName(LevelTrace) {
+		t.Errorf("expected level %q, got %q (%v)", levelName(LevelTrace), lr.Level, err)
+	}
+}
+
+func TestAdminMux_ControlAPIDisabledWithoutToken(t *testing.T) {
+	srv := httptest.NewServer(newAdminMux("", nil))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/api/v1/loglevel")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected control API to be disabled, got %d", resp.StatusCode)
+	}
+}
+
+func TestRunCommand_CollectGroupRelabels(t *testing.T) {
+	setMemoryBackend()
+	_, c := newSimCluster(t, 1)
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	conf := defaultConfig()
+	relabel, err := newCollectRelabeler(c.ClusterName, &conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	derived, err := newDerivedMetrics(c.ClusterName, derivedConfig{Exprs: []derivedExprConf{{Name: "smb2.ops", Expr: "cluster.protostats.smb2:op_rate * 2"}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pq := PriorityQueue{{value: PqValue{stattype: StatTypeRegularStat, sts: &statTimeSet{groupName: "smb", interval: 30 * time.Second, stats: []string{"cluster.protostats.smb2"}}}, priority: time.Now()}}
+	sg := map[string]statGroup{"smb": {stats: []string{"cluster.protostats.smb2"}}}
+	wq := newWriteQueue(c.ClusterName, 4, queuePolicyBlock)
+	reply := c.runCommand(t.Context(), clusterCommand{kind: clusterCmdCollect, group: "smb"}, conf.Global, &pq, sg, wq, testIntervalOf, relabel, derived)
+	if reply.err != nil {
+		t.Fatalf("unexpected error: %v", reply.err)
+	}
+	points := <-wq.ch
+	names := make(map[string]int)
+	for _, p := range points {
+		names[p.name] = len(p.tags)
+		for _, tags := range p.tags {
+			if tags["op_name"] == "change_notify" {
+				t.Errorf("expected the default rules to drop change_notify, got %v", tags)
+			}
+		}
+	}
+	if names["cluster.protostats.smb2"] != 3 || names["smb2.ops"] != 3 {
+		t.Errorf("expected the remaining operations and their derived metric, got %v", names)
+	}
+}
+
+func TestControlRegistry_PauseSurvivesReload(t *testing.T) {
+	r := &controlRegistry{}
+	ctl := r.register("host1", "cluster1")
+	ctl.setPaused(true)
+	// a reload restarts the collection loop
+	r.unregister(ctl)
+	ctl = r.register("host1", "cluster1")
+	if !ctl.paused.Load() {
+		t.Errorf("expected the cluster to stay paused after a reload")
+	}
+	if other := r.register("host2", "cluster2"); other.paused.Load() {
+		t.Errorf("expected other clusters not to be paused")
+	}
+	ctl.setPaused(false)
+	r.unregister(ctl)
+	if ctl = r.register("host1", "cluster1"); ctl.paused.Load() {
+		t.Errorf("expected a resumed cluster to stay resumed after a reload")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// With many clusters, every collection loop would otherwise make its PAPI
+// requests and back end writes at the same time. The [concurrency] settings
+// limit the number of requests and writes in flight across all clusters, so
+// a single collector can poll many clusters without saturating its network
+// or the back end.
+//
+// Each limit is a fairLimiter shared by every cluster. Requests that have to
+// wait are queued per cluster, and the queues are served in turn, so a
+// cluster with many stat buckets cannot starve the others. A back end write
+// takes a slot from the back end's own limit (if set) and then from the
+// global write limit.
+//
+// The limiters outlive config reloads; a reload only changes their limits.
+
+// Names of the shared limiters
+const (
+	papiLimiterName      = "papi"
+	backendLimiterName   = "backend"
+	backendLimiterPrefix = "backend:"
+)
+
+// concurrencyConfig defines the concurrency limits in the config file
+type concurrencyConfig struct {
+	MaxPapiRequests  int            `toml:"max_papi_requests"`  // PAPI requests in flight across all clusters (0 = unlimited)
+	MaxBackendWrites int            `toml:"max_backend_writes"` // back end writes in flight across all clusters and back ends (0 = unlimited)
+	BackendWrites    map[string]int `toml:"backend_writes"`     // writes in flight per back end name (0 = unlimited)
+}
+
+var limiterWait = promauto.With(selfRegistry).NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: selfMetricsNamespace,
+	Subsystem: "concurrency",
+	Name:      "wait_seconds",
+	Help:      "Time PAPI requests and back end writes waited for a concurrency limit.",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+}, []string{"limiter"})
+
+// validateConcurrency checks the [concurrency] settings
+func validateConcurrency(config *tomlConfig) error {
+	cc := config.Concurrency
+	var errs []error
+	if cc.MaxPapiRequests < 0 {
+		errs = append(errs, errors.New("[concurrency] max_papi_requests must not be negative"))
+	}
+	if cc.MaxBackendWrites < 0 {
+		errs = append(errs, errors.New("[concurrency] max_backend_writes must not be negative"))
+	}
+	for _, name := range slices.Sorted(maps.Keys(cc.BackendWrites)) {
+		if cc.BackendWrites[name] < 0 {
+			errs = append(errs, fmt.Errorf("[concurrency.backend_writes] %s must not be negative", name))
+		}
+		if _, err := getDBWriter(name); err != nil && findBackend(config, name) == nil {
+			errs = append(errs, fmt.Errorf("[concurrency.backend_writes] unknown back end %q", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fairLimiter limits the number of operations in flight, serving waiting
+// operations in turn from each key's queue
+type fairLimiter struct {
+	name    string
+	mu      sync.Mutex
+	limit   int // 0 = unlimited
+	inUse   int
+	waiting map[string][]chan struct{} // per-key queues of waiting operations
+	order   []string                   // keys with waiting operations, in the order they are served
+}
+
+// The limiters shared by all clusters, by name
+var (
+	limitersMu sync.Mutex
+	limiters   = make(map[string]*fairLimiter)
+)
+
+// sharedLimiter returns the named limiter with its limit set. It returns nil
+// (no limit) if the limit is 0 and the limiter has never been used.
+func sharedLimiter(name string, limit int) *fairLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[name]
+	if !ok {
+		if limit <= 0 {
+			return nil
+		}
+		l = &fairLimiter{name: name, waiting: make(map[string][]chan struct{})}
+		limiters[name] = l
+	}
+	l.setLimit(limit)
+	return l
+}
+
+// setLimit changes the limit, starting waiting operations if it was raised
+func (l *fairLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.grantLocked()
+}
+
+// acquire waits for a slot for an operation of key and returns the function
+// to release it. A nil limiter does not limit.
+func (l *fairLimiter) acquire(ctx context.Context, key string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	if l.limit <= 0 || l.inUse < l.limit && len(l.order) == 0 {
+		l.inUse++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	ready := make(chan struct{})
+	if len(l.waiting[key]) == 0 {
+		l.order = append(l.order, key)
+	}
+	l.waiting[key] = append(l.waiting[key], ready)
+	l.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-ready:
+		limiterWait.WithLabelValues(l.name).Observe(time.Since(start).Seconds())
+		return l.release, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		select {
+		case <-ready:
+			// granted as we gave up, so pass the slot on
+			l.inUse--
+			l.grantLocked()
+		default:
+			l.removeLocked(key, ready)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release frees a slot
+func (l *fairLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inUse--
+	l.grantLocked()
+}
+
+// grantLocked starts waiting operations while there are free slots, taking
+// one from each key's queue in turn
+func (l *fairLimiter) grantLocked() {
+	for len(l.order) > 0 && (l.limit <= 0 || l.inUse < l.limit) {
+		key := l.order[0]
+		l.order = l.order[1:]
+		queue := l.waiting[key]
+		ready := queue[0]
+		if len(queue) > 1 {
+			l.waiting[key] = queue[1:]
+			l.order = append(l.order, key)
+		} else {
+			delete(l.waiting, key)
+		}
+		l.inUse++
+		close(ready)
+	}
+}
+
+// removeLocked removes a waiting operation that has given up
+func (l *fairLimiter) removeLocked(key string, ready chan struct{}) {
+	queue := slices.DeleteFunc(l.waiting[key], func(c chan struct{}) bool { return c == ready })
+	if len(queue) > 0 {
+		l.waiting[key] = queue
+		return
+	}
+	delete(l.waiting, key)
+	l.order = slices.DeleteFunc(l.order, func(k string) bool { return k == key })
+}
+
+// setupConcurrency applies the PAPI request limit to the cluster
+func (c *Cluster) setupConcurrency(cc concurrencyConfig) {
+	c.papiLimiter = sharedLimiter(papiLimiterName, cc.MaxPapiRequests)
+}
+
+// limitedWriter limits the writes of a back end to its own and the global
+// back end write limits
+type limitedWriter struct {
+	wrappedWriter
+	cluster string
+	backend *fairLimiter
+	global  *fairLimiter
+}
+
+// limitWrites wraps the named back end's writer if back end writes are limited
+func limitWrites(config *tomlConfig, name string, w DBWriter) DBWriter {
+	backend := sharedLimiter(backendLimiterPrefix+name, config.Concurrency.BackendWrites[name])
+	global := sharedLimiter(backendLimiterName, config.Concurrency.MaxBackendWrites)
+	if backend == nil && global == nil {
+		return w
+	}
+	return &limitedWriter{wrappedWriter: wrappedWriter{w}, backend: backend, global: global}
+}
+
+// Init initializes the underlying writer and records the cluster, which
+// identifies the writes' queue
+func (w *limitedWriter) Init(ctx context.Context, clusterName string, config *tomlConfig, ci int, sd map[string]statDetail) error {
+	w.cluster = clusterName
+	return w.DBWriter.Init(ctx, clusterName, config, ci, sd)
+}
+
+// WritePoints writes the points once the limits allow
+func (w *limitedWriter) WritePoints(ctx context.Context, points []Point) error {
+	releaseBackend, err := w.backend.acquire(ctx, w.cluster)
+	if err != nil {
+		return err
+	}
+	defer releaseBackend()
+	releaseGlobal, err := w.global.acquire(ctx, w.cluster)
+	if err != nil {
+		return err
+	}
+	defer releaseGlobal()
+	return w.DBWriter.WritePoints(ctx, points)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters waits until n operations are queued on the limiter
+func waitForWaiters(t *testing.T, l *fairLimiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		queued := 0
+		for _, q := range l.waiting {
+			queued += len(q)
+		}
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiting operations, got %d", n, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairLimiter_RoundRobin(t *testing.T) {
+	l := &fairLimiter{name: "test", limit: 1, waiting: make(map[string][]chan struct{})}
+	release, err := l.acquire(t.Context(), "a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	enqueue := func(key string, n int) {
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rel, err := l.acquire(t.Context(), key)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				mu.Lock()
+				order = append(order, key)
+				mu.Unlock()
+				rel()
+			}()
+		}
+	}
+	// cluster a queues three operations before cluster b queues one
+	enqueue("a", 3)
+	waitForWaiters(t, l, 3)
+	enqueue("b", 1)
+	waitForWaiters(t, l, 4)
+	release()
+	wg.Wait()
+	if len(order) != 4 || order[0] != "a" || order[1] != "b" {
+		t.Errorf("expected cluster b to be served after one of cluster a's operations, got %v", order)
+	}
+	if l.inUse != 0 {
+		t.Errorf("expected every slot to be released, %d in use", l.inUse)
+	}
+}
+
+func TestFairLimiter_Cancel(t *testing.T) {
+	l := &fairLimiter{name: "test", limit: 1, waiting: make(map[string][]chan struct{})}
+	release, err := l.acquire(t.Context(), "a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait to time out, got %v", err)
+	}
+	if len(l.order) != 0 || len(l.waiting) != 0 {
+		t.Errorf("expected the cancelled operation to be removed from the queue")
+	}
+	release()
+
+	// raising the limit starts waiting operations
+	release, _ = l.acquire(t.Context(), "a")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if rel, err := l.acquire(t.Context(), "b"); err == nil {
+			rel()
+		}
+	}()
+	waitForWaiters(t, l, 1)
+	l.setLimit(2)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the waiting operation to start when the limit was raised")
+	}
+	release()
+	var nilLimiter *fairLimiter
+	if rel, err := nilLimiter.acquire(t.Context(), "a"); err != nil || rel == nil {
+		t.Errorf("expected a nil limiter not to limit, got %v", err)
+	}
+}
+
+// slowWriter records the maximum number of concurrent writes
+type slowWriter struct {
+	DiscardSink
+	active, peak atomic.Int32
+}
+
+func (w *slowWriter) WritePoints(_ context.Context, _ []Point) error {
+	n := w.active.Add(1)
+	defer w.active.Add(-1)
+	for {
+		p := w.peak.Load()
+		if n <= p || w.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return nil
+}
+
+func TestLimitWrites(t *testing.T) {
+	setMemoryBackend()
+	conf := defaultConfig()
+	if w := limitWrites(&conf, "test_unlimited", &DiscardSink{}); w == nil {
+		t.Fatalf("expected a writer")
+	} else if _, ok := w.(*DiscardSink); !ok {
+		t.Errorf("expected an unlimited back end not to be wrapped, got %T", w)
+	}
+
+	conf.Concurrency.BackendWrites = map[string]int{"test_limited": 2}
+	sw := &slowWriter{}
+	var wg sync.WaitGroup
+	for _, cluster := range []string{"c1", "c2", "c3", "c4", "c5"} {
+		w := limitWrites(&conf, "test_limited", sw)
+		if err := w.Init(t.Context(), cluster, &conf, 0, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 3 {
+				if err := w.WritePoints(t.Context(), nil); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if peak := sw.peak.Load(); peak != 2 {
+		t.Errorf("expected at most 2 concurrent writes, got %d", peak)
+	}
+
+	rw := &recordingWriter{}
+	if err := limitWrites(&conf, "test_limited", rw).(DBCloser).Close(); err != nil || !rw.closed {
+		t.Errorf("expected Close to close the wrapped writer, got %v", err)
+	}
+}
+
+func TestValidateConcurrency(t *testing.T) {
+	conf := defaultConfig()
+	conf.Concurrency = concurrencyConfig{MaxPapiRequests: 8, BackendWrites: map[string]int{"discard": 1}}
+	if err := validateConcurrency(&conf); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	conf.Concurrency = concurrencyConfig{MaxPapiRequests: -1, MaxBackendWrites: -1, BackendWrites: map[string]int{"nosuch": 1}}
+	err := validateConcurrency(&conf)
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 3 {
+		t.Errorf("expected 3 errors, got %v", err)
+	}
+}
+
+func TestSimulator_PapiLimit(t *testing.T) {
+	setMemoryBackend()
+	_, c := newSimCluster(t, 3)
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	c.papiLimiter = &fairLimiter{name: "test", limit: 1, waiting: make(map[string][]chan struct{})}
+	release, _ := c.papiLimiter.acquire(t.Context(), "other")
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetStats(ctx, []string{"ifs.bytes.used"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the request to wait for the limit, got %v", err)
+	}
+	release()
+	if _, err := c.GetStats(t.Context(), []string{"ifs.bytes.used"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPapiLimit_RefusingCluster(t *testing.T) {
+	setMemoryBackend()
+	_, healthy := newSimCluster(t, 1)
+	if err := healthy.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	refusedURL := "http://" + ln.Addr().String()
+	_ = ln.Close()
+
+	for _, authType := range []string{authtypeBasic, authtypeSession} {
+		t.Run(authType, func(t *testing.T) {
+			limiter := &fairLimiter{name: "test", limit: 1, waiting: make(map[string][]chan struct{})}
+			healthy.papiLimiter = limiter
+			refusing := &Cluster{Hostname: "refusing", AuthType: authType, baseURL: refusedURL,
+				client: &http.Client{}, maxRetries: 2, papiLimiter: limiter}
+			ctx, cancel := context.WithCancel(t.Context())
+			done := make(chan error, 1)
+			go func() {
+				_, err := refusing.restGet(ctx, statsPath)
+				done <- err
+			}()
+			// the refused connection returns at once, leaving the refusing
+			// cluster in its first one second backoff
+			time.Sleep(100 * time.Millisecond)
+			reqCtx, reqCancel := context.WithTimeout(t.Context(), 500*time.Millisecond)
+			defer reqCancel()
+			if _, err := healthy.GetStats(reqCtx, []string{"ifs.bytes.used"}); err != nil {
+				t.Errorf("expected the healthy cluster not to wait for the refusing one, got %v", err)
+			}
+			cancel()
+			if err := <-done; !errors.Is(err, context.Canceled) {
+				t.Errorf("expected the refusing cluster's request to be cancelled, got %v", err)
+			}
+		})
+	}
+}
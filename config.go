@@ -19,34 +19,129 @@ const defaultMaxRetries = 8
 const processorDefaultMaxRetries = 8
 const processorDefaultRetryIntvl = 5
 
+// Default spool settings
+const defaultSpoolDirectory = "spool"
+const defaultSpoolMaxSizeMB = 100
+const defaultSpoolMaxAge = 86400
+
+// Default stat metadata cache settings
+const defaultStatCacheDirectory = "stat_cache"
+const defaultStatCacheTTL = 7 * 86400
+
+// Default PAPI recording directory
+const defaultPapiRecordingDirectory = "papi_recording"
+
 // Default Normalizaion of ClusterNames
 const defaultPreserveCase = false
 
 // tomlConfig defines the top-level structure of the config file
 type tomlConfig struct {
-	Global       globalConfig
-	Logging      loggingConfig     `toml:"logging"`
-	InfluxDB     influxDBConfig    `toml:"influxdb"`
-	InfluxDBv2   influxDBv2Config  `toml:"influxdbv2"`
-	Prometheus   prometheusConfig  `toml:"prometheus"`
-	PromSD       promSdConf        `toml:"prom_http_sd"`
-	Clusters     []clusterConf     `toml:"cluster"`
-	SummaryStats summaryStatConfig `toml:"summary_stats"`
-	StatGroups   []statGroupConf   `toml:"statgroup"`
+	Global         globalConfig
+	Logging        loggingConfig                   `toml:"logging"`
+	InfluxDB       influxDBConfig                  `toml:"influxdb"`
+	InfluxDBv2     influxDBv2Config                `toml:"influxdbv2"`
+	Prometheus     prometheusConfig                `toml:"prometheus"`
+	File           fileConfig                      `toml:"file"`
+	LineProtocol   lineProtocolConfig              `toml:"lineprotocol"`
+	ProcessorRetry map[string]processorRetryConfig `toml:"stats_processor_retry"`
+	Spool          spoolConfig                     `toml:"spool"`
+	StatCache      statCacheConfig                 `toml:"stat_cache"`
+	PapiRecording  papiRecordingConfig             `toml:"papi_recording"`
+	Scheduler      schedulerConfig                 `toml:"scheduler"`
+	Concurrency    concurrencyConfig               `toml:"concurrency"`
+	Adaptive       adaptiveConfig                  `toml:"adaptive"`
+	Derived        derivedConfig                   `toml:"derived"`
+	Relabel        relabelConfig                   `toml:"relabel"`
+	Backends       []backendConfig                 `toml:"backend"`
+	PromSD         promSdConf                      `toml:"prom_http_sd"`
+	SelfMetrics    selfMetricsConfig               `toml:"self_metrics"`
+	Admin          adminConfig                     `toml:"admin"`
+	Clusters       []clusterConf                   `toml:"cluster"`
+	SummaryStats   summaryStatConfig               `toml:"summary_stats"`
+	StatGroups     []statGroupConf                 `toml:"statgroup"`
 }
 
 // globalConfig defines the global settings in the config file
 type globalConfig struct {
-	Version             string   `toml:"version"`
-	Processor           string   `toml:"stats_processor"`
-	ProcessorMaxRetries int      `toml:"stats_processor_max_retries"`
-	ProcessorRetryIntvl int      `toml:"stats_processor_retry_interval"`
-	MinUpdateInvtl      int      `toml:"min_update_interval_override"`
-	MaxRetries          int      `toml:"max_retries"`
-	ActiveStatGroups    []string `toml:"active_stat_groups"`
-	PreserveCase        bool     `toml:"preserve_case"`       // enable/disable normalization of Cluster Names
-	IncludeDegraded     bool     `toml:"include_degraded"`    // include degraded status tag in metrics
-	FetchByStatgroup    bool     `toml:"fetch_by_statgroup"`  // fetch stats one stat group at a time
+	Version             string            `toml:"version"`
+	Processor           stringList        `toml:"stats_processor"`
+	ProcessorMaxRetries int               `toml:"stats_processor_max_retries"`
+	ProcessorRetryIntvl int               `toml:"stats_processor_retry_interval"`
+	MinUpdateInvtl      int               `toml:"min_update_interval_override"`
+	MaxRetries          int               `toml:"max_retries"`
+	ActiveStatGroups    []string          `toml:"active_stat_groups"`
+	PreserveCase        bool              `toml:"preserve_case"`      // enable/disable normalization of Cluster Names
+	IncludeDegraded     bool              `toml:"include_degraded"`   // include degraded status tag in metrics
+	FetchByStatgroup    bool              `toml:"fetch_by_statgroup"` // fetch stats one stat group at a time
+	WriteQueueSize      int               `toml:"write_queue_size"`   // batches buffered between collection and writing
+	WriteQueuePolicy    string            `toml:"write_queue_policy"` // what to do when the write queue is full
+	Tags                map[string]string `toml:"tags"`               // extra tags for every point, overridden per cluster
+}
+
+// processorRetryConfig overrides the global write retry settings for a single back end
+type processorRetryConfig struct {
+	MaxRetries *int `toml:"max_retries"`    // maximum write attempts (0 = retry forever)
+	RetryIntvl *int `toml:"retry_interval"` // initial retry interval in seconds
+}
+
+// spoolConfig defines the on-disk write-ahead spool settings in the config file
+type spoolConfig struct {
+	Enabled   bool   `toml:"enabled"`
+	Directory string `toml:"directory"`   // root directory; each cluster and back end gets a subdirectory
+	MaxSizeMB int    `toml:"max_size_mb"` // maximum spool size per cluster and back end (0 = unlimited)
+	MaxAge    int    `toml:"max_age"`     // discard spooled batches older than this many seconds (0 = never)
+}
+
+// statCacheConfig defines the on-disk stat metadata cache settings in the config file
+type statCacheConfig struct {
+	Enabled   bool   `toml:"enabled"`
+	Directory string `toml:"directory"` // directory holding one cache file per OneFS release
+	TTL       int    `toml:"ttl"`       // refresh entries older than this many seconds in the background (0 = never)
+}
+
+// papiRecordingConfig defines the PAPI response recording and replay settings in the config file
+type papiRecordingConfig struct {
+	Mode      string  `toml:"mode"`      // "record", "replay" or empty (disabled)
+	Directory string  `toml:"directory"` // directory holding one recording file per cluster
+	Speed     float64 `toml:"speed"`     // replay speed relative to the recording (0 = as fast as possible)
+}
+
+// backendConfig defines a named back end instance in the config file. The
+// optional stanza matching the type replaces the corresponding top-level
+// stanza (e.g. [influxdb]) for this instance.
+type backendConfig struct {
+	Name         string              `toml:"name"`
+	Type         string              `toml:"type"` // back end plugin name, e.g. "influxdb"
+	InfluxDB     *influxDBConfig     `toml:"influxdb"`
+	InfluxDBv2   *influxDBv2Config   `toml:"influxdbv2"`
+	Prometheus   *prometheusConfig   `toml:"prometheus"`
+	File         *fileConfig         `toml:"file"`
+	LineProtocol *lineProtocolConfig `toml:"lineprotocol"`
+}
+
+// stringList is a config value that may be given as either a single string
+// or an array of strings
+type stringList []string
+
+// UnmarshalTOML implements toml.Unmarshaler
+func (l *stringList) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		*l = stringList{v}
+	case []any:
+		list := make(stringList, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return fmt.Errorf("expected string list entry, got %T", e)
+			}
+			list = append(list, s)
+		}
+		*l = list
+	default:
+		return fmt.Errorf("expected string or array of strings, got %T", v)
+	}
+	return nil
 }
 
 // loggingConfig defines the logging settings in the config file
@@ -65,8 +160,14 @@ type influxDBConfig struct {
 	Authenticated      bool   `toml:"authenticated"`
 	Username           string `toml:"username"`
 	Password           string `toml:"password"`
-	UseSSL             bool   `toml:"use_ssl"`         // connect via https instead of http
-	InsecureSkipVerify bool   `toml:"skip_ssl_verify"` // skip TLS certificate verification
+	UseSSL             bool   `toml:"use_ssl"`           // connect via https instead of http
+	InsecureSkipVerify bool   `toml:"skip_ssl_verify"`   // skip TLS certificate verification
+	RetentionPolicy    string `toml:"retention_policy"`  // retention policy to write to (default: the database default)
+	WriteConsistency   string `toml:"write_consistency"` // "any", "one", "quorum" or "all" (InfluxDB Enterprise clusters)
+	Gzip               bool   `toml:"gzip"`              // gzip-compress write requests
+	MaxBatchSize       int    `toml:"max_batch_size"`    // maximum points per write request (0 = unlimited)
+	Transport          string `toml:"transport"`         // "http" (default) or "udp"
+	UDPPayloadSize     int    `toml:"udp_payload_size"`  // maximum UDP packet payload in bytes (default 512)
 }
 
 // influxDBv2Config defines the InfluxDBv2 settings in the config file
@@ -76,8 +177,12 @@ type influxDBv2Config struct {
 	Org                string `toml:"org"`
 	Bucket             string `toml:"bucket"`
 	Token              string `toml:"access_token"`
-	UseSSL             bool   `toml:"use_ssl"`         // connect via https instead of http
-	InsecureSkipVerify bool   `toml:"skip_ssl_verify"` // skip TLS certificate verification
+	UseSSL             bool   `toml:"use_ssl"`            // connect via https instead of http
+	InsecureSkipVerify bool   `toml:"skip_ssl_verify"`    // skip TLS certificate verification
+	WriteMode          string `toml:"write_mode"`         // "blocking" (default) or "async"
+	BatchSize          uint   `toml:"batch_size"`         // async: points per write request (default 5000)
+	FlushInterval      uint   `toml:"flush_interval_ms"`  // async: maximum time between writes in ms (default 1000)
+	RetryBufferLimit   uint   `toml:"retry_buffer_limit"` // async: maximum points held for retry (default 50000)
 }
 
 // prometheusConfig defines the Prometheus settings in the config file
@@ -90,6 +195,33 @@ type prometheusConfig struct {
 	InstanceLabelName *string `toml:"instance_label_name"`
 }
 
+// fileConfig defines the file/stdout back end settings in the config file
+type fileConfig struct {
+	Path           string `toml:"path"`            // output file; empty or "-" writes to stdout
+	Format         string `toml:"format"`          // "line" (Influx line protocol), "json" (JSON lines) or "csv"
+	MaxSizeMB      int    `toml:"max_size_mb"`     // rotate when the file reaches this size (0 = no size-based rotation)
+	RotateInterval int    `toml:"rotate_interval"` // rotate after this many seconds (0 = no time-based rotation)
+	MaxBackups     int    `toml:"max_backups"`     // number of rotated files to keep (0 = keep all)
+	Compress       bool   `toml:"compress"`        // gzip rotated files
+}
+
+// lineProtocolConfig defines the line protocol over HTTP back end settings in the config file
+type lineProtocolConfig struct {
+	URL                string `toml:"url"`              // base URL of the server, e.g. "http://localhost:8086"
+	API                string `toml:"api"`              // "v1" (default), "v2" or "v3"; selects the write path and query parameters
+	Path               string `toml:"path"`             // override the write path implied by api
+	Database           string `toml:"database"`         // v1/v3 database
+	RetentionPolicy    string `toml:"retention_policy"` // v1 retention policy
+	Org                string `toml:"org"`              // v2 organization
+	Bucket             string `toml:"bucket"`           // v2 bucket
+	AuthHeader         string `toml:"auth_header"`      // name of the authentication header (default "Authorization")
+	AuthValue          string `toml:"auth_value"`       // value of the authentication header, e.g. "Token <token>"
+	Gzip               bool   `toml:"gzip"`             // gzip-compress write requests
+	MaxBatchSize       int    `toml:"max_batch_size"`   // maximum lines per write request (0 = unlimited)
+	Timeout            int    `toml:"timeout"`          // request timeout in seconds (default 30)
+	InsecureSkipVerify bool   `toml:"skip_ssl_verify"`  // skip TLS certificate verification
+}
+
 // promSdConf defines the Prometheus HTTP Service Discovery settings in the config file
 type promSdConf struct {
 	Enabled    bool
@@ -97,16 +229,35 @@ type promSdConf struct {
 	SDport     uint64 `toml:"sd_port"`
 }
 
+// selfMetricsConfig defines the collector self-monitoring settings in the config file
+type selfMetricsConfig struct {
+	ListenAddr   string `toml:"listen_addr"`   // address for the self-metrics HTTP endpoint, e.g. ":9100" (empty = disabled)
+	Path         string `toml:"path"`          // URL path of the endpoint (default "/metrics")
+	Push         bool   `toml:"push"`          // also write per-cluster self-metrics through the cluster's back end
+	PushInterval int    `toml:"push_interval"` // seconds between pushes (default 60)
+}
+
+// adminConfig defines the admin HTTP server settings in the config file
+type adminConfig struct {
+	ListenAddr     string `toml:"listen_addr"`               // address for the admin HTTP server, e.g. ":8081" (empty = disabled)
+	UnhealthyAfter int    `toml:"unhealthy_after_intervals"` // unhealthy if no collection for this many collection intervals (default 3)
+	APIToken       string `toml:"api_token"`                 // bearer token for the control API; supports $env:VAR (empty = control API disabled)
+	TLSCert        string `toml:"tls_cert"`                  // serve the admin API over TLS with this certificate
+	TLSKey         string `toml:"tls_key"`                   // and key
+}
+
 // clusterConf defines the per-cluster settings in the config file
 type clusterConf struct {
-	Hostname       string  // cluster name/ip; ideally use a SmartConnect name
-	Username       string  // account with the appropriate PAPI roles
-	Password       string  // password for the account
-	AuthType       string  // authentication type: "session" or "basic-auth"
-	SSLCheck       bool    `toml:"verify-ssl"` // turn on/off SSL cert checking to handle self-signed certificates
-	Disabled       bool    // if set, disable collection for this cluster
-	PrometheusPort *uint64 `toml:"prometheus_port"` // If using the Prometheus collector, define the listener port for the metrics handler
-	PreserveCase   *bool   `toml:"preserve_case"`   // Overwrite normalization of Cluster Name
+	Hostname       string            // cluster name/ip; ideally use a SmartConnect name
+	Username       string            // account with the appropriate PAPI roles
+	Password       string            // password for the account
+	AuthType       string            // authentication type: "session" or "basic-auth"
+	SSLCheck       bool              `toml:"verify-ssl"` // turn on/off SSL cert checking to handle self-signed certificates
+	Disabled       bool              // if set, disable collection for this cluster
+	PrometheusPort *uint64           `toml:"prometheus_port"` // If using the Prometheus collector, define the listener port for the metrics handler
+	PreserveCase   *bool             `toml:"preserve_case"`   // Overwrite normalization of Cluster Name
+	Backend        stringList        `toml:"backend"`         // back end(s) for this cluster, overriding stats_processor
+	Tags           map[string]string `toml:"tags"`            // extra tags for every point from this cluster
 }
 
 // summaryStatConfig defines whether protocol and/or client summary stats are collected
@@ -145,12 +296,7 @@ func validateConfigVersion(confVersion string) error {
 // This is used for config reloads (SIGHUP) where a failure should be logged and
 // recovered from rather than causing the process to exit.
 func readConfig(configFileName string) (tomlConfig, error) {
-	var conf tomlConfig
-	conf.Global.MaxRetries = defaultMaxRetries
-	conf.Global.ProcessorMaxRetries = processorDefaultMaxRetries
-	conf.Global.ProcessorRetryIntvl = processorDefaultRetryIntvl
-	conf.Global.MinUpdateInvtl = defaultMinUpdateInterval
-	conf.Global.PreserveCase = defaultPreserveCase
+	conf := defaultConfig()
 
 	_, err := toml.DecodeFile(configFileName, &conf)
 	if err != nil {
@@ -167,10 +313,69 @@ func readConfig(configFileName string) (tomlConfig, error) {
 	if conf.Global.ProcessorMaxRetries <= 0 {
 		conf.Global.ProcessorMaxRetries = math.MaxInt
 	}
+	if err := validateQueuePolicy(conf.Global.WriteQueuePolicy); err != nil {
+		return tomlConfig{}, err
+	}
+	if err := validateBackends(&conf); err != nil {
+		return tomlConfig{}, err
+	}
+	if err := validatePapiRecording(conf.PapiRecording); err != nil {
+		return tomlConfig{}, err
+	}
+	if err := validateScheduler(conf.Scheduler); err != nil {
+		return tomlConfig{}, err
+	}
+	if err := validateConcurrency(&conf); err != nil {
+		return tomlConfig{}, err
+	}
+	if err := validateAdaptive(conf.Adaptive); err != nil {
+		return tomlConfig{}, err
+	}
+	if err := validateDerived(conf.Derived); err != nil {
+		return tomlConfig{}, err
+	}
+	if err := validateRelabel(&conf); err != nil {
+		return tomlConfig{}, err
+	}
+	if err := validateClusterTags(&conf); err != nil {
+		return tomlConfig{}, err
+	}
+	if err := validateAdmin(conf.Admin); err != nil {
+		return tomlConfig{}, err
+	}
 
 	return conf, nil
 }
 
+// defaultConfig returns the config with the defaults for settings which are
+// not set in the config file
+func defaultConfig() tomlConfig {
+	var conf tomlConfig
+	conf.Global.MaxRetries = defaultMaxRetries
+	conf.Global.ProcessorMaxRetries = processorDefaultMaxRetries
+	conf.Global.ProcessorRetryIntvl = processorDefaultRetryIntvl
+	conf.Global.MinUpdateInvtl = defaultMinUpdateInterval
+	conf.Global.PreserveCase = defaultPreserveCase
+	conf.Global.WriteQueueSize = defaultWriteQueueSize
+	conf.Global.WriteQueuePolicy = defaultWriteQueuePolicy
+	conf.Spool.Directory = defaultSpoolDirectory
+	conf.Spool.MaxSizeMB = defaultSpoolMaxSizeMB
+	conf.Spool.MaxAge = defaultSpoolMaxAge
+	conf.StatCache.Directory = defaultStatCacheDirectory
+	conf.StatCache.TTL = defaultStatCacheTTL
+	conf.PapiRecording.Directory = defaultPapiRecordingDirectory
+	conf.PapiRecording.Speed = 1
+	conf.Scheduler.CatchUp = defaultCatchUp
+	conf.Adaptive.LatencyThreshold = defaultAdaptiveLatencyThreshold
+	conf.Adaptive.MaxBackoff = defaultAdaptiveMaxBackoff
+	conf.Adaptive.RecoverAfter = defaultAdaptiveRecoverAfter
+	conf.Adaptive.SplitAfter = defaultAdaptiveSplitAfter
+	conf.Relabel.Defaults = true
+	conf.SelfMetrics.Path = defaultSelfMetricsPath
+	conf.SelfMetrics.PushInterval = defaultSelfMetricsPushInterval
+	return conf
+}
+
 // mustReadConfig reads the config file or exits the program if this fails.
 // Used at startup where a bad config is unrecoverable.
 func mustReadConfig(configFileName string) tomlConfig {
@@ -3,6 +3,8 @@ package main
 import (
 	"os"
 	"testing"
+
+	"github.com/BurntSushi/toml"
 )
 
 func TestSecretFromEnv_PlainString(t *testing.T) {
@@ -42,3 +44,33 @@ func TestSecretFromEnv_EmptyPrefix(t *testing.T) {
 		t.Errorf("expected error for empty env var name, got none")
 	}
 }
+
+func TestStringList_UnmarshalTOML(t *testing.T) {
+	var conf struct {
+		Single stringList `toml:"single"`
+		Multi  stringList `toml:"multi"`
+	}
+	_, err := toml.Decode(`single = "influxdb"
+multi = ["influxdb", "prometheus"]`, &conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conf.Single) != 1 || conf.Single[0] != "influxdb" {
+		t.Errorf("expected [influxdb], got %v", conf.Single)
+	}
+	if len(conf.Multi) != 2 || conf.Multi[1] != "prometheus" {
+		t.Errorf("expected [influxdb prometheus], got %v", conf.Multi)
+	}
+}
+
+func TestStringList_UnmarshalTOML_BadType(t *testing.T) {
+	var conf struct {
+		List stringList `toml:"list"`
+	}
+	if _, err := toml.Decode(`list = [1, 2]`, &conf); err == nil {
+		t.Errorf("expected error for non-string list entries")
+	}
+	if _, err := toml.Decode(`list = 42`, &conf); err == nil {
+		t.Errorf("expected error for integer value")
+	}
+}
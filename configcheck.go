@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The check-config subcommand validates the config file without starting
+// collection. It reports every problem it finds rather than stopping at the
+// first, with the line number where one can be determined, and can optionally
+// connect to each cluster to validate the configured stats against the
+// cluster's stat keys and print the resulting collection schedule.
+
+// Problem severities
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// configProblem is a single problem found in the config file
+type configProblem struct {
+	line     int // 0 if unknown
+	severity string
+	msg      string
+}
+
+// configChecker accumulates the problems found in a config file
+type configChecker struct {
+	fileName string
+	lines    []string
+	problems []configProblem
+}
+
+var tableHeaderRE = regexp.MustCompile(`^\s*\[`)
+
+// newConfigChecker returns a checker for the config file source
+func newConfigChecker(fileName string, src []byte) *configChecker {
+	return &configChecker{fileName: fileName, lines: strings.Split(string(src), "\n")}
+}
+
+func (cc *configChecker) errorf(line int, format string, args ...any) {
+	cc.problems = append(cc.problems, configProblem{line: line, severity: severityError, msg: fmt.Sprintf(format, args...)})
+}
+
+func (cc *configChecker) warnf(line int, format string, args ...any) {
+	cc.problems = append(cc.problems, configProblem{line: line, severity: severityWarning, msg: fmt.Sprintf(format, args...)})
+}
+
+// errors returns the number of errors found
+func (cc *configChecker) errors() int {
+	n := 0
+	for _, p := range cc.problems {
+		if p.severity == severityError {
+			n++
+		}
+	}
+	return n
+}
+
+// tableLine returns the line number of the nth (0-based) occurrence of the
+// table header for the given table name, e.g. "cluster" matches [[cluster]]
+func (cc *configChecker) tableLine(table string, n int) int {
+	re := regexp.MustCompile(`^\s*\[\[?\s*` + regexp.QuoteMeta(table) + `\s*\]\]?\s*(#.*)?$`)
+	for i, l := range cc.lines {
+		if re.MatchString(l) {
+			if n == 0 {
+				return i + 1
+			}
+			n--
+		}
+	}
+	return 0
+}
+
+// lineInTable returns the line number of the first line at or after start,
+// and before the next table header, that matches re
+func (cc *configChecker) lineInTable(start int, re *regexp.Regexp) int {
+	if start <= 0 {
+		return 0
+	}
+	for i := start; i <= len(cc.lines); i++ {
+		l := cc.lines[i-1]
+		if i > start && tableHeaderRE.MatchString(l) {
+			break
+		}
+		if re.MatchString(l) {
+			return i
+		}
+	}
+	return 0
+}
+
+// keyLine returns the line number of the assignment to key in the table
+// starting at start, or start itself if the key is not found
+func (cc *configChecker) keyLine(start int, key string) int {
+	if line := cc.lineInTable(start, regexp.MustCompile(`^\s*"?`+regexp.QuoteMeta(key)+`"?\s*=`)); line != 0 {
+		return line
+	}
+	return start
+}
+
+// stringLine returns the line number of the quoted string in the table
+// starting at start, or start itself if it is not found
+func (cc *configChecker) stringLine(start int, s string) int {
+	if line := cc.lineInTable(start, regexp.MustCompile(regexp.QuoteMeta(strconv.Quote(s)))); line != 0 {
+		return line
+	}
+	return start
+}
+
+// undecodedKeyLine returns the line number of a key not used by the config
+func (cc *configChecker) undecodedKeyLine(key toml.Key) int {
+	if len(key) == 1 {
+		for i, l := range cc.lines {
+			if tableHeaderRE.MatchString(l) {
+				break
+			}
+			if regexp.MustCompile(`^\s*"?` + regexp.QuoteMeta(key[0]) + `"?\s*=`).MatchString(l) {
+				return i + 1
+			}
+		}
+		return 0
+	}
+	table := strings.Join(key[:len(key)-1], ".")
+	for n := 0; ; n++ {
+		start := cc.tableLine(table, n)
+		if start == 0 {
+			return 0
+		}
+		if line := cc.keyLine(start, key[len(key)-1]); line != start {
+			return line
+		}
+	}
+}
+
+// checkConfig reads and checks the config file, returning the checker with
+// the problems found and the decoded config, which is nil if the file could
+// not be read or parsed
+func checkConfig(fileName string) (*configChecker, *tomlConfig) {
+	src, err := os.ReadFile(fileName)
+	if err != nil {
+		cc := newConfigChecker(fileName, nil)
+		cc.errorf(0, "unable to read config file: %v", err)
+		return cc, nil
+	}
+	cc := newConfigChecker(fileName, src)
+	conf := defaultConfig()
+	md, err := toml.Decode(string(src), &conf)
+	if err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			cc.errorf(pe.Position.Line, "%s", pe.Message)
+		} else {
+			cc.errorf(0, "%v", err)
+		}
+		return cc, nil
+	}
+	for _, key := range md.Undecoded() {
+		cc.warnf(cc.undecodedKeyLine(key), "unknown setting %q", key.String())
+	}
+	cc.checkGlobal(&conf)
+	cc.checkBackends(&conf)
+	cc.checkClusters(&conf)
+	cc.checkStatGroups(&conf)
+	cc.checkDerived(&conf)
+	cc.checkRelabel(&conf)
+	return cc, &conf
+}
+
+// checkGlobal checks the [global] settings
+func (cc *configChecker) checkGlobal(conf *tomlConfig) {
+	global := cc.tableLine("global", 0)
+	if err := validateConfigVersion(conf.Global.Version); err != nil {
+		cc.errorf(cc.keyLine(global, "version"), "%v", err)
+	}
+	if err := validateQueuePolicy(conf.Global.WriteQueuePolicy); err != nil {
+		cc.errorf(cc.keyLine(global, "write_queue_policy"), "%v", err)
+	}
+	if err := validatePapiRecording(conf.PapiRecording); err != nil {
+		cc.errorf(cc.tableLine("papi_recording", 0), "%v", err)
+	}
+	if err := validateScheduler(conf.Scheduler); err != nil {
+		cc.errorf(cc.tableLine("scheduler", 0), "%v", err)
+	}
+	if err := validateConcurrency(conf); err != nil {
+		cc.errorf(cc.tableLine("concurrency", 0), "%v", err)
+	}
+	if err := validateAdaptive(conf.Adaptive); err != nil {
+		cc.errorf(cc.tableLine("adaptive", 0), "%v", err)
+	}
+	if err := validateAdmin(conf.Admin); err != nil {
+		cc.errorf(cc.tableLine("admin", 0), "%v", err)
+	}
+	if err := validateTags(conf.Global.Tags, instanceLabelNames(conf)); err != nil {
+		cc.errorf(cc.keyLine(global, "tags"), "[global] tags: %v", err)
+	}
+	if len(conf.Global.Processor) == 0 && slices.ContainsFunc(conf.Clusters, func(cl clusterConf) bool { return len(cl.Backend) == 0 }) {
+		cc.errorf(global, "stats_processor is not set")
+	}
+}
+
+// checkBackends checks the back end names and the stanzas of the back ends in use
+func (cc *configChecker) checkBackends(conf *tomlConfig) {
+	global := cc.tableLine("global", 0)
+	if err := validateBackends(conf); err != nil {
+		var errs []error
+		if je, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = je.Unwrap()
+		} else {
+			errs = []error{err}
+		}
+		for _, e := range errs {
+			cc.errorf(cc.keyLine(global, "stats_processor"), "%v", e)
+		}
+		return
+	}
+
+	// check the stanza of every back end referenced by an enabled cluster once
+	checked := make(map[string]bool)
+	for ci, cl := range conf.Clusters {
+		if cl.Disabled {
+			continue
+		}
+		for _, name := range clusterBackends(conf, ci) {
+			if checked[name] {
+				continue
+			}
+			checked[name] = true
+			bconf, line := conf, cc.tableLine(backendType(conf, name), 0)
+			for bi := range conf.Backends {
+				if conf.Backends[bi].Name == name {
+					bconf = conf.Backends[bi].apply(conf)
+					line = cc.stringLine(cc.tableLine("backend", bi), name)
+				}
+			}
+			for _, err := range backendStanzaProblems(backendType(conf, name), bconf) {
+				cc.errorf(line, "backend %q: %v", name, err)
+			}
+		}
+	}
+}
+
+// backendStanzaProblems checks the config stanza for a back end type without
+// connecting to the back end
+func backendStanzaProblems(typ string, conf *tomlConfig) []error {
+	var errs []error
+	secret := func(what string, s string) {
+		if _, err := secretFromEnv(s); err != nil {
+			errs = append(errs, fmt.Errorf("unable to resolve %s: %w", what, err))
+		}
+	}
+	switch typ {
+	case influxPluginName:
+		ic := conf.InfluxDB
+		if ic.Host == "" {
+			errs = append(errs, errors.New("[influxdb] host is not set"))
+		}
+		if ic.Database == "" && !strings.EqualFold(ic.Transport, influxTransportUDP) {
+			errs = append(errs, errors.New("[influxdb] database is not set"))
+		}
+		switch strings.ToLower(ic.WriteConsistency) {
+		case "", "any", "one", "quorum", "all":
+		default:
+			errs = append(errs, fmt.Errorf("unknown [influxdb] write_consistency %q", ic.WriteConsistency))
+		}
+		switch strings.ToLower(ic.Transport) {
+		case "", influxTransportHTTP, influxTransportUDP:
+		default:
+			errs = append(errs, fmt.Errorf("unknown [influxdb] transport %q", ic.Transport))
+		}
+		if ic.Authenticated {
+			if ic.Username == "" || ic.Password == "" {
+				errs = append(errs, errors.New("[influxdb] authenticated is set but username or password is not"))
+			}
+			secret("[influxdb] password", ic.Password)
+		}
+	case influxV2PluginName:
+		ic := conf.InfluxDBv2
+		if ic.Host == "" {
+			errs = append(errs, errors.New("[influxdbv2] host is not set"))
+		}
+		if ic.Org == "" || ic.Bucket == "" {
+			errs = append(errs, errors.New("[influxdbv2] org and bucket must be set"))
+		}
+		if ic.Token == "" {
+			errs = append(errs, errors.New("[influxdbv2] access_token is not set"))
+		}
+		secret("[influxdbv2] access_token", ic.Token)
+		switch ic.WriteMode {
+		case "", influxWriteModeBlocking, influxWriteModeAsync:
+		default:
+			errs = append(errs, fmt.Errorf("unknown [influxdbv2] write_mode %q", ic.WriteMode))
+		}
+	case lineProtocolPluginName:
+		if _, err := lineProtocolWriteURL(conf.LineProtocol); err != nil {
+			errs = append(errs, fmt.Errorf("[lineprotocol] %w", err))
+		}
+		secret("[lineprotocol] auth_value", conf.LineProtocol.AuthValue)
+	case filePluginName:
+		switch strings.ToLower(conf.File.Format) {
+		case "", fileFormatLine, fileFormatJSON, fileFormatCSV:
+		default:
+			errs = append(errs, fmt.Errorf("unknown [file] format %q", conf.File.Format))
+		}
+		if conf.File.writesStdout() && conf.Logging.LogToStdout {
+			errs = append(errs, errStdoutLogging)
+		}
+	}
+	return errs
+}
+
+// checkClusters checks the [[cluster]] stanzas
+func (cc *configChecker) checkClusters(conf *tomlConfig) {
+	if len(conf.Clusters) == 0 {
+		cc.errorf(0, "no clusters are configured")
+		return
+	}
+	hostnames := make(map[string]bool)
+	promPorts := make(map[uint64]string)
+	enabled := 0
+	for ci, cl := range conf.Clusters {
+		line := cc.tableLine("cluster", ci)
+		if cl.Hostname == "" {
+			cc.errorf(line, "cluster has no hostname")
+		} else if hostnames[cl.Hostname] {
+			cc.errorf(cc.keyLine(line, "hostname"), "duplicate cluster hostname %q", cl.Hostname)
+		}
+		hostnames[cl.Hostname] = true
+		if cl.Disabled {
+			continue
+		}
+		enabled++
+		if cl.Username == "" || cl.Password == "" {
+			cc.errorf(line, "cluster %s: username and password must be set", cl.Hostname)
+		} else if _, err := secretFromEnv(cl.Password); err != nil {
+			cc.errorf(cc.keyLine(line, "password"), "cluster %s: unable to resolve password: %v", cl.Hostname, err)
+		}
+		if err := validateTags(cl.Tags, instanceLabelNames(conf)); err != nil {
+			cc.errorf(cc.keyLine(line, "tags"), "cluster %s: tags: %v", cl.Hostname, err)
+		} else if _, err := clusterTags(cl, conf.Global); err != nil {
+			cc.errorf(cc.keyLine(line, "tags"), "cluster %s: unable to resolve tags: %v", cl.Hostname, err)
+		}
+		if cl.AuthType != "" && cl.AuthType != authtypeSession && cl.AuthType != authtypeBasic {
+			cc.warnf(cc.keyLine(line, "authtype"), "cluster %s: unknown authtype %q, %q will be used", cl.Hostname, cl.AuthType, defaultAuthType)
+		}
+		usesProm := slices.ContainsFunc(clusterBackends(conf, ci), func(name string) bool {
+			return backendType(conf, name) == promPluginName
+		})
+		if usesProm {
+			if cl.PrometheusPort == nil {
+				cc.errorf(line, "cluster %s: prometheus_port must be set for the prometheus back end", cl.Hostname)
+			} else if other, ok := promPorts[*cl.PrometheusPort]; ok {
+				cc.errorf(cc.keyLine(line, "prometheus_port"), "cluster %s: prometheus_port %d is also used by cluster %s", cl.Hostname, *cl.PrometheusPort, other)
+			} else {
+				promPorts[*cl.PrometheusPort] = cl.Hostname
+			}
+		}
+	}
+	if enabled == 0 {
+		cc.warnf(0, "every cluster is disabled")
+	}
+}
+
+// checkStatGroups checks the [[statgroup]] stanzas and the active stat groups
+func (cc *configChecker) checkStatGroups(conf *tomlConfig) {
+	groups := make(map[string]int) // group name -> index
+	for gi, sg := range conf.StatGroups {
+		line := cc.tableLine("statgroup", gi)
+		if sg.Name == "" {
+			cc.errorf(line, "stat group has no name")
+			continue
+		}
+		if _, ok := groups[sg.Name]; ok {
+			cc.errorf(cc.keyLine(line, "name"), "duplicate stat group name %q", sg.Name)
+			continue
+		}
+		groups[sg.Name] = gi
+		if err := checkUpdateIntvl(sg.UpdateIntvl); err != nil {
+			cc.errorf(cc.keyLine(line, "update_interval"), "stat group %s: %v", sg.Name, err)
+		} else if v, err := strconv.ParseFloat(sg.UpdateIntvl, 64); err == nil && v < float64(conf.Global.MinUpdateInvtl) {
+			cc.warnf(cc.keyLine(line, "update_interval"), "stat group %s: update_interval %s is less than min_update_interval_override and will be clamped to %d",
+				sg.Name, sg.UpdateIntvl, conf.Global.MinUpdateInvtl)
+		}
+		if len(sg.Stats) == 0 {
+			cc.warnf(line, "stat group %s has no stats", sg.Name)
+		}
+	}
+
+	global := cc.tableLine("global", 0)
+	if len(conf.Global.ActiveStatGroups) == 0 {
+		cc.errorf(cc.keyLine(global, "active_stat_groups"), "no active stat groups")
+	}
+	seen := make(map[string]string) // stat -> group
+	for _, group := range conf.Global.ActiveStatGroups {
+		gi, ok := groups[group]
+		if !ok {
+			cc.errorf(cc.stringLine(cc.keyLine(global, "active_stat_groups"), group), "active stat group %q is not defined", group)
+			continue
+		}
+		line := cc.tableLine("statgroup", gi)
+		for _, stat := range conf.StatGroups[gi].Stats {
+			if other, ok := seen[stat]; ok {
+				cc.errorf(cc.stringLine(line, stat), "stat %s is in both stat group %s and %s", stat, other, group)
+				continue
+			}
+			seen[stat] = group
+		}
+	}
+}
+
+// checkUpdateIntvl checks a stat group update interval, which parseUpdateIntvl
+// would otherwise replace with the default
+func checkUpdateIntvl(interval string) error {
+	if interval == "" {
+		return errors.New("update_interval is not set")
+	}
+	if m, ok := strings.CutPrefix(interval, "*"); ok {
+		if m == "" {
+			return nil
+		}
+		if v, err := strconv.ParseFloat(m, 64); err != nil || v <= 0 {
+			return fmt.Errorf("invalid update_interval multiplier %q", interval)
+		}
+		return nil
+	}
+	if v, err := strconv.ParseFloat(interval, 64); err != nil || v <= 0 {
+		return fmt.Errorf("invalid update_interval %q", interval)
+	}
+	return nil
+}
+
+// checkClusterStats connects to the configured cluster and checks its stats
+func (cc *configChecker) checkClusterStats(ctx context.Context, conf *tomlConfig, ci int, sg map[string]statGroup, w io.Writer) {
+	cl := conf.Clusters[ci]
+	line := cc.tableLine("cluster", ci)
+	c, err := newCluster(cl, conf.Global)
+	if err != nil {
+		cc.errorf(line, "cluster %s: %v", cl.Hostname, err)
+		return
+	}
+	if err := c.Connect(ctx); err != nil {
+		cc.errorf(line, "cluster %s: unable to connect: %v", cl.Hostname, err)
+		return
+	}
+	if err := cc.checkStats(ctx, c, conf, sg, w); err != nil {
+		cc.errorf(line, "cluster %s: %v", cl.Hostname, err)
+	}
+}
+
+// checkStats checks the active stats against the stat keys of the connected
+// cluster and writes the collection schedule to w
+func (cc *configChecker) checkStats(ctx context.Context, c *Cluster, conf *tomlConfig, sg map[string]statGroup, w io.Writer) error {
+	keys, err := c.listStatKeys(ctx)
+	if err != nil {
+		return err
+	}
+	known := indexStatKeys(keys)
+	sd := make(map[string]statDetail)
+	for gi, g := range conf.StatGroups {
+		if _, ok := sg[g.Name]; !ok {
+			continue
+		}
+		for _, stat := range g.Stats {
+			k, ok := known[stat]
+			if !ok {
+				cc.warnf(cc.stringLine(cc.tableLine("statgroup", gi), stat), "stat %s in stat group %s is not available on cluster %s (OneFS %s)", stat, g.Name, c.ClusterName, c.OSVersion)
+				continue
+			}
+			sd[stat] = k.detail()
+		}
+	}
+	writeSchedule(w, c, calcBuckets(c, conf.Global.MinUpdateInvtl, sg, sd, conf.Global.FetchByStatgroup), conf.SummaryStats)
+	return nil
+}
+
+// writeSchedule writes a cluster's collection schedule
+func writeSchedule(w io.Writer, c *Cluster, buckets []statTimeSet, ss summaryStatConfig) {
+	slices.SortFunc(buckets, func(a, b statTimeSet) int {
+		if a.interval != b.interval {
+			return int(a.interval - b.interval)
+		}
+		return strings.Compare(a.groupName, b.groupName)
+	})
+	fmt.Fprintf(w, "\nCollection schedule for cluster %s (%s, OneFS %s):\n", c.ClusterName, c.Hostname, c.OSVersion)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  INTERVAL\tGROUP\tSTATS")
+	for _, b := range buckets {
+		group := b.groupName
+		if group == "" {
+			group = "-"
+		}
+		fmt.Fprintf(tw, "  %v\t%s\t%d\n", b.interval, group, len(b.stats))
+	}
+	for _, s := range []struct {
+		enabled bool
+		name    string
+	}{{ss.Protocol, "summary protocol"}, {ss.Client, "summary client"}, {ss.Drive, "summary drive"}} {
+		if s.enabled {
+			fmt.Fprintf(tw, "  %v\t%s\t-\n", summaryStatsInterval, s.name)
+		}
+	}
+	_ = tw.Flush()
+}
+
+// writeProblems writes the problems found, in line order
+func (cc *configChecker) writeProblems(w io.Writer) {
+	slices.SortStableFunc(cc.problems, func(a, b configProblem) int { return a.line - b.line })
+	for _, p := range cc.problems {
+		if p.line > 0 {
+			fmt.Fprintf(w, "%s:%d: %s: %s\n", cc.fileName, p.line, p.severity, p.msg)
+		} else {
+			fmt.Fprintf(w, "%s: %s: %s\n", cc.fileName, p.severity, p.msg)
+		}
+	}
+}
+
+// runCheckConfig implements the check-config subcommand and returns the exit status
+func runCheckConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s check-config [options]\n\nCheck the config file for problems without starting collection.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	configFileName := flags.String("config-file", "idic.toml", "pathname of config file")
+	connect := flags.Bool("connect", false, "connect to each enabled cluster to check the stats and print the collection schedule")
+	clusterName := flags.String("cluster", "", "with -connect, only connect to the cluster with this hostname")
+	timeout := flags.Duration("timeout", 2*time.Minute, "with -connect, time limit for checking each cluster")
+	logLevel := flags.String("loglevel", "ERROR", "log level [CRITICAL|ERROR|WARNING|NOTICE|INFO|DEBUG|TRACE]")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := setupCommandLogging(*logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "check-config: %v\n", err)
+		return 2
+	}
+
+	cc, conf := checkConfig(*configFileName)
+	if conf != nil && *connect && cc.errors() == 0 {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+		sg := parseStatConfig(*conf)
+		for ci, cl := range conf.Clusters {
+			if cl.Disabled || *clusterName != "" && cl.Hostname != *clusterName {
+				continue
+			}
+			cctx, ccancel := context.WithTimeout(ctx, *timeout)
+			cc.checkClusterStats(cctx, conf, ci, sg, os.Stdout)
+			ccancel()
+		}
+	}
+	cc.writeProblems(os.Stdout)
+	errs := cc.errors()
+	fmt.Printf("%s: %d error(s), %d warning(s)\n", *configFileName, errs, len(cc.problems)-errs)
+	if errs > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkDerived checks the derived metrics, warning about stats that are not
+// collected
+func (cc *configChecker) checkDerived(conf *tomlConfig) {
+	collected := make(map[string]bool)
+	groupOf := make(map[string]statGroupConf)
+	for _, sg := range conf.StatGroups {
+		if slices.Contains(conf.Global.ActiveStatGroups, sg.Name) {
+			for _, stat := range sg.Stats {
+				collected[stat] = true
+				groupOf[stat] = sg
+			}
+		}
+	}
+	names := make(map[string]bool)
+	for i, rc := range conf.Derived.Rates {
+		line := cc.tableLine("derived.rate", i)
+		if rc.Stat == "" {
+			cc.errorf(line, "derived rate has no stat")
+			continue
+		}
+		if names[rc.rateName()] {
+			cc.errorf(line, "duplicate derived metric name %q", rc.rateName())
+		}
+		names[rc.rateName()] = true
+		if !collected[rc.Stat] {
+			cc.warnf(cc.keyLine(line, "stat"), "derived rate of stat %s, which is not in an active stat group", rc.Stat)
+		}
+	}
+	for i, ec := range conf.Derived.Exprs {
+		line := cc.tableLine("derived.expr", i)
+		if ec.Name == "" {
+			cc.errorf(line, "derived expression has no name")
+			continue
+		}
+		if names[ec.Name] {
+			cc.errorf(cc.keyLine(line, "name"), "duplicate derived metric name %q", ec.Name)
+		}
+		names[ec.Name] = true
+		expr, err := parseDerivedExpr(ec.Expr)
+		if err != nil {
+			cc.errorf(cc.keyLine(line, "expr"), "derived metric %s: %v", ec.Name, err)
+			continue
+		}
+		var groups []statGroupConf
+		for _, ref := range expr.refs(nil) {
+			stat := ref.stat
+			if i := slices.IndexFunc(conf.Derived.Rates, func(rc derivedRateConf) bool { return rc.rateName() == ref.stat }); i >= 0 {
+				// a rate is computed in the bucket of its stat
+				stat = conf.Derived.Rates[i].Stat
+			} else if !collected[stat] {
+				cc.warnf(cc.keyLine(line, "expr"), "derived metric %s refers to %s, which is neither a stat in an active stat group nor a derived rate", ec.Name, ref.stat)
+			}
+			if sg, ok := groupOf[stat]; ok && !slices.ContainsFunc(groups, func(g statGroupConf) bool { return g.Name == sg.Name }) {
+				groups = append(groups, sg)
+			}
+		}
+		cc.checkDerivedBuckets(conf, cc.keyLine(line, "expr"), ec.Name, groups)
+	}
+}
+
+// checkDerivedBuckets warns if the stat groups of the stats a derived
+// expression refers to are collected in different buckets, since an
+// expression is only evaluated over the stats of a single bucket
+func (cc *configChecker) checkDerivedBuckets(conf *tomlConfig, line int, name string, groups []statGroupConf) {
+	if len(groups) < 2 {
+		return
+	}
+	names := make([]string, len(groups))
+	for i, sg := range groups {
+		names[i] = sg.Name
+	}
+	if conf.Global.FetchByStatgroup {
+		cc.warnf(line, "derived metric %s refers to stats in stat groups %s, which are collected separately with fetch_by_statgroup", name, strings.Join(names, ", "))
+		return
+	}
+	// invalid intervals have already been reported, and intervals below the
+	// minimum are clamped here to avoid parseUpdateIntvl logging it again
+	mui := conf.Global.MinUpdateInvtl
+	refresh := make([]sgRefresh, len(groups))
+	for i, sg := range groups {
+		if checkUpdateIntvl(sg.UpdateIntvl) != nil {
+			return
+		}
+		interval := sg.UpdateIntvl
+		if v, err := strconv.ParseFloat(interval, 64); err == nil && v < float64(mui) {
+			interval = strconv.Itoa(mui)
+		}
+		refresh[i] = parseUpdateIntvl(interval, mui)
+	}
+	for _, r := range refresh[1:] {
+		if r != refresh[0] {
+			cc.warnf(line, "derived metric %s refers to stats in stat groups %s, which have different update intervals and are collected separately", name, strings.Join(names, ", "))
+			return
+		}
+	}
+}
+
+// checkRelabel checks the relabel rules
+func (cc *configChecker) checkRelabel(conf *tomlConfig) {
+	for i, rc := range conf.Relabel.Rules {
+		line := cc.tableLine("relabel.rule", i)
+		if _, err := compileRelabelRule(rc); err != nil {
+			cc.errorf(line, "relabel rule: %v", err)
+		}
+		for _, b := range rc.Backends {
+			if _, err := getDBWriter(b); err != nil && findBackend(conf, b) == nil {
+				cc.errorf(cc.stringLine(cc.keyLine(line, "backends"), b), "relabel rule: unknown back end %q", b)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes the config source to a temporary file and returns its path
+func writeTestConfig(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "idic.toml")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatalf("unable to write config: %v", err)
+	}
+	return path
+}
+
+// problemAt reports whether a problem of the given severity containing msg was found at line
+func problemAt(cc *configChecker, line int, severity, msg string) bool {
+	for _, p := range cc.problems {
+		if p.line == line && p.severity == severity && strings.Contains(p.msg, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheckConfig_ReportsAllProblems(t *testing.T) {
+	setMemoryBackend()
+	path := writeTestConfig(t, `[global]
+version = "v0.39"
+stats_processor = "influxdb"
+active_stat_groups = ["cluster_cpu_stats", "missing_stats", "more_cpu_stats"]
+no_such_setting = 1
+
+[influxdb]
+database = "isi_data_insights"
+
+[[cluster]]
+hostname = "cluster1"
+username = "user"
+password = "pass"
+
+[[cluster]]
+hostname = "cluster1"
+username = "user"
+password = "pass"
+authtype = "kerberos"
+
+[[statgroup]]
+name = "cluster_cpu_stats"
+update_interval = "*bogus"
+stats = [
+    "cluster.cpu.sys.avg",
+]
+
+[[statgroup]]
+name = "more_cpu_stats"
+update_interval = "*"
+stats = [
+    "cluster.cpu.user.avg",
+    "cluster.cpu.sys.avg",
+]
+`)
+	cc, conf := checkConfig(path)
+	if conf == nil {
+		t.Fatalf("expected the config to parse, got %+v", cc.problems)
+	}
+	for _, want := range []struct {
+		line     int
+		severity string
+		msg      string
+	}{
+		{4, severityError, `"missing_stats" is not defined`},
+		{5, severityWarning, `unknown setting "global.no_such_setting"`},
+		{7, severityError, "host is not set"},
+		{16, severityError, "duplicate cluster hostname"},
+		{19, severityWarning, "unknown authtype"},
+		{23, severityError, "invalid update_interval multiplier"},
+		{33, severityError, "stat cluster.cpu.sys.avg is in both"},
+	} {
+		if !problemAt(cc, want.line, want.severity, want.msg) {
+			t.Errorf("expected %s %q at line %d, got %+v", want.severity, want.msg, want.line, cc.problems)
+		}
+	}
+	if cc.errors() != 5 {
+		t.Errorf("expected 5 errors, got %d: %+v", cc.errors(), cc.problems)
+	}
+}
+
+func TestCheckConfig_ParseError(t *testing.T) {
+	path := writeTestConfig(t, "[global]\nversion = \"v0.39\"\nstats_processor = [\"influxdb\"\n\n[[cluster]]\n")
+	cc, conf := checkConfig(path)
+	if conf != nil {
+		t.Fatalf("expected no config for a parse error")
+	}
+	if len(cc.problems) != 1 || cc.problems[0].line == 0 || cc.errors() != 1 {
+		t.Errorf("expected a single parse error with a line number, got %+v", cc.problems)
+	}
+}
+
+func TestCheckConfig_Example(t *testing.T) {
+	setMemoryBackend()
+	cc, conf := checkConfig("example_isi_data_insights_d.toml")
+	if conf == nil || len(cc.problems) != 0 {
+		t.Errorf("expected the example config to be clean, got %+v", cc.problems)
+	}
+}
+
+func TestCheckClusterStats_Schedule(t *testing.T) {
+	setMemoryBackend()
+	var listings, lookups atomic.Int32
+	c := newStatKeysServer(t, &listings, &lookups)
+	path := writeTestConfig(t, `[global]
+version = "v0.39"
+stats_processor = "discard"
+active_stat_groups = ["ifs_stats"]
+min_update_interval_override = 5
+
+[summary_stats]
+protocol = true
+
+[[cluster]]
+hostname = "cluster1"
+username = "user"
+password = "pass"
+
+[[statgroup]]
+name = "ifs_stats"
+update_interval = "*2"
+stats = [
+    "node.ifs.bytes.out",
+    "node.no.such.stat",
+]
+`)
+	cc, conf := checkConfig(path)
+	if conf == nil || cc.errors() != 0 {
+		t.Fatalf("unexpected problems: %+v", cc.problems)
+	}
+	var sb strings.Builder
+	if err := cc.checkStats(t.Context(), c, conf, parseStatConfig(*conf), &sb); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !problemAt(cc, 20, severityWarning, "node.no.such.stat in stat group ifs_stats is not available") {
+		t.Errorf("expected unavailable stat warning, got %+v", cc.problems)
+	}
+	out := sb.String()
+	if !strings.Contains(out, (10*time.Second).String()) || !strings.Contains(out, "summary protocol") {
+		t.Errorf("unexpected schedule:\n%s", out)
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Derived metrics are computed from the decoded points of each collection
+// before they are queued for the back end, and written as additional points.
+//
+// A [[derived.rate]] computes the per-second rate (or, with delta = true, the
+// change) of a cumulative counter stat between consecutive collections. The
+// previous sample is kept per tag set and field, so each node, protocol
+// operation etc. is tracked separately. If a counter goes down, which happens
+// when a node restarts or a counter wraps, no value is emitted for it and the
+// new value becomes the baseline. A tag set missing from a collection is
+// forgotten, so a node that leaves and rejoins the cluster starts afresh.
+//
+// A [[derived.expr]] evaluates an arithmetic expression (+, -, *, / and
+// parentheses) over stats collected in the same stat bucket, or derived rates
+// of them, e.g. "node.ifs.cache.l1.data.hit / (node.ifs.cache.l1.data.hit +
+// node.ifs.cache.l1.data.miss)". A stat name refers to the stat's "value"
+// field; "stat:field" refers to another field. Points of the referenced stats
+// are matched on their tags; a stat with a single tag set, such as a cluster
+// stat, matches every tag set of the others. Tag sets for which a stat is
+// missing, or the expression divides by zero, are skipped.
+
+// Default field of a stat in a derived expression
+const derivedDefaultField = "value"
+
+// derivedConfig defines the derived metrics in the config file
+type derivedConfig struct {
+	Rates []derivedRateConf `toml:"rate"`
+	Exprs []derivedExprConf `toml:"expr"`
+}
+
+// derivedRateConf defines a rate or delta of a counter stat
+type derivedRateConf struct {
+	Stat   string   `toml:"stat"`   // counter stat
+	Name   string   `toml:"name"`   // name of the derived points (default <stat>.rate or <stat>.delta)
+	Fields []string `toml:"fields"` // fields to derive (default all numeric fields)
+	Delta  bool     `toml:"delta"`  // emit the change rather than the per-second rate
+}
+
+// derivedExprConf defines an expression across stats of a bucket
+type derivedExprConf struct {
+	Name string `toml:"name"` // name of the derived points, with the result in the "value" field
+	Expr string `toml:"expr"`
+}
+
+var counterResets = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: selfMetricsNamespace,
+	Subsystem: "derived",
+	Name:      "counter_resets_total",
+	Help:      "Number of counter decreases (e.g. node restarts) seen when computing derived rates.",
+}, []string{"cluster", "stat"})
+
+// rateName returns the name of the derived rate points
+func (rc derivedRateConf) rateName() string {
+	switch {
+	case rc.Name != "":
+		return rc.Name
+	case rc.Delta:
+		return rc.Stat + ".delta"
+	}
+	return rc.Stat + ".rate"
+}
+
+// validateDerived checks the [derived] settings
+func validateDerived(dc derivedConfig) error {
+	var errs []error
+	names := make(map[string]bool)
+	addName := func(name string) {
+		if names[name] {
+			errs = append(errs, fmt.Errorf("[derived] duplicate derived metric name %q", name))
+		}
+		names[name] = true
+	}
+	for i, rc := range dc.Rates {
+		if rc.Stat == "" {
+			errs = append(errs, fmt.Errorf("[[derived.rate]] %d has no stat", i+1))
+			continue
+		}
+		addName(rc.rateName())
+	}
+	for i, ec := range dc.Exprs {
+		if ec.Name == "" {
+			errs = append(errs, fmt.Errorf("[[derived.expr]] %d has no name", i+1))
+			continue
+		}
+		addName(ec.Name)
+		if _, err := parseDerivedExpr(ec.Expr); err != nil {
+			errs = append(errs, fmt.Errorf("[[derived.expr]] %s: %w", ec.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// derivedDetails returns the details of the derived metrics, for back ends
+// which describe each metric, based on the details of the stats they are
+// derived from
+func derivedDetails(dc derivedConfig, sd map[string]statDetail) map[string]statDetail {
+	details := make(map[string]statDetail)
+	for _, rc := range dc.Rates {
+		source, ok := sd[rc.Stat]
+		if !ok {
+			continue
+		}
+		detail := statDetail{valid: source.valid, scope: source.scope, datatype: source.datatype, updateIntvl: source.updateIntvl}
+		if rc.Delta {
+			detail.description = "Change in " + rc.Stat
+		} else {
+			detail.description = "Per-second rate of " + rc.Stat
+		}
+		details[rc.rateName()] = detail
+	}
+	for _, ec := range dc.Exprs {
+		expr, err := parseDerivedExpr(ec.Expr)
+		if err != nil {
+			continue
+		}
+		detail := statDetail{valid: true, description: "Derived from " + ec.Expr}
+		for _, ref := range expr.refs(nil) {
+			source, ok := sd[ref.stat]
+			if !ok {
+				source, ok = details[ref.stat]
+			}
+			if !ok || !source.valid {
+				detail.valid = false
+				break
+			}
+			detail.updateIntvl = max(detail.updateIntvl, source.updateIntvl)
+		}
+		if detail.valid {
+			details[ec.Name] = detail
+		}
+	}
+	return details
+}
+
+// rateSample is the previous value of a counter
+type rateSample struct {
+	value float64
+	time  int64
+}
+
+// derivedRate computes a rate for a cluster
+type derivedRate struct {
+	derivedRateConf
+	name string
+	last map[string]rateSample // by tag set and field
+}
+
+// derivedExpr evaluates an expression for a cluster
+type derivedExpr struct {
+	name string
+	expr *exprNode
+	refs []exprRef
+}
+
+// derivedMetrics computes the derived metrics of a cluster's points
+type derivedMetrics struct {
+	label string // cluster name for logs and metrics
+	rates map[string][]*derivedRate
+	exprs []derivedExpr
+}
+
+// newDerivedMetrics returns the derived metrics for the cluster, or nil if
+// none are configured
+func newDerivedMetrics(clusterName string, dc derivedConfig) (*derivedMetrics, error) {
+	if len(dc.Rates) == 0 && len(dc.Exprs) == 0 {
+		return nil, nil
+	}
+	dm := &derivedMetrics{label: clusterName, rates: make(map[string][]*derivedRate)}
+	for _, rc := range dc.Rates {
+		dm.rates[rc.Stat] = append(dm.rates[rc.Stat], &derivedRate{derivedRateConf: rc, name: rc.rateName(), last: make(map[string]rateSample)})
+	}
+	for _, ec := range dc.Exprs {
+		expr, err := parseDerivedExpr(ec.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("derived metric %s: %w", ec.Name, err)
+		}
+		dm.exprs = append(dm.exprs, derivedExpr{name: ec.Name, expr: expr, refs: expr.refs(nil)})
+	}
+	return dm, nil
+}
+
+// apply returns the points with the derived points appended. A nil
+// derivedMetrics returns the points unchanged.
+func (dm *derivedMetrics) apply(points []Point) []Point {
+	if dm == nil {
+		return points
+	}
+	n := len(points)
+	for i := range n {
+		for _, r := range dm.rates[points[i].name] {
+			if p, ok := dm.rate(r, points[i]); ok {
+				points = append(points, p)
+			}
+		}
+	}
+	if len(dm.exprs) == 0 {
+		return points
+	}
+	byName := make(map[string]*Point, len(points))
+	for i := range points {
+		byName[points[i].name] = &points[i]
+	}
+	var exprPoints []Point
+	for _, e := range dm.exprs {
+		if p, ok := e.eval(byName); ok {
+			exprPoints = append(exprPoints, p)
+		}
+	}
+	return append(points, exprPoints...)
+}
+
+// derivedTagKey identifies a tag set, ignoring whether the result was degraded
+func derivedTagKey(tags ptTags) string {
+	var sb strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		if k == "degraded" {
+			continue
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(tags[k])
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// numericValue returns a field value as a float64
+func numericValue(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// rate computes the derived rate point for a point of the counter stat
+func (dm *derivedMetrics) rate(r *derivedRate, p Point) (Point, bool) {
+	out := Point{name: r.name, time: p.time}
+	last := make(map[string]rateSample, len(r.last))
+	for i, fields := range p.fields {
+		key := derivedTagKey(p.tags[i])
+		names := r.Fields
+		if len(names) == 0 {
+			names = slices.Sorted(maps.Keys(fields))
+		}
+		derived := make(ptFields)
+		for _, f := range names {
+			v, ok := numericValue(fields[f])
+			if !ok {
+				continue
+			}
+			sk := key + "\x00" + f
+			prev, seen := r.last[sk]
+			if seen && p.time <= prev.time {
+				// not updated since the previous collection
+				last[sk] = prev
+				continue
+			}
+			last[sk] = rateSample{value: v, time: p.time}
+			if !seen {
+				continue
+			}
+			delta := v - prev.value
+			if delta < 0 {
+				counterResets.WithLabelValues(dm.label, r.Stat).Inc()
+				log.Debug("counter reset, restarting rate", slog.String("cluster", dm.label), slog.String("stat", r.Stat),
+					slog.String("field", f), slog.Any("tags", p.tags[i]))
+				continue
+			}
+			if r.Delta {
+				derived[f] = delta
+			} else {
+				derived[f] = delta / float64(p.time-prev.time)
+			}
+		}
+		if len(derived) > 0 {
+			out.fields = append(out.fields, derived)
+			out.tags = append(out.tags, maps.Clone(p.tags[i]))
+		}
+	}
+	r.last = last
+	return out, len(out.fields) > 0
+}
+
+// eval evaluates the expression for each matching tag set of the points
+func (e derivedExpr) eval(byName map[string]*Point) (Point, bool) {
+	// the stat with the most tag sets drives the evaluation
+	var driver *Point
+	for _, ref := range e.refs {
+		p, ok := byName[ref.stat]
+		if !ok {
+			return Point{}, false
+		}
+		if driver == nil || len(p.tags) > len(driver.tags) {
+			driver = p
+		}
+	}
+	if driver == nil {
+		return Point{}, false
+	}
+	indexes := make(map[string]map[string]int, len(e.refs)) // stat -> tag key -> instance
+	for _, ref := range e.refs {
+		if _, ok := indexes[ref.stat]; ok {
+			continue
+		}
+		idx := make(map[string]int)
+		for i, tags := range byName[ref.stat].tags {
+			idx[derivedTagKey(tags)] = i
+		}
+		indexes[ref.stat] = idx
+	}
+	out := Point{name: e.name}
+	values := make(map[exprRef]float64, len(e.refs))
+instances:
+	for _, tags := range driver.tags {
+		key := derivedTagKey(tags)
+		var t int64
+		for _, ref := range e.refs {
+			p := byName[ref.stat]
+			i, ok := indexes[ref.stat][key]
+			if !ok {
+				if len(p.tags) != 1 {
+					continue instances
+				}
+				i = 0
+			}
+			v, ok := numericValue(p.fields[i][ref.field])
+			if !ok {
+				continue instances
+			}
+			values[ref] = v
+			t = max(t, p.time)
+		}
+		v, ok := e.expr.eval(values)
+		if !ok {
+			continue
+		}
+		out.time = max(out.time, t)
+		out.fields = append(out.fields, ptFields{derivedDefaultField: v})
+		out.tags = append(out.tags, maps.Clone(tags))
+	}
+	return out, len(out.fields) > 0
+}
+
+// exprRef is a reference to a stat field in a derived expression
+type exprRef struct {
+	stat  string
+	field string
+}
+
+// exprNode is a node of a parsed derived expression
+type exprNode struct {
+	op    byte // '0' number, 'r' reference, 'n' negation, or a binary operator
+	num   float64
+	ref   exprRef
+	left  *exprNode
+	right *exprNode
+}
+
+// refs appends the stat references of the expression to refs
+func (n *exprNode) refs(refs []exprRef) []exprRef {
+	switch n.op {
+	case '0':
+	case 'r':
+		if !slices.Contains(refs, n.ref) {
+			refs = append(refs, n.ref)
+		}
+	case 'n':
+		refs = n.left.refs(refs)
+	default:
+		refs = n.right.refs(n.left.refs(refs))
+	}
+	return refs
+}
+
+// eval evaluates the expression, reporting false if the result is not a
+// finite number
+func (n *exprNode) eval(values map[exprRef]float64) (float64, bool) {
+	var v float64
+	switch n.op {
+	case '0':
+		return n.num, true
+	case 'r':
+		v, ok := values[n.ref]
+		return v, ok
+	case 'n':
+		l, ok := n.left.eval(values)
+		return -l, ok
+	}
+	l, ok := n.left.eval(values)
+	if !ok {
+		return 0, false
+	}
+	r, ok := n.right.eval(values)
+	if !ok {
+		return 0, false
+	}
+	switch n.op {
+	case '+':
+		v = l + r
+	case '-':
+		v = l - r
+	case '*':
+		v = l * r
+	case '/':
+		if r == 0 {
+			return 0, false
+		}
+		v = l / r
+	}
+	return v, !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// exprParser is a recursive descent parser for derived expressions
+type exprParser struct {
+	s   string
+	pos int
+}
+
+// parseDerivedExpr parses a derived expression
+func parseDerivedExpr(s string) (*exprNode, error) {
+	p := &exprParser{s: s}
+	n, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at offset %d in expression", p.s[p.pos], p.pos)
+	}
+	if len(n.refs(nil)) == 0 {
+		return nil, errors.New("expression does not refer to any stat")
+	}
+	return n, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space character, or 0 at the end
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// sum parses terms separated by + and -
+func (p *exprParser) sum() (*exprNode, error) {
+	n, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		n = &exprNode{op: op, left: n, right: r}
+	}
+	return n, nil
+}
+
+// product parses factors separated by * and /
+func (p *exprParser) product() (*exprNode, error) {
+	n, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		n = &exprNode{op: op, left: n, right: r}
+	}
+	return n, nil
+}
+
+// factor parses a number, a stat reference, a negation or a parenthesized sum
+func (p *exprParser) factor() (*exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	case c == '-':
+		p.pos++
+		n, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{op: 'n', left: n}, nil
+	case c == '(':
+		p.pos++
+		n, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at offset %d in expression", p.pos)
+		}
+		p.pos++
+		return n, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] >= '0' && p.s[p.pos] <= '9' || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in expression", p.s[start:p.pos])
+		}
+		return &exprNode{op: '0', num: v}, nil
+	case isExprNameChar(c):
+		start := p.pos
+		for p.pos < len(p.s) && (isExprNameChar(p.s[p.pos]) || p.s[p.pos] == ':') {
+			p.pos++
+		}
+		stat, field, found := strings.Cut(p.s[start:p.pos], ":")
+		if !found {
+			field = derivedDefaultField
+		}
+		if stat == "" || field == "" || strings.Contains(field, ":") {
+			return nil, fmt.Errorf("invalid stat reference %q in expression", p.s[start:p.pos])
+		}
+		return &exprNode{op: 'r', ref: exprRef{stat: stat, field: field}}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d in expression", c, p.pos)
+}
+
+// isExprNameChar reports whether c can be part of a stat or field name
+func isExprNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// nodePoint returns a point with a "value" field for each node
+func nodePoint(name string, t int64, values map[string]any) Point {
+	p := Point{name: name, time: t}
+	for node, v := range values {
+		p.fields = append(p.fields, ptFields{"value": v})
+		p.tags = append(p.tags, ptTags{"cluster": "c1", "node": node})
+	}
+	return p
+}
+
+// derivedValues returns the "value" field of the named point by node
+func derivedValues(points []Point, name string) map[string]float64 {
+	var values map[string]float64
+	for _, p := range points {
+		if p.name != name {
+			continue
+		}
+		values = make(map[string]float64)
+		for i, f := range p.fields {
+			values[p.tags[i]["node"]], _ = numericValue(f["value"])
+		}
+	}
+	return values
+}
+
+func TestDerivedMetrics_Rate(t *testing.T) {
+	setMemoryBackend()
+	dm, err := newDerivedMetrics("c1", derivedConfig{Rates: []derivedRateConf{
+		{Stat: "node.ifs.bytes.in"},
+		{Stat: "node.ifs.bytes.in", Delta: true},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	points := dm.apply([]Point{nodePoint("node.ifs.bytes.in", 100, map[string]any{"1": 1000.0, "2": int64(500)})})
+	if len(points) != 1 {
+		t.Fatalf("expected no rates from the first sample, got %+v", points)
+	}
+
+	// node 2's counter was reset by a restart and node 3 joined
+	points = dm.apply([]Point{nodePoint("node.ifs.bytes.in", 110, map[string]any{"1": 1500.0, "2": int64(20), "3": 7.0})})
+	rates := derivedValues(points, "node.ifs.bytes.in.rate")
+	if len(rates) != 1 || rates["1"] != 50 {
+		t.Errorf("expected a rate for node 1 only, got %v", rates)
+	}
+	if deltas := derivedValues(points, "node.ifs.bytes.in.delta"); len(deltas) != 1 || deltas["1"] != 500 {
+		t.Errorf("expected a delta for node 1 only, got %v", deltas)
+	}
+
+	// a sample that was not updated since the previous collection is skipped
+	points = dm.apply([]Point{nodePoint("node.ifs.bytes.in", 110, map[string]any{"1": 1500.0, "2": int64(20), "3": 7.0})})
+	if len(points) != 1 {
+		t.Errorf("expected no rates without a new sample, got %+v", points)
+	}
+	points = dm.apply([]Point{nodePoint("node.ifs.bytes.in", 120, map[string]any{"1": 1600.0, "2": int64(120), "3": 27.0})})
+	if rates := derivedValues(points, "node.ifs.bytes.in.rate"); len(rates) != 3 || rates["1"] != 10 || rates["2"] != 10 || rates["3"] != 2 {
+		t.Errorf("expected rates for every node, got %v", rates)
+	}
+
+	// a node missing from a collection starts afresh
+	dm.apply([]Point{nodePoint("node.ifs.bytes.in", 130, map[string]any{"1": 1700.0})})
+	points = dm.apply([]Point{nodePoint("node.ifs.bytes.in", 140, map[string]any{"1": 1800.0, "2": int64(5000)})})
+	if rates := derivedValues(points, "node.ifs.bytes.in.rate"); len(rates) != 1 || rates["1"] != 10 {
+		t.Errorf("expected a rate for node 1 only, got %v", rates)
+	}
+
+	var nilMetrics *derivedMetrics
+	if points := nilMetrics.apply(points); len(points) != 3 {
+		t.Errorf("expected nil derived metrics to leave the points unchanged")
+	}
+}
+
+func TestDerivedMetrics_Expr(t *testing.T) {
+	setMemoryBackend()
+	dm, err := newDerivedMetrics("c1", derivedConfig{Exprs: []derivedExprConf{
+		{Name: "node.cache.hit_ratio", Expr: "100 * hits / (hits + misses)"},
+		{Name: "node.cpu.share", Expr: "cpu / cluster.cpu"},
+		{Name: "node.ops.total", Expr: "ops:reads + ops:writes - -1"},
+		{Name: "node.missing", Expr: "hits + nosuch"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ops := Point{name: "ops", time: 100,
+		fields: []ptFields{{"reads": 3.0, "writes": int64(4)}, {"reads": 1.0, "writes": 1.0}},
+		tags:   []ptTags{{"cluster": "c1", "node": "1"}, {"cluster": "c1", "node": "2", "degraded": "true"}},
+	}
+	points := dm.apply([]Point{
+		nodePoint("hits", 100, map[string]any{"1": 30.0, "2": 0.0, "3": 5.0}),
+		nodePoint("misses", 101, map[string]any{"1": 10.0, "2": 0.0}),
+		nodePoint("cpu", 100, map[string]any{"1": 20.0, "2": 60.0}),
+		{name: "cluster.cpu", time: 100, fields: []ptFields{{"value": 40.0}}, tags: []ptTags{{"cluster": "c1"}}},
+		ops,
+	})
+	// node 2 divides by zero and node 3 has no misses
+	if ratio := derivedValues(points, "node.cache.hit_ratio"); len(ratio) != 1 || ratio["1"] != 75 {
+		t.Errorf("unexpected hit ratios %v", ratio)
+	}
+	if share := derivedValues(points, "node.cpu.share"); len(share) != 2 || share["1"] != 0.5 || share["2"] != 1.5 {
+		t.Errorf("expected the cluster stat to match every node, got %v", share)
+	}
+	if total := derivedValues(points, "node.ops.total"); len(total) != 2 || total["1"] != 8 || total["2"] != 3 {
+		t.Errorf("unexpected operation totals %v", total)
+	}
+	if missing := derivedValues(points, "node.missing"); missing != nil {
+		t.Errorf("expected no points when a stat is missing, got %v", missing)
+	}
+	for _, p := range points {
+		if p.name == "node.cache.hit_ratio" && p.time != 101 {
+			t.Errorf("expected the latest time of the referenced stats, got %d", p.time)
+		}
+	}
+}
+
+func TestParseDerivedExpr(t *testing.T) {
+	for expr, want := range map[string]float64{
+		"a + 2 * 3":         7,
+		"(a + 2) * 3":       9,
+		"a - 4 - 1":         -4,
+		"-a / 2":            -0.5,
+		"a:value * .5 + 1.": 1.5,
+	} {
+		n, err := parseDerivedExpr(expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", expr, err)
+			continue
+		}
+		if v, ok := n.eval(map[exprRef]float64{{"a", "value"}: 1}); !ok || math.Abs(v-want) > 1e-9 {
+			t.Errorf("%s: expected %v, got %v", expr, want, v)
+		}
+	}
+	for _, expr := range []string{"", "a +", "(a", "a b", "2 * 3", "a:", "a:b:c", "1..2 * a", "a % 2"} {
+		if _, err := parseDerivedExpr(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
+
+func TestCheckConfig_Derived(t *testing.T) {
+	setMemoryBackend()
+	path := writeTestConfig(t, `[global]
+version = "v0.39"
+stats_processor = "discard"
+active_stat_groups = ["cpu"]
+
+[[cluster]]
+hostname = "cluster1"
+username = "user"
+password = "pass"
+
+[[statgroup]]
+name = "cpu"
+update_interval = "*"
+stats = ["node.cpu.user.avg", "node.ifs.bytes.in"]
+
+[[derived.rate]]
+stat = "node.ifs.bytes.in"
+
+[[derived.rate]]
+stat = "node.ifs.bytes.out"
+
+[[derived.expr]]
+name = "node.ifs.bytes.in.rate"
+expr = "node.ifs.bytes.in.rate * 8"
+
+[[derived.expr]]
+name = "node.cpu.double"
+expr = "node.cpu.user.avg * 2 + node.cpu.nosuch"
+
+[[derived.expr]]
+name = "bad"
+expr = "node.cpu.user.avg *"
+`)
+	cc, conf := checkConfig(path)
+	if conf == nil {
+		t.Fatalf("expected the config to parse, got %+v", cc.problems)
+	}
+	for _, want := range []struct {
+		line     int
+		severity string
+		msg      string
+	}{
+		{20, severityWarning, "node.ifs.bytes.out, which is not in an active stat group"},
+		{23, severityError, `duplicate derived metric name "node.ifs.bytes.in.rate"`},
+		{28, severityWarning, "refers to node.cpu.nosuch"},
+		{32, severityError, "unexpected end of expression"},
+	} {
+		if !problemAt(cc, want.line, want.severity, want.msg) {
+			t.Errorf("expected %s %q at line %d, got %+v", want.severity, want.msg, want.line, cc.problems)
+		}
+	}
+	if len(cc.problems) != 4 {
+		t.Errorf("expected 4 problems, got %+v", cc.problems)
+	}
+}
+
+func TestCheckConfig_DerivedBuckets(t *testing.T) {
+	setMemoryBackend()
+	config := `[global]
+version = "v0.39"
+stats_processor = "discard"
+active_stat_groups = ["cpu", "net", "ifs"]
+fetch_by_statgroup = %v
+
+[[cluster]]
+hostname = "cluster1"
+username = "user"
+password = "pass"
+
+[[statgroup]]
+name = "cpu"
+update_interval = "*"
+stats = ["node.cpu.user.avg"]
+
+[[statgroup]]
+name = "net"
+update_interval = "*1.0"
+stats = ["node.net.ext.bytes.in"]
+
+[[statgroup]]
+name = "ifs"
+update_interval = "30"
+stats = ["node.ifs.bytes.in"]
+
+[[derived.rate]]
+stat = "node.ifs.bytes.in"
+
+[[derived.expr]]
+name = "node.same"
+expr = "node.cpu.user.avg + node.net.ext.bytes.in"
+
+[[derived.expr]]
+name = "node.different"
+expr = "node.cpu.user.avg * node.ifs.bytes.in.rate"
+`
+	cc, conf := checkConfig(writeTestConfig(t, fmt.Sprintf(config, false)))
+	if conf == nil {
+		t.Fatalf("expected the config to parse, got %+v", cc.problems)
+	}
+	if !problemAt(cc, 36, severityWarning, "stat groups cpu, ifs, which have different update intervals") {
+		t.Errorf("expected a warning for the stats with different intervals, got %+v", cc.problems)
+	}
+	if len(cc.problems) != 1 {
+		t.Errorf("expected 1 problem, got %+v", cc.problems)
+	}
+
+	cc, _ = checkConfig(writeTestConfig(t, fmt.Sprintf(config, true)))
+	if !problemAt(cc, 32, severityWarning, "stat groups cpu, net, which are collected separately with fetch_by_statgroup") {
+		t.Errorf("expected a warning for the stats in different groups, got %+v", cc.problems)
+	}
+	if len(cc.problems) != 2 {
+		t.Errorf("expected 2 problems, got %+v", cc.problems)
+	}
+}
+
+func TestDerivedDetails(t *testing.T) {
+	dc := derivedConfig{
+		Rates: []derivedRateConf{{Stat: "hits"}, {Stat: "nosuch"}},
+		Exprs: []derivedExprConf{
+			{Name: "ratio", Expr: "hits.rate / misses"},
+			{Name: "broken", Expr: "hits / nosuch"},
+		},
+	}
+	sd := map[string]statDetail{
+		"hits":   {valid: true, updateIntvl: 5},
+		"misses": {valid: true, updateIntvl: 30},
+	}
+	details := derivedDetails(dc, sd)
+	if d, ok := details["hits.rate"]; !ok || !d.valid || d.updateIntvl != 5 {
+		t.Errorf("unexpected rate details %+v", d)
+	}
+	if d, ok := details["ratio"]; !ok || !d.valid || d.updateIntvl != 30 {
+		t.Errorf("expected the expression to use the longest update interval, got %+v", d)
+	}
+	if len(details) != 2 {
+		t.Errorf("expected no details for metrics of unknown stats, got %v", details)
+	}
+}
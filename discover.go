@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// The discover subcommand lists the stat keys available on a cluster, to help
+// build stat groups. It can output the keys as a table, as JSON or as
+// [[statgroup]] stanzas, grouping the keys by the leading components of their
+// names.
+
+// discoverOptions holds the discover subcommand's filter and output settings
+type discoverOptions struct {
+	match      *regexp.Regexp // only keys whose names match
+	scope      string         // only keys with this scope
+	format     string         // table, json or toml
+	groupDepth int            // leading key name components used to group keys in toml output
+}
+
+// runDiscover implements the discover subcommand and returns the exit status
+func runDiscover(args []string) int {
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s discover [options]\n\nList the stat keys available on a cluster.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	configFileName := fs.String("config-file", "idic.toml", "pathname of config file, used for cluster credentials if -host is not set")
+	clusterName := fs.String("cluster", "", "hostname of the configured cluster to query (default first enabled cluster)")
+	host := fs.String("host", "", "hostname of the cluster to query instead of a configured cluster")
+	username := fs.String("username", "", "username for -host")
+	password := fs.String("password", "", "password for -host (supports $env:VAR)")
+	authType := fs.String("authtype", authtypeSession, "authentication type for -host [session|basic-auth]")
+	verifySSL := fs.Bool("verify-ssl", false, "verify the TLS certificate of -host")
+	match := fs.String("match", "", "only list keys whose names match this regular expression")
+	scope := fs.String("scope", "", "only list keys with this scope [cluster|node]")
+	format := fs.String("format", "table", "output format [table|json|toml]")
+	groupDepth := fs.Int("group-depth", 2, "number of leading key name components used to group keys in toml output")
+	logLevel := fs.String("loglevel", "WARNING", "log level [CRITICAL|ERROR|WARNING|NOTICE|INFO|DEBUG|TRACE]")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	opts := discoverOptions{scope: *scope, format: *format, groupDepth: *groupDepth}
+	if err := setupCommandLogging(*logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "discover: %v\n", err)
+		return 2
+	}
+	if *match != "" {
+		re, err := regexp.Compile(*match)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "discover: invalid -match expression: %v\n", err)
+			return 2
+		}
+		opts.match = re
+	}
+	if !slices.Contains([]string{"table", "json", "toml"}, opts.format) {
+		fmt.Fprintf(os.Stderr, "discover: unknown output format %q\n", opts.format)
+		return 2
+	}
+	if opts.groupDepth < 1 {
+		fmt.Fprintf(os.Stderr, "discover: -group-depth must be at least 1\n")
+		return 2
+	}
+
+	var cc clusterConf
+	gc := globalConfig{MaxRetries: defaultMaxRetries, PreserveCase: defaultPreserveCase}
+	if *host != "" {
+		cc = clusterConf{Hostname: *host, Username: *username, Password: *password, AuthType: *authType, SSLCheck: *verifySSL}
+	} else {
+		conf, err := readConfig(*configFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "discover: %v\n", err)
+			return 1
+		}
+		cc, err = findClusterConf(conf.Clusters, *clusterName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "discover: %v\n", err)
+			return 1
+		}
+		gc = conf.Global
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := discover(ctx, cc, gc, opts, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "discover: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// findClusterConf returns the configured cluster with the given hostname, or
+// the first enabled cluster if hostname is empty
+func findClusterConf(clusters []clusterConf, hostname string) (clusterConf, error) {
+	for _, cc := range clusters {
+		if hostname == "" && !cc.Disabled || hostname != "" && cc.Hostname == hostname {
+			return cc, nil
+		}
+	}
+	if hostname == "" {
+		return clusterConf{}, errors.New("no enabled clusters found in config")
+	}
+	return clusterConf{}, fmt.Errorf("cluster %q not found in config", hostname)
+}
+
+// discover connects to the cluster and writes its stat keys to w
+func discover(ctx context.Context, cc clusterConf, gc globalConfig, opts discoverOptions, w io.Writer) error {
+	c, err := newCluster(cc, gc)
+	if err != nil {
+		return err
+	}
+	if err := c.Connect(ctx); err != nil {
+		return fmt.Errorf("unable to connect to %s: %w", cc.Hostname, err)
+	}
+	log.Info("Listing stat keys", slog.String("cluster", c.ClusterName), slog.String("version", c.OSVersion))
+	keys, err := c.listStatKeys(ctx)
+	if err != nil {
+		return err
+	}
+	keys = filterStatKeys(keys, opts.match, opts.scope)
+	switch opts.format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(keys)
+	case "toml":
+		return writeStatGroups(w, c.ClusterName, keys, opts.groupDepth)
+	}
+	return writeStatKeysTable(w, keys)
+}
+
+// filterStatKeys returns the keys matching the regular expression and scope,
+// sorted by name. A nil expression or empty scope matches everything.
+func filterStatKeys(keys []statKeyInfo, match *regexp.Regexp, scope string) []statKeyInfo {
+	filtered := make([]statKeyInfo, 0, len(keys))
+	for _, k := range keys {
+		if match != nil && !match.MatchString(k.Key) {
+			continue
+		}
+		if scope != "" && k.Scope != scope {
+			continue
+		}
+		filtered = append(filtered, k)
+	}
+	slices.SortFunc(filtered, func(a, b statKeyInfo) int { return strings.Compare(a.Key, b.Key) })
+	return filtered
+}
+
+// writeStatKeysTable writes the keys as an aligned table
+func writeStatKeysTable(w io.Writer, keys []statKeyInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSCOPE\tTYPE\tUNITS\tINTERVAL\tAGGREGATION\tDESCRIPTION")
+	for _, k := range keys {
+		interval := "on-demand"
+		if k.UpdateInterval > 0 {
+			interval = fmt.Sprintf("%gs", k.UpdateInterval)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.Key, k.Scope, k.Type, k.Units, interval, k.Aggregation, k.Description)
+	}
+	return tw.Flush()
+}
+
+// statKeyPrefix returns the first depth dot-separated components of the key name
+func statKeyPrefix(key string, depth int) string {
+	parts := strings.SplitN(key, ".", depth+1)
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return strings.Join(parts, ".")
+}
+
+// writeStatGroups writes the keys as [[statgroup]] stanzas, one per key name
+// prefix, ready to paste into the config file
+func writeStatGroups(w io.Writer, cluster string, keys []statKeyInfo, depth int) error {
+	groups := make(map[string][]statKeyInfo)
+	var prefixes []string
+	for _, k := range keys {
+		p := statKeyPrefix(k.Key, depth)
+		if _, ok := groups[p]; !ok {
+			prefixes = append(prefixes, p)
+		}
+		groups[p] = append(groups[p], k)
+	}
+	slices.Sort(prefixes)
+
+	bw := &errWriter{w: w}
+	fmt.Fprintf(bw, "# stat groups generated by gostats discover from cluster %s\n", cluster)
+	for _, p := range prefixes {
+		fmt.Fprintf(bw, "\n[[statgroup]]\nname = %q\nupdate_interval = \"*\"\nstats = [\n", strings.ReplaceAll(p, ".", "_")+"_stats")
+		for _, k := range groups[p] {
+			fmt.Fprintf(bw, "    %q,", k.Key)
+			if desc := strings.Join(strings.Fields(k.Description), " "); desc != "" {
+				fmt.Fprintf(bw, " # %s", desc)
+			}
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintln(bw, "]")
+	}
+	return bw.err
+}
+
+// errWriter records the first error from a sequence of writes
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, err := ew.w.Write(p)
+	ew.err = err
+	return n, err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+const statKeysPage1 = `{"keys":[
+{"key":"node.ifs.bytes.in","description":"Bytes in","units":"bytes","scope":"node","type":"int64","aggregation_type":"avg",
+ "policies":[{"interval":300,"persistent":true,"retention":86400},{"interval":5,"persistent":false,"retention":600}]},
+{"key":"cluster.cpu.user.avg","description":"Average user\ncpu","units":"percent","scope":"cluster","type":"double","aggregation_type":"avg","policies":null}
+],"resume":"page2","total":3}`
+
+const statKeysPage2 = `{"keys":[
+{"key":"node.ifs.bytes.out","description":"Bytes out","units":"bytes","scope":"node","type":"int64","aggregation_type":"avg",
+ "policies":[{"interval":5,"persistent":false,"retention":600}]}
+],"resume":null,"total":3}`
+
+func TestListStatKeys_Paging(t *testing.T) {
+	setMemoryBackend()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != statKeysPath {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.RawQuery {
+		case "limit=1000":
+			_, _ = w.Write([]byte(statKeysPage1))
+		case "resume=page2":
+			_, _ = w.Write([]byte(statKeysPage2))
+		default:
+			http.Error(w, "bad query "+r.URL.RawQuery, http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	c := &Cluster{AuthType: authtypeBasic, baseURL: srv.URL, client: srv.Client(), maxRetries: 1}
+
+	keys, err := c.listStatKeys(t.Context())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 keys across both pages, got %d", len(keys))
+	}
+	if keys[0].UpdateInterval != 5 || keys[0].Scope != "node" || keys[0].Aggregation != "avg" {
+		t.Errorf("unexpected key metadata %+v", keys[0])
+	}
+	if keys[1].UpdateInterval != 0 {
+		t.Errorf("expected on-demand key to have no update interval, got %v", keys[1].UpdateInterval)
+	}
+}
+
+func TestParseStatKeys_Error(t *testing.T) {
+	_, _, err := parseStatKeys([]byte(`{"errors":[{"code":"AEC_FORBIDDEN","message":"no privilege"}]}`))
+	if err == nil || !strings.Contains(err.Error(), "AEC_FORBIDDEN") {
+		t.Errorf("expected API error, got %v", err)
+	}
+}
+
+func TestFilterStatKeys(t *testing.T) {
+	keys, _, err := parseStatKeys([]byte(statKeysPage1))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := filterStatKeys(keys, nil, ""); len(got) != 2 || got[0].Key != "cluster.cpu.user.avg" {
+		t.Errorf("expected all keys sorted by name, got %+v", got)
+	}
+	if got := filterStatKeys(keys, nil, "node"); len(got) != 1 || got[0].Key != "node.ifs.bytes.in" {
+		t.Errorf("expected node scope keys only, got %+v", got)
+	}
+	if got := filterStatKeys(keys, regexp.MustCompile(`\.cpu\.`), ""); len(got) != 1 || got[0].Key != "cluster.cpu.user.avg" {
+		t.Errorf("expected matching keys only, got %+v", got)
+	}
+}
+
+func TestWriteStatGroups(t *testing.T) {
+	keys := []statKeyInfo{
+		{Key: "cluster.cpu.user.avg", Description: "Average user\ncpu"},
+		{Key: "node.ifs.bytes.in", Description: "Bytes in"},
+		{Key: "node.ifs.bytes.out"},
+		{Key: "ifs"},
+	}
+	var sb strings.Builder
+	if err := writeStatGroups(&sb, "test", keys, 2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the output must be valid config
+	var conf struct {
+		StatGroups []statGroupConf `toml:"statgroup"`
+	}
+	if _, err := toml.Decode(sb.String(), &conf); err != nil {
+		t.Fatalf("generated TOML does not parse: %v\n%s", err, sb.String())
+	}
+	if len(conf.StatGroups) != 3 {
+		t.Fatalf("expected 3 stat groups, got %+v", conf.StatGroups)
+	}
+	want := map[string]int{"cluster_cpu_stats": 1, "ifs_stats": 1, "node_ifs_stats": 2}
+	for _, g := range conf.StatGroups {
+		if want[g.Name] != len(g.Stats) || g.UpdateIntvl != "*" {
+			t.Errorf("unexpected stat group %+v", g)
+		}
+	}
+}
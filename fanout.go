@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// fanoutQueueLen is the number of batches buffered for each back end before
+// the oldest batch is dropped to make room for new data
+const fanoutQueueLen = 32
+
+// FanoutWriter is a DBWriter that writes every batch of points to several
+// back ends. Each back end is serviced by its own goroutine with its own
+// queue and retry policy, so a slow or failing back end does not hold up
+// collection or writes to the others.
+//
+// The writer goroutines do not stop with the collection: Close stops
+// accepting writes and lets each back end write its queued batches for up to
+// drainTimeout, so a reload or shutdown does not lose the points in flight.
+type FanoutWriter struct {
+	cluster      string
+	targets      []*fanoutTarget
+	drainTimeout time.Duration      // defaults to writeQueueDrainTimeout
+	cancel       context.CancelFunc // stops the writer goroutines
+	wg           sync.WaitGroup     // tracks the per-back end writer goroutines
+	mu           sync.RWMutex       // guards closed and the queues against Close
+	closed       bool
+}
+
+// errFanoutClosed is returned for writes to a closed FanoutWriter
+var errFanoutClosed = errors.New("fan-out writer is closed")
+
+// fanoutTarget is a single back end written to by a FanoutWriter
+type fanoutTarget struct {
+	name  string
+	w     DBWriter
+	rp    retryPolicy
+	queue chan []Point
+}
+
+// newFanoutWriter returns a FanoutWriter for the named back ends
+func newFanoutWriter(config *tomlConfig, cluster string, names []string) (*FanoutWriter, error) {
+	fw := &FanoutWriter{}
+	for _, name := range names {
+		w, err := resolveBackend(config, name)
+		if err != nil {
+			return nil, err
+		}
+		rp, err := backendRetryPolicy(config, cluster, name)
+		if err != nil {
+			return nil, err
+		}
+		fw.targets = append(fw.targets, &fanoutTarget{
+			name:  name,
+			w:     w,
+			rp:    rp,
+			queue: make(chan []Point, fanoutQueueLen),
+		})
+	}
+	return fw, nil
+}
+
+// Init starts a writer goroutine for each back end. Back end initialization
+// happens in the writer goroutine and is retried until it succeeds, so a back
+// end that is unavailable at startup does not prevent writes to the others.
+func (fw *FanoutWriter) Init(ctx context.Context, clusterName string, config *tomlConfig, ci int, sd map[string]statDetail) error {
+	fw.cluster = clusterName
+	ctx, fw.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	for _, t := range fw.targets {
+		fw.wg.Add(1)
+		go func() {
+			defer fw.wg.Done()
+			t.run(ctx, clusterName, config, ci, sd)
+		}()
+	}
+	return nil
+}
+
+// WritePoints queues the points for each back end. It never blocks; if a back
+// end's queue is full, its oldest pending batch is discarded.
+func (fw *FanoutWriter) WritePoints(_ context.Context, points []Point) error {
+	fw.mu.RLock()
+	defer fw.mu.RUnlock()
+	if fw.closed {
+		return errFanoutClosed
+	}
+	for _, t := range fw.targets {
+		t.enqueue(fw.cluster, points)
+	}
+	return nil
+}
+
+// Close stops accepting writes, waits up to the drain timeout for the
+// queued batches to be written, then stops the writer goroutines and closes
+// each back end, which flushes any points they buffer internally
+func (fw *FanoutWriter) Close() error {
+	fw.mu.Lock()
+	if fw.closed {
+		fw.mu.Unlock()
+		return nil
+	}
+	fw.closed = true
+	for _, t := range fw.targets {
+		close(t.queue)
+	}
+	fw.mu.Unlock()
+	if fw.cancel != nil {
+		timeout := fw.drainTimeout
+		if timeout <= 0 {
+			timeout = writeQueueDrainTimeout
+		}
+		drainTimer := time.AfterFunc(timeout, fw.cancel)
+		fw.wg.Wait()
+		drainTimer.Stop()
+		fw.cancel()
+	}
+	for _, t := range fw.targets {
+		closeDBWriter(fw.cluster, t.w)
+	}
+	return nil
+}
+
+// enqueue adds a batch to the back end's queue, discarding the oldest
+// pending batch if the queue is full
+func (t *fanoutTarget) enqueue(cluster string, points []Point) {
+	for {
+		select {
+		case t.queue <- points:
+			return
+		default:
+		}
+		select {
+		case old := <-t.queue:
+			log.Warn("back end queue full, dropping oldest batch", slog.String("cluster", cluster), slog.String("backend", t.name))
+			backendPointsDropped.WithLabelValues(cluster, t.name).Add(float64(countFieldSets(old)))
+		default:
+		}
+	}
+}
+
+// abandon spools, or drops, the given batches and those still queued
+func (t *fanoutTarget) abandon(cluster string, pending ...[]Point) {
+	for drained := false; !drained; {
+		select {
+		case points, ok := <-t.queue:
+			if ok {
+				pending = append(pending, points)
+			} else {
+				drained = true
+			}
+		default:
+			drained = true
+		}
+	}
+	dropped := 0
+	for _, points := range pending {
+		if t.rp.spool != nil {
+			err := t.rp.spool.append(points)
+			if err == nil {
+				continue
+			}
+			log.Error("unable to spool queued batch", slog.String("cluster", cluster), slog.String("backend", t.name), slog.String("error", err.Error()))
+		}
+		dropped += countFieldSets(points)
+	}
+	if dropped > 0 {
+		log.Warn("back end queue not drained before close, dropping points", slog.String("cluster", cluster), slog.String("backend", t.name), slog.Int("points", dropped))
+		backendPointsDropped.WithLabelValues(cluster, t.name).Add(float64(dropped))
+	}
+}
+
+// run initializes the back end and then writes queued batches until the
+// queue is closed and drained, or the context is cancelled
+func (t *fanoutTarget) run(ctx context.Context, clusterName string, config *tomlConfig, ci int, sd map[string]statDetail) {
+	const maxRetryTime = time.Second * 1280
+	retryTime := t.rp.retryIntvl
+	if retryTime <= 0 {
+		retryTime = time.Second
+	}
+	for {
+		err := t.w.Init(ctx, clusterName, config, ci, sd)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, context.Canceled) {
+			t.abandon(clusterName)
+			return
+		}
+		log.Error("Unable to initialize backend, retrying", slog.String("cluster", clusterName), slog.String("backend", t.name),
+			slog.String("error", err.Error()), slog.Duration("retry time", retryTime))
+		select {
+		case <-time.After(retryTime):
+		case <-ctx.Done():
+			t.abandon(clusterName)
+			return
+		}
+		if retryTime < maxRetryTime {
+			retryTime *= 2
+		}
+	}
+	for {
+		select {
+		case points, ok := <-t.queue:
+			if !ok {
+				return
+			}
+			if err := writeWithRetry(ctx, t.w, t.rp, points); err != nil {
+				if errors.Is(err, context.Canceled) {
+					t.abandon(clusterName, points)
+					return
+				}
+				log.Error("dropping batch after write retries exceeded", slog.String("cluster", clusterName), slog.String("backend", t.name),
+					slog.Int("points", len(points)))
+			}
+		case <-ctx.Done():
+			t.abandon(clusterName)
+			return
+		}
+	}
+}
+
+// newDBWriter returns the DBWriter for the named back end(s) along with the
+// retry policy the caller should apply to writes. A single back end is
+// returned directly; multiple back ends are wrapped in a FanoutWriter which
+// applies per-back end retries itself and never returns a write error.
+func newDBWriter(config *tomlConfig, cluster string, names []string) (DBWriter, retryPolicy, error) {
+	switch len(names) {
+	case 0:
+		return nil, retryPolicy{}, fmt.Errorf("no stats_processor configured")
+	case 1:
+		w, err := resolveBackend(config, names[0])
+		if err != nil {
+			return nil, retryPolicy{}, err
+		}
+		rp, err := backendRetryPolicy(config, cluster, names[0])
+		return w, rp, err
+	}
+	fw, err := newFanoutWriter(config, cluster, names)
+	return fw, retryPolicy{maxRetries: 1}, err
+}
+
+// backendRetryPolicy returns the retry policy for the named back end,
+// including its spool if spooling is enabled
+func backendRetryPolicy(config *tomlConfig, cluster string, name string) (retryPolicy, error) {
+	rp := processorRetryPolicy(config, name)
+	rp.cluster = cluster
+	rp.backend = name
+	spool, err := openSpool(config.Spool, cluster, name)
+	if err != nil {
+		return rp, err
+	}
+	rp.spool = spool
+	return rp, nil
+}
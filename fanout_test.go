@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// recordingWriter is a DBWriter that records the batches written to it and
+// can be made to fail or block
+type recordingWriter struct {
+	sync.Mutex
+	batches [][]Point
+	fail    bool
+	block   chan struct{} // if non-nil, WritePoints waits for this to be closed
+	closed  bool
+}
+
+func (w *recordingWriter) Init(_ context.Context, _ string, _ *tomlConfig, _ int, _ map[string]statDetail) error {
+	return nil
+}
+
+func (w *recordingWriter) WritePoints(ctx context.Context, points []Point) error {
+	if w.block != nil {
+		select {
+		case <-w.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.fail {
+		return errors.New("write failed")
+	}
+	w.batches = append(w.batches, points)
+	return nil
+}
+
+func (w *recordingWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	w.closed = true
+	return nil
+}
+
+func (w *recordingWriter) count() int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.batches)
+}
+
+// waitFor polls cond until it returns true or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestFanoutWriter_IsolatesSlowBackend(t *testing.T) {
+	setMemoryBackend()
+	fast := &recordingWriter{}
+	slow := &recordingWriter{block: make(chan struct{})}
+	rp := retryPolicy{maxRetries: 1, retryIntvl: time.Millisecond}
+	fw := &FanoutWriter{targets: []*fanoutTarget{
+		{name: "slow", w: slow, rp: rp, queue: make(chan []Point, 2)},
+		{name: "fast", w: fast, rp: rp, queue: make(chan []Point, fanoutQueueLen)},
+	}}
+	fw.drainTimeout = 10 * time.Millisecond
+	ctx := t.Context()
+	defer fw.Close() //nolint:errcheck
+	if err := fw.Init(ctx, "clusterA", &tomlConfig{}, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := range 10 {
+		if err := fw.WritePoints(ctx, []Point{{name: "stat", time: int64(i)}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if !waitFor(t, time.Second, func() bool { return fast.count() == 10 }) {
+		t.Fatalf("expected 10 batches written to fast back end, got %d", fast.count())
+	}
+	if slow.count() != 0 {
+		t.Errorf("expected no batches written to blocked back end, got %d", slow.count())
+	}
+}
+
+func TestFanoutTarget_EnqueueDropsOldest(t *testing.T) {
+	setMemoryBackend()
+	target := &fanoutTarget{name: "slow", queue: make(chan []Point, 2)}
+	for i := range 10 {
+		target.enqueue("clusterA", []Point{{name: "stat", time: int64(i)}})
+	}
+	if len(target.queue) != 2 {
+		t.Fatalf("expected queue to hold 2 batches, got %d", len(target.queue))
+	}
+	if b := <-target.queue; b[0].time != 8 {
+		t.Errorf("expected oldest retained batch to be 8, got %d", b[0].time)
+	}
+	if b := <-target.queue; b[0].time != 9 {
+		t.Errorf("expected newest batch to be 9, got %d", b[0].time)
+	}
+}
+
+func TestFanoutWriter_FailingBackendDoesNotStopOthers(t *testing.T) {
+	setMemoryBackend()
+	good := &recordingWriter{}
+	bad := &recordingWriter{fail: true}
+	rp := retryPolicy{maxRetries: 2, retryIntvl: time.Millisecond}
+	fw := &FanoutWriter{targets: []*fanoutTarget{
+		{name: "bad", w: bad, rp: rp, queue: make(chan []Point, fanoutQueueLen)},
+		{name: "good", w: good, rp: rp, queue: make(chan []Point, fanoutQueueLen)},
+	}}
+	fw.drainTimeout = 10 * time.Millisecond
+	ctx := t.Context()
+	defer fw.Close() //nolint:errcheck
+	if err := fw.Init(ctx, "clusterA", &tomlConfig{}, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for range 3 {
+		_ = fw.WritePoints(ctx, []Point{{name: "stat"}})
+	}
+	if !waitFor(t, time.Second, func() bool { return good.count() == 3 }) {
+		t.Fatalf("expected 3 batches written to good back end, got %d", good.count())
+	}
+	if !waitFor(t, time.Second, func() bool { return len(fw.targets[0].queue) == 0 }) {
+		t.Errorf("expected failing back end to drop its batches")
+	}
+}
+
+func TestProcessorRetryPolicy(t *testing.T) {
+	zero := 0
+	three := 3
+	ten := 10
+	config := &tomlConfig{
+		Global: globalConfig{ProcessorMaxRetries: 8, ProcessorRetryIntvl: 5},
+		ProcessorRetry: map[string]processorRetryConfig{
+			"influxdb":   {MaxRetries: &three, RetryIntvl: &ten},
+			"prometheus": {MaxRetries: &zero},
+		},
+	}
+	rp := processorRetryPolicy(config, "influxdb")
+	if rp.maxRetries != 3 || rp.retryIntvl != 10*time.Second {
+		t.Errorf("unexpected influxdb policy: %+v", rp)
+	}
+	rp = processorRetryPolicy(config, "prometheus")
+	if rp.maxRetries <= 1<<30 || rp.retryIntvl != 5*time.Second {
+		t.Errorf("expected unlimited retries with global interval for prometheus, got %+v", rp)
+	}
+	rp = processorRetryPolicy(config, "discard")
+	if rp.maxRetries != 8 || rp.retryIntvl != 5*time.Second {
+		t.Errorf("expected global policy for discard, got %+v", rp)
+	}
+}
+
+func TestNewDBWriter(t *testing.T) {
+	config := &tomlConfig{Global: globalConfig{Processor: stringList{"discard"}, ProcessorMaxRetries: 4}}
+	w, rp, err := newDBWriter(config, "clusterA", config.Global.Processor)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := w.(*DiscardSink); !ok {
+		t.Errorf("expected a single back end to be returned directly, got %T", w)
+	}
+	if rp.maxRetries != 4 {
+		t.Errorf("expected global retry count, got %d", rp.maxRetries)
+	}
+
+	config.Global.Processor = stringList{"discard", "file"}
+	w, rp, err = newDBWriter(config, "clusterA", config.Global.Processor)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fw, ok := w.(*FanoutWriter); !ok || len(fw.targets) != 2 {
+		t.Errorf("expected fan-out writer with 2 targets, got %T", w)
+	}
+	if rp.maxRetries != 1 {
+		t.Errorf("expected single attempt for fan-out writer, got %d", rp.maxRetries)
+	}
+
+	config.Global.Processor = stringList{"discard", "nosuch"}
+	if _, _, err = newDBWriter(config, "clusterA", config.Global.Processor); err == nil {
+		t.Errorf("expected error for unknown back end")
+	}
+	config.Global.Processor = nil
+	if _, _, err = newDBWriter(config, "clusterA", config.Global.Processor); err == nil {
+		t.Errorf("expected error for empty back end list")
+	}
+}
+
+func TestFanoutWriter_CloseStopsAndClosesTargets(t *testing.T) {
+	setMemoryBackend()
+	a, b := &recordingWriter{}, &recordingWriter{}
+	fw := &FanoutWriter{targets: []*fanoutTarget{
+		{name: "a", w: a, rp: retryPolicy{maxRetries: 1}, queue: make(chan []Point, fanoutQueueLen)},
+		{name: "b", w: b, rp: retryPolicy{maxRetries: 1}, queue: make(chan []Point, fanoutQueueLen)},
+	}}
+	if err := fw.Init(t.Context(), "clusterA", &tomlConfig{}, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = fw.WritePoints(t.Context(), []Point{{name: "one"}})
+	if !waitFor(t, time.Second, func() bool { return a.count() == 1 && b.count() == 1 }) {
+		t.Fatalf("expected batch to be written to both back ends")
+	}
+	// Close must return without the parent context being cancelled
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !a.closed || !b.closed {
+		t.Errorf("expected all back ends to be closed")
+	}
+}
+
+func TestFanoutWriter_CloseDrainsQueues(t *testing.T) {
+	setMemoryBackend()
+	slow := &recordingWriter{block: make(chan struct{})}
+	fw := &FanoutWriter{targets: []*fanoutTarget{
+		{name: "slow", w: slow, rp: retryPolicy{maxRetries: 1}, queue: make(chan []Point, fanoutQueueLen)},
+	}}
+	// collection has stopped by the time the writer is closed
+	ctx, cancel := context.WithCancel(t.Context())
+	if err := fw.Init(ctx, "clusterA", &tomlConfig{}, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := range 5 {
+		if err := fw.WritePoints(ctx, []Point{{name: "stat", time: int64(i)}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	cancel()
+	time.AfterFunc(50*time.Millisecond, func() { close(slow.block) })
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := slow.count(); n != 5 {
+		t.Errorf("expected all 5 queued batches to be written, got %d", n)
+	}
+	if !slow.closed {
+		t.Errorf("expected the back end to be closed")
+	}
+	if err := fw.WritePoints(t.Context(), []Point{{name: "stat"}}); !errors.Is(err, errFanoutClosed) {
+		t.Errorf("expected writes after Close to fail, got %v", err)
+	}
+
+	// a back end that does not drain in time is stopped
+	stuck := &recordingWriter{block: make(chan struct{})}
+	fw = &FanoutWriter{drainTimeout: 20 * time.Millisecond, targets: []*fanoutTarget{
+		{name: "stuck", w: stuck, rp: retryPolicy{maxRetries: 1}, queue: make(chan []Point, fanoutQueueLen)},
+	}}
+	if err := fw.Init(t.Context(), "clusterA", &tomlConfig{}, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for range 3 {
+		_ = fw.WritePoints(t.Context(), []Point{{name: "stat", fields: []ptFields{{"value": 1}}}})
+	}
+	before := testutil.ToFloat64(backendPointsDropped.WithLabelValues("clusterA", "stuck"))
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dropped := testutil.ToFloat64(backendPointsDropped.WithLabelValues("clusterA", "stuck")) - before; dropped != 3 {
+		t.Errorf("expected the 3 undrained points to be counted as dropped, got %v", dropped)
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File output formats
+const (
+	fileFormatLine = "line" // Influx line protocol
+	fileFormatJSON = "json" // JSON lines
+	fileFormatCSV  = "csv"  // CSV, one row per field
+)
+
+// errStdoutLogging is returned when points would be interleaved with log output
+var errStdoutLogging = errors.New("file back end cannot write to stdout while log_to_stdout is set; set [file] path or turn off log_to_stdout")
+
+// csvHeader is written at the start of each new CSV output file
+var csvHeader = []string{"time", "measurement", "field", "value", "tags"}
+
+// FileSink defines the data for the file/stdout back end
+type FileSink struct {
+	cluster string
+	format  string
+	out     pointOutput
+}
+
+// GetFileWriter returns a file DBWriter
+func GetFileWriter() DBWriter {
+	return &FileSink{}
+}
+
+// pointOutput is the destination for encoded points. Outputs are shared
+// between all clusters writing to the same path, so each Write call must be
+// atomic with respect to other writers.
+type pointOutput interface {
+	Write(p []byte) error
+	Close() error
+	setFormat(format string, header []byte) error // switch to a (reloaded) format
+}
+
+var (
+	fileOutputsMu sync.Mutex
+	fileOutputs   = make(map[string]pointOutput)
+)
+
+// writesStdout reports whether the file back end writes to stdout
+func (fc fileConfig) writesStdout() bool {
+	return fc.Path == "" || fc.Path == "-"
+}
+
+// getFileOutput returns the shared output for the given config, creating it
+// if required. The format and rotation settings of an existing output are
+// updated to match the (possibly reloaded) config.
+func getFileOutput(fc fileConfig, format string, header []byte) (pointOutput, error) {
+	fileOutputsMu.Lock()
+	defer fileOutputsMu.Unlock()
+	key := fc.Path
+	if fc.writesStdout() {
+		key = "-"
+	}
+	if out, ok := fileOutputs[key]; ok {
+		if rf, ok := out.(*rotatingFile); ok {
+			rf.configure(fc)
+		}
+		if err := out.setFormat(format, header); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+	var out pointOutput
+	if key == "-" {
+		out = &stdoutOutput{w: os.Stdout, format: format, header: header}
+	} else {
+		rf := &rotatingFile{path: fc.Path, format: format, header: header}
+		rf.configure(fc)
+		if err := rf.open(); err != nil {
+			return nil, err
+		}
+		out = rf
+	}
+	fileOutputs[key] = out
+	return out, nil
+}
+
+// Init initializes a FileSink so that points can be written
+func (s *FileSink) Init(_ context.Context, clusterName string, config *tomlConfig, _ int, _ map[string]statDetail) error {
+	s.cluster = clusterName
+	fc := config.File
+	s.format = strings.ToLower(fc.Format)
+	if s.format == "" {
+		s.format = fileFormatLine
+	}
+	var header []byte
+	switch s.format {
+	case fileFormatLine, fileFormatJSON:
+	case fileFormatCSV:
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		_ = w.Write(csvHeader)
+		w.Flush()
+		header = buf.Bytes()
+	default:
+		return fmt.Errorf("unknown file back end format %q", fc.Format)
+	}
+	if fc.writesStdout() && config.Logging.LogToStdout {
+		return errStdoutLogging
+	}
+	out, err := getFileOutput(fc, s.format, header)
+	if err != nil {
+		return fmt.Errorf("unable to open file back end output: %w", err)
+	}
+	s.out = out
+	log.Info("file back end initialized", slog.String("cluster", clusterName), slog.String("path", fc.Path), slog.String("format", s.format))
+	return nil
+}
+
+// WritePoints encodes a batch of points in the configured format and writes them out
+func (s *FileSink) WritePoints(_ context.Context, points []Point) error {
+	var buf bytes.Buffer
+	switch s.format {
+	case fileFormatLine:
+		for _, point := range points {
+			if err := appendLineProtocol(&buf, point); err != nil {
+				log.Warn("failed to encode point", slog.String("measurement", point.name), slog.String("error", err.Error()))
+			}
+		}
+	case fileFormatJSON:
+		if err := encodeJSONLines(&buf, points); err != nil {
+			return fmt.Errorf("failed to encode points: %w", err)
+		}
+	case fileFormatCSV:
+		if err := encodeCSV(&buf, points); err != nil {
+			return fmt.Errorf("failed to encode points: %w", err)
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if err := s.out.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write points: %w", err)
+	}
+	return nil
+}
+
+// jsonPoint is the JSON lines representation of a single field/tag set
+type jsonPoint struct {
+	Name   string   `json:"name"`
+	Time   int64    `json:"time"`
+	Tags   ptTags   `json:"tags"`
+	Fields ptFields `json:"fields"`
+}
+
+// encodeJSONLines writes one JSON object per field/tag set to w
+func encodeJSONLines(w io.Writer, points []Point) error {
+	enc := json.NewEncoder(w)
+	for _, point := range points {
+		for i, fields := range point.fields {
+			jp := jsonPoint{Name: point.name, Time: point.time, Fields: fields}
+			if i < len(point.tags) {
+				jp.Tags = point.tags[i]
+			}
+			if err := enc.Encode(jp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeCSV writes one CSV row per field to w. The tags column holds the
+// sorted tag set as a semicolon-separated list of name=value pairs.
+func encodeCSV(w io.Writer, points []Point) error {
+	cw := csv.NewWriter(w)
+	for _, point := range points {
+		ts := strconv.FormatInt(point.time, 10)
+		for i, fields := range point.fields {
+			var tags string
+			if i < len(point.tags) {
+				tags = formatTagList(point.tags[i])
+			}
+			for _, k := range slices.Sorted(maps.Keys(fields)) {
+				row := []string{ts, point.name, k, fmt.Sprint(fields[k]), tags}
+				if err := cw.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatTagList returns the tags as a sorted, semicolon-separated list of name=value pairs
+func formatTagList(tags ptTags) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+// stdoutOutput serializes writes to stdout
+type stdoutOutput struct {
+	sync.Mutex
+	w             io.Writer
+	format        string
+	header        []byte
+	headerWritten bool
+}
+
+// setFormat writes the new format's header, if any, before the next points
+func (o *stdoutOutput) setFormat(format string, header []byte) error {
+	o.Lock()
+	defer o.Unlock()
+	if format != o.format {
+		o.format = format
+		o.header = header
+		o.headerWritten = false
+	}
+	return nil
+}
+
+// Write writes p to stdout, preceded by the header on first use
+func (o *stdoutOutput) Write(p []byte) error {
+	o.Lock()
+	defer o.Unlock()
+	if !o.headerWritten && len(o.header) > 0 {
+		if _, err := o.w.Write(o.header); err != nil {
+			return err
+		}
+	}
+	o.headerWritten = true
+	_, err := o.w.Write(p)
+	return err
+}
+
+// Close is a no-op for stdout
+func (o *stdoutOutput) Close() error {
+	return nil
+}
+
+// rotatingFile is an append-only output file that is rotated when it exceeds
+// a maximum size or age. Rotated files are renamed with a timestamp suffix and
+// optionally gzip-compressed.
+type rotatingFile struct {
+	sync.Mutex
+	path       string
+	format     string
+	header     []byte
+	maxSize    int64         // rotate when the file would exceed this size (0 = never)
+	interval   time.Duration // rotate when the file is older than this (0 = never)
+	maxBackups int           // number of rotated files to retain (0 = all)
+	compress   bool          // gzip rotated files
+
+	f       *os.File
+	size    int64
+	opened  time.Time
+	nowFunc func() time.Time // for testing
+}
+
+// configure applies the rotation settings from the file config
+func (rf *rotatingFile) configure(fc fileConfig) {
+	rf.Lock()
+	defer rf.Unlock()
+	rf.maxSize = int64(fc.MaxSizeMB) * 1024 * 1024
+	rf.interval = time.Duration(fc.RotateInterval) * time.Second
+	rf.maxBackups = fc.MaxBackups
+	rf.compress = fc.Compress
+}
+
+// setFormat rotates the file if it holds points in another format, so that
+// the new file starts with the new format's header
+func (rf *rotatingFile) setFormat(format string, header []byte) error {
+	rf.Lock()
+	defer rf.Unlock()
+	if format == rf.format {
+		return nil
+	}
+	rf.format = format
+	rf.header = header
+	if rf.f == nil {
+		return nil
+	}
+	if rf.size == 0 {
+		// nothing written yet, so only the header is needed
+		n, err := rf.f.Write(header)
+		rf.size += int64(n)
+		return err
+	}
+	return rf.rotate()
+}
+
+func (rf *rotatingFile) now() time.Time {
+	if rf.nowFunc != nil {
+		return rf.nowFunc()
+	}
+	return time.Now()
+}
+
+// open opens (or creates) the output file for appending
+func (rf *rotatingFile) open() error {
+	if dir := filepath.Dir(rf.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	rf.opened = rf.now()
+	if rf.size == 0 && len(rf.header) > 0 {
+		n, err := f.Write(rf.header)
+		rf.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write appends p to the file, rotating first if required
+func (rf *rotatingFile) Write(p []byte) error {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return err
+		}
+	}
+	if rf.shouldRotate(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			log.Error("failed to rotate output file", slog.String("path", rf.path), slog.String("error", err.Error()))
+			if rf.f == nil {
+				return err
+			}
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return err
+}
+
+// shouldRotate reports whether writing n more bytes requires rotation.
+// A file containing nothing but the header is never rotated.
+func (rf *rotatingFile) shouldRotate(n int64) bool {
+	if rf.size <= int64(len(rf.header)) {
+		return false
+	}
+	if rf.maxSize > 0 && rf.size+n > rf.maxSize {
+		return true
+	}
+	if rf.interval > 0 && rf.now().Sub(rf.opened) >= rf.interval {
+		return true
+	}
+	return false
+}
+
+// rotateSuffixFormat is the time format of the suffix of rotated files
+const rotateSuffixFormat = "20060102T150405.000"
+
+// rotate closes the current file, renames it out of the way, and opens a new
+// one. If the file cannot be renamed, it is reopened so that writes continue
+// to be appended to it.
+func (rf *rotatingFile) rotate() error {
+	err := rf.f.Close()
+	rf.f = nil
+	backup := rf.path + "." + rf.now().Format(rotateSuffixFormat)
+	if err == nil {
+		err = os.Rename(rf.path, backup)
+	}
+	if err != nil {
+		return errors.Join(err, rf.open())
+	}
+	log.Info("rotated output file", slog.String("path", rf.path), slog.String("backup", backup))
+	if rf.compress {
+		if err := gzipFile(backup); err != nil {
+			log.Error("failed to compress rotated file", slog.String("path", backup), slog.String("error", err.Error()))
+		}
+	}
+	rf.pruneBackups()
+	return rf.open()
+}
+
+// pruneBackups removes the oldest rotated files beyond the retention limit
+func (rf *rotatingFile) pruneBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	// only remove the files rotate created, e.g. not out.lp.conf
+	var backups []string
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, rf.path+"."), ".gz")
+		if _, err := time.Parse(rotateSuffixFormat, suffix); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// the timestamp suffix sorts chronologically
+	sort.Strings(backups)
+	for len(backups) > rf.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Warn("failed to remove old output file", slog.String("path", backups[0]), slog.String("error", err.Error()))
+		}
+		backups = backups[1:]
+	}
+}
+
+// Close closes the underlying file
+func (rf *rotatingFile) Close() error {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+// gzipFile compresses path to path.gz and removes the original
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close() //nolint:errcheck
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	if _, err = io.Copy(zw, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPoint returns a two-entry multi-valued point for encoding tests
+func testPoint() Point {
+	return Point{
+		name: "node.ifs.heat.lock",
+		time: 1700000000,
+		fields: []ptFields{
+			{"op_rate": float64(1.5), "op_count": int64(3)},
+			{"op_rate": float64(2.25), "op_count": 7},
+		},
+		tags: []ptTags{
+			{"cluster": "clusterA", "node": "1", "path": "SYSTEM (0x0)"},
+			{"cluster": "clusterA", "node": "1", "path": "/ifs/data,x"},
+		},
+	}
+}
+
+func TestAppendLineProtocol(t *testing.T) {
+	var buf bytes.Buffer
+	if err := appendLineProtocol(&buf, testPoint()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `node.ifs.heat.lock,cluster=clusterA,node=1,path=SYSTEM\ (0x0) op_count=3i,op_rate=1.5 1700000000
+node.ifs.heat.lock,cluster=clusterA,node=1,path=/ifs/data\,x op_count=7i,op_rate=2.25 1700000000
+`
+	if buf.String() != want {
+		t.Errorf("unexpected line protocol output:\ngot:  %q\nwant: %q", buf.String(), want)
+	}
+}
+
+func TestAppendLineProtocol_StringAndEmptyTag(t *testing.T) {
+	var buf bytes.Buffer
+	pt := Point{
+		name:   "my stat",
+		time:   1,
+		fields: []ptFields{{"s": `a "quoted" value`}},
+		tags:   []ptTags{{"cluster": "c", "empty": ""}},
+	}
+	if err := appendLineProtocol(&buf, pt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `my\ stat,cluster=c s="a \"quoted\" value" 1` + "\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestAppendLineProtocol_UnsupportedType(t *testing.T) {
+	var buf bytes.Buffer
+	pt := Point{name: "x", time: 1, fields: []ptFields{{"v": []int{1}}}, tags: []ptTags{{}}}
+	if err := appendLineProtocol(&buf, pt); err == nil {
+		t.Fatalf("expected error for unsupported field type")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no partial output, got %q", buf.String())
+	}
+}
+
+func TestEncodeJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	if err := encodeJSONLines(&buf, []Point{testPoint()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	var jp jsonPoint
+	if err := json.Unmarshal([]byte(lines[1]), &jp); err != nil {
+		t.Fatalf("unable to parse JSON line: %v", err)
+	}
+	if jp.Name != "node.ifs.heat.lock" || jp.Time != 1700000000 {
+		t.Errorf("unexpected name/time: %v/%v", jp.Name, jp.Time)
+	}
+	if jp.Tags["path"] != "/ifs/data,x" {
+		t.Errorf("unexpected path tag: %q", jp.Tags["path"])
+	}
+	if jp.Fields["op_rate"] != 2.25 {
+		t.Errorf("unexpected op_rate field: %v", jp.Fields["op_rate"])
+	}
+}
+
+func TestEncodeCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := encodeCSV(&buf, []Point{testPoint()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `1700000000,node.ifs.heat.lock,op_count,3,cluster=clusterA;node=1;path=SYSTEM (0x0)
+1700000000,node.ifs.heat.lock,op_rate,1.5,cluster=clusterA;node=1;path=SYSTEM (0x0)
+1700000000,node.ifs.heat.lock,op_count,7,"cluster=clusterA;node=1;path=/ifs/data,x"
+1700000000,node.ifs.heat.lock,op_rate,2.25,"cluster=clusterA;node=1;path=/ifs/data,x"
+`
+	if buf.String() != want {
+		t.Errorf("unexpected CSV output:\ngot:  %q\nwant: %q", buf.String(), want)
+	}
+}
+
+func TestFileSink_CSVHeader(t *testing.T) {
+	setMemoryBackend()
+	path := filepath.Join(t.TempDir(), "out.csv")
+	conf := &tomlConfig{File: fileConfig{Path: path, Format: "csv"}}
+	s := &FileSink{}
+	if err := s.Init(t.Context(), "clusterA", conf, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { closeFileOutput(t, path) })
+	if err := s.WritePoints(t.Context(), []Point{testPoint()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read output: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if lines[0] != "time,measurement,field,value,tags" {
+		t.Errorf("expected CSV header, got %q", lines[0])
+	}
+	if len(lines) != 5 {
+		t.Errorf("expected header + 4 rows, got %d lines", len(lines))
+	}
+}
+
+func TestFileSink_UnknownFormat(t *testing.T) {
+	setMemoryBackend()
+	conf := &tomlConfig{File: fileConfig{Path: filepath.Join(t.TempDir(), "out"), Format: "xml"}}
+	s := &FileSink{}
+	if err := s.Init(t.Context(), "clusterA", conf, 0, nil); err == nil {
+		t.Fatalf("expected error for unknown format")
+	}
+}
+
+func TestFileSink_StdoutLogging(t *testing.T) {
+	setMemoryBackend()
+	conf := &tomlConfig{File: fileConfig{Path: "-"}, Logging: loggingConfig{LogToStdout: true}}
+	s := &FileSink{}
+	if err := s.Init(t.Context(), "clusterA", conf, 0, nil); !errors.Is(err, errStdoutLogging) {
+		t.Fatalf("expected stdout to be refused while logging to stdout, got %v", err)
+	}
+}
+
+func TestFileSink_FormatReload(t *testing.T) {
+	setMemoryBackend()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out")
+	conf := &tomlConfig{File: fileConfig{Path: path, Format: "line"}}
+	s := &FileSink{}
+	if err := s.Init(t.Context(), "clusterA", conf, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { closeFileOutput(t, path) })
+	if err := s.WritePoints(t.Context(), []Point{testPoint()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a reload switching to CSV reuses the output, which starts a new file with the header
+	conf.File.Format = "csv"
+	s = &FileSink{}
+	if err := s.Init(t.Context(), "clusterA", conf, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.WritePoints(t.Context(), []Point{testPoint()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read output: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); lines[0] != "time,measurement,field,value,tags" || len(lines) != 5 {
+		t.Errorf("expected a CSV file with a header, got %q", data)
+	}
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 1 {
+		t.Errorf("expected the line protocol file to be rotated, got %v", backups)
+	}
+
+	var buf strings.Builder
+	out := &stdoutOutput{w: &buf, format: fileFormatCSV, header: []byte("h1\n")}
+	_ = out.Write([]byte("a\n"))
+	_ = out.setFormat(fileFormatCSV, []byte("h1\n"))
+	_ = out.Write([]byte("b\n"))
+	_ = out.setFormat(fileFormatJSON, nil)
+	_ = out.Write([]byte("c\n"))
+	if buf.String() != "h1\na\nb\nc\n" {
+		t.Errorf("unexpected stdout output %q", buf.String())
+	}
+}
+
+// closeFileOutput closes and unregisters the shared output for path
+func closeFileOutput(t *testing.T, path string) {
+	t.Helper()
+	fileOutputsMu.Lock()
+	defer fileOutputsMu.Unlock()
+	if out, ok := fileOutputs[path]; ok {
+		_ = out.Close()
+		delete(fileOutputs, path)
+	}
+}
+
+func TestRotatingFile_SizeRotationAndCompress(t *testing.T) {
+	setMemoryBackend()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.lp")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rf := &rotatingFile{path: path, nowFunc: func() time.Time { now = now.Add(time.Second); return now }}
+	rf.configure(fileConfig{MaxSizeMB: 1, MaxBackups: 2, Compress: true})
+	if err := rf.open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rf.Close() //nolint:errcheck
+	// files that only share the output's name are not backups
+	for _, name := range []string{path + ".conf", path + ".lock"} {
+		if err := os.WriteFile(name, []byte("keep"), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	chunk := bytes.Repeat([]byte("x"), 600*1024)
+	for range 4 {
+		if err := rf.Write(chunk); err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".*.gz")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 compressed backups (pruned to max_backups), got %v", backups)
+	}
+	f, err := os.Open(backups[0])
+	if err != nil {
+		t.Fatalf("unable to open backup: %v", err)
+	}
+	defer f.Close() //nolint:errcheck
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("backup is not gzip: %v", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unable to decompress backup: %v", err)
+	}
+	if len(data) != len(chunk) {
+		t.Errorf("expected %d bytes in backup, got %d", len(chunk), len(data))
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unable to stat current file: %v", err)
+	}
+	if fi.Size() != int64(len(chunk)) {
+		t.Errorf("expected current file size %d, got %d", len(chunk), fi.Size())
+	}
+	for _, name := range []string{path + ".conf", path + ".lock"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("expected %s to survive pruning, got %v", name, err)
+		}
+	}
+}
+
+func TestRotatingFile_RotateFailure(t *testing.T) {
+	setMemoryBackend()
+	path := filepath.Join(t.TempDir(), "out.lp")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rf := &rotatingFile{path: path, nowFunc: func() time.Time { return now }}
+	rf.configure(fileConfig{RotateInterval: 60})
+	if err := rf.open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rf.Close() //nolint:errcheck
+
+	if err := rf.Write([]byte("first\n")); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	// a directory in the way of the backup makes the rename fail
+	now = now.Add(time.Minute)
+	if err := os.MkdirAll(filepath.Join(path+"."+now.Format(rotateSuffixFormat), "x"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, line := range []string{"second\n", "third\n"} {
+		if err := rf.Write([]byte(line)); err != nil {
+			t.Errorf("expected writes to continue after a failed rotation, got %v", err)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "first\nsecond\nthird\n" {
+		t.Errorf("expected the writes to be appended to the current file, got %q", data)
+	}
+}
+
+func TestRotatingFile_TimeRotation(t *testing.T) {
+	setMemoryBackend()
+	path := filepath.Join(t.TempDir(), "out.json")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rf := &rotatingFile{path: path, nowFunc: func() time.Time { return now }}
+	rf.configure(fileConfig{RotateInterval: 60})
+	if err := rf.open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rf.Close() //nolint:errcheck
+
+	_ = rf.Write([]byte("first\n"))
+	now = now.Add(30 * time.Second)
+	_ = rf.Write([]byte("second\n"))
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 0 {
+		t.Fatalf("unexpected rotation before interval: %v", backups)
+	}
+	now = now.Add(30 * time.Second)
+	_ = rf.Write([]byte("third\n"))
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup after interval, got %v", backups)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "third\n" {
+		t.Errorf("expected new file to contain only the latest write, got %q", data)
+	}
+}
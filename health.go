@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Cluster collection states reported by the health endpoints
+const (
+	clusterStateStarting    = "starting"
+	clusterStateConnecting  = "connecting"
+	clusterStateFetching    = "fetching_stat_details"
+	clusterStateInitBackend = "initializing_backend"
+	clusterStateCollecting  = "collecting"
+	clusterStatePaused      = "paused"
+	clusterStateWriteFailed = "write_failed"
+	clusterStateStopped     = "stopped"
+)
+
+// defaultHealthStaleFactor is the default number of collection intervals
+// without a successful collection after which a cluster is unhealthy
+const defaultHealthStaleFactor = 3
+
+// clusterHealth is the health of the collection loop for a single cluster
+type clusterHealth struct {
+	Hostname       string    `json:"hostname"`
+	Cluster        string    `json:"cluster,omitempty"` // cluster name, once connected
+	State          string    `json:"state"`
+	Ready          bool      `json:"ready"`
+	Healthy        bool      `json:"healthy"`
+	Interval       float64   `json:"interval_seconds,omitempty"` // shortest collection interval
+	LastCollection time.Time `json:"last_collection,omitzero"`
+	Error          string    `json:"error,omitempty"`
+	readyTime      time.Time // staleness baseline until the next collection
+}
+
+// healthRegistry tracks the health of every enabled cluster in the current run
+type healthRegistry struct {
+	sync.Mutex
+	clusters    map[string]*clusterHealth
+	order       []string
+	staleFactor int              // unhealthy after this many collection intervals without a collection
+	nowFunc     func() time.Time // for testing
+}
+
+var health = newHealthRegistry()
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{clusters: make(map[string]*clusterHealth)}
+}
+
+func (h *healthRegistry) now() time.Time {
+	if h.nowFunc != nil {
+		return h.nowFunc()
+	}
+	return time.Now()
+}
+
+// reset starts tracking the given clusters, discarding any previous state.
+// Called at the start of each run (i.e., at startup and after a reload).
+func (h *healthRegistry) reset(hostnames []string, staleFactor int) {
+	h.Lock()
+	defer h.Unlock()
+	if staleFactor <= 0 {
+		staleFactor = defaultHealthStaleFactor
+	}
+	h.staleFactor = staleFactor
+	h.clusters = make(map[string]*clusterHealth, len(hostnames))
+	h.order = hostnames
+	for _, host := range hostnames {
+		h.clusters[host] = &clusterHealth{Hostname: host, State: clusterStateStarting}
+	}
+}
+
+// update applies fn to the named cluster's health, if it is being tracked
+func (h *healthRegistry) update(hostname string, fn func(ch *clusterHealth)) {
+	h.Lock()
+	defer h.Unlock()
+	if ch, ok := h.clusters[hostname]; ok {
+		fn(ch)
+	}
+}
+
+// setState records the cluster's current collection state
+func (h *healthRegistry) setState(hostname string, state string) {
+	h.update(hostname, func(ch *clusterHealth) { ch.State = state })
+}
+
+// setReady records that the cluster is connected, its back end initialized and
+// collection has started
+func (h *healthRegistry) setReady(hostname string, cluster string, interval time.Duration) {
+	now := h.now()
+	h.update(hostname, func(ch *clusterHealth) {
+		ch.Cluster = cluster
+		ch.State = clusterStateCollecting
+		ch.Ready = true
+		ch.Interval = interval.Seconds()
+		ch.readyTime = now
+	})
+}
+
+// setInterval records a change in the cluster's shortest collection interval
+func (h *healthRegistry) setInterval(hostname string, interval time.Duration) {
+	h.update(hostname, func(ch *clusterHealth) { ch.Interval = interval.Seconds() })
+}
+
+// resumed records that collection was resumed after a pause. Staleness is
+// measured from now until the next collection.
+func (h *healthRegistry) resumed(hostname string) {
+	now := h.now()
+	h.update(hostname, func(ch *clusterHealth) {
+		ch.State = clusterStateCollecting
+		ch.readyTime = now
+	})
+}
+
+// collected records a successful collection
+func (h *healthRegistry) collected(hostname string) {
+	now := h.now()
+	h.update(hostname, func(ch *clusterHealth) { ch.LastCollection = now })
+}
+
+// setError records an error which stopped or degraded collection
+func (h *healthRegistry) setError(hostname string, state string, err error) {
+	h.update(hostname, func(ch *clusterHealth) {
+		ch.State = state
+		ch.Error = err.Error()
+	})
+}
+
+// stopped records that the collection loop for the cluster has exited
+func (h *healthRegistry) stopped(hostname string) {
+	h.update(hostname, func(ch *clusterHealth) {
+		ch.Ready = false
+		if ch.State != clusterStateWriteFailed {
+			ch.State = clusterStateStopped
+		}
+	})
+}
+
+// status returns a snapshot of every cluster's health, and whether all
+// clusters are ready and healthy. A cluster is unhealthy if its collection
+// loop has stopped, its back end writes have failed, or its last successful
+// collection is more than unhealthy_after_intervals collection intervals ago.
+func (h *healthRegistry) status() (clusters []clusterHealth, ready bool, healthy bool) {
+	h.Lock()
+	defer h.Unlock()
+	now := h.now()
+	ready, healthy = true, true
+	for _, host := range h.order {
+		ch := *h.clusters[host]
+		switch ch.State {
+		case clusterStateStopped, clusterStateWriteFailed:
+			ch.Healthy = false
+		case clusterStateCollecting:
+			last := ch.LastCollection
+			if ch.readyTime.After(last) {
+				last = ch.readyTime
+			}
+			maxAge := time.Duration(float64(h.staleFactor) * ch.Interval * float64(time.Second))
+			ch.Healthy = maxAge <= 0 || now.Sub(last) <= maxAge
+			if !ch.Healthy {
+				ch.Error = "no successful collection since " + last.Format(time.RFC3339)
+			}
+		default:
+			// still starting up, or paused via the admin API
+			ch.Healthy = true
+		}
+		ready = ready && ch.Ready
+		healthy = healthy && ch.Healthy
+		clusters = append(clusters, ch)
+	}
+	return clusters, ready, healthy
+}
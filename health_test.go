@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthRegistry_Lifecycle(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := newHealthRegistry()
+	h.nowFunc = func() time.Time { return now }
+	h.reset([]string{"a", "b"}, 3)
+
+	if _, ready, healthy := h.status(); ready || !healthy {
+		t.Errorf("starting clusters should be healthy but not ready, got ready=%v healthy=%v", ready, healthy)
+	}
+
+	h.setState("a", clusterStateConnecting)
+	h.setReady("a", "clusterA", 30*time.Second)
+	h.setReady("b", "clusterB", 30*time.Second)
+	if _, ready, healthy := h.status(); !ready || !healthy {
+		t.Errorf("expected ready and healthy, got ready=%v healthy=%v", ready, healthy)
+	}
+
+	// b keeps collecting, a does not
+	now = now.Add(2 * time.Minute)
+	h.collected("b")
+	clusters, _, healthy := h.status()
+	if healthy {
+		t.Errorf("expected unhealthy when a cluster has not collected for more than 3 intervals")
+	}
+	if clusters[0].Healthy || !clusters[1].Healthy {
+		t.Errorf("expected only cluster a to be unhealthy, got %+v", clusters)
+	}
+
+	h.collected("a")
+	h.setError("b", clusterStateWriteFailed, errors.New("write failed"))
+	h.stopped("b")
+	clusters, ready, healthy := h.status()
+	if ready || healthy {
+		t.Errorf("expected a failed back end to make the collector unhealthy and not ready")
+	}
+	if clusters[1].State != clusterStateWriteFailed || clusters[1].Error != "write failed" {
+		t.Errorf("expected write failure to be reported, got %+v", clusters[1])
+	}
+
+	// a cluster resumed after a long pause is given a fresh staleness baseline
+	h.setState("a", clusterStatePaused)
+	now = now.Add(time.Hour)
+	h.resumed("a")
+	if clusters, _, _ := h.status(); !clusters[0].Healthy || clusters[0].State != clusterStateCollecting {
+		t.Errorf("expected a resumed cluster to be healthy, got %+v", clusters[0])
+	}
+	now = now.Add(2 * time.Minute)
+	if clusters, _, _ := h.status(); clusters[0].Healthy {
+		t.Errorf("expected a resumed cluster that does not collect to become unhealthy")
+	}
+
+	// untracked clusters are ignored
+	h.collected("nosuch")
+}
+
+func TestValidateAdmin(t *testing.T) {
+	for _, tc := range []struct {
+		ac adminConfig
+		ok bool
+	}{
+		{adminConfig{ListenAddr: ":8081"}, true},
+		{adminConfig{ListenAddr: ":8081", APIToken: "t"}, false},
+		{adminConfig{ListenAddr: "127.0.0.1:8081", APIToken: "t"}, true},
+		{adminConfig{ListenAddr: "[::1]:8081", APIToken: "t"}, true},
+		{adminConfig{ListenAddr: "localhost:8081", APIToken: "t"}, true},
+		{adminConfig{ListenAddr: "0.0.0.0:8081", APIToken: "t", TLSCert: "c.pem", TLSKey: "k.pem"}, true},
+		{adminConfig{ListenAddr: ":8081", TLSCert: "c.pem"}, false},
+	} {
+		if err := validateAdmin(tc.ac); (err == nil) != tc.ok {
+			t.Errorf("%+v: unexpected result %v", tc.ac, err)
+		}
+	}
+}
+
+func TestAdminMux_HealthEndpoints(t *testing.T) {
+	health.reset([]string{"a"}, 0)
+	defer health.reset(nil, 0)
+	srv := httptest.NewServer(newAdminMux("", nil))
+	defer srv.Close()
+
+	get := func(path string) (int, healthResponse) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close() //nolint:errcheck
+		var hr healthResponse
+		if err := json.NewDecoder(resp.Body).Decode(&hr); err != nil {
+			t.Fatalf("unable to decode response: %v", err)
+		}
+		return resp.StatusCode, hr
+	}
+
+	if code, hr := get("/readyz"); code != http.StatusServiceUnavailable || hr.Status != "not ready" {
+		t.Errorf("expected 503 before the cluster is ready, got %d %q", code, hr.Status)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("expected 200 while starting up, got %d", code)
+	}
+
+	health.setReady("a", "clusterA", time.Minute)
+	code, hr := get("/readyz")
+	if code != http.StatusOK || hr.Status != "ready" {
+		t.Errorf("expected 200 once ready, got %d %q", code, hr.Status)
+	}
+	if len(hr.Clusters) != 1 || hr.Clusters[0].Cluster != "clusterA" || hr.Clusters[0].Interval != 60 {
+		t.Errorf("unexpected cluster status %+v", hr.Clusters)
+	}
+
+	health.stopped("a")
+	if code, hr := get("/healthz"); code != http.StatusServiceUnavailable || hr.Status != "unhealthy" {
+		t.Errorf("expected 503 after the collection loop stopped, got %d %q", code, hr.Status)
+	}
+}
+
+func TestShortestInterval(t *testing.T) {
+	buckets := []statTimeSet{{interval: 30 * time.Second}, {interval: 10 * time.Second}}
+	if d := shortestInterval(buckets, summaryStatConfig{}); d != 10*time.Second {
+		t.Errorf("expected 10s, got %v", d)
+	}
+	if d := shortestInterval(buckets, summaryStatConfig{Client: true}); d != summaryStatsInterval {
+		t.Errorf("expected summary stats interval, got %v", d)
+	}
+}
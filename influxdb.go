@@ -4,16 +4,25 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
+	"strings"
 	"time"
 
 	client "github.com/influxdata/influxdb1-client/v2"
 )
 
+// InfluxDB v1 transports
+const (
+	influxTransportHTTP = "http"
+	influxTransportUDP  = "udp"
+)
+
 // InfluxDBSink defines the data to allow us talk to an InfluxDB database
 type InfluxDBSink struct {
-	cluster  string
-	client   client.Client
-	bpConfig client.BatchPointsConfig
+	cluster      string
+	client       client.Client
+	bpConfig     client.BatchPointsConfig
+	maxBatchSize int
 }
 
 // GetInfluxDBWriter returns an InfluxDB DBWriter
@@ -27,17 +36,47 @@ func (s *InfluxDBSink) Init(_ context.Context, cluster string, config *tomlConfi
 	var username, password string
 	var err error
 	ic := config.InfluxDB
+
+	consistency := strings.ToLower(ic.WriteConsistency)
+	switch consistency {
+	case "", "any", "one", "quorum", "all":
+	default:
+		return fmt.Errorf("unknown InfluxDB write_consistency %q (expected \"any\", \"one\", \"quorum\" or \"all\")", ic.WriteConsistency)
+	}
+	s.bpConfig = client.BatchPointsConfig{
+		Database:         ic.Database,
+		Precision:        "s",
+		RetentionPolicy:  ic.RetentionPolicy,
+		WriteConsistency: consistency,
+	}
+	s.maxBatchSize = ic.MaxBatchSize
+
+	transport := strings.ToLower(ic.Transport)
+	switch transport {
+	case "", influxTransportHTTP:
+	case influxTransportUDP:
+		// UDP writes go to the database configured in the InfluxDB UDP listener,
+		// and there is no response so the connection cannot be verified
+		dbClient, err := client.NewUDPClient(client.UDPConfig{
+			Addr:        net.JoinHostPort(ic.Host, ic.Port),
+			PayloadSize: ic.UDPPayloadSize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create InfluxDB UDP client: %w", err)
+		}
+		log.Info("writing to InfluxDB over UDP", slog.String("cluster", cluster), slog.String("host", ic.Host), slog.String("port", ic.Port))
+		s.client = dbClient
+		return nil
+	default:
+		return fmt.Errorf("unknown InfluxDB transport %q (expected %q or %q)", ic.Transport, influxTransportHTTP, influxTransportUDP)
+	}
+
 	scheme := "http"
 	if ic.UseSSL {
 		scheme = "https"
 	}
 	url := scheme + "://" + ic.Host + ":" + ic.Port
 
-	s.bpConfig = client.BatchPointsConfig{
-		Database:  ic.Database,
-		Precision: "s",
-	}
-
 	if ic.Authenticated {
 		username = ic.Username
 		password = ic.Password
@@ -47,12 +86,16 @@ func (s *InfluxDBSink) Init(_ context.Context, cluster string, config *tomlConfi
 		}
 	}
 
-	dbClient, err := client.NewHTTPClient(client.HTTPConfig{
+	httpConfig := client.HTTPConfig{
 		Addr:               url,
 		Username:           username,
 		Password:           password,
 		InsecureSkipVerify: ic.InsecureSkipVerify,
-	})
+	}
+	if ic.Gzip {
+		httpConfig.WriteEncoding = client.GzipEncoding
+	}
+	dbClient, err := client.NewHTTPClient(httpConfig)
 	if err != nil {
 		return fmt.Errorf("failed to create InfluxDB client: %w", err)
 	}
@@ -66,31 +109,54 @@ func (s *InfluxDBSink) Init(_ context.Context, cluster string, config *tomlConfi
 	return nil
 }
 
-// WritePoints writes a batch of points to InfluxDB
+// WritePoints writes a batch of points to InfluxDB. If max_batch_size is set,
+// the points are split across multiple write requests.
 func (s *InfluxDBSink) WritePoints(_ context.Context, points []Point) error {
-	bp, err := client.NewBatchPoints(s.bpConfig)
-	if err != nil {
-		return fmt.Errorf("unable to create InfluxDB batch points: %w", err)
-	}
+	var pts []*client.Point
 	for _, point := range points {
-		var pts []*client.Point
 		for i, f := range point.fields {
-			var pt *client.Point
-			pt, err = client.NewPoint(point.name, point.tags[i], f, time.Unix(point.time, 0).UTC())
+			pt, err := client.NewPoint(point.name, point.tags[i], f, time.Unix(point.time, 0).UTC())
 			if err != nil {
 				log.Warn("failed to create point", slog.String("measurement", point.name))
 				continue
 			}
 			pts = append(pts, pt)
 		}
-		if len(pts) > 0 {
-			bp.AddPoints(pts)
-		}
 	}
-	// write the batch
-	err = s.client.Write(bp)
-	if err != nil {
-		return fmt.Errorf("failed to write batch of points: %w", err)
+	for _, chunk := range splitBatch(pts, s.maxBatchSize) {
+		bp, err := client.NewBatchPoints(s.bpConfig)
+		if err != nil {
+			return fmt.Errorf("unable to create InfluxDB batch points: %w", err)
+		}
+		bp.AddPoints(chunk)
+		// if a later chunk fails, the retry rewrites the earlier chunks too, which
+		// is harmless since InfluxDB overwrites points with the same series and time
+		if err = s.client.Write(bp); err != nil {
+			return fmt.Errorf("failed to write batch of points: %w", err)
+		}
 	}
 	return nil
 }
+
+// Close closes the client connection
+func (s *InfluxDBSink) Close() error {
+	if s.client == nil {
+		return nil
+	}
+	return s.client.Close()
+}
+
+// splitBatch splits pts into chunks of at most size points. A size of zero
+// or less returns a single chunk. An empty input still returns one (empty)
+// chunk so that a write is always attempted.
+func splitBatch[T any](pts []T, size int) [][]T {
+	if size <= 0 || len(pts) <= size {
+		return [][]T{pts}
+	}
+	chunks := make([][]T, 0, (len(pts)+size-1)/size)
+	for len(pts) > size {
+		chunks = append(chunks, pts[:size:size])
+		pts = pts[size:]
+	}
+	return append(chunks, pts)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitBatch(t *testing.T) {
+	pts := []int{1, 2, 3, 4, 5, 6, 7}
+	tests := []struct {
+		size int
+		want []int // chunk lengths
+	}{
+		{0, []int{7}},
+		{10, []int{7}},
+		{7, []int{7}},
+		{3, []int{3, 3, 1}},
+		{1, []int{1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		chunks := splitBatch(pts, tt.size)
+		if len(chunks) != len(tt.want) {
+			t.Errorf("size %d: expected %d chunks, got %d", tt.size, len(tt.want), len(chunks))
+			continue
+		}
+		n := 0
+		for i, c := range chunks {
+			if len(c) != tt.want[i] {
+				t.Errorf("size %d: chunk %d has %d points, expected %d", tt.size, i, len(c), tt.want[i])
+			}
+			for _, v := range c {
+				n++
+				if v != n {
+					t.Errorf("size %d: points out of order", tt.size)
+				}
+			}
+		}
+	}
+}
+
+func TestInfluxDBSink_InitRejectsBadOptions(t *testing.T) {
+	setMemoryBackend()
+	for _, ic := range []influxDBConfig{
+		{Host: "localhost", Port: "8089", Transport: "tcp"},
+		{Host: "localhost", Port: "8089", WriteConsistency: "most"},
+	} {
+		s := &InfluxDBSink{}
+		if err := s.Init(t.Context(), "clusterA", &tomlConfig{InfluxDB: ic}, 0, nil); err == nil {
+			t.Errorf("expected error for config %+v", ic)
+		}
+	}
+}
+
+func TestInfluxDBSink_UDP(t *testing.T) {
+	setMemoryBackend()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen for UDP: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	ic := influxDBConfig{Host: "127.0.0.1", Port: port, Transport: "udp", MaxBatchSize: 2}
+	s := &InfluxDBSink{}
+	if err := s.Init(t.Context(), "clusterA", &tomlConfig{InfluxDB: ic}, 0, nil); err != nil {
+		t.Fatalf("unexpected error initializing UDP sink: %v", err)
+	}
+	defer s.Close() //nolint:errcheck
+	points := []Point{{
+		name:   "node.ifs.bytes",
+		time:   1700000000,
+		fields: []ptFields{{"value": 1.0}, {"value": 2.0}, {"value": 3.0}},
+		tags:   []ptTags{{"node": "1"}, {"node": "2"}, {"node": "3"}},
+	}}
+	if err := s.WritePoints(t.Context(), points); err != nil {
+		t.Fatalf("unexpected error writing over UDP: %v", err)
+	}
+
+	// three points with a batch size of two should arrive as two packets
+	var lines int
+	buf := make([]byte, 65536)
+	for range 2 {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected two UDP packets: %v", err)
+		}
+		lines += strings.Count(strings.TrimSpace(string(buf[:n])), "\n") + 1
+	}
+	if lines != 3 {
+		t.Errorf("expected 3 lines across both packets, got %d", lines)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"strings"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
@@ -12,11 +13,19 @@ import (
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
 )
 
+// InfluxDBv2 write modes
+const (
+	influxWriteModeBlocking = "blocking"
+	influxWriteModeAsync    = "async"
+)
+
 // InfluxDBv2Sink defines the data to allow us talk to an InfluxDBv2 database
 type InfluxDBv2Sink struct {
-	cluster  string
-	c        influxdb2.Client
-	writeAPI api.WriteAPIBlocking
+	cluster    string
+	c          influxdb2.Client
+	writeAPI   api.WriteAPIBlocking
+	asyncAPI   api.WriteAPI  // set instead of writeAPI in async mode
+	errorsDone chan struct{} // closed when the async error reader exits
 }
 
 // GetInfluxDBv2Writer returns an InfluxDBv2 DBWriter
@@ -35,6 +44,15 @@ func (s *InfluxDBv2Sink) Init(ctx context.Context, cluster string, config *tomlC
 	}
 	url := scheme + "://" + ic.Host + ":" + ic.Port
 
+	mode := strings.ToLower(ic.WriteMode)
+	switch mode {
+	case "":
+		mode = influxWriteModeBlocking
+	case influxWriteModeBlocking, influxWriteModeAsync:
+	default:
+		return fmt.Errorf("unknown InfluxDBv2 write_mode %q (expected %q or %q)", ic.WriteMode, influxWriteModeBlocking, influxWriteModeAsync)
+	}
+
 	token := ic.Token
 	if token == "" {
 		return fmt.Errorf("InfluxDBv2 access token is missing or empty")
@@ -47,26 +65,55 @@ func (s *InfluxDBv2Sink) Init(ctx context.Context, cluster string, config *tomlC
 	if ic.InsecureSkipVerify {
 		opts.SetTLSConfig(&tls.Config{InsecureSkipVerify: true}) //nolint:gosec
 	}
+	if ic.BatchSize > 0 {
+		opts.SetBatchSize(ic.BatchSize)
+	}
+	if ic.FlushInterval > 0 {
+		opts.SetFlushInterval(ic.FlushInterval)
+	}
+	if ic.RetryBufferLimit > 0 {
+		opts.SetRetryBufferLimit(ic.RetryBufferLimit)
+	}
 	client := influxdb2.NewClientWithOptions(url, token, opts)
-	
+
 	// ping the database to ensure we can connect
 	pingCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 	ok, err := client.Ping(pingCtx)
 	if err != nil {
+		client.Close()
 		return fmt.Errorf("failed to ping InfluxDBv2: %w", err)
 	}
 	if !ok {
+		client.Close()
 		return fmt.Errorf("InfluxDBv2 ping failed - server not reachable")
 	}
-	log.Info("successfully connected to InfluxDBv2", slog.String("cluster", cluster))
-	
+	log.Info("successfully connected to InfluxDBv2", slog.String("cluster", cluster), slog.String("write_mode", mode))
+
 	s.c = client
+	if mode == influxWriteModeAsync {
+		s.asyncAPI = client.WriteAPI(ic.Org, ic.Bucket)
+		s.errorsDone = make(chan struct{})
+		go s.readErrors(s.asyncAPI.Errors())
+		return nil
+	}
 	s.writeAPI = client.WriteAPIBlocking(ic.Org, ic.Bucket)
 	return nil
 }
 
-// WritePoints writes a batch of points to InfluxDBv2
+// readErrors logs and counts errors from the async write API until the
+// channel is closed when the client is closed
+func (s *InfluxDBv2Sink) readErrors(errCh <-chan error) {
+	defer close(s.errorsDone)
+	for err := range errCh {
+		log.Error("InfluxDBv2 async write failed", slog.String("cluster", s.cluster), slog.String("error", err.Error()))
+		backendAsyncWriteErrors.WithLabelValues(s.cluster, influxV2PluginName).Inc()
+	}
+}
+
+// WritePoints writes a batch of points to InfluxDBv2. In async mode the points
+// are buffered by the client and written in the background, so write errors
+// are reported through logging and self-metrics rather than returned.
 func (s *InfluxDBv2Sink) WritePoints(ctx context.Context, points []Point) error {
 	var pts []*write.Point
 	for _, point := range points {
@@ -74,8 +121,26 @@ func (s *InfluxDBv2Sink) WritePoints(ctx context.Context, points []Point) error
 			pts = append(pts, influxdb2.NewPoint(point.name, point.tags[i], field, time.Unix(point.time, 0).UTC()))
 		}
 	}
+	if s.asyncAPI != nil {
+		for _, pt := range pts {
+			s.asyncAPI.WritePoint(pt)
+		}
+		return nil
+	}
 	if err := s.writeAPI.WritePoint(ctx, pts...); err != nil {
 		return fmt.Errorf("InfluxDBv2 write failed: %w", err)
 	}
 	return nil
 }
+
+// Close flushes any buffered points and closes the client
+func (s *InfluxDBv2Sink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	s.c.Close()
+	if s.errorsDone != nil {
+		<-s.errorsDone
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeInfluxDBv2 returns a test server which accepts pings and records the
+// bodies of write requests, failing writes if fail is set
+func fakeInfluxDBv2(t *testing.T, fail bool) (*httptest.Server, func() string) {
+	t.Helper()
+	var mu sync.Mutex
+	var written strings.Builder
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if fail {
+			http.Error(w, `{"code":"invalid","message":"bad request"}`, http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		written.Write(body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return written.String()
+	}
+}
+
+func testInfluxDBv2Config(t *testing.T, srv *httptest.Server) *tomlConfig {
+	t.Helper()
+	u, _ := url.Parse(srv.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	return &tomlConfig{InfluxDBv2: influxDBv2Config{
+		Host: host, Port: port, Org: "org", Bucket: "bucket", Token: "token",
+		WriteMode: "async", FlushInterval: 60000,
+	}}
+}
+
+var v2TestPoints = []Point{{
+	name:   "node.ifs.bytes",
+	time:   1700000000,
+	fields: []ptFields{{"value": 1.0}, {"value": 2.0}},
+	tags:   []ptTags{{"node": "1"}, {"node": "2"}},
+}}
+
+func TestInfluxDBv2Sink_AsyncFlushesOnClose(t *testing.T) {
+	setMemoryBackend()
+	srv, written := fakeInfluxDBv2(t, false)
+	s := &InfluxDBv2Sink{}
+	if err := s.Init(t.Context(), "clusterA", testInfluxDBv2Config(t, srv), 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.WritePoints(t.Context(), v2TestPoints); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the flush interval is long, so nothing is written until Close
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := strings.Count(written(), "node.ifs.bytes"); n != 2 {
+		t.Errorf("expected 2 points flushed on close, got %d:\n%s", n, written())
+	}
+}
+
+func TestInfluxDBv2Sink_AsyncErrorsCounted(t *testing.T) {
+	setMemoryBackend()
+	srv, _ := fakeInfluxDBv2(t, true)
+	s := &InfluxDBv2Sink{}
+	if err := s.Init(t.Context(), "clusterB", testInfluxDBv2Config(t, srv), 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.WritePoints(t.Context(), v2TestPoints); err != nil {
+		t.Fatalf("async write should not return an error, got %v", err)
+	}
+	_ = s.Close()
+	if n := testutil.ToFloat64(backendAsyncWriteErrors.WithLabelValues("clusterB", influxV2PluginName)); n < 1 {
+		t.Errorf("expected async write error to be counted")
+	}
+}
+
+func TestInfluxDBv2Sink_BadWriteMode(t *testing.T) {
+	setMemoryBackend()
+	srv, _ := fakeInfluxDBv2(t, false)
+	config := testInfluxDBv2Config(t, srv)
+	config.InfluxDBv2.WriteMode = "fire-and-forget"
+	if err := (&InfluxDBv2Sink{}).Init(t.Context(), "clusterA", config, 0, nil); err == nil {
+		t.Errorf("expected error for unknown write_mode")
+	}
+}
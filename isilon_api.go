@@ -14,6 +14,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -48,6 +49,11 @@ type Cluster struct {
 	maxRetries   int
 	PreserveCase bool
 	badStats     mapset.Set[string]
+	recorder     *papiRecorder // if set, PAPI responses are recorded
+	replayer     *papiReplayer // if set, PAPI responses are replayed instead of requested
+	papiLimiter  *fairLimiter  // if set, limits the PAPI requests in flight across clusters
+	tagConf      ptTags        // extra tags from the config, before placeholders are expanded
+	tags         ptTags        // extra tags for every point from the cluster
 }
 
 // StatResult contains the information returned for a single stat key
@@ -88,6 +94,9 @@ const summaryStatsPath = "/platform/3/statistics/summary/"
 // Summary stats will be persisted as "node.summary.<stat_type>"
 const summaryStatsBasename = "node.summary."
 
+// Summary stats are all on a 5-second collection interval
+const summaryStatsInterval = 5 * time.Second
+
 // Isi stats key error codes
 const (
 	StatErrorNone = iota
@@ -288,14 +297,53 @@ func (c *Cluster) initialize() error {
 	return nil
 }
 
+// clone returns an unconnected copy of the cluster's connection settings,
+// for use by a goroutine other than the one that owns the cluster
+func (c *Cluster) clone() *Cluster {
+	return &Cluster{
+		AuthInfo:     c.AuthInfo,
+		AuthType:     c.AuthType,
+		Hostname:     c.Hostname,
+		Port:         c.Port,
+		VerifySSL:    c.VerifySSL,
+		ClusterName:  c.ClusterName,
+		maxRetries:   c.maxRetries,
+		PreserveCase: c.PreserveCase,
+		recorder:     c.recorder,
+		replayer:     c.replayer,
+		papiLimiter:  c.papiLimiter,
+		tagConf:      c.tagConf,
+		tags:         c.tags,
+	}
+}
+
 // String returns the string representation of Cluster as the cluster name
 func (c *Cluster) String() string {
 	return c.ClusterName
 }
 
+// metricsLabel returns the cluster label for self-metrics. The hostname is
+// used until the cluster name has been retrieved during Connect.
+func (c *Cluster) metricsLabel() string {
+	if c.ClusterName != "" {
+		return c.ClusterName
+	}
+	return c.Hostname
+}
+
 // Authenticate authenticates to the cluster using the session API endpoint
 // and saves the cookies needed to authenticate subsequent requests
 func (c *Cluster) Authenticate(ctx context.Context) error {
+	err := c.authenticate(ctx)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	papiAuthentications.WithLabelValues(c.metricsLabel(), result).Inc()
+	return err
+}
+
+func (c *Cluster) authenticate(ctx context.Context) error {
 	var err error
 	var resp *http.Response
 
@@ -328,7 +376,7 @@ func (c *Cluster) Authenticate(ctx context.Context) error {
 		}
 		req.Header.Set("User-Agent", userAgent)
 		req.Header.Set("Content-Type", "application/json")
-		resp, err = c.client.Do(req)
+		resp, err = c.papiDo(req)
 		if err == nil {
 			break
 		}
@@ -429,6 +477,7 @@ func (c *Cluster) GetClusterConfig(ctx context.Context) error {
 	} else {
 		c.ClusterName = strings.ToLower(name)
 	}
+	c.tags = expandTags(c.tagConf, c)
 	return nil
 }
 
@@ -438,7 +487,7 @@ func (c *Cluster) Connect(ctx context.Context) error {
 	if err := c.initialize(); err != nil {
 		return fmt.Errorf("initialize: %w", err)
 	}
-	if c.AuthType == authtypeSession {
+	if c.AuthType == authtypeSession && c.replayer == nil {
 		if err := c.Authenticate(ctx); err != nil {
 			return fmt.Errorf("authenticate: %w", err)
 		}
@@ -616,36 +665,79 @@ func parseStatResult(res []byte) ([]StatResult, error) {
 	return nil, errmsg
 }
 
-// fetchStatDetails gathers and returns the API-provided metadata for the given set of stats
-func (c *Cluster) fetchStatDetails(ctx context.Context, sg map[string]statGroup) map[string]statDetail {
-	badStat := statDetail{valid: false}
+// fetchStatDetails gathers and returns the API-provided metadata for the given set of stats.
+// The metadata comes from the bulk stat keys listing, which is cached on disk
+// per OneFS release if the stat cache is enabled. Only stats missing from the
+// listing are looked up individually, and the results of those lookups are
+// added to the cache.
+func (c *Cluster) fetchStatDetails(ctx context.Context, sg map[string]statGroup, sc statCacheConfig) map[string]statDetail {
+	cache := newStatKeyCache(sc)
+	md := c.statKeyMetadata(ctx, cache)
+	known := make(map[string]statKeyInfo)
+	invalid := make(map[string]bool)
+	if md != nil {
+		known = indexStatKeys(md.Keys)
+		for _, stat := range md.Invalid {
+			invalid[stat] = true
+		}
+	}
 
+	var found []statKeyInfo
+	var missing []string
 	statInfo := make(map[string]statDetail)
 	for group := range sg {
 		stats := sg[group].stats
 		for _, stat := range stats {
-			path := statInfoPath + stat
-			resp, err := c.restGet(ctx, path)
-			if err != nil {
-				if !errors.Is(err, context.Canceled) {
-					log.Warn("failed to retrieve information for stat - removing", slog.String("cluster", c.String()), slog.String("stat", stat), slog.String("error", err.Error()))
-				}
-				statInfo[stat] = badStat
+			if k, ok := known[stat]; ok {
+				statInfo[stat] = k.detail()
 				continue
 			}
-			// parse stat info
-			detail, err := parseStatInfo(resp)
-			if err != nil {
-				log.Warn("failed to parse detailed information for stat - removing", slog.String("cluster", c.String()), slog.String("stat", stat), slog.String("error", err.Error()))
-				statInfo[stat] = badStat
+			if invalid[stat] {
+				log.Debug("stat is cached as unavailable - removing", slog.String("cluster", c.String()), slog.String("stat", stat))
+				statInfo[stat] = statDetail{valid: false}
 				continue
 			}
-			statInfo[stat] = *detail
+			detail, notFound := c.fetchStatDetail(ctx, stat)
+			statInfo[stat] = detail
+			if detail.valid {
+				found = append(found, detail.keyInfo(stat))
+			} else if notFound {
+				missing = append(missing, stat)
+			}
+		}
+	}
+	if cache != nil && md != nil && (len(found) > 0 || len(missing) > 0) {
+		if err := cache.update(c.OSVersion, found, missing); err != nil {
+			log.Warn("unable to update stat key cache", slog.String("cluster", c.String()), slog.String("error", err.Error()))
 		}
 	}
 	return statInfo
 }
 
+// fetchStatDetail retrieves the metadata for a single stat from the
+// statistics detail endpoint. notFound is true if the cluster reported that
+// the stat does not exist, as opposed to the lookup failing.
+func (c *Cluster) fetchStatDetail(ctx context.Context, stat string) (detail statDetail, notFound bool) {
+	badStat := statDetail{valid: false}
+
+	path := statInfoPath + stat
+	resp, err := c.restGet(ctx, path)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Warn("failed to retrieve information for stat - removing", slog.String("cluster", c.String()), slog.String("stat", stat), slog.String("error", err.Error()))
+		}
+		var se *httpStatusError
+		return badStat, errors.As(err, &se) && se.code == http.StatusNotFound
+	}
+	// parse stat info
+	d, err := parseStatInfo(resp)
+	if err != nil {
+		log.Warn("failed to parse detailed information for stat - removing", slog.String("cluster", c.String()), slog.String("stat", stat), slog.String("error", err.Error()))
+		return badStat, false
+	}
+	return *d, false
+}
+
 // parseStatInfo parses the OneFS API statistics metric metadata returned
 // from the statistics detail endpoint
 func parseStatInfo(res []byte) (*statDetail, error) {
@@ -760,11 +852,44 @@ func isConnectionRefused(err error) bool {
 
 // restGet returns the REST response for the given endpoint from the API
 func (c *Cluster) restGet(ctx context.Context, endpoint string) ([]byte, error) {
+	start := time.Now()
+	var body []byte
+	var err error
+	if c.replayer != nil {
+		body, err = c.replayer.get(ctx, c, endpoint)
+	} else {
+		body, err = c.doRestGet(ctx, endpoint)
+		if c.recorder != nil && !errors.Is(err, context.Canceled) {
+			c.recorder.record(endpoint, start, body, err, c.Password, c.csrfToken)
+		}
+	}
+	label := c.metricsLabel()
+	papiRequests.WithLabelValues(label).Inc()
+	papiRequestDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, context.Canceled) {
+		papiRequestErrors.WithLabelValues(label).Inc()
+	}
+	return body, err
+}
+
+// httpStatusError is returned when the API responds with an unexpected HTTP status
+type httpStatusError struct {
+	cluster string
+	status  string
+	code    int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("cluster %s returned unexpected HTTP response: %v", e.cluster, e.status)
+}
+
+func (c *Cluster) doRestGet(ctx context.Context, endpoint string) ([]byte, error) {
 	var err error
 	var resp *http.Response
 
 	if c.AuthType == authtypeSession && time.Now().After(c.reauthTime) {
 		log.Info("re-authenticating to cluster based on timer", slog.String("cluster", c.String()))
+		papiReauthentications.WithLabelValues(c.metricsLabel(), "timer").Inc()
 		if err = c.Authenticate(ctx); err != nil {
 			return nil, err
 		}
@@ -781,7 +906,7 @@ func (c *Cluster) restGet(ctx context.Context, endpoint string) ([]byte, error)
 
 	retrySecs := 1
 	for i := 1; i <= c.maxRetries; i++ {
-		resp, err = c.client.Do(req)
+		resp, err = c.papiDo(req)
 		if err == nil {
 			// We got a valid http response
 			if resp.StatusCode == http.StatusOK {
@@ -795,6 +920,7 @@ func (c *Cluster) restGet(ctx context.Context, endpoint string) ([]byte, error)
 					return nil, fmt.Errorf("basic authentication for cluster %s failed - check username and password", c)
 				}
 				log.Log(ctx, LevelNotice, "Session-based authentication failed, attempting to re-authenticate", slog.String("cluster", c.String()))
+				papiReauthentications.WithLabelValues(c.metricsLabel(), "unauthorized").Inc()
 				if err = c.Authenticate(ctx); err != nil {
 					return nil, err
 				}
@@ -804,7 +930,7 @@ func (c *Cluster) restGet(ctx context.Context, endpoint string) ([]byte, error)
 				}
 				continue
 			}
-			return nil, fmt.Errorf("cluster %s returned unexpected HTTP response: %v", c, resp.Status)
+			return nil, &httpStatusError{cluster: c.String(), status: resp.Status, code: resp.StatusCode}
 		}
 		// assert err != nil
 		// TODO - consider adding more retryable cases e.g. temporary DNS hiccup
@@ -827,12 +953,40 @@ func (c *Cluster) restGet(ctx context.Context, endpoint string) ([]byte, error)
 	}
 	defer resp.Body.Close() //nolint:errcheck
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("cluster %s returned unexpected HTTP response: %v", c, resp.Status)
+		return nil, &httpStatusError{cluster: c.String(), status: resp.Status, code: resp.StatusCode}
 	}
 	body, err := io.ReadAll(resp.Body)
 	return body, err
 }
 
+// papiDo sends a request to the cluster. It holds a slot from the PAPI
+// limiter until the response body is closed, but not while the caller backs
+// off between attempts, so an unreachable cluster cannot starve the others.
+func (c *Cluster) papiDo(req *http.Request) (*http.Response, error) {
+	release, err := c.papiLimiter.acquire(req.Context(), c.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, release: sync.OnceFunc(release)}
+	return resp, nil
+}
+
+// limitedBody releases the limiter slot of a response when it is closed
+type limitedBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *limitedBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
 // newGetRequest creates a new HTTP GET request with the appropriate headers
 // and authentication information
 func (c *Cluster) newGetRequest(ctx context.Context, url string) (*http.Request, error) {
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Influx line protocol encoding shared by the back ends that emit it directly
+// (i.e., without going through a vendor client library).
+//
+// Each Point expands to one line per field/tag set:
+//
+//	<measurement>,<tag>=<value>,... <field>=<value>,... <timestamp>
+//
+// Tags and fields are sorted by key so that the output is deterministic.
+
+var (
+	lpMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	lpKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	lpStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// appendLineProtocol appends the line protocol representation of the given
+// Point to buf. Field/tag sets with no usable fields are skipped.
+func appendLineProtocol(buf *bytes.Buffer, point Point) error {
+	for i, fields := range point.fields {
+		if len(fields) == 0 {
+			continue
+		}
+		var tags ptTags
+		if i < len(point.tags) {
+			tags = point.tags[i]
+		}
+		if err := appendLine(buf, point.name, tags, fields, point.time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendLine appends a single line protocol entry to buf
+func appendLine(buf *bytes.Buffer, name string, tags ptTags, fields ptFields, ts int64) error {
+	// encode the fields first into a scratch buffer so that an unsupported
+	// field type does not leave a partial line in buf
+	var fb bytes.Buffer
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		if fb.Len() > 0 {
+			fb.WriteByte(',')
+		}
+		fb.WriteString(lpKeyEscaper.Replace(k))
+		fb.WriteByte('=')
+		if err := appendLineProtocolValue(&fb, fields[k]); err != nil {
+			return fmt.Errorf("measurement %q field %q: %w", name, k, err)
+		}
+	}
+	buf.WriteString(lpMeasurementEscaper.Replace(name))
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		v := tags[k]
+		// empty tag values are not permitted by the protocol
+		if v == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(lpKeyEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(lpKeyEscaper.Replace(v))
+	}
+	buf.WriteByte(' ')
+	buf.Write(fb.Bytes())
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(ts, 10))
+	buf.WriteByte('\n')
+	return nil
+}
+
+// appendLineProtocolValue appends a line protocol encoded field value to buf
+func appendLineProtocolValue(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case float64:
+		buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	case float32:
+		buf.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 32))
+	case int:
+		buf.WriteString(strconv.Itoa(v))
+		buf.WriteByte('i')
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+		buf.WriteByte('i')
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case string:
+		buf.WriteByte('"')
+		buf.WriteString(lpStringEscaper.Replace(v))
+		buf.WriteByte('"')
+	default:
+		return fmt.Errorf("unsupported field value type %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Line protocol write APIs
+const (
+	lineProtocolAPIv1 = "v1" // InfluxDB 1.x /write, also VictoriaMetrics and QuestDB
+	lineProtocolAPIv2 = "v2" // InfluxDB 2.x /api/v2/write
+	lineProtocolAPIv3 = "v3" // InfluxDB 3 /api/v3/write_lp
+)
+
+const defaultLineProtocolTimeout = 30
+
+// LineProtocolSink writes points as Influx line protocol over plain HTTP,
+// without a vendor client library
+type LineProtocolSink struct {
+	cluster      string
+	client       *http.Client
+	writeURL     string
+	authHeader   string
+	authValue    string
+	gzip         bool
+	maxBatchSize int
+}
+
+// GetLineProtocolWriter returns a line protocol over HTTP DBWriter
+func GetLineProtocolWriter() DBWriter {
+	return &LineProtocolSink{}
+}
+
+// lineProtocolWriteURL returns the write endpoint for the configured API
+func lineProtocolWriteURL(lc lineProtocolConfig) (string, error) {
+	if lc.URL == "" {
+		return "", fmt.Errorf("lineprotocol back end url is missing")
+	}
+	u, err := url.Parse(lc.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid lineprotocol back end url: %w", err)
+	}
+	q := u.Query()
+	var path string
+	switch strings.ToLower(lc.API) {
+	case "", lineProtocolAPIv1:
+		path = "/write"
+		q.Set("db", lc.Database)
+		if lc.RetentionPolicy != "" {
+			q.Set("rp", lc.RetentionPolicy)
+		}
+		q.Set("precision", "s")
+	case lineProtocolAPIv2:
+		path = "/api/v2/write"
+		q.Set("org", lc.Org)
+		q.Set("bucket", lc.Bucket)
+		q.Set("precision", "s")
+	case lineProtocolAPIv3:
+		path = "/api/v3/write_lp"
+		q.Set("db", lc.Database)
+		q.Set("precision", "second")
+	default:
+		return "", fmt.Errorf("unknown lineprotocol api %q (expected %q, %q or %q)", lc.API,
+			lineProtocolAPIv1, lineProtocolAPIv2, lineProtocolAPIv3)
+	}
+	if lc.Path != "" {
+		path = lc.Path
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Init initializes a LineProtocolSink so that points can be written
+func (s *LineProtocolSink) Init(_ context.Context, cluster string, config *tomlConfig, _ int, _ map[string]statDetail) error {
+	s.cluster = cluster
+	lc := config.LineProtocol
+	var err error
+	s.writeURL, err = lineProtocolWriteURL(lc)
+	if err != nil {
+		return err
+	}
+	if lc.AuthValue != "" {
+		s.authValue, err = secretFromEnv(lc.AuthValue)
+		if err != nil {
+			return fmt.Errorf("unable to retrieve lineprotocol auth_value from environment: %w", err)
+		}
+		s.authHeader = lc.AuthHeader
+		if s.authHeader == "" {
+			s.authHeader = "Authorization"
+		}
+	}
+	timeout := lc.Timeout
+	if timeout <= 0 {
+		timeout = defaultLineProtocolTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if lc.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	}
+	s.client = &http.Client{Transport: transport, Timeout: time.Duration(timeout) * time.Second}
+	s.gzip = lc.Gzip
+	s.maxBatchSize = lc.MaxBatchSize
+	log.Info("lineprotocol back end initialized", slog.String("cluster", cluster), slog.String("api", lc.API),
+		slog.String("url", lc.URL))
+	return nil
+}
+
+// WritePoints encodes the points as line protocol and posts them to the
+// server. If max_batch_size is set, the lines are split across multiple requests.
+func (s *LineProtocolSink) WritePoints(ctx context.Context, points []Point) error {
+	var buf bytes.Buffer
+	for _, point := range points {
+		if err := appendLineProtocol(&buf, point); err != nil {
+			log.Warn("failed to encode point", slog.String("measurement", point.name), slog.String("error", err.Error()))
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	for _, chunk := range splitLines(buf.Bytes(), s.maxBatchSize) {
+		if err := s.post(ctx, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitLines splits newline-terminated line protocol into chunks of at most
+// n lines. An n of zero or less returns a single chunk.
+func splitLines(b []byte, n int) [][]byte {
+	if n <= 0 {
+		return [][]byte{b}
+	}
+	var chunks [][]byte
+	for len(b) > 0 {
+		end, lines := 0, 0
+		for lines < n && end < len(b) {
+			i := bytes.IndexByte(b[end:], '\n')
+			if i < 0 {
+				end = len(b)
+				break
+			}
+			end += i + 1
+			lines++
+		}
+		chunks = append(chunks, b[:end])
+		b = b[end:]
+	}
+	return chunks
+}
+
+// post sends a single write request
+func (s *LineProtocolSink) post(ctx context.Context, body []byte) error {
+	if s.gzip {
+		var zbuf bytes.Buffer
+		zw := gzip.NewWriter(&zbuf)
+		if _, err := zw.Write(body); err != nil {
+			return fmt.Errorf("failed to compress points: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress points: %w", err)
+		}
+		body = zbuf.Bytes()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create write request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.authValue != "" {
+		req.Header.Set(s.authHeader, s.authValue)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("lineprotocol write failed: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("lineprotocol write failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// Close releases idle connections
+func (s *LineProtocolSink) Close() error {
+	if s.client != nil {
+		s.client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLineProtocolWriteURL(t *testing.T) {
+	tests := []struct {
+		lc   lineProtocolConfig
+		want string
+	}{
+		{lineProtocolConfig{URL: "http://influx:8086", Database: "stats"},
+			"http://influx:8086/write?db=stats&precision=s"},
+		{lineProtocolConfig{URL: "http://influx:8086/", API: "v1", Database: "stats", RetentionPolicy: "week"},
+			"http://influx:8086/write?db=stats&precision=s&rp=week"},
+		{lineProtocolConfig{URL: "https://influx:8086", API: "v2", Org: "my org", Bucket: "stats"},
+			"https://influx:8086/api/v2/write?bucket=stats&org=my+org&precision=s"},
+		{lineProtocolConfig{URL: "http://influx:8181", API: "v3", Database: "stats"},
+			"http://influx:8181/api/v3/write_lp?db=stats&precision=second"},
+		{lineProtocolConfig{URL: "http://vm:8428/insert", Path: "/influx/write", Database: "stats"},
+			"http://vm:8428/insert/influx/write?db=stats&precision=s"},
+	}
+	for _, tt := range tests {
+		got, err := lineProtocolWriteURL(tt.lc)
+		if err != nil {
+			t.Errorf("unexpected error for %+v: %v", tt.lc, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, got)
+		}
+	}
+	for _, lc := range []lineProtocolConfig{{}, {URL: "http://influx:8086", API: "v4"}} {
+		if _, err := lineProtocolWriteURL(lc); err == nil {
+			t.Errorf("expected error for %+v", lc)
+		}
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	b := []byte("a\nb\nc\nd\ne\n")
+	if got := splitLines(b, 0); len(got) != 1 || string(got[0]) != string(b) {
+		t.Errorf("expected a single chunk, got %q", got)
+	}
+	got := splitLines(b, 2)
+	if len(got) != 3 || string(got[0]) != "a\nb\n" || string(got[1]) != "c\nd\n" || string(got[2]) != "e\n" {
+		t.Errorf("unexpected chunks %q", got)
+	}
+}
+
+func TestLineProtocolSink_Write(t *testing.T) {
+	setMemoryBackend()
+	var mu sync.Mutex
+	var bodies []string
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" {
+			http.NotFound(w, r)
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		b, _ := io.ReadAll(body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		auth = r.Header.Get("Authorization")
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	t.Setenv("LP_TOKEN", "secret")
+	config := &tomlConfig{LineProtocol: lineProtocolConfig{
+		URL: srv.URL, API: "v2", Org: "org", Bucket: "bucket",
+		AuthValue: "$env:LP_TOKEN", Gzip: true, MaxBatchSize: 2,
+	}}
+	s := &LineProtocolSink{}
+	if err := s.Init(t.Context(), "clusterA", config, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close() //nolint:errcheck
+	points := []Point{{
+		name:   "node.ifs.bytes",
+		time:   1700000000,
+		fields: []ptFields{{"value": 1.0}, {"value": 2.0}, {"value": 3.0}},
+		tags:   []ptTags{{"node": "1"}, {"node": "2"}, {"node": "3"}},
+	}}
+	if err := s.WritePoints(t.Context(), points); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 requests with max_batch_size 2, got %d", len(bodies))
+	}
+	if !strings.HasPrefix(bodies[0], "node.ifs.bytes,node=1 value=1 1700000000\n") {
+		t.Errorf("unexpected body %q", bodies[0])
+	}
+	if auth != "secret" {
+		t.Errorf("expected auth header to be resolved from the environment, got %q", auth)
+	}
+}
+
+func TestLineProtocolSink_WriteError(t *testing.T) {
+	setMemoryBackend()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "database not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	s := &LineProtocolSink{}
+	if err := s.Init(t.Context(), "clusterA", &tomlConfig{LineProtocol: lineProtocolConfig{URL: srv.URL, Database: "nope"}}, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := s.WritePoints(t.Context(), []Point{{name: "m", time: 1, fields: []ptFields{{"v": 1}}, tags: []ptTags{{}}}})
+	if err == nil || !strings.Contains(err.Error(), "database not found") {
+		t.Errorf("expected error including server message, got %v", err)
+	}
+}
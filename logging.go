@@ -24,6 +24,10 @@ const (
 // Default logger
 var log *slog.Logger
 
+// runtimeLogLevel is the level of the handlers created by setupLogging. It may
+// be changed at runtime via the admin API and is reset on config reload.
+var runtimeLogLevel slog.LevelVar
+
 // ParseLevel converts a string to a slog.Level.
 // It handles standard levels and is case-insensitive.
 // If the string does not match a known level, it returns an error.
@@ -51,7 +55,29 @@ func ParseLevel(levelStr string) (slog.Level, error) {
 	return level, err
 }
 
-func loggingOptions(level slog.Level) *slog.HandlerOptions {
+// levelName returns the name of the level, including custom level values
+func levelName(level slog.Level) string {
+	switch {
+	case level < LevelDebug:
+		return "TRACE"
+	case level < LevelInfo:
+		return "DEBUG"
+	case level < LevelNotice:
+		return "INFO"
+	case level < LevelWarning:
+		return "NOTICE"
+	case level < LevelError:
+		return "WARN"
+	case level < LevelCritical:
+		return "ERROR"
+	case level < LevelFatal:
+		return "CRITICAL"
+	default:
+		return "FATAL"
+	}
+}
+
+func loggingOptions(level slog.Leveler) *slog.HandlerOptions {
 	return &slog.HandlerOptions{
 		Level:     level,
 		AddSource: true,
@@ -65,28 +91,7 @@ func loggingOptions(level slog.Level) *slog.HandlerOptions {
 					return a
 				}
 
-				// This could also look up the name from a map or other structure, but
-				// this demonstrates using a switch statement to rename levels. For
-				// maximum performance, the string values should be constants, but this
-				// example uses the raw strings for readability.
-				switch {
-				case level < LevelDebug:
-					a.Value = slog.StringValue("TRACE")
-				case level < LevelInfo:
-					a.Value = slog.StringValue("DEBUG")
-				case level < LevelNotice:
-					a.Value = slog.StringValue("INFO")
-				case level < LevelWarning:
-					a.Value = slog.StringValue("NOTICE")
-				case level < LevelError:
-					a.Value = slog.StringValue("WARN")
-				case level < LevelCritical:
-					a.Value = slog.StringValue("ERROR")
-				case level < LevelFatal:
-					a.Value = slog.StringValue("CRITICAL")
-				default:
-					a.Value = slog.StringValue("FATAL")
-				}
+				a.Value = slog.StringValue(levelName(level))
 			}
 
 			return a
@@ -124,7 +129,8 @@ func setupLogging(lc loggingConfig, logLevel string, logFileName string) {
 
 	// Up to two backends (one file, one stdout)
 	backends := make([]slog.Handler, 0, 2)
-	options := loggingOptions(level)
+	runtimeLogLevel.Set(level)
+	options := loggingOptions(&runtimeLogLevel)
 
 	// Up to two backends (one file, one stdout)
 	// default is to not log to file
@@ -169,3 +175,15 @@ func setupLogging(lc loggingConfig, logLevel string, logFileName string) {
 	}
 	log = slog.New(slogmulti.Fanout(backends...))
 }
+
+// setupCommandLogging initializes logging to stderr for subcommands, which
+// keep stdout for their own output
+func setupCommandLogging(logLevel string) error {
+	level, err := ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	runtimeLogLevel.Set(level)
+	log = slog.New(slog.NewTextHandler(os.Stderr, loggingOptions(&runtimeLogLevel)))
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,10 +29,12 @@ const defaultAuthType = authtypeSession
 
 // Config file plugin names
 const (
-	discardPluginName  = "discard"
-	influxPluginName   = "influxdb"
-	influxV2PluginName = "influxdbv2"
-	promPluginName     = "prometheus"
+	discardPluginName      = "discard"
+	filePluginName         = "file"
+	influxPluginName       = "influxdb"
+	influxV2PluginName     = "influxdbv2"
+	lineProtocolPluginName = "lineprotocol"
+	promPluginName         = "prometheus"
 )
 
 // parsed/populated stat structures
@@ -50,6 +53,15 @@ var checkStatReturn = flag.Bool("check-stat-return",
 	false,
 	"Verify that the api returns results for every stat requested")
 
+// subcommands maps the names of the subcommands to their implementations,
+// which return the process exit status
+var subcommands = map[string]func(args []string) int{
+	"discover":     runDiscover,
+	"stat-cache":   runStatCache,
+	"check-config": runCheckConfig,
+	"simulate":     runSimulate,
+}
+
 func die(msg string, args ...any) {
 	log.Log(context.Background(), LevelFatal, msg, args...)
 	os.Exit(1)
@@ -57,10 +69,18 @@ func die(msg string, args ...any) {
 
 func main() {
 	setupEarlyLogging()
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
 	logFileName := flag.String("logfile", "", "pathname of log file")
 	configFileName := flag.String("config-file", "idic.toml", "pathname of config file")
 	versionFlag := flag.Bool("version", false, "Print application version")
 	logLevel := flag.String("loglevel", "", "log level [CRITICAL|ERROR|WARNING|NOTICE|INFO|DEBUG|TRACE]")
+	onceFlag := flag.Bool("once", false, "collect all stats once, output them and exit (logs go to stderr)")
+	onceCluster := flag.String("cluster", "", "with -once, hostname of the configured cluster to collect from (default all enabled clusters)")
+	onceOutput := flag.String("output", onceOutputTable, "with -once, where to send the points [table|json|backend]")
 	// parse command line
 	flag.Parse()
 
@@ -73,6 +93,21 @@ func main() {
 	// read in our config (fatal on error at startup)
 	conf := mustReadConfig(*configFileName)
 
+	if *onceFlag {
+		level := *logLevel
+		if level == "" {
+			level = "WARNING"
+		}
+		if err := setupCommandLogging(level); err != nil {
+			fmt.Fprintf(os.Stderr, "gostats: %v\n", err)
+			os.Exit(2)
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		status := runOnce(ctx, &conf, onceOptions{cluster: *onceCluster, output: *onceOutput}, os.Stdout)
+		cancel()
+		os.Exit(status)
+	}
+
 	// set up logging
 	setupLogging(conf.Logging, *logLevel, *logFileName)
 
@@ -127,6 +162,12 @@ func main() {
 		log.Warn("Config file watching not available", slog.String("error", err.Error()))
 	}
 
+	if conf.Admin.ListenAddr != "" {
+		if err := startAdminListener(ctx, conf.Admin, reload); err != nil {
+			log.Error("Failed to start admin API listener", slog.String("error", err.Error()))
+		}
+	}
+
 outer:
 	for {
 		// Ensure the config contains at least one stat to poll
@@ -144,12 +185,26 @@ outer:
 		runCtx, cancelRun := context.WithCancel(ctx)
 
 		// ugly, but we have to do this here since it's global, not a per-cluster
-		if conf.Global.Processor == promPluginName && conf.PromSD.Enabled {
+		if usesBackendType(&conf, promPluginName) && conf.PromSD.Enabled {
 			if err := startPromSdListener(runCtx, conf); err != nil {
 				log.Error("Failed to start Prometheus SD listener", slog.String("error", err.Error()))
 			}
 		}
 
+		if conf.SelfMetrics.ListenAddr != "" {
+			if err := startSelfMetricsListener(runCtx, conf.SelfMetrics); err != nil {
+				log.Error("Failed to start self-metrics listener", slog.String("error", err.Error()))
+			}
+		}
+
+		var enabled []string
+		for _, cl := range conf.Clusters {
+			if !cl.Disabled {
+				enabled = append(enabled, cl.Hostname)
+			}
+		}
+		health.reset(enabled, conf.Admin.UnhealthyAfter)
+
 		// start collecting from each defined and enabled cluster
 		var wg sync.WaitGroup
 		for ci, cl := range conf.Clusters {
@@ -184,11 +239,13 @@ outer:
 			if err != nil {
 				log.Error("Config reload failed, continuing with existing config",
 					slog.String("error", err.Error()))
+				configReloads.WithLabelValues("failure").Inc()
 				// conf is unchanged; the loop restarts with the existing config
 			} else {
 				conf = newConf
 				setupLogging(conf.Logging, *logLevel, *logFileName)
 				log.Log(ctx, LevelNotice, "Config reloaded successfully")
+				configReloads.WithLabelValues("success").Inc()
 			}
 			continue
 		case <-done:
@@ -300,18 +357,8 @@ type statTimeSet struct {
 	groupName string // non-empty when fetch_by_statgroup is enabled
 }
 
-// statsloop is the main collection loop for a single cluster
-// it connects to the cluster, determines the stats to collect and their
-// collection intervals, and then enters a loop collecting and writing
-// stats to the backend database
-func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]statGroup) {
-	var err error
-	var password string
-	var ss DBWriter // ss = stats sink
-
-	cc := config.Clusters[ci]
-	gc := config.Global
-
+// newCluster returns the (unconnected) API client for a configured cluster
+func newCluster(cc clusterConf, gc globalConfig) (*Cluster, error) {
 	var preserveCase bool
 
 	if cc.PreserveCase == nil { // check for cluster overwrite setting of PreserveCase, default and to global setting
@@ -320,7 +367,6 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]st
 		preserveCase = *cc.PreserveCase
 	}
 
-	// Connect to the cluster
 	authtype := cc.AuthType
 	if authtype == "" {
 		log.Info("No authentication type defined, using default", slog.String("default", authtypeSession), slog.String("cluster", cc.Hostname))
@@ -331,15 +377,17 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]st
 		authtype = defaultAuthType
 	}
 	if cc.Username == "" || cc.Password == "" {
-		log.Error("Username and password must not be null", slog.String("cluster", cc.Hostname))
-		return
+		return nil, errors.New("username and password must not be null")
 	}
-	password, err = secretFromEnv(cc.Password)
+	password, err := secretFromEnv(cc.Password)
 	if err != nil {
-		log.Error("Unable to retrieve password from environment", slog.String("cluster", cc.Hostname), slog.String("error", err.Error()))
-		return
+		return nil, fmt.Errorf("unable to retrieve password from environment: %w", err)
+	}
+	tags, err := clusterTags(cc, gc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve cluster tags: %w", err)
 	}
-	c := &Cluster{
+	return &Cluster{
 		AuthInfo: AuthInfo{
 			Username: cc.Username,
 			Password: password,
@@ -350,7 +398,42 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]st
 		VerifySSL:    cc.SSLCheck,
 		maxRetries:   gc.MaxRetries,
 		PreserveCase: preserveCase,
+		tagConf:      tags,
+	}, nil
+}
+
+// statsloop is the main collection loop for a single cluster
+// it connects to the cluster, determines the stats to collect and their
+// collection intervals, and then enters a loop collecting and writing
+// stats to the backend database
+func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]statGroup) {
+	var err error
+	var ss DBWriter // ss = stats sink
+	var rp retryPolicy
+
+	cc := config.Clusters[ci]
+	gc := config.Global
+
+	// a collection loop that exits other than on shutdown or reload is unhealthy
+	parentCtx := ctx
+	defer func() {
+		if parentCtx.Err() == nil {
+			health.stopped(cc.Hostname)
+		}
+	}()
+
+	// Connect to the cluster
+	c, err := newCluster(cc, gc)
+	if err != nil {
+		log.Error("Unable to configure cluster", slog.String("cluster", cc.Hostname), slog.String("error", err.Error()))
+		return
+	}
+	if err = c.setupRecording(config.PapiRecording); err != nil {
+		log.Error("Unable to set up PAPI recording", slog.String("cluster", cc.Hostname), slog.String("error", err.Error()))
+		return
 	}
+	c.setupConcurrency(config.Concurrency)
+	health.setState(cc.Hostname, clusterStateConnecting)
 	if err = c.Connect(ctx); err != nil {
 		if !errors.Is(err, context.Canceled) {
 			log.Error("Connection failed", slog.String("cluster", c.Hostname), slog.String("error", err.Error()))
@@ -360,7 +443,8 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]st
 	log.Info("Connected", slog.String("cluster", c.ClusterName), slog.String("version", c.OSVersion))
 
 	log.Info("Fetching stat information", slog.String("cluster", c.ClusterName), slog.String("version", c.OSVersion))
-	sd := c.fetchStatDetails(ctx, sg)
+	health.setState(cc.Hostname, clusterStateFetching)
+	sd := c.fetchStatDetails(ctx, sg, config.StatCache)
 
 	// divide stats into buckets based on update interval
 	log.Info("Calculating stat refresh times", slog.String("cluster", c.ClusterName))
@@ -371,74 +455,139 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]st
 	}
 
 	// initialize minHeap/pq with our time-based buckets
-	startTime := time.Now()
 	pq := make(PriorityQueue, len(statBuckets))
 	for i := range statBuckets {
-		value := PqValue{StatTypeRegularStat, &statBuckets[i]}
 		pq[i] = &Item{
-			value:    value, // statTimeSet
-			priority: startTime,
-			index:    i,
+			value: PqValue{StatTypeRegularStat, &statBuckets[i]}, // statTimeSet
+			index: i,
 		}
 	}
-	i := len(pq)
 	// add entries for summary stats
-	if config.SummaryStats.Protocol {
-		item := Item{
-			value:    PqValue{StatTypeSummaryStatProtocol, nil},
-			priority: startTime,
-			index:    i,
+	for _, s := range []struct {
+		enabled bool
+		st      StatType
+	}{
+		{config.SummaryStats.Protocol, StatTypeSummaryStatProtocol},
+		{config.SummaryStats.Client, StatTypeSummaryStatClient},
+		{config.SummaryStats.Drive, StatTypeSummaryStatDrive},
+		{config.SelfMetrics.Push, StatTypeSelfMetrics},
+	} {
+		if s.enabled {
+			pq = append(pq, &Item{value: PqValue{s.st, nil}, index: len(pq)})
 		}
-		pq = append(pq, &item)
-		i++
 	}
-	if config.SummaryStats.Client {
-		item := Item{
-			value:    PqValue{StatTypeSummaryStatClient, nil},
-			priority: startTime,
-			index:    i,
+	selfMetricsInterval := time.Duration(config.SelfMetrics.PushInterval) * time.Second
+	if selfMetricsInterval <= 0 {
+		selfMetricsInterval = defaultSelfMetricsPushInterval * time.Second
+	}
+	adapt := newAdaptiveIntervals(c.ClusterName, config.Adaptive)
+	derived, err := newDerivedMetrics(c.ClusterName, config.Derived)
+	if err != nil {
+		log.Error("invalid derived metrics", slog.String("cluster", c.ClusterName), slog.String("error", err.Error()))
+		return
+	}
+	relabel, err := newCollectRelabeler(c.ClusterName, config)
+	if err != nil {
+		log.Error("invalid relabel rules", slog.String("cluster", c.ClusterName), slog.String("error", err.Error()))
+		return
+	}
+	intervalOf := func(item *Item) time.Duration {
+		switch item.value.stattype {
+		case StatTypeRegularStat:
+			return adapt.interval(item)
+		case StatTypeSelfMetrics:
+			return selfMetricsInterval
 		}
-		pq = append(pq, &item)
-		i++
+		return summaryStatsInterval
 	}
-	if config.SummaryStats.Drive {
-		item := Item{
-			value:    PqValue{StatTypeSummaryStatDrive, nil},
-			priority: startTime,
-			index:    i,
+	// schedule the first collections, with self metrics first pushed after one interval
+	startTime := time.Now()
+	sched := newCollectionScheduler(cc.Hostname, c.ClusterName, config.Scheduler)
+	for _, item := range pq {
+		base := startTime
+		if item.value.stattype == StatTypeSelfMetrics {
+			base = startTime.Add(selfMetricsInterval)
 		}
-		pq = append(pq, &item)
+		sched.start(item, base, intervalOf(item))
 	}
 	heap.Init(&pq)
 
-	// Configure/initialize backend database writer
-	ss, err = getDBWriter(gc.Processor)
+	// Configure/initialize backend database writer(s)
+	health.setState(cc.Hostname, clusterStateInitBackend)
+	backendNames := clusterBackends(config, ci)
+	backends := strings.Join(backendNames, ",")
+	ss, rp, err = newDBWriter(config, c.ClusterName, backendNames)
 	if err != nil {
-		log.Error("failed to obtain backend", slog.String("backend", gc.Processor), slog.String("error", err.Error()))
+		log.Error("failed to obtain backend", slog.String("backend", backends), slog.String("error", err.Error()))
 		return
 	}
 	err = ss.Init(ctx, c.ClusterName, config, ci, sd)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
-			log.Error("Unable to initialize backend", slog.String("backend", gc.Processor), slog.String("error", err.Error()))
+			log.Error("Unable to initialize backend", slog.String("backend", backends), slog.String("error", err.Error()))
 		}
 		return
 	}
+	defer closeDBWriter(c.ClusterName, ss)
+
+	// Writes happen asynchronously in a separate goroutine so that back end
+	// latency does not delay collection. The writer has its own context, so
+	// that once collection stops the batches still queued are written, for up
+	// to writeQueueDrainTimeout; collection is stopped via ctx if the writer
+	// fails.
+	writeCtx, stopWrites := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopWrites()
+	ctx, stopCollection := context.WithCancel(ctx)
+	defer stopCollection()
+	wq := newWriteQueue(c.ClusterName, gc.WriteQueueSize, gc.WriteQueuePolicy)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		if err := wq.run(writeCtx, ss, rp); err != nil {
+			log.Error("unable to write stats to database, stopping collection", slog.String("cluster", c.ClusterName), slog.String("error", err.Error()))
+			health.setError(cc.Hostname, clusterStateWriteFailed, err)
+			stopCollection()
+		}
+	}()
+	defer func() {
+		wq.close()
+		drainTimer := time.AfterFunc(writeQueueDrainTimeout, stopWrites)
+		<-writerDone
+		drainTimer.Stop()
+	}()
 
 	// loop collecting and pushing stats
+	ctl := controls.register(cc.Hostname, c.ClusterName)
+	defer controls.unregister(ctl)
+	health.setReady(cc.Hostname, c.ClusterName, shortestInterval(statBuckets, config.SummaryStats))
+	if ctl.paused.Load() {
+		log.Info("collection remains paused after reload", slog.String("cluster", c.ClusterName))
+		health.setState(cc.Hostname, clusterStatePaused)
+	}
 	log.Info("Starting stat collection loop", slog.String("cluster", c.ClusterName))
 	for {
 		nextItem := heap.Pop(&pq).(*Item)
-		curTime := time.Now()
 		nextTime := nextItem.priority
-		if curTime.Before(nextTime) {
-			select {
-			case <-time.After(nextTime.Sub(curTime)):
-			case <-ctx.Done():
-				log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
-				return
-			}
+		// wait for the next collection, handling admin API commands meanwhile
+		timer := time.NewTimer(max(time.Until(nextTime), 0))
+		select {
+		case <-timer.C:
+		case cmd := <-ctl.cmds:
+			timer.Stop()
+			heap.Push(&pq, nextItem)
+			cmd.reply <- c.runCommand(ctx, cmd, gc, &pq, sg, wq, intervalOf, relabel, derived)
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+			log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
+			return
+		}
+		if ctl.paused.Load() {
+			sched.next(nextItem, intervalOf(nextItem), time.Now())
+			heap.Push(&pq, nextItem)
+			continue
 		}
+		collectionLag.WithLabelValues(c.ClusterName).Observe(max(time.Since(nextTime), 0).Seconds())
 		// Collect one set of stats
 		if nextItem.value.sts != nil && nextItem.value.sts.groupName != "" {
 			log.Debug("start stat collection", slog.String("cluster", c.ClusterName), slog.String("group", nextItem.value.sts.groupName))
@@ -451,11 +600,27 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]st
 			readFailCount := 0
 			const maxRetryTime = time.Second * 1280
 			retryTime := time.Second * 10
+			split := false
 			for {
-				sr, err = c.GetStats(ctx, stats)
+				reqCtx, cancelReq := adapt.requestContext(ctx, nextItem)
+				reqStart := time.Now()
+				sr, err = c.GetStats(reqCtx, stats)
+				cancelReq()
+				if adapt.observe(ctx, nextItem, time.Since(reqStart), err) {
+					health.setInterval(cc.Hostname, currentShortestInterval(append(slices.Clone(pq), nextItem), intervalOf))
+				}
 				if err == nil {
 					break
 				}
+				if adapt.shouldSplit(nextItem) {
+					if items := adapt.split(nextItem, sg); items != nil {
+						for _, item := range items {
+							heap.Push(&pq, item)
+						}
+						split = true
+						break
+					}
+				}
 				readFailCount++
 				if !errors.Is(err, context.Canceled) {
 					log.Error("Failed to retrieve stats", slog.String("cluster", c.ClusterName), slog.String("error", err.Error()),
@@ -475,106 +640,55 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]st
 					retryTime *= 2
 				}
 			}
+			if split {
+				// the new buckets are collected at the original bucket's tick
+				continue
+			}
+			health.collected(cc.Hostname)
 			if *checkStatReturn {
 				verifyStatReturn(c.ClusterName, stats, sr)
 			}
-			nextItem.priority = nextItem.priority.Add(nextItem.value.sts.interval)
+			sched.next(nextItem, intervalOf(nextItem), time.Now())
 			heap.Push(&pq, nextItem)
-			log.Debug("start writing stats to back end", slog.String("cluster", c.ClusterName))
-			// write stats, now with retries
-			err = c.WriteStats(ctx, gc, ss, sr)
+			points, err := c.decodeStats(gc, sr)
 			if err != nil {
-				if !errors.Is(err, context.Canceled) {
-					log.Error("unable to write stats to database, stopping collection", slog.String("cluster", c.ClusterName))
-				}
+				log.Error("unable to decode stats, stopping collection", slog.String("cluster", c.ClusterName), slog.String("error", err.Error()))
 				return
 			}
-		} else if nextItem.value.stattype == StatTypeSummaryStatProtocol {
-			log.Debug("collecting protocol summary stats", slog.String("cluster", c.ClusterName))
-			ssp, err := c.GetSummaryProtocolStats(ctx)
-			if err != nil {
-				if !errors.Is(err, context.Canceled) {
-					log.Error("failed to collect summary protocol stats", slog.String("cluster", c.ClusterName), slog.String("error", err.Error()))
-				}
-			} else {
-				name := summaryStatsBasename + "protocol"
-				points := make([]Point, len(ssp))
-				for i, stat := range ssp {
-					var fa []ptFields
-					var ta []ptTags
-					fields, tags := decodeProtocolSummaryStat(c.ClusterName, stat)
-					fa = append(fa, fields)
-					ta = append(ta, tags)
-					points[i] = Point{name: name, time: stat.Time, fields: fa, tags: ta}
-				}
-				log.Debug("start writing protocol summary stats to back end", slog.String("cluster", c.ClusterName))
-				err = ss.WritePoints(ctx, points)
-				if err != nil {
-					if !errors.Is(err, context.Canceled) {
-						log.Error("unable to write protocol summary stats to database, stopping collection", slog.String("cluster", c.ClusterName))
-					}
-					return
-				}
+			points = relabel.applyDerived(derived, points)
+			// queue stats for the writer goroutine
+			if err = wq.put(ctx, points); err != nil {
+				log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
+				return
 			}
-			nextItem.priority = nextItem.priority.Add(time.Second * 5) // Summary stats are all on a 5-second collection interval
-			heap.Push(&pq, nextItem)
-		} else if nextItem.value.stattype == StatTypeSummaryStatClient {
-			log.Debug("collecting client summary stats", slog.String("cluster", c.ClusterName))
-			ssc, err := c.GetSummaryClientStats(ctx)
+		} else if nextItem.value.stattype == StatTypeSummaryStatProtocol ||
+			nextItem.value.stattype == StatTypeSummaryStatClient ||
+			nextItem.value.stattype == StatTypeSummaryStatDrive {
+			st := statTypeName(nextItem.value.stattype)
+			log.Debug("collecting summary stats", slog.String("cluster", c.ClusterName), slog.String("type", st))
+			points, err := c.collectSummaryStats(ctx, nextItem.value.stattype)
 			if err != nil {
 				if !errors.Is(err, context.Canceled) {
-					log.Error("failed to collect summary client stats", slog.String("cluster", c.ClusterName), slog.String("error", err.Error()))
+					log.Error("failed to collect summary stats", slog.String("cluster", c.ClusterName), slog.String("type", st), slog.String("error", err.Error()))
 				}
 			} else {
-				name := summaryStatsBasename + "client"
-				points := make([]Point, len(ssc))
-				for i, stat := range ssc {
-					var fa []ptFields
-					var ta []ptTags
-					fields, tags := decodeClientSummaryStat(c.ClusterName, stat)
-					fa = append(fa, fields)
-					ta = append(ta, tags)
-					points[i] = Point{name: name, time: stat.Time, fields: fa, tags: ta}
-				}
-				log.Debug("start writing client summary stats to back end", slog.String("cluster", c.ClusterName))
-				err = ss.WritePoints(ctx, points)
-				if err != nil {
-					if !errors.Is(err, context.Canceled) {
-						log.Error("unable to write client summary stats to database, stopping collection", slog.String("cluster", c.ClusterName))
-					}
+				health.collected(cc.Hostname)
+				if err = wq.put(ctx, relabel.apply(points)); err != nil {
+					log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
 					return
 				}
 			}
-			nextItem.priority = nextItem.priority.Add(time.Second * 5) // Summary stats are all on a 5-second collection interval
+			sched.next(nextItem, intervalOf(nextItem), time.Now())
 			heap.Push(&pq, nextItem)
-		} else if nextItem.value.stattype == StatTypeSummaryStatDrive {
-			log.Debug("collecting drive summary stats", slog.String("cluster", c.ClusterName))
-			ssd, err := c.GetSummaryDriveStats(ctx)
+		} else if nextItem.value.stattype == StatTypeSelfMetrics {
+			points, err := selfMetricsPoints(c.ClusterName, time.Now())
 			if err != nil {
-				if !errors.Is(err, context.Canceled) {
-					log.Error("failed to collect summary drive stats", slog.String("cluster", c.ClusterName), slog.String("error", err.Error()))
-				}
-			} else {
-				name := summaryStatsBasename + "drive"
-				points := make([]Point, len(ssd))
-				for i, stat := range ssd {
-					var fa []ptFields
-					var ta []ptTags
-					fields, tags := decodeDriveSummaryStat(c.ClusterName, stat)
-					fa = append(fa, fields)
-					ta = append(ta, tags)
-					points[i] = Point{name: name, time: stat.Time, fields: fa, tags: ta}
-				}
-				log.Debug("start writing drive summary stats to back end", slog.String("cluster", c.ClusterName))
-				err = ss.WritePoints(ctx, points)
-				if err != nil {
-					if !errors.Is(err, context.Canceled) {
-						log.Error("unable to write drive summary stats to database, stopping collection", slog.String("cluster", c.ClusterName))
-					}
-					return
-				}
+				log.Warn("failed to collect self-metrics", slog.String("cluster", c.ClusterName), slog.String("error", err.Error()))
+			} else if err = wq.put(ctx, relabel.apply(points)); err != nil {
+				log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
+				return
 			}
-			nextItem.priority = nextItem.priority.Add(time.Second * 5) // Summary stats are all on a 5-second collection interval
+			sched.next(nextItem, intervalOf(nextItem), time.Now())
 			heap.Push(&pq, nextItem)
 		} else {
 			die("logic error: unknown summary stat type", slog.Int("stat type", int(nextItem.value.stattype)))
@@ -583,6 +697,20 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int, sg map[string]st
 	}
 }
 
+// shortestInterval returns the shortest collection interval for the cluster
+func shortestInterval(buckets []statTimeSet, ssc summaryStatConfig) time.Duration {
+	var shortest time.Duration
+	for _, b := range buckets {
+		if shortest == 0 || b.interval < shortest {
+			shortest = b.interval
+		}
+	}
+	if (ssc.Protocol || ssc.Client || ssc.Drive) && (shortest == 0 || summaryStatsInterval < shortest) {
+		shortest = summaryStatsInterval
+	}
+	return shortest
+}
+
 // calcBuckets calculates the collection buckets for the given cluster
 // based on the stat groups, their multipliers/absolute times, and the
 // individual stat update intervals.
@@ -668,10 +796,14 @@ func getDBWriter(sp string) (DBWriter, error) {
 	switch sp {
 	case discardPluginName:
 		return GetDiscardWriter(), nil
+	case filePluginName:
+		return GetFileWriter(), nil
 	case influxPluginName:
 		return GetInfluxDBWriter(), nil
 	case influxV2PluginName:
 		return GetInfluxDBv2Writer(), nil
+	case lineProtocolPluginName:
+		return GetLineProtocolWriter(), nil
 	case promPluginName:
 		return GetPrometheusWriter(), nil
 	default:
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// With -once, gostats collects every active stat group and enabled summary
+// stat from each cluster a single time instead of running the collection
+// loops, and then either prints the decoded points or writes them to the
+// cluster's back end(s). This is intended for cron jobs and for checking how
+// stats are decoded.
+
+// Output destinations for -once
+const (
+	onceOutputTable   = "table"
+	onceOutputJSON    = "json"
+	onceOutputBackend = "backend"
+)
+
+// onceOptions holds the -once settings
+type onceOptions struct {
+	cluster string // hostname of the configured cluster to collect from (default all enabled clusters)
+	output  string // table, json or backend
+}
+
+// runOnce collects the stats of the selected clusters once and outputs them
+// to w or the back ends. It returns the process exit status.
+func runOnce(ctx context.Context, conf *tomlConfig, opts onceOptions, w io.Writer) int {
+	if !slices.Contains([]string{onceOutputTable, onceOutputJSON, onceOutputBackend}, opts.output) {
+		log.Error("unknown -output destination", slog.String("output", opts.output))
+		return 2
+	}
+	var clusters []int
+	for ci, cl := range conf.Clusters {
+		if opts.cluster == "" && !cl.Disabled || opts.cluster != "" && cl.Hostname == opts.cluster {
+			clusters = append(clusters, ci)
+		}
+	}
+	if len(clusters) == 0 {
+		if opts.cluster != "" {
+			log.Error("cluster not found in config", slog.String("cluster", opts.cluster))
+		} else {
+			log.Error("no enabled clusters found in config")
+		}
+		return 1
+	}
+
+	sg := parseStatConfig(*conf)
+	status := 0
+	for _, ci := range clusters {
+		hostname := conf.Clusters[ci].Hostname
+		c, points, err := collectOnce(ctx, conf, ci, sg)
+		if err != nil {
+			log.Error("collection failed", slog.String("cluster", hostname), slog.String("error", err.Error()))
+			status = 1
+		}
+		if c == nil {
+			continue
+		}
+		switch opts.output {
+		case onceOutputTable:
+			err = writePointsTable(w, points)
+		case onceOutputJSON:
+			err = encodeJSONLines(w, points)
+		case onceOutputBackend:
+			err = writeOnce(ctx, conf, ci, c.ClusterName, points)
+		}
+		if err != nil {
+			log.Error("failed to output stats", slog.String("cluster", hostname), slog.String("output", opts.output), slog.String("error", err.Error()))
+			status = 1
+		}
+		if ctx.Err() != nil {
+			return 1
+		}
+	}
+	return status
+}
+
+// collectOnce connects to the cluster and collects each of its stat buckets
+// and enabled summary stats once. It returns the points collected even if
+// some of the collections failed, along with an error for every failure.
+// The returned cluster is nil if the connection failed.
+func collectOnce(ctx context.Context, conf *tomlConfig, ci int, sg map[string]statGroup) (*Cluster, []Point, error) {
+	gc := conf.Global
+	c, err := newCluster(conf.Clusters[ci], gc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.setupRecording(conf.PapiRecording); err != nil {
+		return nil, nil, err
+	}
+	c.setupConcurrency(conf.Concurrency)
+	if err := c.Connect(ctx); err != nil {
+		return nil, nil, fmt.Errorf("connection failed: %w", err)
+	}
+	log.Info("Connected", slog.String("cluster", c.ClusterName), slog.String("version", c.OSVersion))
+	points, err := c.collectAll(ctx, conf, sg)
+	return c, points, err
+}
+
+// collectAll collects each of the connected cluster's stat buckets and
+// enabled summary stats once
+func (c *Cluster) collectAll(ctx context.Context, conf *tomlConfig, sg map[string]statGroup) ([]Point, error) {
+	gc := conf.Global
+	sd := c.fetchStatDetails(ctx, sg, conf.StatCache)
+	buckets := calcBuckets(c, gc.MinUpdateInvtl, sg, sd, gc.FetchByStatgroup)
+	// rates need two collections, so only derived expressions are computed
+	derived, err := newDerivedMetrics(c.ClusterName, conf.Derived)
+	if err != nil {
+		return nil, err
+	}
+	relabel, err := newCollectRelabeler(c.ClusterName, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []Point
+	var errs []error
+	for _, b := range buckets {
+		sr, err := c.GetStats(ctx, b.stats)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to retrieve stats: %w", err))
+			continue
+		}
+		if *checkStatReturn {
+			verifyStatReturn(c.ClusterName, b.stats, sr)
+		}
+		p, err := c.decodeStats(gc, sr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		points = append(points, relabel.applyDerived(derived, p)...)
+	}
+	for _, s := range []struct {
+		enabled bool
+		st      StatType
+	}{
+		{conf.SummaryStats.Protocol, StatTypeSummaryStatProtocol},
+		{conf.SummaryStats.Client, StatTypeSummaryStatClient},
+		{conf.SummaryStats.Drive, StatTypeSummaryStatDrive},
+	} {
+		if !s.enabled {
+			continue
+		}
+		p, err := c.collectSummaryStats(ctx, s.st)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to collect %s stats: %w", statTypeName(s.st), err))
+			continue
+		}
+		points = append(points, relabel.apply(p)...)
+	}
+	if len(buckets) == 0 && len(points) == 0 && len(errs) == 0 {
+		errs = append(errs, errors.New("no stats to collect. Check your config file"))
+	}
+	return points, errors.Join(errs...)
+}
+
+// writeOnce writes the points to each of the cluster's back ends in turn.
+// Failed writes are retried according to the back end's retry policy but
+// are not spooled.
+func writeOnce(ctx context.Context, conf *tomlConfig, ci int, clusterName string, points []Point) error {
+	var errs []error
+	for _, name := range clusterBackends(conf, ci) {
+		if backendType(conf, name) == promPluginName {
+			errs = append(errs, fmt.Errorf("back end %s: the prometheus back end cannot be used with -once", name))
+			continue
+		}
+		ss, err := resolveBackend(conf, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("back end %s: %w", name, err))
+			continue
+		}
+		if err := ss.Init(ctx, clusterName, conf, ci, nil); err != nil {
+			errs = append(errs, fmt.Errorf("back end %s: unable to initialize: %w", name, err))
+			continue
+		}
+		rp := processorRetryPolicy(conf, name)
+		rp.cluster = clusterName
+		rp.backend = name
+		if err := writeWithRetry(ctx, ss, rp, points); err != nil {
+			errs = append(errs, fmt.Errorf("back end %s: %w", name, err))
+		}
+		closeDBWriter(clusterName, ss)
+	}
+	return errors.Join(errs...)
+}
+
+// writePointsTable writes one row per field/tag set to w, sorted by
+// measurement name
+func writePointsTable(w io.Writer, points []Point) error {
+	points = slices.Clone(points)
+	slices.SortStableFunc(points, func(a, b Point) int { return strings.Compare(a.name, b.name) })
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tNAME\tTAGS\tFIELDS")
+	for _, point := range points {
+		ts := time.Unix(point.time, 0).Format(time.RFC3339)
+		for i, fields := range point.fields {
+			var tags string
+			if i < len(point.tags) {
+				tags = formatTagList(point.tags[i])
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", ts, point.name, tags, formatFieldList(fields))
+		}
+	}
+	return tw.Flush()
+}
+
+// formatFieldList returns the fields as a sorted, space-separated list of name=value pairs
+func formatFieldList(fields ptFields) string {
+	pairs := make([]string, 0, len(fields))
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, fields[k]))
+	}
+	return strings.Join(pairs, " ")
+}
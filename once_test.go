@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newOnceServer returns a fake cluster serving the stat keys listing, the
+// current stats for node.ifs.bytes.out and the protocol summary stats. The
+// client summary stats fail.
+func newOnceServer(t *testing.T) *Cluster {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == statKeysPath:
+			_, _ = w.Write([]byte(statKeysPage2))
+		case r.URL.Path == statsPath && r.URL.Query().Get("key") == "node.ifs.bytes.out":
+			_, _ = w.Write([]byte(`{"stats":[{"devid":1,"node":1,"key":"node.ifs.bytes.out","error_code":0,"error":"","time":1700000000,"value":42}]}`))
+		case r.URL.Path == summaryStatsPath+"protocol":
+			_, _ = w.Write([]byte(`{"protocol":[{"class":"read","node":1,"operation":"nfs3_read","protocol":"nfs3","operation_count":100,"time":1700000000}]}`))
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &Cluster{ClusterName: "test", AuthType: authtypeBasic, OSVersion: "9.11.0.0", baseURL: srv.URL, client: srv.Client(), maxRetries: 1}
+}
+
+func TestCollectAll(t *testing.T) {
+	setMemoryBackend()
+	c := newOnceServer(t)
+	conf := defaultConfig()
+	conf.StatCache.Enabled = false
+	conf.SummaryStats.Protocol = true
+	sg := map[string]statGroup{"ifs": {sgRefresh: sgRefresh{multiplier: 1}, stats: []string{"node.ifs.bytes.out"}}}
+
+	points, err := c.collectAll(t.Context(), &conf, sg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(points) != 2 || points[0].name != "node.ifs.bytes.out" || points[1].name != "node.summary.protocol" {
+		t.Fatalf("expected a stat and a protocol summary point, got %+v", points)
+	}
+
+	// relabel rules for every back end apply to the collected points
+	conf.Relabel.Rules = []relabelRuleConf{{Action: relabelDrop, SourceLabels: []string{relabelNameLabel}, Regex: ptr("node.summary.*")}}
+	points, err = c.collectAll(t.Context(), &conf, sg)
+	if err != nil || len(points) != 1 || points[0].name != "node.ifs.bytes.out" {
+		t.Fatalf("expected the summary point to be dropped, got %+v, %v", points, err)
+	}
+	conf.Relabel.Rules = nil
+
+	// a failed collection is reported but the other points are still returned
+	conf.SummaryStats.Client = true
+	points, err = c.collectAll(t.Context(), &conf, sg)
+	if err == nil || !strings.Contains(err.Error(), "summary_client") {
+		t.Errorf("expected client summary stats error, got %v", err)
+	}
+	if len(points) != 2 {
+		t.Errorf("expected the successful collections' points, got %+v", points)
+	}
+}
+
+func TestWritePointsTable(t *testing.T) {
+	points := []Point{
+		{name: "node.ifs.bytes.out", time: 1700000000, fields: []ptFields{{"value": 42}}, tags: []ptTags{{"cluster": "test", "node": "1"}}},
+		{name: "cluster.cpu.user.avg", time: 1700000000, fields: []ptFields{{"value": 1.5}}, tags: []ptTags{{"cluster": "test"}}},
+	}
+	var buf bytes.Buffer
+	if err := writePointsTable(&buf, points); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "TIME") {
+		t.Fatalf("expected a header and 2 rows, got:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[1], "cluster.cpu.user.avg") || !strings.Contains(lines[2], "cluster=test;node=1") || !strings.HasSuffix(lines[2], "value=42") {
+		t.Errorf("unexpected rows:\n%s", buf.String())
+	}
+}
+
+func TestRunOnce_Selection(t *testing.T) {
+	setMemoryBackend()
+	conf := defaultConfig()
+	conf.Clusters = []clusterConf{{Hostname: "disabled", Disabled: true}}
+	if status := runOnce(t.Context(), &conf, onceOptions{output: "xml"}, &bytes.Buffer{}); status != 2 {
+		t.Errorf("expected usage error for unknown output, got status %d", status)
+	}
+	if status := runOnce(t.Context(), &conf, onceOptions{output: onceOutputJSON}, &bytes.Buffer{}); status != 1 {
+		t.Errorf("expected failure with no enabled clusters, got status %d", status)
+	}
+	if status := runOnce(t.Context(), &conf, onceOptions{cluster: "other", output: onceOutputJSON}, &bytes.Buffer{}); status != 1 {
+		t.Errorf("expected failure for unknown cluster, got status %d", status)
+	}
+}
+
+func TestWriteOnce(t *testing.T) {
+	setMemoryBackend()
+	conf := defaultConfig()
+	conf.Global.Processor = stringList{filePluginName, promPluginName}
+	conf.File = fileConfig{Path: filepath.Join(t.TempDir(), "points.json"), Format: fileFormatJSON}
+	conf.Clusters = []clusterConf{{Hostname: "cluster1"}}
+	points := []Point{{name: "node.ifs.bytes.out", time: 1700000000, fields: []ptFields{{"value": 42}}, tags: []ptTags{{"node": "1"}}}}
+
+	err := writeOnce(t.Context(), &conf, 0, "test", points)
+	if err == nil || !strings.Contains(err.Error(), "cannot be used with -once") {
+		t.Errorf("expected the prometheus back end to be rejected, got %v", err)
+	}
+	data, err := os.ReadFile(conf.File.Path)
+	if err != nil {
+		t.Fatalf("expected the file back end to be written: %v", err)
+	}
+	if !strings.Contains(string(data), `"name":"node.ifs.bytes.out"`) {
+		t.Errorf("unexpected file contents %q", data)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PAPI responses can be recorded to disk and replayed later, so that issues
+// seen on a customer's clusters can be reproduced without access to them, and
+// so that the collector can be tested end to end against realistic data.
+//
+// When recording, every restGet request made for a cluster is appended, with
+// its response, to a JSON lines file in the recording directory:
+//
+//	<directory>/<cluster hostname>.jsonl
+//
+// Only the endpoint and the response are saved; request headers, cookies and
+// the session login are not. The cluster's password and session tokens are
+// also redacted from any response that contains them.
+//
+// When replaying, no connection is made to the cluster. Each request is
+// answered with the next recorded response for the same endpoint, and is
+// held back until the time at which the response arrived during recording
+// (relative to the start of the recording), divided by the replay speed.
+
+// Recording modes
+const (
+	papiRecordingModeRecord = "record"
+	papiRecordingModeReplay = "replay"
+)
+
+const papiRecordingSuffix = ".jsonl"
+
+// papiRedacted replaces credentials in recorded responses
+const papiRedacted = "REDACTED"
+
+// errReplayExhausted is returned once all recorded responses for an endpoint
+// have been replayed
+var errReplayExhausted = errors.New("no more recorded responses")
+
+// papiExchange is a single recorded request and response
+type papiExchange struct {
+	Offset   int64           `json:"offset_ms"`  // request time since the start of the recording
+	Latency  int64           `json:"latency_ms"` // time taken for the response
+	Endpoint string          `json:"endpoint"`
+	Code     int             `json:"code,omitempty"`   // HTTP status code of an unexpected HTTP response
+	Status   string          `json:"status,omitempty"` // HTTP status of an unexpected HTTP response
+	Error    string          `json:"error,omitempty"`  // any other request error
+	Body     json.RawMessage `json:"body,omitempty"`   // JSON response body
+	Text     string          `json:"text,omitempty"`   // response body if it was not valid JSON
+}
+
+// validatePapiRecording checks the [papi_recording] settings
+func validatePapiRecording(rc papiRecordingConfig) error {
+	switch rc.Mode {
+	case "":
+		return nil
+	case papiRecordingModeRecord, papiRecordingModeReplay:
+	default:
+		return fmt.Errorf("unknown [papi_recording] mode %q", rc.Mode)
+	}
+	if rc.Directory == "" {
+		return errors.New("[papi_recording] directory must be set")
+	}
+	if rc.Speed < 0 {
+		return errors.New("[papi_recording] speed must not be negative")
+	}
+	return nil
+}
+
+// papiRecordingPath returns the recording file for the cluster
+func papiRecordingPath(dir string, hostname string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, hostname)
+	return filepath.Join(dir, name+papiRecordingSuffix)
+}
+
+// normalizeEndpoint returns the endpoint with its query arguments in a
+// canonical order, so that requests for the same stats in a different order
+// match the recording
+func normalizeEndpoint(endpoint string) string {
+	path, query, ok := strings.Cut(endpoint, "?")
+	if !ok {
+		return endpoint
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return endpoint
+	}
+	for _, v := range values {
+		slices.Sort(v)
+	}
+	return path + "?" + values.Encode()
+}
+
+// papiRecorder appends the requests made for a cluster to its recording file
+type papiRecorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+}
+
+// papiReplayer serves the recorded responses for a cluster
+type papiReplayer struct {
+	mu        sync.Mutex
+	start     time.Time
+	speed     float64
+	exchanges map[string][]papiExchange // normalized endpoint -> unreplayed responses, in recorded order
+}
+
+// The recorders and replayers are shared by every Cluster for the same
+// hostname, including those created after a config reload, so that a
+// recording covers the whole run and a replay carries on where it left off.
+var (
+	papiRecordingMu sync.Mutex
+	papiRecorders   = make(map[string]*papiRecorder)
+	papiReplayers   = make(map[string]*papiReplayer)
+)
+
+// setupRecording configures the cluster to record or replay its PAPI requests
+func (c *Cluster) setupRecording(rc papiRecordingConfig) error {
+	if rc.Mode == "" {
+		return nil
+	}
+	path := papiRecordingPath(rc.Directory, c.Hostname)
+	papiRecordingMu.Lock()
+	defer papiRecordingMu.Unlock()
+	switch rc.Mode {
+	case papiRecordingModeRecord:
+		r, ok := papiRecorders[path]
+		if !ok {
+			var err error
+			if r, err = newPapiRecorder(path); err != nil {
+				return err
+			}
+			papiRecorders[path] = r
+			log.Log(context.Background(), LevelNotice, "recording PAPI responses", slog.String("cluster", c.Hostname), slog.String("file", path))
+		}
+		c.recorder = r
+	case papiRecordingModeReplay:
+		r, ok := papiReplayers[path]
+		if !ok {
+			var err error
+			if r, err = newPapiReplayer(path, rc.Speed); err != nil {
+				return err
+			}
+			papiReplayers[path] = r
+			log.Log(context.Background(), LevelNotice, "replaying recorded PAPI responses", slog.String("cluster", c.Hostname), slog.String("file", path))
+		}
+		c.replayer = r
+	}
+	return nil
+}
+
+// newPapiRecorder starts a new recording in the file, replacing any previous one
+func newPapiRecorder(path string) (*papiRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("unable to create recording directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create recording file: %w", err)
+	}
+	return &papiRecorder{f: f, start: time.Now()}, nil
+}
+
+// record appends a request and its outcome to the recording, redacting the
+// given secrets from the response
+func (r *papiRecorder) record(endpoint string, start time.Time, body []byte, err error, secrets ...string) {
+	ex := papiExchange{
+		Offset:   start.Sub(r.start).Milliseconds(),
+		Latency:  time.Since(start).Milliseconds(),
+		Endpoint: endpoint,
+	}
+	if err != nil {
+		var se *httpStatusError
+		if errors.As(err, &se) {
+			ex.Code, ex.Status = se.code, se.status
+		} else {
+			ex.Error = redact(err.Error(), secrets)
+		}
+	} else if body = []byte(redact(string(body), secrets)); json.Valid(body) {
+		var buf bytes.Buffer
+		if json.Compact(&buf, body) == nil {
+			ex.Body = buf.Bytes()
+		}
+	} else {
+		ex.Text = string(body)
+	}
+	line, merr := json.Marshal(ex)
+	if merr != nil {
+		log.Warn("unable to record PAPI response", slog.String("endpoint", endpoint), slog.String("error", merr.Error()))
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, werr := r.f.Write(append(line, '\n')); werr != nil {
+		log.Warn("unable to record PAPI response", slog.String("endpoint", endpoint), slog.String("error", werr.Error()))
+	}
+}
+
+// redact replaces each non-empty secret in s
+func redact(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, papiRedacted)
+		}
+	}
+	return s
+}
+
+// newPapiReplayer loads a recording for replay at the given speed (0 = no delays)
+func newPapiReplayer(path string, speed float64) (*papiReplayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open recording: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+	r := &papiReplayer{start: time.Now(), speed: speed, exchanges: make(map[string][]papiExchange)}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 256*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var ex papiExchange
+		if err := json.Unmarshal(sc.Bytes(), &ex); err != nil {
+			return nil, fmt.Errorf("invalid recording %s line %d: %w", path, line, err)
+		}
+		key := normalizeEndpoint(ex.Endpoint)
+		r.exchanges[key] = append(r.exchanges[key], ex)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read recording %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// get returns the next recorded response for the endpoint once it is due
+func (r *papiReplayer) get(ctx context.Context, c *Cluster, endpoint string) ([]byte, error) {
+	key := normalizeEndpoint(endpoint)
+	r.mu.Lock()
+	pending := r.exchanges[key]
+	if len(pending) == 0 {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w for %s", errReplayExhausted, endpoint)
+	}
+	ex := pending[0]
+	r.exchanges[key] = pending[1:]
+	r.mu.Unlock()
+
+	if r.speed > 0 {
+		scale := func(ms int64) time.Duration {
+			return time.Duration(float64(ms) * float64(time.Millisecond) / r.speed)
+		}
+		due := r.start.Add(scale(ex.Offset + ex.Latency))
+		if latest := time.Now().Add(scale(ex.Latency)); latest.After(due) {
+			due = latest
+		}
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	switch {
+	case ex.Code != 0:
+		return nil, &httpStatusError{cluster: c.String(), status: ex.Status, code: ex.Code}
+	case ex.Error != "":
+		return nil, errors.New(ex.Error)
+	case ex.Body != nil:
+		return ex.Body, nil
+	}
+	return []byte(ex.Text), nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPapiRecordReplay(t *testing.T) {
+	setMemoryBackend()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case configPath:
+			_, _ = w.Write([]byte(`{"name":"Recorded","description":"pw=s3cret","onefs_version":{"version":"9.11.0.0"}}`))
+		case statsPath:
+			_, _ = w.Write([]byte(`{"stats":[{"devid":0,"key":"stat.one","error_code":0,"error":"","time":1700000000,"value":1.0}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	path := papiRecordingPath(t.TempDir(), "cluster1")
+	rec, err := newPapiRecorder(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := &Cluster{AuthInfo: AuthInfo{Username: "user", Password: "s3cret"}, AuthType: authtypeBasic,
+		baseURL: srv.URL, client: srv.Client(), maxRetries: 1, recorder: rec}
+	if err := c.GetClusterConfig(t.Context()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.GetStats(t.Context(), []string{"stat.one", "stat.two"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.restGet(t.Context(), statInfoPath+"stat.three"); err == nil {
+		t.Fatalf("expected 404 error")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(data), "s3cret") || !strings.Contains(string(data), papiRedacted) {
+		t.Errorf("expected the password to be redacted from the recording:\n%s", data)
+	}
+
+	rp, err := newPapiReplayer(path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c = &Cluster{AuthInfo: AuthInfo{Username: "user", Password: "s3cret"}, AuthType: authtypeSession, Hostname: "cluster1", replayer: rp}
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected replay connect error: %v", err)
+	}
+	if c.ClusterName != "recorded" || c.OSVersion != "9.11.0.0" {
+		t.Errorf("unexpected replayed cluster config %q %q", c.ClusterName, c.OSVersion)
+	}
+	// the stats may be requested in a different order
+	sr, err := c.GetStats(t.Context(), []string{"stat.two", "stat.one"})
+	if err != nil || len(sr) != 1 || sr[0].Key != "stat.one" {
+		t.Errorf("unexpected replayed stats %+v, error %v", sr, err)
+	}
+	var se *httpStatusError
+	if _, err := c.restGet(t.Context(), statInfoPath+"stat.three"); !errors.As(err, &se) || se.code != http.StatusNotFound {
+		t.Errorf("expected replayed 404, got %v", err)
+	}
+	if _, err := c.GetStats(t.Context(), []string{"stat.one", "stat.two"}); !errors.Is(err, errReplayExhausted) {
+		t.Errorf("expected the replay to be exhausted, got %v", err)
+	}
+}
+
+func TestPapiReplayTiming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cluster1.jsonl")
+	data := `{"offset_ms":0,"latency_ms":100,"endpoint":"/a","body":{}}
+{"offset_ms":200,"latency_ms":100,"endpoint":"/b","body":{}}
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rp, err := newPapiReplayer(path, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := &Cluster{replayer: rp}
+	start := time.Now()
+	if _, err := c.restGet(t.Context(), "/b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the response arrived 300ms into the recording, replayed at double speed
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected the response to be delayed by at least 150ms, got %v", elapsed)
+	}
+}
+
+func TestStatsloopReplay(t *testing.T) {
+	setMemoryBackend()
+	dir := t.TempDir()
+	recording := `{"offset_ms":0,"latency_ms":1,"endpoint":"/platform/1/cluster/config","body":{"name":"Replayed","onefs_version":{"version":"9.11.0.0"}}}
+{"offset_ms":2,"latency_ms":1,"endpoint":"/platform/1/statistics/keys?limit=1000","body":` + strings.ReplaceAll(statKeysPage2, "\n", "") + `}
+{"offset_ms":4,"latency_ms":1,"endpoint":"/platform/1/statistics/current?degraded=true&devid=all&show_nodes=true&key=node.ifs.bytes.out","body":{"stats":[{"devid":1,"node":1,"key":"node.ifs.bytes.out","error_code":0,"error":"","time":1700000000,"value":42}]}}
+`
+	if err := os.WriteFile(papiRecordingPath(dir, "cluster1"), []byte(recording), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conf := defaultConfig()
+	conf.Global.Processor = stringList{filePluginName}
+	conf.File = fileConfig{Path: filepath.Join(dir, "points.json"), Format: fileFormatJSON}
+	conf.StatCache.Enabled = false
+	conf.PapiRecording = papiRecordingConfig{Mode: papiRecordingModeReplay, Directory: dir}
+	conf.Clusters = []clusterConf{{Hostname: "cluster1", Username: "user", Password: "pass"}}
+	sg := map[string]statGroup{"ifs": {sgRefresh: sgRefresh{multiplier: 1}, stats: []string{"node.ifs.bytes.out"}}}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		statsloop(ctx, &conf, 0, sg)
+	}()
+	for {
+		data, _ := os.ReadFile(conf.File.Path)
+		if strings.Contains(string(data), `"name":"node.ifs.bytes.out"`) {
+			if !strings.Contains(string(data), `"cluster":"replayed"`) {
+				t.Errorf("unexpected points %s", data)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("no points written from the replayed responses")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+}
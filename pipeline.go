@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Write queue backpressure policies. These determine what happens when the
+// collector produces batches faster than the back end can accept them.
+const (
+	queuePolicyBlock      = "block"       // wait for space in the queue (collection is delayed)
+	queuePolicyDropOldest = "drop-oldest" // discard the oldest queued batch
+	queuePolicyDropNewest = "drop-newest" // discard the batch being queued
+)
+
+const defaultWriteQueueSize = 16
+const defaultWriteQueuePolicy = queuePolicyBlock
+
+// writeQueueDrainTimeout bounds how long the batches still queued when
+// collection stops (on reload or shutdown) are written for
+const writeQueueDrainTimeout = 30 * time.Second
+
+// validateQueuePolicy checks that the write queue policy is recognized
+func validateQueuePolicy(policy string) error {
+	switch policy {
+	case queuePolicyBlock, queuePolicyDropOldest, queuePolicyDropNewest:
+		return nil
+	}
+	return fmt.Errorf("unknown write_queue_policy %q (expected %q, %q or %q)", policy,
+		queuePolicyBlock, queuePolicyDropOldest, queuePolicyDropNewest)
+}
+
+// writeQueue decouples stat collection from writing to the back end. The
+// collection loop puts decoded batches on the queue and a separate writer
+// goroutine drains it, so back end latency does not delay the next collection.
+type writeQueue struct {
+	cluster string
+	policy  string
+	ch      chan []Point
+}
+
+// newWriteQueue returns a write queue holding up to size batches
+func newWriteQueue(cluster string, size int, policy string) *writeQueue {
+	if size < 1 {
+		size = 1
+	}
+	return &writeQueue{cluster: cluster, policy: policy, ch: make(chan []Point, size)}
+}
+
+// put adds a batch to the queue, applying the backpressure policy if it is full.
+// It only returns an error if the context is cancelled while blocked.
+func (q *writeQueue) put(ctx context.Context, points []Point) error {
+	defer q.updateDepth()
+	select {
+	case q.ch <- points:
+		return nil
+	default:
+	}
+	switch q.policy {
+	case queuePolicyDropNewest:
+		log.Warn("write queue full, dropping newest batch", slog.String("cluster", q.cluster), slog.Int("points", len(points)))
+		writeQueueDropped.WithLabelValues(q.cluster).Inc()
+		return nil
+	case queuePolicyDropOldest:
+		for {
+			select {
+			case q.ch <- points:
+				return nil
+			default:
+			}
+			select {
+			case old := <-q.ch:
+				log.Warn("write queue full, dropping oldest batch", slog.String("cluster", q.cluster), slog.Int("points", len(old)))
+				writeQueueDropped.WithLabelValues(q.cluster).Inc()
+			default:
+			}
+		}
+	default:
+		log.Debug("write queue full, waiting for back end", slog.String("cluster", q.cluster))
+		select {
+		case q.ch <- points:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// close indicates that no more batches will be queued
+func (q *writeQueue) close() {
+	close(q.ch)
+}
+
+// run writes queued batches to the back end until the queue is closed and
+// empty, or the context is cancelled. A write error (i.e., retries exhausted
+// with no spool) is returned to the caller so collection can be stopped.
+// Batches not written when the context is cancelled are spooled if a spool
+// is configured, and dropped otherwise.
+func (q *writeQueue) run(ctx context.Context, ss DBWriter, rp retryPolicy) error {
+	for {
+		select {
+		case points, ok := <-q.ch:
+			if !ok {
+				return nil
+			}
+			q.updateDepth()
+			log.Debug("start writing stats to back end", slog.String("cluster", q.cluster), slog.Int("points", len(points)))
+			if err := writeWithRetry(ctx, ss, rp, points); err != nil {
+				if ctx.Err() != nil {
+					q.abandon(rp, points)
+					return nil
+				}
+				return err
+			}
+		case <-ctx.Done():
+			q.abandon(rp)
+			return nil
+		}
+	}
+}
+
+// abandon spools, or drops, the given batches and those still queued
+func (q *writeQueue) abandon(rp retryPolicy, pending ...[]Point) {
+	for drained := false; !drained; {
+		select {
+		case points, ok := <-q.ch:
+			if ok {
+				pending = append(pending, points)
+			} else {
+				drained = true
+			}
+		default:
+			drained = true
+		}
+	}
+	q.updateDepth()
+	dropped := 0
+	for _, points := range pending {
+		if rp.spool != nil {
+			err := rp.spool.append(points)
+			if err == nil {
+				continue
+			}
+			log.Error("unable to spool queued batch", slog.String("cluster", q.cluster), slog.String("error", err.Error()))
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		log.Warn("collection stopped before the write queue was drained, dropping batches", slog.String("cluster", q.cluster), slog.Int("batches", dropped))
+		writeQueueDropped.WithLabelValues(q.cluster).Add(float64(dropped))
+	}
+}
+
+func (q *writeQueue) updateDepth() {
+	writeQueueDepth.WithLabelValues(q.cluster).Set(float64(len(q.ch)))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// queuedTimes drains the queue and returns the timestamps of the queued batches
+func queuedTimes(q *writeQueue) []int64 {
+	var times []int64
+	for {
+		select {
+		case b := <-q.ch:
+			times = append(times, b[0].time)
+		default:
+			return times
+		}
+	}
+}
+
+func TestWriteQueue_DropOldest(t *testing.T) {
+	setMemoryBackend()
+	q := newWriteQueue("clusterA", 2, queuePolicyDropOldest)
+	for i := range 5 {
+		if err := q.put(t.Context(), []Point{{time: int64(i)}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	got := queuedTimes(q)
+	if len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Errorf("expected newest batches [3 4] to be retained, got %v", got)
+	}
+}
+
+func TestWriteQueue_DropNewest(t *testing.T) {
+	setMemoryBackend()
+	q := newWriteQueue("clusterA", 2, queuePolicyDropNewest)
+	for i := range 5 {
+		if err := q.put(t.Context(), []Point{{time: int64(i)}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	got := queuedTimes(q)
+	if len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("expected oldest batches [0 1] to be retained, got %v", got)
+	}
+}
+
+func TestWriteQueue_BlockUntilCancelled(t *testing.T) {
+	setMemoryBackend()
+	q := newWriteQueue("clusterA", 1, queuePolicyBlock)
+	if err := q.put(t.Context(), []Point{{time: 0}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.put(ctx, []Point{{time: 1}}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected put to block until the context expired, got %v", err)
+	}
+}
+
+func TestWriteQueue_RunWritesInOrder(t *testing.T) {
+	setMemoryBackend()
+	q := newWriteQueue("clusterA", 4, queuePolicyBlock)
+	for i := range 3 {
+		_ = q.put(t.Context(), []Point{{time: int64(i)}})
+	}
+	q.close()
+	w := &recordingWriter{}
+	if err := q.run(t.Context(), w, retryPolicy{maxRetries: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.batches) != 3 {
+		t.Fatalf("expected 3 batches written, got %d", len(w.batches))
+	}
+	for i, b := range w.batches {
+		if b[0].time != int64(i) {
+			t.Errorf("batch %d written out of order", i)
+		}
+	}
+}
+
+func TestWriteQueue_RunReturnsWriteError(t *testing.T) {
+	setMemoryBackend()
+	q := newWriteQueue("clusterA", 1, queuePolicyBlock)
+	_ = q.put(t.Context(), []Point{{time: 0}})
+	err := q.run(t.Context(), &recordingWriter{fail: true}, retryPolicy{maxRetries: 1})
+	if err == nil {
+		t.Fatalf("expected write error to be returned")
+	}
+}
+
+func TestWriteQueue_RunSpoolsWhenCancelled(t *testing.T) {
+	setMemoryBackend()
+	q := newWriteQueue("clusterA", 4, queuePolicyBlock)
+	for i := range 3 {
+		_ = q.put(t.Context(), []Point{{name: "stat", time: int64(i), fields: []ptFields{{"value": 1.0}}, tags: []ptTags{{}}}})
+	}
+	q.close()
+	sp := testSpool(t, spoolConfig{Directory: t.TempDir()})
+	ctx, cancel := context.WithCancel(t.Context())
+	w := &recordingWriter{block: make(chan struct{})}
+	done := make(chan error)
+	go func() { done <- q.run(ctx, w, retryPolicy{maxRetries: 1, spool: sp}) }()
+	// the drain deadline passes while the first batch is being written
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sp.Len() != 3 || len(q.ch) != 0 {
+		t.Errorf("expected every unwritten batch to be spooled, got %d spooled, %d queued", sp.Len(), len(q.ch))
+	}
+
+	// without a spool, the batches are dropped
+	q = newWriteQueue("clusterA", 4, queuePolicyBlock)
+	_ = q.put(t.Context(), []Point{{time: 0}})
+	before := testutil.ToFloat64(writeQueueDropped.WithLabelValues("clusterA"))
+	if err := q.run(ctx, &recordingWriter{block: make(chan struct{})}, retryPolicy{maxRetries: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := testutil.ToFloat64(writeQueueDropped.WithLabelValues("clusterA")) - before; got != 1 {
+		t.Errorf("expected 1 dropped batch, got %v", got)
+	}
+}
+
+func TestValidateQueuePolicy(t *testing.T) {
+	for _, p := range []string{queuePolicyBlock, queuePolicyDropOldest, queuePolicyDropNewest} {
+		if err := validateQueuePolicy(p); err != nil {
+			t.Errorf("unexpected error for policy %q: %v", p, err)
+		}
+	}
+	if err := validateQueuePolicy("drop-random"); err == nil {
+		t.Errorf("expected error for unknown policy")
+	}
+}
@@ -18,6 +18,7 @@ const (
 	StatTypeSummaryStatProtocol
 	StatTypeSummaryStatClient
 	StatTypeSummaryStatDrive
+	StatTypeSelfMetrics
 )
 
 // PqValue is the value stored in the priority queue
@@ -32,6 +33,7 @@ type PqValue struct {
 type Item struct {
 	value    PqValue   // The value of the item; arbitrary.
 	priority time.Time // The priority of the item in the queue.
+	due      time.Time // The scheduled collection time, before any jitter.
 	// The index is needed by update and is maintained by the heap.Interface methods.
 	index int // The index of the item in the heap.
 }
@@ -36,6 +36,7 @@ type PrometheusSink struct {
 	instanceLabelName string
 	client            PrometheusClient
 	metricMap         map[string]*statDetail
+	selfMetricsIntvl  int // push interval of the self-metrics points
 
 	sync.Mutex
 	fam map[string]*MetricFamily
@@ -281,6 +282,10 @@ func (s *PrometheusSink) Init(ctx context.Context, clusterName string, config *t
 	for stat, detail := range sd {
 		metricMap[stat] = &detail
 	}
+	// derived metric information
+	for name, detail := range derivedDetails(config.Derived, sd) {
+		metricMap[name] = &detail
+	}
 	// protocol summary stat information
 	if config.SummaryStats.Protocol {
 		sd := statDetail{
@@ -307,6 +312,12 @@ func (s *PrometheusSink) Init(ctx context.Context, clusterName string, config *t
 		metricMap[summaryStatsBasename+"drive"] = &sd
 	}
 	s.metricMap = metricMap
+	// pushed self-metrics are described as they are first written, since
+	// their names depend on which metrics have been recorded
+	s.selfMetricsIntvl = config.SelfMetrics.PushInterval
+	if s.selfMetricsIntvl <= 0 {
+		s.selfMetricsIntvl = defaultSelfMetricsPushInterval
+	}
 
 	// Set up http server here
 	return pc.Connect(ctx)
@@ -434,6 +445,16 @@ func (s *PrometheusSink) WritePoints(_ context.Context, points []Point) error {
 
 	for _, point := range points {
 		promstat, ok := s.metricMap[point.name]
+		if !ok && point.origin != "" {
+			// renamed by a relabel rule
+			promstat, ok = s.metricMap[point.origin]
+		}
+		if !ok {
+			if detail, found := selfMetricDetail(point.name, s.selfMetricsIntvl); found {
+				promstat, ok = &detail, true
+				s.metricMap[point.name] = promstat
+			}
+		}
 		if !ok {
 			return fmt.Errorf("unable to find metric map entry for point %q", point.name)
 		}
@@ -468,12 +489,6 @@ func (s *PrometheusSink) WritePoints(_ context.Context, points []Point) error {
 			basename := promStatBasename(point.name)
 			for k, v := range fields {
 				var name string
-				// ugly special case handling
-				// we drop "op_id" since there's no point creating a separate metric, but the API will still return it
-				// so for now, hardcode it to be skipped
-				if k == "op_id" {
-					continue
-				}
 				if !multiValued {
 					name = basename
 				} else {
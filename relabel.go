@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Relabel rules filter and rewrite points on their way to a back end, in the
+// style of Prometheus relabel_configs. Each instance of a point (one set of
+// fields and tags) is relabeled separately: its tags are the labels, along
+// with the measurement name as the "__name__" label, and the rules are
+// applied in order:
+//
+//   - replace (the default) joins the values of source_labels with separator
+//     and, if regex matches the result, sets target_label to replacement with
+//     the regex groups expanded ($1 etc.). An empty result removes the label.
+//     Setting "__name__" renames the measurement.
+//   - keep and drop drop the instance unless, or if, regex matches the joined
+//     source_labels.
+//   - labeldrop and labelkeep remove the tags whose names match, or do not
+//     match, regex. labelmap copies the tags whose names match regex to the
+//     names given by replacement.
+//   - fielddrop and fieldkeep remove the fields whose names match, or do not
+//     match, regex. An instance without fields is dropped.
+//
+// Regular expressions are anchored at both ends. The rules without backends
+// are applied as the points are collected, so they also shape the -once
+// output and the points derived metrics are computed from; the derived points
+// are relabeled in turn. A rule with backends set only applies to the back
+// ends of those names or types, as the points are written.
+//
+// Unless [relabel] defaults is false, the default rules are applied before
+// the configured ones. They drop SMB change notify operations, whose
+// latencies are misleadingly large, and the op_id field for Prometheus, which
+// would otherwise become a metric of its own.
+
+// Relabel actions
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelKeep = "labelkeep"
+	relabelLabelMap  = "labelmap"
+	relabelFieldDrop = "fielddrop"
+	relabelFieldKeep = "fieldkeep"
+)
+
+// relabelNameLabel is the label holding the measurement name
+const relabelNameLabel = "__name__"
+
+// relabelConfig defines the relabel rules in the config file
+type relabelConfig struct {
+	Defaults bool              `toml:"defaults"` // apply the default rules before the configured ones
+	Rules    []relabelRuleConf `toml:"rule"`
+}
+
+// relabelRuleConf defines a relabel rule
+type relabelRuleConf struct {
+	Action       string   `toml:"action"`
+	SourceLabels []string `toml:"source_labels"`
+	Separator    *string  `toml:"separator"` // default ";"
+	Regex        *string  `toml:"regex"`     // default "(.*)"
+	TargetLabel  string   `toml:"target_label"`
+	Replacement  *string  `toml:"replacement"` // default "$1"
+	Backends     []string `toml:"backends"`    // back end names or types the rule applies to (default all)
+}
+
+// defaultRelabelRules replace the special cases formerly hard-coded in the
+// stat decoding and the Prometheus back end
+var defaultRelabelRules = []relabelRuleConf{
+	{Action: relabelDrop, SourceLabels: []string{"op_name"}, Regex: ptr("change_notify|read_directory_change")},
+	{Action: relabelFieldDrop, Regex: ptr("op_id"), Backends: []string{promPluginName}},
+}
+
+// ptr returns a pointer to a copy of v
+func ptr[T any](v T) *T {
+	return &v
+}
+
+var relabelDropped = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: selfMetricsNamespace,
+	Subsystem: "relabel",
+	Name:      "dropped_total",
+	Help:      "Number of point instances dropped by relabel rules, per back end (empty for the rules applied during collection).",
+}, []string{"cluster", "backend"})
+
+// relabelRule is a compiled relabel rule
+type relabelRule struct {
+	action      string
+	sources     []string
+	separator   string
+	regex       *regexp.Regexp
+	target      string
+	replacement string
+	backends    []string
+}
+
+// compileRelabelRule checks and compiles a relabel rule
+func compileRelabelRule(rc relabelRuleConf) (*relabelRule, error) {
+	r := &relabelRule{action: rc.Action, sources: rc.SourceLabels, separator: ";", target: rc.TargetLabel, replacement: "$1", backends: rc.Backends}
+	if r.action == "" {
+		r.action = relabelReplace
+	}
+	if rc.Separator != nil {
+		r.separator = *rc.Separator
+	}
+	if rc.Replacement != nil {
+		r.replacement = *rc.Replacement
+	}
+	expr := "(.*)"
+	if rc.Regex != nil {
+		expr = *rc.Regex
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", expr, err)
+	}
+	r.regex = re
+	switch r.action {
+	case relabelReplace:
+		if r.target == "" {
+			return nil, errors.New("replace rule has no target_label")
+		}
+		if len(r.sources) == 0 && rc.Regex != nil {
+			return nil, errors.New("replace rule with a regex has no source_labels")
+		}
+	case relabelKeep, relabelDrop:
+		if len(r.sources) == 0 {
+			return nil, fmt.Errorf("%s rule has no source_labels", r.action)
+		}
+	case relabelLabelDrop, relabelLabelKeep, relabelFieldDrop, relabelFieldKeep:
+		if rc.Regex == nil {
+			return nil, fmt.Errorf("%s rule has no regex", r.action)
+		}
+	case relabelLabelMap:
+		if rc.Regex == nil {
+			return nil, errors.New("labelmap rule has no regex")
+		}
+	default:
+		return nil, fmt.Errorf("unknown relabel action %q", r.action)
+	}
+	return r, nil
+}
+
+// appliesTo reports whether the rule applies to the back end
+func (r *relabelRule) appliesTo(name string, typ string) bool {
+	return len(r.backends) == 0 || slices.Contains(r.backends, name) || slices.Contains(r.backends, typ)
+}
+
+// validateRelabel checks the [relabel] settings
+func validateRelabel(config *tomlConfig) error {
+	var errs []error
+	for i, rc := range config.Relabel.Rules {
+		if _, err := compileRelabelRule(rc); err != nil {
+			errs = append(errs, fmt.Errorf("[[relabel.rule]] %d: %w", i+1, err))
+		}
+		for _, b := range rc.Backends {
+			if _, err := getDBWriter(b); err != nil && findBackend(config, b) == nil {
+				errs = append(errs, fmt.Errorf("[[relabel.rule]] %d: unknown back end %q", i+1, b))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compileRelabelRules returns the default (if enabled) and configured rules
+// for which keep returns true, compiled
+func compileRelabelRules(config *tomlConfig, keep func(r *relabelRule) bool) ([]*relabelRule, error) {
+	var confs []relabelRuleConf
+	if config.Relabel.Defaults {
+		confs = append(confs, defaultRelabelRules...)
+	}
+	confs = append(confs, config.Relabel.Rules...)
+	var rules []*relabelRule
+	for _, rc := range confs {
+		r, err := compileRelabelRule(rc)
+		if err != nil {
+			return nil, err
+		}
+		if keep(r) {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// relabelRules returns the compiled rules limited to back ends that apply to
+// the named back end
+func relabelRules(config *tomlConfig, name string) ([]*relabelRule, error) {
+	typ := backendType(config, name)
+	return compileRelabelRules(config, func(r *relabelRule) bool {
+		return len(r.backends) > 0 && r.appliesTo(name, typ)
+	})
+}
+
+// collectRelabeler applies the rules without backends to a cluster's points
+// as they are collected
+type collectRelabeler struct {
+	cluster string
+	rules   []*relabelRule
+}
+
+// newCollectRelabeler returns the cluster's collection relabeler, or nil if
+// no rules apply to every back end
+func newCollectRelabeler(cluster string, config *tomlConfig) (*collectRelabeler, error) {
+	rules, err := compileRelabelRules(config, func(r *relabelRule) bool { return len(r.backends) == 0 })
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+	return &collectRelabeler{cluster: cluster, rules: rules}, nil
+}
+
+// apply returns the relabeled points. A nil relabeler returns the points unchanged.
+func (rl *collectRelabeler) apply(points []Point) []Point {
+	if rl == nil {
+		return points
+	}
+	points, dropped := relabelPoints(rl.rules, points)
+	if dropped > 0 {
+		relabelDropped.WithLabelValues(rl.cluster, "").Add(float64(dropped))
+	}
+	return points
+}
+
+// applyDerived relabels the decoded points, computes the derived metrics
+// from the result and relabels the derived points in turn
+func (rl *collectRelabeler) applyDerived(dm *derivedMetrics, points []Point) []Point {
+	points = rl.apply(points)
+	n := len(points)
+	points = dm.apply(points)
+	return append(points[:n], rl.apply(points[n:])...)
+}
+
+// relabelInstance applies the rules to the labels and fields of a point
+// instance, which it may modify, and reports whether the instance is kept
+func relabelInstance(rules []*relabelRule, labels ptTags, fields ptFields) bool {
+	for _, r := range rules {
+		switch r.action {
+		case relabelReplace:
+			value := r.joinSources(labels)
+			m := r.regex.FindStringSubmatchIndex(value)
+			if m == nil {
+				continue
+			}
+			res := string(r.regex.ExpandString(nil, r.replacement, value, m))
+			if res == "" {
+				delete(labels, r.target)
+			} else {
+				labels[r.target] = res
+			}
+		case relabelKeep:
+			if !r.regex.MatchString(r.joinSources(labels)) {
+				return false
+			}
+		case relabelDrop:
+			if r.regex.MatchString(r.joinSources(labels)) {
+				return false
+			}
+		case relabelLabelDrop, relabelLabelKeep:
+			for name := range labels {
+				if name != relabelNameLabel && r.regex.MatchString(name) == (r.action == relabelLabelDrop) {
+					delete(labels, name)
+				}
+			}
+		case relabelLabelMap:
+			for _, name := range slices.Sorted(maps.Keys(labels)) {
+				if name == relabelNameLabel {
+					continue
+				}
+				if m := r.regex.FindStringSubmatchIndex(name); m != nil {
+					labels[string(r.regex.ExpandString(nil, r.replacement, name, m))] = labels[name]
+				}
+			}
+		case relabelFieldDrop, relabelFieldKeep:
+			for name := range fields {
+				if r.regex.MatchString(name) == (r.action == relabelFieldDrop) {
+					delete(fields, name)
+				}
+			}
+			if len(fields) == 0 {
+				return false
+			}
+		}
+	}
+	return labels[relabelNameLabel] != ""
+}
+
+// joinSources returns the values of the rule's source labels joined by its separator
+func (r *relabelRule) joinSources(labels ptTags) string {
+	values := make([]string, len(r.sources))
+	for i, s := range r.sources {
+		values[i] = labels[s]
+	}
+	return strings.Join(values, r.separator)
+}
+
+// relabelPoints returns the points with the rules applied, and the number of
+// instances dropped. The points are not modified. Instances of a point
+// renamed to different measurements become separate points.
+func relabelPoints(rules []*relabelRule, points []Point) ([]Point, int) {
+	out := make([]Point, 0, len(points))
+	dropped := 0
+	for _, p := range points {
+		first := len(out)
+		for i := range p.fields {
+			labels := maps.Clone(p.tags[i])
+			if labels == nil {
+				labels = make(ptTags)
+			}
+			labels[relabelNameLabel] = p.name
+			fields := maps.Clone(p.fields[i])
+			if !relabelInstance(rules, labels, fields) {
+				dropped++
+				continue
+			}
+			name := labels[relabelNameLabel]
+			delete(labels, relabelNameLabel)
+			j := slices.IndexFunc(out[first:], func(o Point) bool { return o.name == name })
+			if j < 0 {
+				origin := p.origin
+				if name != p.name && origin == "" {
+					origin = p.name
+				}
+				out = append(out, Point{name: name, time: p.time, origin: origin})
+				j = len(out) - 1 - first
+			}
+			out[first+j].fields = append(out[first+j].fields, fields)
+			out[first+j].tags = append(out[first+j].tags, labels)
+		}
+	}
+	return out, dropped
+}
+
+// relabelWriter applies the rules limited to a back end to the points written to it
+type relabelWriter struct {
+	wrappedWriter
+	cluster string
+	backend string
+	rules   []*relabelRule
+}
+
+// relabelWrites wraps the named back end's writer if any relabel rules apply to it
+func relabelWrites(config *tomlConfig, name string, w DBWriter) (DBWriter, error) {
+	rules, err := relabelRules(config, name)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %w", name, err)
+	}
+	if len(rules) == 0 {
+		return w, nil
+	}
+	return &relabelWriter{wrappedWriter: wrappedWriter{w}, backend: name, rules: rules}, nil
+}
+
+// Init initializes the underlying writer and records the cluster for metrics
+func (w *relabelWriter) Init(ctx context.Context, clusterName string, config *tomlConfig, ci int, sd map[string]statDetail) error {
+	w.cluster = clusterName
+	return w.DBWriter.Init(ctx, clusterName, config, ci, sd)
+}
+
+// WritePoints relabels the points and writes the result
+func (w *relabelWriter) WritePoints(ctx context.Context, points []Point) error {
+	points, dropped := relabelPoints(w.rules, points)
+	if dropped > 0 {
+		relabelDropped.WithLabelValues(w.cluster, w.backend).Add(float64(dropped))
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	return w.DBWriter.WritePoints(ctx, points)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+)
+
+// relabelDefaults applies the default collection relabel rules to the decoded fields and tags of a stat
+func relabelDefaults(t *testing.T, name string, fa []ptFields, ta []ptTags) ([]ptFields, []ptTags) {
+	t.Helper()
+	conf := defaultConfig()
+	rl, err := newCollectRelabeler("c1", &conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	points := rl.apply([]Point{{name: name, fields: fa, tags: ta}})
+	if len(points) != 1 {
+		t.Fatalf("expected a single point, got %+v", points)
+	}
+	return points[0].fields, points[0].tags
+}
+
+// testRules compiles relabel rules, failing the test on errors
+func testRules(t *testing.T, confs ...relabelRuleConf) []*relabelRule {
+	t.Helper()
+	var rules []*relabelRule
+	for _, rc := range confs {
+		r, err := compileRelabelRule(rc)
+		if err != nil {
+			t.Fatalf("unexpected error for %+v: %v", rc, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func TestRelabelPoints(t *testing.T) {
+	rules := testRules(t,
+		// drop noisy operations
+		relabelRuleConf{Action: relabelDrop, SourceLabels: []string{"op_name"}, Regex: ptr("getattr|lookup")},
+		// rename the node tag
+		relabelRuleConf{SourceLabels: []string{"node"}, TargetLabel: "host", Replacement: ptr("node-$1")},
+		relabelRuleConf{Action: relabelLabelDrop, Regex: ptr("node|devid")},
+		// rename the measurement by protocol
+		relabelRuleConf{SourceLabels: []string{relabelNameLabel}, Regex: ptr(`node\.protostats\.(.*)`), TargetLabel: relabelNameLabel, Replacement: ptr("proto_$1")},
+		relabelRuleConf{Action: relabelFieldDrop, Regex: ptr("op_id|.*_std_dev")},
+	)
+	in := []Point{{
+		name: "node.protostats.nfs",
+		time: 100,
+		fields: []ptFields{
+			{"op_id": 1.0, "op_rate": 5.0, "time_std_dev": 1.0},
+			{"op_id": 2.0, "op_rate": 7.0},
+			{"op_id": 3.0, "time_std_dev": 2.0},
+		},
+		tags: []ptTags{
+			{"cluster": "c1", "node": "1", "devid": "1", "op_name": "read"},
+			{"cluster": "c1", "node": "1", "devid": "1", "op_name": "lookup"},
+			{"cluster": "c1", "node": "2", "devid": "2", "op_name": "write"},
+		},
+	}, {
+		name:   "cluster.health",
+		time:   100,
+		fields: []ptFields{{"value": 0}},
+		tags:   []ptTags{{"cluster": "c1"}},
+	}}
+	orig := maps.Clone(in[0].tags[0])
+	out, dropped := relabelPoints(rules, in)
+	if dropped != 2 {
+		t.Errorf("expected the lookup and field-less instances to be dropped, got %d", dropped)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 points, got %+v", out)
+	}
+	p := out[0]
+	if p.name != "proto_nfs" || p.origin != "node.protostats.nfs" || p.time != 100 || len(p.fields) != 1 {
+		t.Fatalf("unexpected relabeled point %+v", p)
+	}
+	if !maps.Equal(p.fields[0], ptFields{"op_rate": 5.0}) {
+		t.Errorf("unexpected fields %v", p.fields[0])
+	}
+	if !maps.Equal(p.tags[0], ptTags{"cluster": "c1", "host": "node-1", "op_name": "read"}) {
+		t.Errorf("unexpected tags %v", p.tags[0])
+	}
+	if out[1].name != "cluster.health" || out[1].origin != "" {
+		t.Errorf("expected the other point to be unchanged, got %+v", out[1])
+	}
+	if !maps.Equal(in[0].tags[0], orig) || len(in[0].fields[0]) != 3 {
+		t.Errorf("expected the input points not to be modified")
+	}
+
+	// keep, labelkeep and labelmap, and renaming instances apart
+	rules = testRules(t,
+		relabelRuleConf{Action: relabelKeep, SourceLabels: []string{"cluster", "node"}, Regex: ptr("c1;[12]")},
+		relabelRuleConf{Action: relabelLabelMap, Regex: ptr("(node)"), Replacement: ptr("isi_$1")},
+		relabelRuleConf{Action: relabelLabelKeep, Regex: ptr("isi_.*")},
+		relabelRuleConf{SourceLabels: []string{"isi_node"}, Regex: ptr("2"), TargetLabel: relabelNameLabel, Replacement: ptr("second")},
+	)
+	out, dropped = relabelPoints(rules, []Point{nodePoint("node.cpu", 1, map[string]any{"1": 1.0, "2": 2.0, "3": 3.0})})
+	if dropped != 1 || len(out) != 2 {
+		t.Fatalf("expected node 3 to be dropped and node 2 renamed, got %d dropped, %+v", dropped, out)
+	}
+	for _, p := range out {
+		want := map[string]string{"node.cpu": "1", "second": "2"}[p.name]
+		if len(p.tags) != 1 || !maps.Equal(p.tags[0], ptTags{"isi_node": want}) {
+			t.Errorf("%s: unexpected tags %v", p.name, p.tags)
+		}
+	}
+}
+
+func TestRelabelRules_Defaults(t *testing.T) {
+	conf := defaultConfig()
+	conf.Backends = []backendConfig{{Name: "prom2", Type: promPluginName}}
+	point := Point{name: "node.protostats.smb2", fields: []ptFields{{"op_id": 1.0, "op_rate": 5.0}}, tags: []ptTags{{"op_name": "read"}}}
+	for _, tc := range []struct {
+		backend string
+		fields  int
+	}{
+		{influxPluginName, 2},
+		{promPluginName, 1},
+		{"prom2", 1},
+	} {
+		rules, err := relabelRules(&conf, tc.backend)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		out, _ := relabelPoints(rules, []Point{point})
+		if len(out) != 1 || len(out[0].fields[0]) != tc.fields {
+			t.Errorf("%s: expected %d fields, got %+v", tc.backend, tc.fields, out)
+		}
+	}
+	conf.Relabel.Defaults = false
+	if rules, _ := relabelRules(&conf, promPluginName); len(rules) != 0 {
+		t.Errorf("expected no rules without the defaults, got %d", len(rules))
+	}
+}
+
+// countingWriter records the points written to it
+type countingWriter struct {
+	DiscardSink
+	points []Point
+}
+
+func (w *countingWriter) WritePoints(_ context.Context, points []Point) error {
+	w.points = append(w.points, points...)
+	return nil
+}
+
+func TestRelabelWrites(t *testing.T) {
+	setMemoryBackend()
+	conf := defaultConfig()
+	conf.Relabel.Defaults = false
+	if w, err := relabelWrites(&conf, discardPluginName, &DiscardSink{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, ok := w.(*DiscardSink); !ok {
+		t.Errorf("expected the writer not to be wrapped without rules, got %T", w)
+	}
+
+	// rules for every back end are applied during collection instead
+	conf.Relabel.Rules = []relabelRuleConf{{Action: relabelLabelDrop, Regex: ptr("node")}}
+	if w, err := relabelWrites(&conf, discardPluginName, &DiscardSink{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, ok := w.(*DiscardSink); !ok {
+		t.Errorf("expected the writer not to be wrapped without back end rules, got %T", w)
+	}
+
+	conf.Relabel.Rules = []relabelRuleConf{{Action: relabelDrop, SourceLabels: []string{relabelNameLabel}, Regex: ptr("cluster.*"), Backends: []string{discardPluginName}}}
+	cw := &countingWriter{}
+	w, err := relabelWrites(&conf, discardPluginName, cw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Init(t.Context(), "c1", &conf, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.WritePoints(t.Context(), []Point{nodePoint("cluster.health", 1, map[string]any{"1": 1.0})}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.WritePoints(t.Context(), []Point{nodePoint("node.cpu", 1, map[string]any{"1": 1.0})}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cw.points) != 1 || cw.points[0].name != "node.cpu" {
+		t.Errorf("expected only node.cpu to be written, got %+v", cw.points)
+	}
+}
+
+func TestCollectRelabeler(t *testing.T) {
+	setMemoryBackend()
+	conf := defaultConfig()
+	conf.Relabel.Defaults = false
+	if rl, err := newCollectRelabeler("c1", &conf); rl != nil || err != nil {
+		t.Errorf("expected no relabeler without rules, got %v, %v", rl, err)
+	}
+	conf.Relabel.Rules = []relabelRuleConf{
+		{Action: relabelDrop, SourceLabels: []string{"node"}, Regex: ptr("3")},
+		{SourceLabels: []string{relabelNameLabel}, Regex: ptr(`node\.(.*)`), TargetLabel: relabelNameLabel, Replacement: ptr("isi_$1")},
+		{Action: relabelLabelDrop, Regex: ptr("node"), Backends: []string{discardPluginName}},
+	}
+	rl, err := newCollectRelabeler("c1", &conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dm, err := newDerivedMetrics("c1", derivedConfig{Exprs: []derivedExprConf{
+		{Name: "node.cpu.total", Expr: "isi_cpu.user + isi_cpu.sys"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	points := rl.applyDerived(dm, []Point{
+		nodePoint("node.cpu.user", 100, map[string]any{"1": 1.0, "2": 2.0, "3": 3.0}),
+		nodePoint("node.cpu.sys", 100, map[string]any{"1": 4.0, "2": 5.0, "3": 6.0}),
+	})
+	var names []string
+	for _, p := range points {
+		names = append(names, p.name)
+		if len(p.tags) != 2 || p.tags[0]["node"] == "" {
+			t.Errorf("%s: expected node 3 to be dropped and the back end rule not to be applied, got %v", p.name, p.tags)
+		}
+	}
+	if !slices.Equal(names, []string{"isi_cpu.user", "isi_cpu.sys", "isi_cpu.total"}) {
+		t.Errorf("expected the derived metric to use and get the relabeled names, got %v", names)
+	}
+	if total := derivedValues(points, "isi_cpu.total"); total["1"] != 5 || total["2"] != 7 {
+		t.Errorf("unexpected derived values %v", total)
+	}
+}
+
+func TestValidateRelabel(t *testing.T) {
+	conf := defaultConfig()
+	conf.Relabel.Rules = []relabelRuleConf{
+		{Action: relabelLabelDrop, Regex: ptr("devid")},
+		{SourceLabels: []string{"node"}, TargetLabel: "host", Backends: []string{influxPluginName}},
+	}
+	if err := validateRelabel(&conf); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	conf.Relabel.Rules = []relabelRuleConf{
+		{Action: "hashmod"},
+		{Action: relabelDrop, Regex: ptr("x")},
+		{Action: relabelFieldDrop},
+		{SourceLabels: []string{"node"}},
+		{Action: relabelLabelDrop, Regex: ptr("(")},
+		{Action: relabelLabelDrop, Regex: ptr("x"), Backends: []string{"nosuch"}},
+	}
+	err := validateRelabel(&conf)
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 6 {
+		t.Errorf("expected 6 errors, got %v", err)
+	}
+}
+
+func TestCheckConfig_Relabel(t *testing.T) {
+	setMemoryBackend()
+	path := writeTestConfig(t, `[global]
+version = "v0.39"
+stats_processor = "discard"
+active_stat_groups = ["cpu"]
+
+[[cluster]]
+hostname = "cluster1"
+username = "user"
+password = "pass"
+
+[[statgroup]]
+name = "cpu"
+update_interval = "*"
+stats = ["node.cpu.user.avg"]
+
+[relabel]
+defaults = false
+
+[[relabel.rule]]
+action = "labeldrop"
+regex = "devid"
+
+[[relabel.rule]]
+action = "drop"
+regex = "x"
+
+[[relabel.rule]]
+action = "labeldrop"
+regex = "node"
+backends = ["discard", "nosuch"]
+`)
+	cc, conf := checkConfig(path)
+	if conf == nil {
+		t.Fatalf("expected the config to parse, got %+v", cc.problems)
+	}
+	if !problemAt(cc, 23, severityError, "drop rule has no source_labels") {
+		t.Errorf("expected an error for the drop rule, got %+v", cc.problems)
+	}
+	if !problemAt(cc, 30, severityError, `unknown back end "nosuch"`) {
+		t.Errorf("expected an error for the unknown back end, got %+v", cc.problems)
+	}
+	if len(cc.problems) != 2 {
+		t.Errorf("expected 2 problems, got %+v", cc.problems)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Back ends are referenced by name, either from the global stats_processor
+// setting or from a cluster's backend setting. A name is either a plugin name
+// (e.g. "influxdb"), which uses the top-level stanza for that plugin, or the
+// name of a [[backend]] instance, which has its own type and stanza. This lets
+// clusters write to different databases, buckets or servers.
+
+// clusterBackends returns the names of the back ends for the given cluster
+func clusterBackends(config *tomlConfig, ci int) []string {
+	if len(config.Clusters[ci].Backend) > 0 {
+		return config.Clusters[ci].Backend
+	}
+	return config.Global.Processor
+}
+
+// findBackend returns the named [[backend]] instance, or nil if there is none
+func findBackend(config *tomlConfig, name string) *backendConfig {
+	for i := range config.Backends {
+		if config.Backends[i].Name == name {
+			return &config.Backends[i]
+		}
+	}
+	return nil
+}
+
+// backendType returns the plugin name for a back end name
+func backendType(config *tomlConfig, name string) string {
+	if b := findBackend(config, name); b != nil {
+		return b.Type
+	}
+	return name
+}
+
+// usesBackendType reports whether any enabled cluster writes to a back end of the given type
+func usesBackendType(config *tomlConfig, typ string) bool {
+	for ci, cl := range config.Clusters {
+		if cl.Disabled {
+			continue
+		}
+		for _, name := range clusterBackends(config, ci) {
+			if backendType(config, name) == typ {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveBackend returns the DBWriter for a back end name
+func resolveBackend(config *tomlConfig, name string) (DBWriter, error) {
+	var w DBWriter
+	b := findBackend(config, name)
+	if b == nil {
+		pw, err := getDBWriter(name)
+		if err != nil {
+			return nil, err
+		}
+		w = pw
+	} else {
+		pw, err := getDBWriter(b.Type)
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %w", name, err)
+		}
+		w = &instanceWriter{wrappedWriter: wrappedWriter{pw}, config: b.apply(config)}
+	}
+	w, err := relabelWrites(config, name, w)
+	if err != nil {
+		return nil, err
+	}
+	return limitWrites(config, name, w), nil
+}
+
+// apply returns a shallow copy of config with the instance's stanza in place
+// of the corresponding top-level stanza
+func (b *backendConfig) apply(config *tomlConfig) *tomlConfig {
+	c := *config
+	if b.InfluxDB != nil {
+		c.InfluxDB = *b.InfluxDB
+	}
+	if b.InfluxDBv2 != nil {
+		c.InfluxDBv2 = *b.InfluxDBv2
+	}
+	if b.Prometheus != nil {
+		c.Prometheus = *b.Prometheus
+	}
+	if b.File != nil {
+		c.File = *b.File
+	}
+	if b.LineProtocol != nil {
+		c.LineProtocol = *b.LineProtocol
+	}
+	return &c
+}
+
+// instanceWriter binds a DBWriter to the config of a named back end instance
+type instanceWriter struct {
+	wrappedWriter
+	config *tomlConfig
+}
+
+// Init initializes the underlying writer with the instance's config
+func (w *instanceWriter) Init(ctx context.Context, clusterName string, _ *tomlConfig, ci int, sd map[string]statDetail) error {
+	return w.DBWriter.Init(ctx, clusterName, w.config, ci, sd)
+}
+
+// validateBackends checks the [[backend]] instances and that every back end
+// name referenced by stats_processor or a cluster can be resolved
+func validateBackends(config *tomlConfig) error {
+	var errs []error
+	seen := make(map[string]bool)
+	for _, b := range config.Backends {
+		if b.Name == "" {
+			errs = append(errs, fmt.Errorf("backend instance with type %q has no name", b.Type))
+			continue
+		}
+		if seen[b.Name] {
+			errs = append(errs, fmt.Errorf("duplicate backend instance name %q", b.Name))
+		}
+		seen[b.Name] = true
+		if _, err := getDBWriter(b.Name); err == nil {
+			errs = append(errs, fmt.Errorf("backend instance name %q conflicts with the back end plugin of the same name", b.Name))
+		}
+		if _, err := getDBWriter(b.Type); err != nil {
+			errs = append(errs, fmt.Errorf("backend %q: %w", b.Name, err))
+		}
+	}
+	check := func(names []string, where string) {
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			if _, err := getDBWriter(name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: unknown backend %q", where, name))
+			}
+		}
+	}
+	check(config.Global.Processor, "stats_processor")
+	for _, cl := range config.Clusters {
+		check(cl.Backend, fmt.Sprintf("cluster %s", cl.Hostname))
+	}
+	return errors.Join(errs...)
+}
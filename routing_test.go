@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+const routingTestConfig = `
+[global]
+stats_processor = "influxdbv2"
+
+[influxdbv2]
+host = "influx"
+bucket = "default"
+
+[[backend]]
+name = "bu_finance_influx"
+type = "influxdbv2"
+[backend.influxdbv2]
+host = "finance-influx"
+bucket = "finance"
+
+[[backend]]
+name = "bu_eng_file"
+type = "file"
+[backend.file]
+path = "eng.lp"
+
+[[cluster]]
+hostname = "shared"
+
+[[cluster]]
+hostname = "finance"
+backend = "bu_finance_influx"
+
+[[cluster]]
+hostname = "eng"
+backend = ["bu_eng_file", "discard"]
+`
+
+func decodeRoutingTestConfig(t *testing.T) *tomlConfig {
+	t.Helper()
+	var conf tomlConfig
+	if _, err := toml.Decode(routingTestConfig, &conf); err != nil {
+		t.Fatalf("unexpected error decoding config: %v", err)
+	}
+	if err := validateBackends(&conf); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	return &conf
+}
+
+func TestClusterBackends(t *testing.T) {
+	conf := decodeRoutingTestConfig(t)
+	tests := []struct {
+		ci   int
+		want []string
+	}{
+		{0, []string{"influxdbv2"}},
+		{1, []string{"bu_finance_influx"}},
+		{2, []string{"bu_eng_file", "discard"}},
+	}
+	for _, tt := range tests {
+		got := clusterBackends(conf, tt.ci)
+		if len(got) != len(tt.want) {
+			t.Errorf("cluster %d: expected %v, got %v", tt.ci, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("cluster %d: expected %v, got %v", tt.ci, tt.want, got)
+			}
+		}
+	}
+	if !usesBackendType(conf, filePluginName) || usesBackendType(conf, promPluginName) {
+		t.Errorf("usesBackendType did not resolve back end instance types")
+	}
+}
+
+func TestResolveBackend_NamedInstance(t *testing.T) {
+	conf := decodeRoutingTestConfig(t)
+	w, err := resolveBackend(conf, "bu_finance_influx")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	iw, ok := w.(*instanceWriter)
+	if !ok {
+		t.Fatalf("expected an instance writer, got %T", w)
+	}
+	if _, ok := iw.DBWriter.(*InfluxDBv2Sink); !ok {
+		t.Errorf("expected an InfluxDBv2 writer, got %T", iw.DBWriter)
+	}
+	if iw.config.InfluxDBv2.Bucket != "finance" || iw.config.InfluxDBv2.Host != "finance-influx" {
+		t.Errorf("expected instance stanza to be applied, got %+v", iw.config.InfluxDBv2)
+	}
+	if conf.InfluxDBv2.Bucket != "default" {
+		t.Errorf("top-level stanza was modified: %+v", conf.InfluxDBv2)
+	}
+
+	// plugin names still resolve to the plugin with the top-level stanza
+	w, err = resolveBackend(conf, "influxdbv2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := w.(*InfluxDBv2Sink); !ok {
+		t.Errorf("expected an InfluxDBv2 writer, got %T", w)
+	}
+}
+
+func TestInstanceWriter_InitUsesInstanceConfig(t *testing.T) {
+	setMemoryBackend()
+	conf := decodeRoutingTestConfig(t)
+	conf.Backends[1].File.Path = t.TempDir() + "/eng.lp"
+	w, err := resolveBackend(conf, "bu_eng_file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the config passed to Init is ignored in favour of the instance's
+	if err := w.Init(t.Context(), "eng", conf, 2, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fs := w.(*instanceWriter).DBWriter.(*FileSink)
+	if _, ok := fs.out.(*rotatingFile); !ok {
+		t.Errorf("expected the instance's file path to be used, got %T", fs.out)
+	}
+}
+
+func TestValidateBackends(t *testing.T) {
+	tests := []struct {
+		name string
+		conf tomlConfig
+	}{
+		{"missing name", tomlConfig{Backends: []backendConfig{{Type: "influxdb"}}}},
+		{"duplicate name", tomlConfig{Backends: []backendConfig{{Name: "a", Type: "influxdb"}, {Name: "a", Type: "file"}}}},
+		{"shadows plugin", tomlConfig{Backends: []backendConfig{{Name: "influxdb", Type: "influxdbv2"}}}},
+		{"unknown type", tomlConfig{Backends: []backendConfig{{Name: "a", Type: "graphite"}}}},
+		{"unknown global", tomlConfig{Global: globalConfig{Processor: stringList{"nosuch"}}}},
+		{"unknown cluster", tomlConfig{Clusters: []clusterConf{{Hostname: "c", Backend: stringList{"nosuch"}}}}},
+	}
+	for _, tt := range tests {
+		if err := validateBackends(&tt.conf); err == nil {
+			t.Errorf("%s: expected validation error", tt.name)
+		}
+	}
+}
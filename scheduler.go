@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Each item in a cluster's collection queue is scheduled on a fixed grid of
+// ticks, one interval apart, so that the time taken by collections, retries
+// and jitter does not accumulate as drift.
+//
+// By default, every item's first tick is when the collection loop starts, so
+// all buckets of all clusters fire together. With spread_start, each item's
+// first tick is instead offset by a fixed fraction of its interval, derived
+// from the cluster hostname and the item, which spreads the load on the
+// collector and the back ends while keeping the phase stable across restarts.
+// jitter_ms adds a random delay of up to that many milliseconds (and at most
+// half the interval) to each collection without moving the grid.
+//
+// With align, the grid is instead aligned to the wall clock: ticks fall on
+// multiples of the interval from the start of each UTC minute, hour or day
+// (whichever is the shortest the interval divides), so that points from
+// different clusters have matching timestamps, e.g. at :00 and :30 for a 30s
+// interval, or every 45s from the top of the hour. If the interval divides
+// none of them, the ticks restart at each boundary of the shortest period
+// longer than the interval, so e.g. a 7s interval collects at :00, :07, ...
+// :56 and again at :00.
+//
+// When a collection overruns, so that its next tick has already passed, the
+// catch_up policy decides what happens: "immediate" collects once straight
+// away and then resumes on the grid, while "skip" waits for the next tick
+// that is still in the future. Either way, any further missed ticks are
+// skipped, logged and counted.
+
+// Catch-up policies for collections that overrun their interval
+const (
+	catchUpImmediate = "immediate"
+	catchUpSkip      = "skip"
+)
+
+// Default catch-up policy
+const defaultCatchUp = catchUpImmediate
+
+// schedulerConfig defines the collection scheduling settings in the config file
+type schedulerConfig struct {
+	SpreadStart bool   `toml:"spread_start"` // offset the first collection of each cluster and bucket within its interval
+	JitterMs    int    `toml:"jitter_ms"`    // maximum random delay added to each collection
+	CatchUp     string `toml:"catch_up"`     // "immediate" or "skip"
+	Align       bool   `toml:"align"`        // align collections to multiples of their interval on the wall clock
+}
+
+var skippedTicks = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: selfMetricsNamespace,
+	Subsystem: "collection",
+	Name:      "skipped_ticks_total",
+	Help:      "Number of scheduled collections skipped because an earlier collection overran its interval.",
+}, []string{"cluster", "type"})
+
+// validateScheduler checks the [scheduler] settings
+func validateScheduler(sc schedulerConfig) error {
+	switch sc.CatchUp {
+	case catchUpImmediate, catchUpSkip:
+	default:
+		return fmt.Errorf("unknown [scheduler] catch_up policy %q", sc.CatchUp)
+	}
+	if sc.JitterMs < 0 {
+		return fmt.Errorf("[scheduler] jitter_ms must not be negative")
+	}
+	if sc.Align && sc.SpreadStart {
+		return fmt.Errorf("[scheduler] align and spread_start cannot both be set")
+	}
+	return nil
+}
+
+// collectionScheduler computes the collection times of a cluster's queue items
+type collectionScheduler struct {
+	cluster string // cluster hostname, which seeds the start offsets
+	label   string // cluster name for logs and metrics
+	conf    schedulerConfig
+	jitter  func(n time.Duration) time.Duration // random duration in [0, n)
+}
+
+// newCollectionScheduler returns the scheduler for the cluster
+func newCollectionScheduler(hostname string, clusterName string, conf schedulerConfig) *collectionScheduler {
+	return &collectionScheduler{cluster: hostname, label: clusterName, conf: conf, jitter: rand.N[time.Duration]}
+}
+
+// itemName identifies the item for start offsets and logging
+func itemName(item *Item) string {
+	if item.value.sts == nil {
+		return statTypeName(item.value.stattype)
+	}
+	if item.value.sts.groupName != "" {
+		return item.value.sts.groupName
+	}
+	return statTypeName(item.value.stattype) + "/" + item.value.sts.interval.String()
+}
+
+// startOffset returns the offset of the item's first tick within its interval
+func (s *collectionScheduler) startOffset(item *Item, interval time.Duration) time.Duration {
+	if !s.conf.SpreadStart || interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s.cluster + "\x00" + itemName(item)))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// start schedules the item's first collection, no earlier than base
+func (s *collectionScheduler) start(item *Item, base time.Time, interval time.Duration) {
+	if s.conf.Align {
+		item.due = alignedTick(base, interval)
+		if !alignsEvenly(interval) {
+			log.Log(context.Background(), LevelNotice, "collection interval does not divide the period it is aligned to, the last collection in each period will be early",
+				slog.String("cluster", s.label), slog.String("item", itemName(item)),
+				slog.Duration("interval", interval), slog.Duration("period", alignPeriod(interval)))
+		}
+	} else {
+		item.due = base.Add(s.startOffset(item, interval))
+	}
+	item.priority = item.due.Add(s.jitterFor(interval))
+}
+
+// jitterFor returns the random delay for a collection of the given interval
+func (s *collectionScheduler) jitterFor(interval time.Duration) time.Duration {
+	limit := min(time.Duration(s.conf.JitterMs)*time.Millisecond, interval/2)
+	if limit <= 0 {
+		return 0
+	}
+	return s.jitter(limit)
+}
+
+// following returns the tick after tick
+func (s *collectionScheduler) following(tick time.Time, interval time.Duration) time.Time {
+	if s.conf.Align {
+		return alignedTick(tick.Add(1), interval)
+	}
+	return tick.Add(interval)
+}
+
+// lastTick returns the latest tick not after t of the grid containing tick,
+// which must not be after t
+func (s *collectionScheduler) lastTick(tick time.Time, t time.Time, interval time.Duration) time.Time {
+	if s.conf.Align {
+		period := alignPeriod(interval)
+		start := t.Add(-time.Duration(t.UnixNano() % int64(period)))
+		return start.Add(t.Sub(start) / interval * interval)
+	}
+	return tick.Add(t.Sub(tick) / interval * interval)
+}
+
+// ticksBetween returns the number of ticks after the tick from, up to and
+// including the tick to
+func (s *collectionScheduler) ticksBetween(from time.Time, to time.Time, interval time.Duration) int {
+	if s.conf.Align {
+		return alignedTickCount(to, interval) - alignedTickCount(from, interval)
+	}
+	return int(to.Sub(from) / interval)
+}
+
+// next schedules the item's next collection after one that started at its
+// due time has finished at now, and returns the number of ticks skipped
+func (s *collectionScheduler) next(item *Item, interval time.Duration, now time.Time) int {
+	if item.due.After(now) {
+		// collected early on request, so keep the scheduled tick
+		item.priority = item.due.Add(s.jitterFor(interval))
+		return 0
+	}
+	last := s.lastTick(item.due, now, interval)
+	missed := s.ticksBetween(item.due, last, interval)
+	if missed == 0 {
+		item.due = s.following(last, interval)
+		item.priority = item.due.Add(s.jitterFor(interval))
+		return 0
+	}
+	// the collection overran
+	skipped := missed
+	if s.conf.CatchUp == catchUpImmediate {
+		skipped--
+		item.due = last
+		item.priority = now // the last missed tick, collected straight away
+	} else {
+		item.due = s.following(last, interval)
+		item.priority = item.due.Add(s.jitterFor(interval))
+	}
+	if skipped > 0 {
+		typ := statTypeName(item.value.stattype)
+		skippedTicks.WithLabelValues(s.label, typ).Add(float64(skipped))
+		log.Log(context.Background(), LevelNotice, "collection overran its interval, skipping missed ticks",
+			slog.String("cluster", s.label), slog.String("item", itemName(item)),
+			slog.Duration("interval", interval), slog.Int("skipped", skipped))
+	}
+	return skipped
+}
+
+// alignPeriod returns the wall-clock period that aligned ticks restart at:
+// the shortest of a minute, an hour and a day that is a multiple of the
+// interval, or if there is none, the shortest that is at least the interval.
+// Intervals longer than a day are their own period. Periods are measured
+// from the Unix epoch, so they start on UTC boundaries.
+func alignPeriod(interval time.Duration) time.Duration {
+	periods := []time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+	for _, period := range periods {
+		if interval <= period && period%interval == 0 {
+			return period
+		}
+	}
+	for _, period := range periods {
+		if interval <= period {
+			return period
+		}
+	}
+	return interval
+}
+
+// alignedTick returns the first tick at or after t for an interval aligned
+// to the wall clock. Ticks fall on multiples of the interval from the start
+// of each alignment period, so if the interval does not divide the period,
+// the last interval of each period is shorter.
+func alignedTick(t time.Time, interval time.Duration) time.Time {
+	period := alignPeriod(interval)
+	start := t.Add(-time.Duration(t.UnixNano() % int64(period)))
+	offset := t.Sub(start)
+	tick := (offset + interval - 1) / interval * interval
+	return start.Add(min(tick, period))
+}
+
+// alignedTickCount returns the number of aligned ticks from the epoch up to
+// and including t
+func alignedTickCount(t time.Time, interval time.Duration) int {
+	period := int64(alignPeriod(interval))
+	perPeriod := (period + int64(interval) - 1) / int64(interval)
+	n := t.UnixNano()
+	return int(n/period*perPeriod + n%period/int64(interval) + 1)
+}
+
+// alignsEvenly reports whether aligned ticks of the interval are evenly spaced
+func alignsEvenly(interval time.Duration) bool {
+	return alignPeriod(interval)%interval == 0
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerStart_Spread(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	interval := 30 * time.Second
+	newItem := func(group string) *Item {
+		return &Item{value: PqValue{StatTypeRegularStat, &statTimeSet{groupName: group, interval: interval}}}
+	}
+
+	s := newCollectionScheduler("cluster1", "cluster1", schedulerConfig{CatchUp: catchUpImmediate})
+	item := newItem("cpu")
+	s.start(item, base, interval)
+	if !item.due.Equal(base) || !item.priority.Equal(base) {
+		t.Errorf("expected the first collection at the start time without spreading, got %v", item.priority)
+	}
+
+	s.conf.SpreadStart = true
+	offsets := make(map[time.Duration]bool)
+	for _, host := range []string{"cluster1", "cluster2"} {
+		for _, group := range []string{"cpu", "ifs", "protocol"} {
+			s.cluster = host
+			item := newItem(group)
+			s.start(item, base, interval)
+			offset := item.due.Sub(base)
+			if offset < 0 || offset >= interval {
+				t.Errorf("%s/%s: offset %v outside the interval", host, group, offset)
+			}
+			again := newItem(group)
+			s.start(again, base, interval)
+			if !again.due.Equal(item.due) {
+				t.Errorf("%s/%s: expected a stable offset, got %v and %v", host, group, item.due, again.due)
+			}
+			offsets[offset] = true
+		}
+	}
+	if len(offsets) < 4 {
+		t.Errorf("expected the start times to be spread, got offsets %v", offsets)
+	}
+}
+
+func TestSchedulerNext_Jitter(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	interval := 10 * time.Second
+	s := newCollectionScheduler("cluster1", "cluster1", schedulerConfig{JitterMs: 60000, CatchUp: catchUpImmediate})
+	var limits []time.Duration
+	s.jitter = func(n time.Duration) time.Duration {
+		limits = append(limits, n)
+		return n - 1
+	}
+	item := &Item{value: PqValue{StatTypeSummaryStatProtocol, nil}}
+	s.start(item, base, interval)
+	for i := 1; i <= 3; i++ {
+		if skipped := s.next(item, interval, item.priority.Add(time.Second)); skipped != 0 {
+			t.Fatalf("unexpected skipped ticks %d", skipped)
+		}
+		// the jitter does not accumulate
+		if want := base.Add(time.Duration(i) * interval); !item.due.Equal(want) {
+			t.Errorf("tick %d: expected due %v, got %v", i, want, item.due)
+		}
+	}
+	if !item.priority.Equal(item.due.Add(interval/2 - 1)) {
+		t.Errorf("expected the jitter to be limited to half the interval, got %v", item.priority.Sub(item.due))
+	}
+	for _, n := range limits {
+		if n != interval/2 {
+			t.Errorf("unexpected jitter limit %v", n)
+		}
+	}
+}
+
+func TestSchedulerNext_CatchUp(t *testing.T) {
+	setMemoryBackend()
+	base := time.Unix(1700000000, 0)
+	interval := 10 * time.Second
+	for _, tc := range []struct {
+		policy   string
+		skipped  int
+		due      time.Time
+		priority time.Time
+	}{
+		// the collection due at base finished at base+35s, missing the ticks at +10s, +20s and +30s
+		{catchUpImmediate, 2, base.Add(30 * time.Second), base.Add(35 * time.Second)},
+		{catchUpSkip, 3, base.Add(40 * time.Second), base.Add(40 * time.Second)},
+	} {
+		s := newCollectionScheduler("cluster1", "cluster1", schedulerConfig{CatchUp: tc.policy})
+		item := &Item{value: PqValue{StatTypeRegularStat, &statTimeSet{interval: interval}}}
+		s.start(item, base, interval)
+		if skipped := s.next(item, interval, base.Add(35*time.Second)); skipped != tc.skipped {
+			t.Errorf("%s: expected %d skipped ticks, got %d", tc.policy, tc.skipped, skipped)
+		}
+		if !item.due.Equal(tc.due) || !item.priority.Equal(tc.priority) {
+			t.Errorf("%s: expected next collection due %v at %v, got %v at %v", tc.policy, tc.due, tc.priority, item.due, item.priority)
+		}
+		// the schedule then continues on the original grid
+		s.next(item, interval, base.Add(36*time.Second))
+		if want := base.Add(40 * time.Second); !item.due.Equal(want) {
+			t.Errorf("%s: expected to resume on the grid at %v, got %v", tc.policy, want, item.due)
+		}
+	}
+}
+
+func TestSchedulerNext_Early(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	interval := 30 * time.Second
+	s := newCollectionScheduler("cluster1", "cluster1", schedulerConfig{CatchUp: catchUpSkip})
+	item := &Item{value: PqValue{StatTypeRegularStat, &statTimeSet{interval: interval}}}
+	s.start(item, base, interval)
+	s.next(item, interval, base.Add(time.Second))
+	// an immediate collection requested through the admin API does not move the grid
+	collectAllNow(&PriorityQueue{item}, base.Add(5*time.Second))
+	s.next(item, interval, base.Add(6*time.Second))
+	if want := base.Add(interval); !item.due.Equal(want) || !item.priority.Equal(want) {
+		t.Errorf("expected the scheduled collection to be kept at %v, got %v", want, item.priority)
+	}
+}
+
+func TestValidateScheduler(t *testing.T) {
+	if err := validateScheduler(defaultConfig().Scheduler); err != nil {
+		t.Errorf("unexpected error for the default settings: %v", err)
+	}
+	for _, sc := range []schedulerConfig{{CatchUp: "later"}, {CatchUp: catchUpSkip, JitterMs: -1}} {
+		if err := validateScheduler(sc); err == nil {
+			t.Errorf("expected error for %+v", sc)
+		}
+	}
+}
+
+func TestAlignedTick(t *testing.T) {
+	noon := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		interval time.Duration
+		t        time.Time
+		want     time.Time
+	}{
+		{30 * time.Second, noon.Add(10 * time.Second), noon.Add(30 * time.Second)},
+		{30 * time.Second, noon.Add(30 * time.Second), noon.Add(30 * time.Second)},
+		// 45s divides the hour, so ticks continue across minutes
+		{45 * time.Second, noon.Add(50 * time.Second), noon.Add(90 * time.Second)},
+		// 7s divides no period, so ticks restart every minute
+		{7 * time.Second, noon.Add(57 * time.Second), noon.Add(time.Minute)},
+		{7 * time.Second, noon.Add(time.Minute + time.Second), noon.Add(time.Minute + 7*time.Second)},
+		{5 * time.Minute, noon.Add(time.Minute), noon.Add(5 * time.Minute)},
+	} {
+		if got := alignedTick(tc.t, tc.interval); !got.Equal(tc.want) {
+			t.Errorf("%v at %v: expected %v, got %v", tc.interval, tc.t.Format(time.TimeOnly), tc.want.Format(time.TimeOnly), got.Format(time.TimeOnly))
+		}
+	}
+	if !alignsEvenly(45*time.Second) || alignsEvenly(7*time.Second) {
+		t.Errorf("unexpected alignsEvenly results")
+	}
+}
+
+func TestSchedulerNext_Align(t *testing.T) {
+	setMemoryBackend()
+	noon := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	interval := 7 * time.Second
+	s := newCollectionScheduler("cluster1", "cluster1", schedulerConfig{Align: true, CatchUp: catchUpSkip})
+	item := &Item{value: PqValue{StatTypeRegularStat, &statTimeSet{interval: interval}}}
+	s.start(item, noon.Add(50*time.Second), interval)
+	if want := noon.Add(56 * time.Second); !item.due.Equal(want) {
+		t.Fatalf("expected the first collection at %v, got %v", want, item.due)
+	}
+	// the last interval of the minute is shortened
+	s.next(item, interval, item.due.Add(time.Second))
+	if want := noon.Add(time.Minute); !item.due.Equal(want) {
+		t.Errorf("expected the next collection at the minute, got %v", item.due)
+	}
+	// an overrun across the minute boundary skips the ticks at :07, :14 and :21
+	if skipped := s.next(item, interval, noon.Add(time.Minute+25*time.Second)); skipped != 3 {
+		t.Errorf("expected 3 skipped ticks, got %d", skipped)
+	}
+	if want := noon.Add(time.Minute + 28*time.Second); !item.due.Equal(want) {
+		t.Errorf("expected the next collection at %v, got %v", want, item.due)
+	}
+
+	if err := validateScheduler(schedulerConfig{Align: true, SpreadStart: true, CatchUp: catchUpSkip}); err == nil {
+		t.Errorf("expected align and spread_start to conflict")
+	}
+}
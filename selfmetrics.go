@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Internal metrics describing the health of the collector itself.
+// These are kept in a dedicated registry, separate from the per-cluster
+// registries used by the Prometheus back end.
+
+const selfMetricsNamespace = "gostats"
+
+var selfRegistry = prometheus.NewRegistry()
+
+var (
+	spoolBatches = promauto.With(selfRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "spool",
+		Name:      "batches",
+		Help:      "Number of batches of points held in the on-disk spool awaiting delivery.",
+	}, []string{"cluster", "backend"})
+	spoolBytes = promauto.With(selfRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "spool",
+		Name:      "bytes",
+		Help:      "Size in bytes of the on-disk spool awaiting delivery.",
+	}, []string{"cluster", "backend"})
+	spoolDiscarded = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "spool",
+		Name:      "discarded_batches_total",
+		Help:      "Number of spooled batches discarded because the spool exceeded its size or age limit.",
+	}, []string{"cluster", "backend"})
+)
+
+var (
+	writeQueueDepth = promauto.With(selfRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "write_queue",
+		Name:      "depth",
+		Help:      "Number of batches waiting in the per-cluster write queue.",
+	}, []string{"cluster"})
+	writeQueueDropped = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "write_queue",
+		Name:      "dropped_batches_total",
+		Help:      "Number of batches discarded because the per-cluster write queue was full.",
+	}, []string{"cluster"})
+)
+
+var backendAsyncWriteErrors = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: selfMetricsNamespace,
+	Subsystem: "backend",
+	Name:      "async_write_errors_total",
+	Help:      "Number of errors reported by back ends that write points asynchronously.",
+}, []string{"cluster", "backend"})
+
+var (
+	papiRequests = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "papi",
+		Name:      "requests_total",
+		Help:      "Number of OneFS API requests made, including any retries and re-authentication.",
+	}, []string{"cluster"})
+	papiRequestErrors = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "papi",
+		Name:      "request_errors_total",
+		Help:      "Number of OneFS API requests that failed.",
+	}, []string{"cluster"})
+	papiRequestDuration = promauto.With(selfRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "papi",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken by OneFS API requests, including any retries and re-authentication.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"cluster"})
+	papiAuthentications = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "papi",
+		Name:      "authentications_total",
+		Help:      "Number of session authentications to the OneFS API by result (success or failure).",
+	}, []string{"cluster", "result"})
+	papiReauthentications = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "papi",
+		Name:      "reauthentications_total",
+		Help:      "Number of session re-authentications by reason (timer or unauthorized).",
+	}, []string{"cluster", "reason"})
+	unavailableStats = promauto.With(selfRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: selfMetricsNamespace,
+		Name:      "unavailable_stats",
+		Help:      "Number of stats the cluster reported as unavailable (not present, not implemented, not configured or no data).",
+	}, []string{"cluster"})
+)
+
+var collectionLag = promauto.With(selfRegistry).NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: selfMetricsNamespace,
+	Subsystem: "collection",
+	Name:      "lag_seconds",
+	Help:      "Delay between the scheduled and actual start of each collection.",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+}, []string{"cluster"})
+
+var (
+	backendPointsWritten = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "backend",
+		Name:      "points_written_total",
+		Help:      "Number of points (field sets) successfully written to the back end.",
+	}, []string{"cluster", "backend"})
+	backendPointsDropped = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "backend",
+		Name:      "points_dropped_total",
+		Help:      "Number of points (field sets) discarded because they could not be written to the back end.",
+	}, []string{"cluster", "backend"})
+	backendWriteErrors = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfMetricsNamespace,
+		Subsystem: "backend",
+		Name:      "write_errors_total",
+		Help:      "Number of failed write attempts to the back end.",
+	}, []string{"cluster", "backend"})
+)
+
+var configReloads = promauto.With(selfRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: selfMetricsNamespace,
+	Subsystem: "config",
+	Name:      "reloads_total",
+	Help:      "Number of config reloads by result (success or failure).",
+}, []string{"result"})
+
+func init() {
+	selfRegistry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+const defaultSelfMetricsPath = "/metrics"
+const defaultSelfMetricsPushInterval = 60
+
+// selfMetricsPrefix is the measurement name prefix for pushed self-metrics
+const selfMetricsPrefix = "gostats."
+
+// countFieldSets returns the number of field sets in a batch, i.e. the number
+// of points as seen by the back end
+func countFieldSets(points []Point) int {
+	n := 0
+	for _, p := range points {
+		n += len(p.fields)
+	}
+	return n
+}
+
+// startSelfMetricsListener serves the self-metrics registry over HTTP until
+// the context is cancelled
+func startSelfMetricsListener(ctx context.Context, sc selfMetricsConfig) error {
+	path := sc.Path
+	if path == "" {
+		path = defaultSelfMetricsPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(selfRegistry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))
+	listener, err := createListener(ctx, sc.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("error creating listener for self-metrics: %w", err)
+	}
+	log.Info("Starting self-metrics listener", slog.String("address", sc.ListenAddr), slog.String("path", path))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("self-metrics listener exited with error", slog.String("error", err.Error()))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
+
+// selfMetricsPoints returns the self-metrics for the given cluster as points
+// named gostats.<metric>, e.g. gostats.papi_requests_total. Metrics without a
+// cluster label (process-wide metrics) are not included. Counters and gauges
+// have a single "value" field; histograms have "count" and "sum" fields.
+func selfMetricsPoints(cluster string, now time.Time) ([]Point, error) {
+	families, err := selfRegistry.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("unable to gather self-metrics: %w", err)
+	}
+	var points []Point
+	for _, mf := range families {
+		point := Point{
+			name: selfMetricsPrefix + strings.TrimPrefix(mf.GetName(), selfMetricsNamespace+"_"),
+			time: now.Unix(),
+		}
+		for _, m := range mf.GetMetric() {
+			tags := ptTags{}
+			for _, lp := range m.GetLabel() {
+				tags[lp.GetName()] = lp.GetValue()
+			}
+			if tags["cluster"] != cluster {
+				continue
+			}
+			var fields ptFields
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				fields = ptFields{"value": m.GetCounter().GetValue()}
+			case dto.MetricType_GAUGE:
+				fields = ptFields{"value": m.GetGauge().GetValue()}
+			case dto.MetricType_HISTOGRAM:
+				// back ends take int64 rather than uint64 fields
+				fields = ptFields{"count": int64(m.GetHistogram().GetSampleCount()), "sum": m.GetHistogram().GetSampleSum()}
+			default:
+				continue
+			}
+			point.fields = append(point.fields, fields)
+			point.tags = append(point.tags, tags)
+		}
+		if len(point.fields) > 0 {
+			points = append(points, point)
+		}
+	}
+	return points, nil
+}
+
+// selfMetricDetail returns the stat details of a pushed self-metrics point,
+// for back ends that need them, and false if the point is not a self-metric.
+// Pushed points expire after the push interval.
+func selfMetricDetail(name string, pushInterval int) (statDetail, bool) {
+	if !strings.HasPrefix(name, selfMetricsPrefix) {
+		return statDetail{}, false
+	}
+	families, err := selfRegistry.Gather()
+	if err != nil {
+		return statDetail{}, false
+	}
+	for _, mf := range families {
+		if selfMetricsPrefix+strings.TrimPrefix(mf.GetName(), selfMetricsNamespace+"_") == name {
+			return statDetail{valid: true, description: mf.GetHelp(), updateIntvl: float64(pushInterval)}, true
+		}
+	}
+	return statDetail{}, false
+}
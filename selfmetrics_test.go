@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSelfMetricsPoints_FiltersByCluster(t *testing.T) {
+	writeQueueDepth.WithLabelValues("selfA").Set(3)
+	writeQueueDepth.WithLabelValues("selfB").Set(5)
+	collectionLag.WithLabelValues("selfA").Observe(0.5)
+
+	now := time.Unix(1700000000, 0)
+	points, err := selfMetricsPoints("selfA", now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	byName := make(map[string]Point)
+	for _, p := range points {
+		byName[p.name] = p
+		if p.time != now.Unix() {
+			t.Errorf("%s: expected time %d, got %d", p.name, now.Unix(), p.time)
+		}
+		for i := range p.tags {
+			if p.tags[i]["cluster"] != "selfA" {
+				t.Errorf("%s: included metric for cluster %q", p.name, p.tags[i]["cluster"])
+			}
+		}
+	}
+	depth, ok := byName["gostats.write_queue_depth"]
+	if !ok {
+		t.Fatalf("expected gostats.write_queue_depth point, got %v", points)
+	}
+	if len(depth.fields) != 1 || depth.fields[0]["value"] != 3.0 {
+		t.Errorf("unexpected write queue depth fields %v", depth.fields)
+	}
+	lag, ok := byName["gostats.collection_lag_seconds"]
+	if !ok {
+		t.Fatalf("expected gostats.collection_lag_seconds point")
+	}
+	if lag.fields[0]["count"] != int64(1) || lag.fields[0]["sum"] != 0.5 {
+		t.Errorf("unexpected histogram fields %v", lag.fields[0])
+	}
+	for name := range byName {
+		if name == "gostats.go_goroutines" || name == "gostats.config_reloads_total" {
+			t.Errorf("process-wide metric %s should not be pushed", name)
+		}
+	}
+}
+
+func TestSelfMetricsPoints_Push(t *testing.T) {
+	setMemoryBackend()
+	writeQueueDepth.WithLabelValues("selfP").Set(2)
+	collectionLag.WithLabelValues("selfP").Observe(0.25)
+	points, err := selfMetricsPoints("selfP", time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "self.lp")
+	conf := defaultConfig()
+	conf.File = fileConfig{Path: path}
+	fs := &FileSink{}
+	if err := fs.Init(t.Context(), "selfP", &conf, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { closeFileOutput(t, path) })
+	if err := fs.WritePoints(t.Context(), points); err != nil {
+		t.Fatalf("unexpected file write error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read output: %v", err)
+	}
+	if !strings.Contains(string(data), "gostats.collection_lag_seconds,cluster=selfP count=1i,sum=0.25") {
+		t.Errorf("expected the histogram in the file output, got:\n%s", data)
+	}
+
+	port := uint64(0)
+	conf.Clusters = []clusterConf{{Hostname: "selfP", PrometheusPort: &port}}
+	conf.SelfMetrics.Push = true
+	ps := &PrometheusSink{}
+	if err := ps.Init(t.Context(), "selfP", &conf, 0, map[string]statDetail{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ps.WritePoints(t.Context(), points); err != nil {
+		t.Fatalf("unexpected Prometheus write error: %v", err)
+	}
+	families, err := ps.client.registry.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	found := false
+	for _, mf := range families {
+		if mf.GetName() == "isilon_stat_gostats_collection_lag_seconds_count" {
+			found = mf.GetMetric()[0].GetGauge().GetValue() == 1
+		}
+	}
+	if !found {
+		t.Errorf("expected the histogram count in the Prometheus registry")
+	}
+	if err := ps.WritePoints(t.Context(), []Point{{name: "gostats.nosuch", fields: []ptFields{{"value": 1.0}}, tags: []ptTags{{}}}}); err == nil {
+		t.Errorf("expected an error for an unknown self-metric")
+	}
+}
+
+func TestWriteWithRetry_RecordsPoints(t *testing.T) {
+	setMemoryBackend()
+	points := []Point{{name: "m", fields: []ptFields{{"v": 1}, {"v": 2}}, tags: []ptTags{{}, {}}}}
+	rp := retryPolicy{maxRetries: 2, retryIntvl: time.Millisecond, cluster: "selfW", backend: "influxdb"}
+
+	if err := writeWithRetry(t.Context(), &recordingWriter{}, rp, points); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := testutil.ToFloat64(backendPointsWritten.WithLabelValues("selfW", "influxdb")); n != 2 {
+		t.Errorf("expected 2 points written, got %v", n)
+	}
+
+	if err := writeWithRetry(t.Context(), &recordingWriter{fail: true}, rp, points); err == nil {
+		t.Fatalf("expected write error")
+	}
+	if n := testutil.ToFloat64(backendPointsDropped.WithLabelValues("selfW", "influxdb")); n != 2 {
+		t.Errorf("expected 2 points dropped, got %v", n)
+	}
+	if n := testutil.ToFloat64(backendWriteErrors.WithLabelValues("selfW", "influxdb")); n != 2 {
+		t.Errorf("expected 2 failed write attempts, got %v", n)
+	}
+}
+
+func TestRestGet_RecordsRequests(t *testing.T) {
+	setMemoryBackend()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	c := &Cluster{
+		AuthType:    authtypeBasic,
+		ClusterName: "selfR",
+		baseURL:     srv.URL,
+		client:      srv.Client(),
+		maxRetries:  1,
+	}
+	if _, err := c.restGet(t.Context(), "/ok"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.restGet(t.Context(), "/missing"); err == nil {
+		t.Fatalf("expected error for missing endpoint")
+	}
+	if n := testutil.ToFloat64(papiRequests.WithLabelValues("selfR")); n != 2 {
+		t.Errorf("expected 2 requests, got %v", n)
+	}
+	if n := testutil.ToFloat64(papiRequestErrors.WithLabelValues("selfR")); n != 1 {
+		t.Errorf("expected 1 request error, got %v", n)
+	}
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/big"
+	mrand "math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The simulate subcommand serves a simulated OneFS cluster's PAPI, for
+// testing the collector and for demos without access to a real cluster. The
+// simulator is also used by the tests.
+//
+// It implements session and basic authentication, the cluster config, the
+// statistics keys listing and per-key metadata, the current statistics
+// (including devid and degraded handling) and the summary statistics. The
+// summary statistics and cluster config are generated from the output
+// schemas vendored under papi/, and the stat values vary over time.
+//
+// Faults can be injected to test error handling: HTTP errors for matching
+// requests, or per-stat error codes in the current statistics.
+
+// simSessionTimeout is the absolute session timeout reported by the simulator
+const simSessionTimeout = 14400
+
+// Stat error codes returned by the current statistics endpoint
+var simStatErrors = map[string]int{
+	"not_present":     1,
+	"not_implemented": 2,
+	"degraded":        3,
+	"stale":           4,
+	"conn_timeout":    5,
+	"timeout":         6,
+	"no_history":      7,
+	"system":          8,
+	"not_configured":  9,
+	"no_data":         10,
+}
+
+// simStatErrorDegraded is the error code of a degraded result, which still
+// has a value
+const simStatErrorDegraded = 3
+
+// simDefaultKeys are the stats served by the simulator in addition to those
+// of the configured stat groups
+var simDefaultKeys = []statKeyInfo{
+	{Key: "cluster.cpu.idle.avg", Description: "Average CPU idle", Units: "percent", Scope: "cluster", Type: "double", Aggregation: "avg", UpdateInterval: 5},
+	{Key: "cluster.cpu.user.avg", Description: "Average CPU user", Units: "percent", Scope: "cluster", Type: "double", Aggregation: "avg", UpdateInterval: 5},
+	{Key: "cluster.cpu.sys.avg", Description: "Average CPU system", Units: "percent", Scope: "cluster", Type: "double", Aggregation: "avg", UpdateInterval: 5},
+	{Key: "cluster.health", Description: "Cluster health", Units: "none", Scope: "cluster", Type: "int32", Aggregation: "max", UpdateInterval: 30},
+	{Key: "cluster.protostats.nfs", Description: "Cluster NFS protocol stats", Units: "none", Scope: "cluster", Type: "protostats", Aggregation: "", UpdateInterval: 5},
+	{Key: "cluster.protostats.nfs.total", Description: "Cluster NFS protocol totals", Units: "none", Scope: "cluster", Type: "protostats", Aggregation: "", UpdateInterval: 5},
+	{Key: "cluster.protostats.smb2", Description: "Cluster SMB2 protocol stats", Units: "none", Scope: "cluster", Type: "protostats", Aggregation: "", UpdateInterval: 5},
+	{Key: "ifs.bytes.avail", Description: "Available IFS bytes", Units: "bytes", Scope: "cluster", Type: "uint64", Aggregation: "sum", UpdateInterval: 30},
+	{Key: "ifs.bytes.total", Description: "Total IFS bytes", Units: "bytes", Scope: "cluster", Type: "uint64", Aggregation: "sum", UpdateInterval: 30},
+	{Key: "ifs.bytes.used", Description: "Used IFS bytes", Units: "bytes", Scope: "cluster", Type: "uint64", Aggregation: "sum", UpdateInterval: 30},
+	{Key: "ifs.percent.used", Description: "Percent of IFS used", Units: "percent", Scope: "cluster", Type: "double", Aggregation: "avg", UpdateInterval: 30},
+	{Key: "node.cpu.idle.avg", Description: "Node average CPU idle", Units: "percent", Scope: "node", Type: "double", Aggregation: "avg", UpdateInterval: 5},
+	{Key: "node.cpu.user.avg", Description: "Node average CPU user", Units: "percent", Scope: "node", Type: "double", Aggregation: "avg", UpdateInterval: 5},
+	{Key: "node.disk.count", Description: "Number of disks in the node", Units: "none", Scope: "node", Type: "int32", Aggregation: "sum", UpdateInterval: 300},
+	{Key: "node.ifs.bytes.in.rate", Description: "Node IFS input rate", Units: "bytes/s", Scope: "node", Type: "double", Aggregation: "sum", UpdateInterval: 5},
+	{Key: "node.ifs.bytes.out.rate", Description: "Node IFS output rate", Units: "bytes/s", Scope: "node", Type: "double", Aggregation: "sum", UpdateInterval: 5},
+	{Key: "node.ifs.heat.lock", Description: "Node file lock heat", Units: "none", Scope: "node", Type: "heat", Aggregation: "", UpdateInterval: 5},
+	{Key: "node.protostats.nfs", Description: "Node NFS protocol stats", Units: "none", Scope: "node", Type: "protostats", Aggregation: "", UpdateInterval: 5},
+}
+
+// simFault is an injected fault. HTTP faults return the status for requests
+// whose path starts with path. Stat faults return the error code for the stat
+// key (all keys if empty) in the current statistics.
+type simFault struct {
+	path        string
+	status      int
+	key         string
+	errorCode   int
+	count       int     // number of times the fault occurs (0 = always)
+	probability float64 // chance of the fault occurring for each matching request (0 = always)
+}
+
+// parseSimFault parses a fault specification of comma-separated key=value
+// settings, e.g. "status=503,path=/platform/1/statistics/current,count=2" or
+// "error=stale,key=node.ifs.bytes.in.rate"
+func parseSimFault(spec string) (simFault, error) {
+	var f simFault
+	for setting := range strings.SplitSeq(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return f, fmt.Errorf("invalid fault setting %q", setting)
+		}
+		var err error
+		switch k {
+		case "status":
+			if f.status, err = strconv.Atoi(v); err == nil && (f.status < 400 || f.status > 599) {
+				err = errors.New("must be an HTTP error status")
+			}
+		case "path":
+			f.path = v
+		case "error":
+			code, ok := simStatErrors[v]
+			if !ok {
+				if code, err = strconv.Atoi(v); err == nil && code <= 0 {
+					err = errors.New("must be positive")
+				}
+			}
+			f.errorCode = code
+		case "key":
+			f.key = v
+		case "count":
+			if f.count, err = strconv.Atoi(v); err == nil && f.count < 0 {
+				err = errors.New("must not be negative")
+			}
+		case "probability":
+			if f.probability, err = strconv.ParseFloat(v, 64); err == nil && (f.probability < 0 || f.probability > 1) {
+				err = errors.New("must be between 0 and 1")
+			}
+		default:
+			return f, fmt.Errorf("unknown fault setting %q", k)
+		}
+		if err != nil {
+			return f, fmt.Errorf("invalid fault %s %q: %w", k, v, err)
+		}
+	}
+	if (f.status == 0) == (f.errorCode == 0) {
+		return f, errors.New("fault must set exactly one of status or error")
+	}
+	return f, nil
+}
+
+// papiSimulator is an http.Handler simulating a cluster's PAPI
+type papiSimulator struct {
+	name     string
+	version  string
+	nodes    int
+	username string
+	password string
+	now      func() time.Time
+
+	keys    []statKeyInfo // sorted by key
+	keyInfo map[string]statKeyInfo
+	schemas map[string]*jsonSchema // summary stats name -> schema
+
+	mu       sync.Mutex
+	sessions map[string]string // session id -> CSRF token
+	faults   []*simFault
+	rnd      *mrand.Rand
+}
+
+// newPapiSimulator returns a simulator for a cluster with the given name,
+// OneFS version and number of nodes, serving the default stat keys and any
+// extra keys
+func newPapiSimulator(name string, version string, nodes int, username string, password string, extraKeys []statKeyInfo) (*papiSimulator, error) {
+	if nodes < 1 {
+		return nil, errors.New("the simulated cluster must have at least one node")
+	}
+	s := &papiSimulator{
+		name:     name,
+		version:  version,
+		nodes:    nodes,
+		username: username,
+		password: password,
+		now:      time.Now,
+		keyInfo:  make(map[string]statKeyInfo),
+		schemas:  make(map[string]*jsonSchema),
+		sessions: make(map[string]string),
+		rnd:      mrand.New(mrand.NewPCG(1, 2)),
+	}
+	for _, k := range slices.Concat(simDefaultKeys, extraKeys) {
+		if _, ok := s.keyInfo[k.Key]; !ok {
+			s.keys = append(s.keys, k)
+		}
+		s.keyInfo[k.Key] = k
+	}
+	slices.SortFunc(s.keys, func(a, b statKeyInfo) int { return strings.Compare(a.Key, b.Key) })
+	for _, summary := range []string{"client", "drive", "heat", "protocol", "protocol-stats", "system"} {
+		schema, err := loadPapiSchema("platform/3/statistics/summary/" + summary)
+		if err != nil {
+			return nil, err
+		}
+		s.schemas[summary] = schema
+	}
+	return s, nil
+}
+
+// addFault injects a fault into the simulator's responses
+func (s *papiSimulator) addFault(f simFault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// trigger reports whether a matching fault occurs for this request, and
+// counts it
+func (s *papiSimulator) trigger(f *simFault) bool {
+	if f.count < 0 {
+		return false // used up
+	}
+	if f.probability > 0 && s.rnd.Float64() >= f.probability {
+		return false
+	}
+	if f.count > 0 {
+		if f.count--; f.count == 0 {
+			f.count = -1
+		}
+	}
+	return true
+}
+
+// httpFault returns the status of any HTTP fault for the request path
+func (s *papiSimulator) httpFault(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.faults {
+		if f.status != 0 && strings.HasPrefix(path, f.path) && s.trigger(f) {
+			return f.status
+		}
+	}
+	return 0
+}
+
+// statFault returns the error code of any stat fault for the key
+func (s *papiSimulator) statFault(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.faults {
+		if f.errorCode != 0 && (f.key == "" || f.key == key) && s.trigger(f) {
+			return f.errorCode
+		}
+	}
+	return 0
+}
+
+// ServeHTTP implements http.Handler
+func (s *papiSimulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	log.Debug("simulator request", slog.String("method", r.Method), slog.String("url", r.URL.String()))
+	if status := s.httpFault(path); status != 0 {
+		s.writeError(w, status, "AEC_EXCEPTION", "injected fault")
+		return
+	}
+	if path == sessionPath {
+		if r.Method != http.MethodPost {
+			s.writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", "method not allowed")
+			return
+		}
+		s.login(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", "method not allowed")
+		return
+	}
+	if !s.authorized(r) {
+		s.writeError(w, http.StatusUnauthorized, "AEC_UNAUTHORIZED", "authorization required")
+		return
+	}
+	switch {
+	case path == configPath:
+		s.writeJSON(w, s.clusterConfig())
+	case path == statKeysPath:
+		s.listKeys(w, r)
+	case strings.HasPrefix(path, statInfoPath):
+		s.keyDetail(w, strings.TrimPrefix(path, statInfoPath))
+	case path == statsPath:
+		s.currentStats(w, r)
+	case strings.HasPrefix(path, summaryStatsPath):
+		s.summaryStats(w, strings.TrimPrefix(path, summaryStatsPath))
+	default:
+		s.writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", "path not found: "+path)
+	}
+}
+
+// writeJSON writes a successful JSON response
+func (s *papiSimulator) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn("simulator failed to write response", slog.String("error", err.Error()))
+	}
+}
+
+// writeError writes a PAPI error response
+func (s *papiSimulator) writeError(w http.ResponseWriter, status int, code string, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"errors": []map[string]string{{"code": code, "message": msg}}})
+}
+
+// login creates a session if the credentials are valid
+func (s *papiSimulator) login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "invalid session request")
+		return
+	}
+	if req.Username != s.username || req.Password != s.password {
+		s.writeError(w, http.StatusUnauthorized, "AEC_UNAUTHORIZED", "invalid username or password")
+		return
+	}
+	sid, csrf := randomToken(), randomToken()
+	s.mu.Lock()
+	s.sessions[sid] = csrf
+	s.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: "isisessid", Value: sid, Path: "/", Secure: true, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: "isicsrf", Value: csrf, Path: "/", Secure: true})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"services":         []string{"platform"},
+		"timeout_absolute": simSessionTimeout,
+		"timeout_inactive": 900,
+		"username":         s.username,
+	})
+}
+
+// authorized checks the request's basic authentication or session cookie
+// and CSRF token
+func (s *papiSimulator) authorized(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		return user == s.username && password == s.password
+	}
+	cookie, err := r.Cookie("isisessid")
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	csrf, ok := s.sessions[cookie.Value]
+	return ok && r.Header.Get("X-CSRF-Token") == csrf
+}
+
+// expireSessions invalidates every session, as if the cluster had rebooted
+func (s *papiSimulator) expireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.sessions)
+}
+
+// clusterConfig returns the cluster config response
+func (s *papiSimulator) clusterConfig() any {
+	schema, err := loadPapiSchema("platform/1/cluster/config")
+	if err != nil {
+		// the schema is embedded, so this cannot happen
+		panic(err)
+	}
+	g := simGen{now: s.now(), nodes: s.nodes}
+	conf := g.generate(schema, "config", "", simRow{}).(map[string]any)
+	conf["name"] = s.name
+	conf["description"] = "Simulated cluster"
+	conf["local_devid"] = 1
+	conf["local_lnn"] = 1
+	conf["onefs_version"] = map[string]any{
+		"build":    "B_" + strings.ReplaceAll(s.version, ".", "_") + "(RELEASE)",
+		"release":  "v" + s.version,
+		"revision": "0",
+		"type":     "Isilon OneFS",
+		"version":  s.version,
+	}
+	return conf
+}
+
+// simKeyItem returns the keys listing item for the key
+func simKeyItem(k statKeyInfo) map[string]any {
+	interval := k.UpdateInterval
+	if interval == 0 {
+		interval = 5
+	}
+	return map[string]any{
+		"key":                k.Key,
+		"description":        k.Description,
+		"units":              k.Units,
+		"scope":              k.Scope,
+		"type":               k.Type,
+		"aggregation_type":   k.Aggregation,
+		"base_name":          nil,
+		"default_cache_time": interval,
+		"policies": []map[string]any{
+			{"interval": interval, "persistent": false, "retention": 600},
+		},
+		"policy_cache_time": nil,
+		"real_name":         nil,
+	}
+}
+
+// listKeys serves a page of the statistics keys listing
+func (s *papiSimulator) listKeys(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, limit := 0, len(s.keys)
+	if resume := q.Get("resume"); resume != "" {
+		// our resume token is the offset and limit of the next page
+		o, l, ok := strings.Cut(resume, ":")
+		var err1, err2 error
+		start, err1 = strconv.Atoi(o)
+		limit, err2 = strconv.Atoi(l)
+		if !ok || err1 != nil || err2 != nil || start < 0 || start > len(s.keys) || limit < 1 {
+			s.writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "invalid resume token")
+			return
+		}
+	} else if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			s.writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "invalid limit")
+			return
+		}
+	}
+	end := min(start+limit, len(s.keys))
+	items := make([]map[string]any, 0, end-start)
+	for _, k := range s.keys[start:end] {
+		items = append(items, simKeyItem(k))
+	}
+	var resume any
+	if end < len(s.keys) {
+		resume = fmt.Sprintf("%d:%d", end, limit)
+	}
+	s.writeJSON(w, map[string]any{"keys": items, "resume": resume, "total": len(s.keys)})
+}
+
+// keyDetail serves the metadata for a single key
+func (s *papiSimulator) keyDetail(w http.ResponseWriter, key string) {
+	k, ok := s.keyInfo[key]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", "statistics key not found: "+key)
+		return
+	}
+	s.writeJSON(w, map[string]any{"keys": []map[string]any{simKeyItem(k)}})
+}
+
+// currentStats serves the current statistics. devid=all returns a result per
+// node for node-scoped stats, and stats with an error code fail the request
+// unless degraded=true is set.
+func (s *papiSimulator) currentStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var keys []string
+	for _, arg := range slices.Concat(q["key"], q["keys"]) {
+		keys = append(keys, strings.Split(arg, ",")...)
+	}
+	devids := []int{1} // the local node
+	if d := q["devid"]; len(d) > 0 {
+		devids = nil
+	parse:
+		for _, arg := range d {
+			for v := range strings.SplitSeq(arg, ",") {
+				if v == "all" {
+					devids = make([]int, s.nodes)
+					for i := range devids {
+						devids[i] = i + 1
+					}
+					break parse
+				}
+				id, err := strconv.Atoi(v)
+				if err != nil || id < 0 || id > s.nodes {
+					s.writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "invalid devid "+v)
+					return
+				}
+				if id == 0 {
+					id = 1
+				}
+				devids = append(devids, id)
+			}
+		}
+	}
+	degraded := q.Get("degraded") == "true"
+	showNodes := q.Get("show_nodes") == "true"
+	now := s.now()
+
+	stats := []StatResult{}
+	result := func(key string, devid int) StatResult {
+		sr := StatResult{Devid: devid, Key: key, UnixTime: now.Unix()}
+		if showNodes && devid != 0 {
+			node := devid
+			sr.Node = &node
+		}
+		return sr
+	}
+	for _, key := range keys {
+		k, ok := s.keyInfo[key]
+		if !ok {
+			sr := result(key, 0)
+			sr.ErrorCode = simStatErrors["not_present"]
+			sr.ErrorString = "statistics key not found"
+			stats = append(stats, sr)
+			continue
+		}
+		nodes := devids
+		if k.Scope != "node" {
+			nodes = []int{0}
+		}
+		for _, devid := range nodes {
+			sr := result(key, devid)
+			if code := s.statFault(key); code != 0 {
+				if !degraded {
+					s.writeError(w, http.StatusInternalServerError, "AEC_EXCEPTION", fmt.Sprintf("statistic %s returned error code %d", key, code))
+					return
+				}
+				sr.ErrorCode = code
+				sr.ErrorString = "injected error"
+				if code != simStatErrorDegraded {
+					stats = append(stats, sr)
+					continue
+				}
+			}
+			sr.Value = simStatValue(k, devid, now)
+			stats = append(stats, sr)
+		}
+	}
+	s.writeJSON(w, map[string]any{"stats": stats})
+}
+
+// summaryStats serves one of the summary statistics
+func (s *papiSimulator) summaryStats(w http.ResponseWriter, name string) {
+	schema, ok := s.schemas[name]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", "path not found: "+summaryStatsPath+name)
+		return
+	}
+	g := simGen{now: s.now(), nodes: s.nodes}
+	s.writeJSON(w, g.generate(schema, name, "", simRow{}))
+}
+
+// randomToken returns a random hex token
+func randomToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// selfSignedCert returns a TLS certificate for the simulator
+func selfSignedCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host, Organization: []string{"gostats simulator"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{host},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+		tmpl.DNSNames = nil
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// simConfigKeys returns metadata for the stats of the config file's stat groups
+func simConfigKeys(configFileName string) ([]statKeyInfo, error) {
+	conf, err := readConfig(configFileName)
+	if err != nil {
+		return nil, err
+	}
+	var keys []statKeyInfo
+	for _, sg := range conf.StatGroups {
+		for _, stat := range sg.Stats {
+			scope := "cluster"
+			if strings.HasPrefix(stat, "node.") {
+				scope = "node"
+			}
+			keys = append(keys, statKeyInfo{Key: stat, Description: stat, Units: "none", Scope: scope, Type: "double", UpdateInterval: 5})
+		}
+	}
+	return keys, nil
+}
+
+// runSimulate implements the simulate subcommand and returns the exit status
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s simulate [options]\n\nServe a simulated OneFS cluster's API for testing and demos.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	listen := fs.String("listen", "localhost:8080", "address to serve the simulated API on (HTTPS with a self-signed certificate)")
+	name := fs.String("name", "simcluster", "name of the simulated cluster")
+	version := fs.String("version", "9.11.0.0", "OneFS version of the simulated cluster")
+	nodes := fs.Int("nodes", 3, "number of nodes in the simulated cluster")
+	username := fs.String("username", "root", "username accepted by the simulated cluster")
+	password := fs.String("password", "password", "password accepted by the simulated cluster")
+	configFileName := fs.String("config-file", "", "also serve the stats of this config file's stat groups")
+	keysFileName := fs.String("keys-file", "", "also serve the stat keys in this file, as output by discover -format json")
+	var faults []simFault
+	fs.Func("fault", "inject a fault, e.g. status=503,path=/platform/1/statistics/current,count=2 or error=stale,key=node.cpu.user.avg,probability=0.1 (repeatable)", func(spec string) error {
+		f, err := parseSimFault(spec)
+		if err != nil {
+			return err
+		}
+		faults = append(faults, f)
+		return nil
+	})
+	logLevel := fs.String("loglevel", "NOTICE", "log level [CRITICAL|ERROR|WARNING|NOTICE|INFO|DEBUG|TRACE]")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := setupCommandLogging(*logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "simulate: %v\n", err)
+		return 2
+	}
+
+	var extraKeys []statKeyInfo
+	if *configFileName != "" {
+		keys, err := simConfigKeys(*configFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "simulate: %v\n", err)
+			return 1
+		}
+		extraKeys = append(extraKeys, keys...)
+	}
+	if *keysFileName != "" {
+		data, err := os.ReadFile(*keysFileName)
+		var keys []statKeyInfo
+		if err == nil {
+			err = json.Unmarshal(data, &keys)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "simulate: unable to read stat keys file: %v\n", err)
+			return 1
+		}
+		extraKeys = append(extraKeys, keys...)
+	}
+	sim, err := newPapiSimulator(*name, *version, *nodes, *username, *password, extraKeys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simulate: %v\n", err)
+		return 2
+	}
+	for _, f := range faults {
+		sim.addFault(f)
+	}
+
+	host, _, err := net.SplitHostPort(*listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simulate: invalid -listen address: %v\n", err)
+		return 2
+	}
+	cert, err := selfSignedCert(host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simulate: unable to create certificate: %v\n", err)
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           sim,
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	log.Log(ctx, LevelNotice, "serving simulated cluster", slog.String("cluster", *name), slog.String("address", *listen),
+		slog.Int("nodes", *nodes), slog.Int("stats", len(sim.keys)))
+	if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error("simulator failed", slog.String("error", err.Error()))
+		return 1
+	}
+	return 0
+}
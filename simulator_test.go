@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSimCluster starts a simulator with the given number of nodes and
+// returns it with an unconnected session-auth cluster pointing at it
+func newSimCluster(t *testing.T, nodes int) (*papiSimulator, *Cluster) {
+	t.Helper()
+	sim, err := newPapiSimulator("SimCluster", "9.11.0.0", nodes, "user", "pass", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv := httptest.NewTLSServer(sim)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, _ := strconv.Atoi(port)
+	c := &Cluster{AuthInfo: AuthInfo{Username: "user", Password: "pass"}, AuthType: authtypeSession,
+		Hostname: host, Port: p, maxRetries: defaultMaxRetries}
+	return sim, c
+}
+
+func TestSimulator_Connect(t *testing.T) {
+	setMemoryBackend()
+	_, c := newSimCluster(t, 3)
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	if c.ClusterName != "simcluster" || c.OSVersion != "9.11.0.0" {
+		t.Errorf("unexpected cluster config %q %q", c.ClusterName, c.OSVersion)
+	}
+	if c.csrfToken == "" {
+		t.Errorf("expected a CSRF token from the session login")
+	}
+
+	_, c = newSimCluster(t, 3)
+	c.Password = "wrong"
+	if err := c.Connect(t.Context()); err == nil {
+		t.Errorf("expected authentication to fail with the wrong password")
+	}
+}
+
+func TestSimulator_ListStatKeys(t *testing.T) {
+	setMemoryBackend()
+	sim, c := newSimCluster(t, 3)
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	keys, err := c.listStatKeys(t.Context())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != len(sim.keys) {
+		t.Fatalf("expected %d keys, got %d", len(sim.keys), len(keys))
+	}
+	// force paging
+	resp, err := c.restGet(t.Context(), statKeysPath+"?limit=5")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	page, resume, err := parseStatKeys(resp)
+	if err != nil || len(page) != 5 || resume == "" {
+		t.Fatalf("expected a 5 key page with a resume token, got %d keys, resume %q, error %v", len(page), resume, err)
+	}
+	if page[0].UpdateInterval == 0 {
+		t.Errorf("expected an update interval from the policies, got %+v", page[0])
+	}
+	var se *httpStatusError
+	if _, err := c.restGet(t.Context(), statInfoPath+"no.such.stat"); !errors.As(err, &se) || se.code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown key, got %v", err)
+	}
+}
+
+func TestSimulator_CurrentStats(t *testing.T) {
+	setMemoryBackend()
+	sim, c := newSimCluster(t, 4)
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	sr, err := c.GetStats(t.Context(), []string{"node.cpu.user.avg", "ifs.bytes.used", "no.such.stat"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	byKey := make(map[string][]StatResult)
+	for _, r := range sr {
+		byKey[r.Key] = append(byKey[r.Key], r)
+	}
+	if n := len(byKey["node.cpu.user.avg"]); n != 4 {
+		t.Errorf("expected a result for each of the 4 nodes, got %d", n)
+	}
+	if r := byKey["ifs.bytes.used"]; len(r) != 1 || r[0].Devid != 0 || r[0].Node != nil || r[0].Value == nil {
+		t.Errorf("expected a single cluster result, got %+v", r)
+	}
+	if r := byKey["no.such.stat"]; len(r) != 1 || r[0].ErrorCode == 0 {
+		t.Errorf("expected an error result for an unknown stat, got %+v", r)
+	}
+	for _, r := range byKey["node.cpu.user.avg"] {
+		if v, ok := r.Value.(float64); !ok || v < 0 || v > 100 || r.Node == nil || *r.Node != r.Devid {
+			t.Errorf("unexpected node result %+v", r)
+		}
+	}
+
+	sim.addFault(simFault{key: "ifs.bytes.used", errorCode: simStatErrors["stale"], count: 1})
+	sim.addFault(simFault{key: "ifs.bytes.avail", errorCode: simStatErrorDegraded, count: 1})
+	sr, err = c.GetStats(t.Context(), []string{"ifs.bytes.used", "ifs.bytes.avail"})
+	if err != nil || len(sr) != 2 {
+		t.Fatalf("unexpected results %+v, error %v", sr, err)
+	}
+	if sr[0].ErrorCode != 4 || sr[0].Value != nil {
+		t.Errorf("expected a stale result without a value, got %+v", sr[0])
+	}
+	if sr[1].ErrorCode != simStatErrorDegraded || sr[1].Value == nil {
+		t.Errorf("expected a degraded result with a value, got %+v", sr[1])
+	}
+
+	// stat errors fail the request without degraded=true
+	sim.addFault(simFault{errorCode: simStatErrors["stale"], count: 1})
+	var se *httpStatusError
+	if _, err := c.restGet(t.Context(), statsPath+"?devid=all&key=ifs.bytes.used"); !errors.As(err, &se) || se.code != http.StatusInternalServerError {
+		t.Errorf("expected the request to fail, got %v", err)
+	}
+}
+
+func TestSimulator_DevidAll(t *testing.T) {
+	setMemoryBackend()
+	_, c := newSimCluster(t, 3)
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	resp, err := c.restGet(t.Context(), statsPath+"?devid=all,1&devid=2&key=node.cpu.user.avg")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sr, err := parseStatResult(resp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sr) != 3 {
+		t.Errorf("expected a single result for each of the 3 nodes, got %+v", sr)
+	}
+}
+
+func TestSimStatValue_Counters(t *testing.T) {
+	now := time.Now()
+	counter := statKeyInfo{Key: "node.ifs.bytes.in", Units: "bytes", Type: "uint64"}
+	prev := simStatValue(counter, 1, now).(float64)
+	for i := 1; i <= 120; i++ {
+		v := simStatValue(counter, 1, now.Add(time.Duration(i)*5*time.Second)).(float64)
+		if v < prev {
+			t.Fatalf("expected the counter to never decrease, got %v after %v", v, prev)
+		}
+		prev = v
+	}
+	if prev == simStatValue(counter, 1, now).(float64) {
+		t.Errorf("expected the counter to increase")
+	}
+
+	protostats := statKeyInfo{Key: "node.protostats.nfs", Type: "protostats"}
+	opCount := func(at time.Time) float64 {
+		return simStatValue(protostats, 1, at).([]any)[0].(map[string]any)["op_count"].(float64)
+	}
+	if a, b := opCount(now), opCount(now.Add(time.Minute)); b <= a {
+		t.Errorf("expected op_count to increase, got %v after %v", b, a)
+	}
+
+	gauge := statKeyInfo{Key: "node.disk.count", Units: "none", Type: "int32"}
+	if v := simStatValue(gauge, 1, now).(float64); v > 1000 {
+		t.Errorf("expected node.disk.count to remain a gauge, got %v", v)
+	}
+}
+
+func TestSimulator_Faults(t *testing.T) {
+	setMemoryBackend()
+	sim, c := newSimCluster(t, 3)
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	// an expired session is re-established transparently
+	sim.expireSessions()
+	if _, err := c.GetStats(t.Context(), []string{"ifs.bytes.used"}); err != nil {
+		t.Errorf("expected re-authentication after the session expired, got %v", err)
+	}
+
+	f, err := parseSimFault("status=503,path=" + statsPath + ",count=1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sim.addFault(f)
+	var se *httpStatusError
+	if _, err := c.GetStats(t.Context(), []string{"ifs.bytes.used"}); !errors.As(err, &se) || se.code != http.StatusServiceUnavailable {
+		t.Errorf("expected injected 503, got %v", err)
+	}
+	if _, err := c.GetStats(t.Context(), []string{"ifs.bytes.used"}); err != nil {
+		t.Errorf("expected the fault to occur only once, got %v", err)
+	}
+
+	for _, spec := range []string{"status=200", "error=bogus", "count=1", "status=503,error=stale", "path"} {
+		if _, err := parseSimFault(spec); err == nil {
+			t.Errorf("expected error for fault %q", spec)
+		}
+	}
+}
+
+func TestSimulator_CollectAll(t *testing.T) {
+	setMemoryBackend()
+	_, c := newSimCluster(t, 2)
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	conf := defaultConfig()
+	conf.StatCache.Enabled = false
+	conf.SummaryStats.Protocol = true
+	conf.SummaryStats.Client = true
+	conf.SummaryStats.Drive = true
+	sg := map[string]statGroup{"demo": {sgRefresh: sgRefresh{multiplier: 1}, stats: []string{
+		"node.ifs.bytes.in.rate", "cluster.protostats.nfs", "node.ifs.heat.lock", "cluster.health",
+	}}}
+
+	points, err := c.collectAll(t.Context(), &conf, sg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	names := make(map[string]int)
+	for _, p := range points {
+		names[p.name]++
+	}
+	for _, name := range []string{"node.ifs.bytes.in.rate", "cluster.protostats.nfs", "node.ifs.heat.lock", "cluster.health",
+		"node.summary.protocol", "node.summary.client", "node.summary.drive"} {
+		if names[name] == 0 {
+			t.Errorf("expected points for %s, got %v", name, names)
+		}
+	}
+	if n := names["node.summary.drive"]; n != 2*simRowsPerNode {
+		t.Errorf("expected %d drive summary points, got %d", 2*simRowsPerNode, n)
+	}
+	for _, p := range points {
+		if p.name == "node.summary.drive" && !strings.Contains(formatTagList(p.tags[0]), "drive_id=") {
+			t.Errorf("expected drive points to be tagged with the drive, got %v", p.tags)
+			break
+		}
+	}
+}
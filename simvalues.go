@@ -0,0 +1,294 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The PAPI simulator generates its responses from the OneFS API output
+// schemas vendored under papi/. Values are deterministic functions of the
+// field's position in the response and the current time, so they vary
+// plausibly over time but are reproducible in tests.
+
+// papiSchemaRelease is the OneFS release whose schemas the simulator uses
+const papiSchemaRelease = "9.11"
+
+//go:embed papi/9.11/platform/1/cluster/config/GET_output_schema.json
+//go:embed papi/9.11/platform/3/statistics/summary/*/GET_output_schema.json
+var papiSchemaFiles embed.FS
+
+// simValuePeriod is the period of the simulated values' variation
+const simValuePeriod = 10 * time.Minute
+
+// simRowsPerNode is the number of rows per node in simulated summary stats
+const simRowsPerNode = 4
+
+// jsonSchema is the subset of a PAPI output schema used to generate responses
+type jsonSchema struct {
+	Type       json.RawMessage        `json:"type"` // a type name, or a list of type names and/or schemas
+	Properties map[string]*jsonSchema `json:"properties"`
+	Items      *jsonSchema            `json:"items"`
+	Enum       []any                  `json:"enum"`
+}
+
+// kind returns the schema's type, skipping "null" in a list of alternatives,
+// and the schema that applies to it
+func (s *jsonSchema) kind() (string, *jsonSchema) {
+	var name string
+	if json.Unmarshal(s.Type, &name) == nil {
+		return name, s
+	}
+	var alts []json.RawMessage
+	if json.Unmarshal(s.Type, &alts) != nil {
+		return "any", s
+	}
+	for _, alt := range alts {
+		if json.Unmarshal(alt, &name) == nil {
+			if name != "null" {
+				return name, s
+			}
+			continue
+		}
+		var sub jsonSchema
+		if json.Unmarshal(alt, &sub) == nil {
+			return sub.kind()
+		}
+	}
+	return "null", s
+}
+
+// loadPapiSchema returns the output schema for a PAPI resource path, e.g.
+// "platform/3/statistics/summary/drive"
+func loadPapiSchema(resource string) (*jsonSchema, error) {
+	data, err := papiSchemaFiles.ReadFile(path.Join("papi", papiSchemaRelease, resource, "GET_output_schema.json"))
+	if err != nil {
+		return nil, err
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema for %s: %w", resource, err)
+	}
+	return &s, nil
+}
+
+// simGen holds the state for generating a single response
+type simGen struct {
+	now   time.Time
+	nodes int
+}
+
+// simRow identifies the row of a generated array, which determines the
+// node and other identifying values of the row
+type simRow struct {
+	index int
+	node  int // LNN
+	bay   int // per-node index
+}
+
+// generate returns a value for the schema. seed identifies the value's
+// position in the response and name is its field name.
+func (g *simGen) generate(s *jsonSchema, seed string, name string, row simRow) any {
+	kind, s := s.kind()
+	if len(s.Enum) > 0 {
+		return s.Enum[row.index%len(s.Enum)]
+	}
+	switch kind {
+	case "object":
+		m := make(map[string]any, len(s.Properties))
+		for prop, ps := range s.Properties {
+			m[prop] = g.generate(ps, seed+"."+prop, prop, row)
+		}
+		return m
+	case "array":
+		if s.Items == nil {
+			return []any{}
+		}
+		n := 3 // nested arrays
+		if row.node == 0 {
+			// top-level arrays have rows for each node
+			n = g.nodes * simRowsPerNode
+			if name == "devices" {
+				n = g.nodes
+			}
+		}
+		items := make([]any, n)
+		for i := range items {
+			r := simRow{index: i, node: i%g.nodes + 1, bay: i / g.nodes}
+			items[i] = g.generate(s.Items, seed+"["+strconv.Itoa(i)+"]", name, r)
+		}
+		return items
+	case "string":
+		return simString(name, row)
+	case "integer":
+		switch name {
+		case "time":
+			return g.now.Unix()
+		case "node", "lnn", "devid":
+			return row.node
+		}
+		return math.Round(g.number(seed, name))
+	case "number", "any":
+		return g.number(seed, name)
+	case "boolean":
+		return false
+	}
+	return nil
+}
+
+// number returns a time-varying value for the field
+func (g *simGen) number(seed string, name string) float64 {
+	return simNumber(seed, simValueScale(name), g.now)
+}
+
+// simValueScale returns the typical magnitude of a value from its name
+func simValueScale(name string) float64 {
+	switch {
+	case strings.Contains(name, "percent"), strings.Contains(name, "cpu"), name == "busy", name == "idle", name == "user", name == "system":
+		return -1 // percentage
+	case strings.Contains(name, "count"), strings.HasSuffix(name, "queue"), name == "health":
+		return 10
+	case strings.Contains(name, "latency"), strings.HasPrefix(name, "time"):
+		return 1000
+	}
+	return 1e6
+}
+
+// simNumber returns a deterministic value that varies over time, with a
+// phase and magnitude derived from seed. A negative scale gives a
+// percentage between 0 and 100.
+func simNumber(seed string, scale float64, now time.Time) float64 {
+	phase, base := simSeed(seed, scale)
+	wave := math.Sin(2*math.Pi*float64(now.UnixNano()%int64(simValuePeriod))/float64(simValuePeriod) + phase)
+	if scale < 0 {
+		return math.Round((50+40*wave)*100) / 100
+	}
+	return math.Round(base*(1+0.5*wave)*100) / 100
+}
+
+// simCounterNumber returns a deterministic value for a cumulative counter.
+// It never decreases: it grows by about base every simValuePeriod, at a rate
+// that varies over time like simNumber's values.
+func simCounterNumber(seed string, scale float64, now time.Time) float64 {
+	phase, base := simSeed(seed, scale)
+	period := simValuePeriod.Seconds()
+	t := float64(now.UnixNano()) / 1e9
+	// the integral of base/period * (1 + 0.5*sin(2πt/period + phase))
+	v := base / period * (t - 0.5*period/(2*math.Pi)*math.Cos(2*math.Pi*t/period+phase))
+	return math.Round(v*100) / 100
+}
+
+// simSeed returns the phase and magnitude of a value's variation from its seed
+func simSeed(seed string, scale float64) (phase float64, base float64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(seed))
+	sum := h.Sum64()
+	return float64(sum%360) * math.Pi / 180, math.Abs(scale) * (1 + float64(sum>>32%9))
+}
+
+// simCounter reports whether a stat key or field is a cumulative counter,
+// e.g. node.ifs.bytes.in or op_count, whose values must never decrease
+func simCounter(name string) bool {
+	return strings.HasSuffix(name, "count") || strings.HasSuffix(name, ".in") || strings.HasSuffix(name, ".out")
+}
+
+// simString returns a plausible value for a string field from its name
+func simString(name string, row simRow) string {
+	pick := func(values ...string) string { return values[row.index%len(values)] }
+	switch name {
+	case "class", "class_name":
+		return pick("read", "write", "namespace_read", "namespace_write", "other")
+	case "protocol":
+		return pick("nfs3", "smb2", "nfs4", "http", "s3")
+	case "operation", "op_name", "event_name":
+		return pick("read", "write", "lookup", "getattr", "create")
+	case "node":
+		return strconv.Itoa(row.node)
+	case "drive_id":
+		return fmt.Sprintf("%d:%d", row.node, row.bay)
+	case "type":
+		return pick("SSD", "HDD")
+	case "local_addr":
+		return fmt.Sprintf("10.0.0.%d", row.node)
+	case "remote_addr":
+		return fmt.Sprintf("10.1.%d.%d", row.node, row.index%250+1)
+	case "local_name":
+		return fmt.Sprintf("node-%d", row.node)
+	case "remote_name":
+		return fmt.Sprintf("client-%d", row.index)
+	case "path":
+		return fmt.Sprintf("/ifs/data/dir%d", row.index)
+	case "lin":
+		return fmt.Sprintf("1:%04x:%04x", row.node, row.index)
+	case "id":
+		return fmt.Sprintf("UID:%d", 1000+row.index)
+	case "guid":
+		return fmt.Sprintf("000e1e%06x", row.index)
+	}
+	return fmt.Sprintf("%s-%d", name, row.index)
+}
+
+// simStatValue returns the value of a regular stat for a node (devid 0 for
+// cluster-scoped stats). Protocol and heat stats return arrays of maps like
+// the real API.
+func simStatValue(k statKeyInfo, devid int, now time.Time) any {
+	seed := k.Key + "#" + strconv.Itoa(devid)
+	row := func(i int, fields ...string) map[string]any {
+		m := make(map[string]any)
+		for _, f := range fields {
+			if simCounter(f) {
+				m[f] = simCounterNumber(seed+"."+strconv.Itoa(i)+"."+f, simValueScale(f), now)
+			} else {
+				m[f] = simNumber(seed+"."+strconv.Itoa(i)+"."+f, simValueScale(f), now)
+			}
+		}
+		return m
+	}
+	switch {
+	case strings.Contains(k.Key, ".protostats.") && strings.HasSuffix(k.Key, ".total"):
+		return []any{row(0, "op_count", "op_rate", "in_rate", "out_rate", "time_avg")}
+	case strings.Contains(k.Key, ".protostats."):
+		ops := make([]any, 4)
+		for i := range ops {
+			m := row(i, "op_count", "op_rate", "in_rate", "out_rate", "time_avg")
+			m["op_name"] = simString("op_name", simRow{index: i})
+			if strings.Contains(k.Key, ".smb") && i == len(ops)-1 {
+				// SMB clients keep change notify requests open; see defaultRelabelRules
+				m["op_name"] = "change_notify"
+			}
+			m["class_name"] = simString("class", simRow{index: i})
+			ops[i] = m
+		}
+		return ops
+	case strings.Contains(k.Key, ".heat."):
+		events := make([]any, 3)
+		for i := range events {
+			m := row(i, "op_count", "op_rate")
+			m["path"] = simString("path", simRow{index: i})
+			m["lin"] = simString("lin", simRow{index: i, node: devid})
+			events[i] = m
+		}
+		return events
+	}
+	scale := simValueScale(k.Key)
+	if k.Units == "percent" {
+		scale = -1
+	}
+	var v float64
+	if simCounter(k.Key) && scale > 0 && k.Type != "int32" {
+		// int32 stats such as node.disk.count count things rather than events
+		v = simCounterNumber(seed, scale, now)
+	} else {
+		v = simNumber(seed, scale, now)
+	}
+	if strings.Contains(k.Type, "int") {
+		return math.Round(v)
+	}
+	return v
+}
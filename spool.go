@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The spool is an optional on-disk write-ahead buffer used when a back end is
+// unavailable. Once writes to a back end have exhausted their retries, batches
+// are appended to the spool instead of being lost, and collection carries on.
+// Subsequent writes drain the spool in order before writing new data, so the
+// back end receives points in the order they were collected.
+//
+// Each batch is stored in its own file, named so that lexical order matches
+// the order in which the batches were spooled:
+//
+//	<spool dir>/<cluster>/<backend>/<unix nanoseconds>-<sequence>.spool
+
+const spoolFileSuffix = ".spool"
+
+// spoolDrainLimit is the maximum number of spooled batches written back in a
+// single call so that draining a large backlog does not stall collection
+const spoolDrainLimit = 64
+
+// spoolPoint is the on-disk representation of a Point
+type spoolPoint struct {
+	Name   string
+	Time   int64
+	Fields []map[string]any
+	Tags   []map[string]string
+}
+
+// spoolSegment describes a single spooled batch
+type spoolSegment struct {
+	path    string
+	size    int64
+	created time.Time
+}
+
+// diskSpool is a bounded on-disk FIFO of batches of points for a single
+// cluster and back end
+type diskSpool struct {
+	sync.Mutex
+	dir      string
+	cluster  string
+	backend  string
+	maxBytes int64
+	maxAge   time.Duration
+	segments []spoolSegment // oldest first
+	bytes    int64
+	seq      int
+	nowFunc  func() time.Time // for testing
+}
+
+// openSpool returns the spool for the given cluster and back end, or nil if
+// spooling is disabled. Batches left over from a previous run are retained.
+func openSpool(sc spoolConfig, cluster string, backend string) (*diskSpool, error) {
+	if !sc.Enabled {
+		return nil, nil
+	}
+	s := &diskSpool{
+		dir:      filepath.Join(sc.Directory, cluster, backend),
+		cluster:  cluster,
+		backend:  backend,
+		maxBytes: int64(sc.MaxSizeMB) * 1024 * 1024,
+		maxAge:   time.Duration(sc.MaxAge) * time.Second,
+	}
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return nil, fmt.Errorf("unable to create spool directory: %w", err)
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if len(s.segments) > 0 {
+		log.Log(context.Background(), LevelNotice, "found spooled batches from previous run", slog.String("cluster", cluster),
+			slog.String("backend", backend), slog.Int("batches", len(s.segments)), slog.Int64("bytes", s.bytes))
+	}
+	return s, nil
+}
+
+func (s *diskSpool) now() time.Time {
+	if s.nowFunc != nil {
+		return s.nowFunc()
+	}
+	return time.Now()
+}
+
+// load scans the spool directory for existing batches
+func (s *diskSpool) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("unable to read spool directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolFileSuffix) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		created, ok := parseSpoolName(e.Name())
+		if !ok {
+			log.Warn("ignoring unrecognized file in spool directory", slog.String("file", e.Name()))
+			continue
+		}
+		s.segments = append(s.segments, spoolSegment{path: filepath.Join(s.dir, e.Name()), size: fi.Size(), created: created})
+		s.bytes += fi.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].path < s.segments[j].path })
+	s.updateMetrics()
+	return nil
+}
+
+// parseSpoolName extracts the creation time from a spool file name
+func parseSpoolName(name string) (time.Time, bool) {
+	ts, _, ok := strings.Cut(strings.TrimSuffix(name, spoolFileSuffix), "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// Len returns the number of spooled batches
+func (s *diskSpool) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.segments)
+}
+
+// append adds a batch to the tail of the spool, discarding the oldest batches
+// if the spool exceeds its size limit
+func (s *diskSpool) append(points []Point) error {
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", now.UnixNano(), s.seq%1000000, spoolFileSuffix)
+	path := filepath.Join(s.dir, name)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("unable to create spool file: %w", err)
+	}
+	sp := make([]spoolPoint, len(points))
+	for i, p := range points {
+		sp[i] = spoolPoint{Name: p.name, Time: p.time, Fields: make([]map[string]any, len(p.fields)), Tags: make([]map[string]string, len(p.tags))}
+		for j := range p.fields {
+			sp[i].Fields[j] = p.fields[j]
+		}
+		for j := range p.tags {
+			sp[i].Tags[j] = p.tags[j]
+		}
+	}
+	if err = gob.NewEncoder(f).Encode(sp); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to encode spool file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write spool file: %w", err)
+	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("unable to write spool file: %w", err)
+	}
+	s.segments = append(s.segments, spoolSegment{path: path, size: fi.Size(), created: now})
+	s.bytes += fi.Size()
+	s.enforceLimits()
+	s.updateMetrics()
+	return nil
+}
+
+// enforceLimits discards the oldest batches that exceed the size or age limit.
+// The newest batch is always retained. Must be called with the lock held.
+func (s *diskSpool) enforceLimits() {
+	now := s.now()
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		tooBig := s.maxBytes > 0 && s.bytes > s.maxBytes
+		tooOld := s.maxAge > 0 && now.Sub(oldest.created) > s.maxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		log.Warn("spool limit exceeded, discarding oldest batch", slog.String("cluster", s.cluster), slog.String("backend", s.backend),
+			slog.Bool("size_limit", tooBig), slog.Bool("age_limit", tooOld))
+		s.removeOldest()
+		spoolDiscarded.WithLabelValues(s.cluster, s.backend).Inc()
+	}
+}
+
+// removeOldest deletes the batch at the head of the spool. Must be called with the lock held.
+func (s *diskSpool) removeOldest() {
+	oldest := s.segments[0]
+	if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+		log.Warn("unable to remove spool file", slog.String("file", oldest.path), slog.String("error", err.Error()))
+	}
+	s.segments = s.segments[1:]
+	s.bytes -= oldest.size
+}
+
+// readSegment decodes a spooled batch
+func readSegment(path string) ([]Point, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+	var sp []spoolPoint
+	if err := gob.NewDecoder(f).Decode(&sp); err != nil {
+		return nil, err
+	}
+	points := make([]Point, len(sp))
+	for i, p := range sp {
+		points[i] = Point{name: p.Name, time: p.Time, fields: make([]ptFields, len(p.Fields)), tags: make([]ptTags, len(p.Tags))}
+		for j := range p.Fields {
+			points[i].fields[j] = p.Fields[j]
+		}
+		for j := range p.Tags {
+			points[i].tags[j] = p.Tags[j]
+		}
+	}
+	return points, nil
+}
+
+// drain writes spooled batches to the back end, oldest first, stopping at the
+// first failure or after spoolDrainLimit batches. It returns nil only if the
+// spool is now empty.
+func (s *diskSpool) drain(ctx context.Context, ss DBWriter) error {
+	s.Lock()
+	defer s.Unlock()
+	s.enforceLimits()
+	defer s.updateMetrics()
+	for n := 0; len(s.segments) > 0; n++ {
+		if n == spoolDrainLimit {
+			return fmt.Errorf("spool drain limit reached with %d batches remaining", len(s.segments))
+		}
+		points, err := readSegment(s.segments[0].path)
+		if err != nil {
+			log.Error("unable to read spooled batch, discarding", slog.String("file", s.segments[0].path), slog.String("error", err.Error()))
+			s.removeOldest()
+			continue
+		}
+		if err = ss.WritePoints(ctx, points); err != nil {
+			return err
+		}
+		backendPointsWritten.WithLabelValues(s.cluster, s.backend).Add(float64(countFieldSets(points)))
+		s.removeOldest()
+		if len(s.segments) == 0 {
+			log.Log(ctx, LevelNotice, "spool drained", slog.String("cluster", s.cluster), slog.String("backend", s.backend))
+		}
+	}
+	return nil
+}
+
+// updateMetrics publishes the current spool depth. Must be called with the lock held.
+func (s *diskSpool) updateMetrics() {
+	spoolBatches.WithLabelValues(s.cluster, s.backend).Set(float64(len(s.segments)))
+	spoolBytes.WithLabelValues(s.cluster, s.backend).Set(float64(s.bytes))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testSpool returns an enabled spool rooted in a temporary directory
+func testSpool(t *testing.T, sc spoolConfig) *diskSpool {
+	t.Helper()
+	sc.Enabled = true
+	if sc.Directory == "" {
+		sc.Directory = t.TempDir()
+	}
+	s, err := openSpool(sc, "clusterA", "influxdb")
+	if err != nil {
+		t.Fatalf("unable to open spool: %v", err)
+	}
+	return s
+}
+
+func TestOpenSpool_Disabled(t *testing.T) {
+	s, err := openSpool(spoolConfig{Directory: t.TempDir()}, "clusterA", "influxdb")
+	if err != nil || s != nil {
+		t.Fatalf("expected nil spool when disabled, got %v/%v", s, err)
+	}
+}
+
+func TestDiskSpool_RoundTrip(t *testing.T) {
+	setMemoryBackend()
+	s := testSpool(t, spoolConfig{})
+	for i := range 3 {
+		pts := []Point{{
+			name:   "node.cpu",
+			time:   int64(1700000000 + i),
+			fields: []ptFields{{"f": float64(i) + 0.5, "i": i, "i64": int64(i)}},
+			tags:   []ptTags{{"cluster": "clusterA", "node": "1"}},
+		}}
+		if err := s.append(pts); err != nil {
+			t.Fatalf("unexpected append error: %v", err)
+		}
+	}
+	if s.Len() != 3 {
+		t.Fatalf("expected 3 spooled batches, got %d", s.Len())
+	}
+
+	w := &recordingWriter{}
+	if err := s.drain(t.Context(), w); err != nil {
+		t.Fatalf("unexpected drain error: %v", err)
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected empty spool after drain, got %d", s.Len())
+	}
+	if len(w.batches) != 3 {
+		t.Fatalf("expected 3 drained batches, got %d", len(w.batches))
+	}
+	for i, b := range w.batches {
+		if b[0].time != int64(1700000000+i) {
+			t.Errorf("batch %d drained out of order: time %d", i, b[0].time)
+		}
+	}
+	f := w.batches[2][0].fields[0]
+	if f["f"] != 2.5 || f["i"] != 2 || f["i64"] != int64(2) {
+		t.Errorf("field values/types not preserved: %#v", f)
+	}
+	if w.batches[2][0].tags[0]["node"] != "1" {
+		t.Errorf("tags not preserved: %v", w.batches[2][0].tags[0])
+	}
+}
+
+func TestDiskSpool_DrainStopsOnFailure(t *testing.T) {
+	setMemoryBackend()
+	s := testSpool(t, spoolConfig{})
+	_ = s.append([]Point{{name: "a"}})
+	_ = s.append([]Point{{name: "b"}})
+	if err := s.drain(t.Context(), &recordingWriter{fail: true}); err == nil {
+		t.Fatalf("expected drain error when back end fails")
+	}
+	if s.Len() != 2 {
+		t.Errorf("expected batches to remain spooled, got %d", s.Len())
+	}
+}
+
+func TestDiskSpool_ReloadsExistingBatches(t *testing.T) {
+	setMemoryBackend()
+	dir := t.TempDir()
+	s := testSpool(t, spoolConfig{Directory: dir})
+	_ = s.append([]Point{{name: "first"}})
+	_ = s.append([]Point{{name: "second"}})
+
+	s2 := testSpool(t, spoolConfig{Directory: dir})
+	if s2.Len() != 2 {
+		t.Fatalf("expected 2 batches after reopening spool, got %d", s2.Len())
+	}
+	w := &recordingWriter{}
+	if err := s2.drain(t.Context(), w); err != nil {
+		t.Fatalf("unexpected drain error: %v", err)
+	}
+	if w.batches[0][0].name != "first" || w.batches[1][0].name != "second" {
+		t.Errorf("batches reloaded out of order")
+	}
+}
+
+func TestDiskSpool_Limits(t *testing.T) {
+	setMemoryBackend()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := testSpool(t, spoolConfig{MaxAge: 60})
+	s.nowFunc = func() time.Time { return now }
+	_ = s.append([]Point{{name: "old"}})
+	now = now.Add(2 * time.Minute)
+	_ = s.append([]Point{{name: "new"}})
+	if s.Len() != 1 {
+		t.Fatalf("expected batch older than max_age to be discarded, got %d batches", s.Len())
+	}
+
+	// size limit: each batch is well under 1KB, so a tiny limit keeps only the newest
+	s.maxAge = 0
+	s.maxBytes = 1
+	_ = s.append([]Point{{name: "newest"}})
+	if s.Len() != 1 {
+		t.Fatalf("expected size limit to retain only the newest batch, got %d", s.Len())
+	}
+	w := &recordingWriter{}
+	_ = s.drain(t.Context(), w)
+	if len(w.batches) != 1 || w.batches[0][0].name != "newest" {
+		t.Errorf("expected only the newest batch to remain, got %v", w.batches)
+	}
+}
+
+func TestWriteWithRetry_SpoolsAndDrains(t *testing.T) {
+	setMemoryBackend()
+	s := testSpool(t, spoolConfig{})
+	w := &recordingWriter{fail: true}
+	rp := retryPolicy{maxRetries: 2, retryIntvl: time.Millisecond, spool: s}
+
+	// back end down: batch is spooled rather than returning an error
+	if err := writeWithRetry(t.Context(), w, rp, []Point{{name: "one"}}); err != nil {
+		t.Fatalf("expected batch to be spooled, got error %v", err)
+	}
+	// still down: new batch goes straight to the spool behind the backlog
+	if err := writeWithRetry(t.Context(), w, rp, []Point{{name: "two"}}); err != nil {
+		t.Fatalf("expected batch to be spooled, got error %v", err)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 spooled batches, got %d", s.Len())
+	}
+
+	// back end recovers: backlog is drained in order ahead of the new batch
+	w.fail = false
+	if err := writeWithRetry(t.Context(), w, rp, []Point{{name: "three"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected spool to be drained, got %d", s.Len())
+	}
+	var names []string
+	for _, b := range w.batches {
+		names = append(names, b[0].name)
+	}
+	if len(names) != 3 || names[0] != "one" || names[1] != "two" || names[2] != "three" {
+		t.Errorf("expected batches in order [one two three], got %v", names)
+	}
+}
+
+func TestWriteWithRetry_NoSpoolReturnsError(t *testing.T) {
+	setMemoryBackend()
+	rp := retryPolicy{maxRetries: 2, retryIntvl: time.Millisecond}
+	if err := writeWithRetry(t.Context(), &recordingWriter{fail: true}, rp, []Point{{name: "one"}}); err == nil {
+		t.Fatalf("expected error when retries are exhausted without a spool")
+	}
+}
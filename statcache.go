@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The stat metadata cache holds the stat key listing of each OneFS release on
+// disk, one file per release, shared by every cluster running that release.
+// Entries older than the TTL are still used so that collection can start
+// straight away, but are refreshed in the background for the next startup or
+// reload.
+
+// statKeyCache is the on-disk stat key metadata cache
+type statKeyCache struct {
+	dir string
+	ttl time.Duration // entries older than this are refreshed (0 = never)
+}
+
+// statKeyCacheFile is the cached stat key metadata of one OneFS release
+type statKeyCacheFile struct {
+	OSVersion string        `json:"os_version"`
+	Fetched   time.Time     `json:"fetched"`
+	Keys      []statKeyInfo `json:"keys"`
+	Invalid   []string      `json:"invalid,omitempty"` // stats the cluster reported as not existing
+}
+
+// statKeyCacheMu serializes updates to the cache files and guards
+// statKeyRefreshes, the releases with a background refresh in progress
+var (
+	statKeyCacheMu   sync.Mutex
+	statKeyRefreshes = make(map[string]bool)
+)
+
+// newStatKeyCache returns the configured cache, or nil if it is disabled
+func newStatKeyCache(sc statCacheConfig) *statKeyCache {
+	if !sc.Enabled {
+		return nil
+	}
+	return &statKeyCache{dir: sc.Directory, ttl: time.Duration(sc.TTL) * time.Second}
+}
+
+// expired returns true if the entry is older than the TTL
+func (cf *statKeyCacheFile) expired(ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(cf.Fetched) > ttl
+}
+
+// path returns the cache file name for the OneFS release
+func (sc *statKeyCache) path(osVersion string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, osVersion)
+	return filepath.Join(sc.dir, "keys-"+name+".json")
+}
+
+// load reads the cached stat key metadata for the OneFS release
+func (sc *statKeyCache) load(osVersion string) (*statKeyCacheFile, error) {
+	cf, err := readStatKeyCacheFile(sc.path(osVersion))
+	if err != nil {
+		return nil, err
+	}
+	if cf.OSVersion != osVersion {
+		return nil, fmt.Errorf("stat key cache is for OneFS %q, not %q", cf.OSVersion, osVersion)
+	}
+	return cf, nil
+}
+
+// readStatKeyCacheFile reads and decodes a cache file
+func readStatKeyCacheFile(name string) (*statKeyCacheFile, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var cf statKeyCacheFile
+	if err := json.Unmarshal(b, &cf); err != nil {
+		return nil, fmt.Errorf("corrupt stat key cache %s: %w", name, err)
+	}
+	return &cf, nil
+}
+
+// save writes the cache file for the entry's OneFS release
+func (sc *statKeyCache) save(cf *statKeyCacheFile) error {
+	statKeyCacheMu.Lock()
+	defer statKeyCacheMu.Unlock()
+	return sc.write(cf)
+}
+
+// write replaces the cache file atomically; the caller must hold statKeyCacheMu
+func (sc *statKeyCache) write(cf *statKeyCacheFile) error {
+	if err := os.MkdirAll(sc.dir, 0o755); err != nil {
+		return fmt.Errorf("unable to create stat key cache directory: %w", err)
+	}
+	b, err := json.Marshal(cf)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(sc.dir, ".keys-*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create stat key cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("unable to write stat key cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write stat key cache file: %w", err)
+	}
+	return os.Rename(tmp.Name(), sc.path(cf.OSVersion))
+}
+
+// update adds the results of individual stat lookups to the release's
+// existing cache entry. It does nothing if there is no entry.
+func (sc *statKeyCache) update(osVersion string, found []statKeyInfo, missing []string) error {
+	statKeyCacheMu.Lock()
+	defer statKeyCacheMu.Unlock()
+	cf, err := sc.load(osVersion)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	known := indexStatKeys(cf.Keys)
+	for _, k := range found {
+		if _, ok := known[k.Key]; !ok {
+			cf.Keys = append(cf.Keys, k)
+		}
+	}
+	for _, stat := range missing {
+		if !slices.Contains(cf.Invalid, stat) {
+			cf.Invalid = append(cf.Invalid, stat)
+		}
+	}
+	return sc.write(cf)
+}
+
+// list returns every cache entry, ordered by OneFS release
+func (sc *statKeyCache) list() ([]*statKeyCacheFile, error) {
+	names, err := filepath.Glob(filepath.Join(sc.dir, "keys-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*statKeyCacheFile
+	for _, name := range names {
+		cf, err := readStatKeyCacheFile(name)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, cf)
+	}
+	slices.SortFunc(entries, func(a, b *statKeyCacheFile) int { return strings.Compare(a.OSVersion, b.OSVersion) })
+	return entries, nil
+}
+
+// invalidate removes the cache entry for the OneFS release
+func (sc *statKeyCache) invalidate(osVersion string) error {
+	statKeyCacheMu.Lock()
+	defer statKeyCacheMu.Unlock()
+	return os.Remove(sc.path(osVersion))
+}
+
+// statKeyMetadata returns the metadata of every stat key on the cluster, from
+// the cache if possible. It returns nil if the keys could not be listed, in
+// which case every stat is looked up individually.
+func (c *Cluster) statKeyMetadata(ctx context.Context, cache *statKeyCache) *statKeyCacheFile {
+	if cache != nil {
+		cf, err := cache.load(c.OSVersion)
+		if err == nil {
+			log.Debug("using cached stat key metadata", slog.String("cluster", c.String()), slog.String("version", c.OSVersion))
+			if cf.expired(cache.ttl, time.Now()) {
+				c.refreshStatKeyCache(ctx, cache)
+			}
+			return cf
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("ignoring unusable stat key cache", slog.String("cluster", c.String()), slog.String("error", err.Error()))
+		}
+	}
+	keys, err := c.listStatKeys(ctx)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Warn("unable to list stat keys, retrieving stat information individually", slog.String("cluster", c.String()), slog.String("error", err.Error()))
+		}
+		return nil
+	}
+	cf := &statKeyCacheFile{OSVersion: c.OSVersion, Fetched: time.Now(), Keys: keys}
+	if cache != nil {
+		if err := cache.save(cf); err != nil {
+			log.Warn("unable to save stat key cache", slog.String("cluster", c.String()), slog.String("error", err.Error()))
+		}
+	}
+	return cf
+}
+
+// refreshStatKeyCache relists the stat keys in the background and replaces
+// the release's cache entry, unless a refresh for the release is already in
+// progress. The refresh uses its own API session since the Cluster is owned by
+// its collection loop.
+func (c *Cluster) refreshStatKeyCache(ctx context.Context, cache *statKeyCache) {
+	osVersion := c.OSVersion
+	statKeyCacheMu.Lock()
+	if statKeyRefreshes[osVersion] {
+		statKeyCacheMu.Unlock()
+		return
+	}
+	statKeyRefreshes[osVersion] = true
+	statKeyCacheMu.Unlock()
+
+	log.Info("stat key cache expired, refreshing in the background", slog.String("cluster", c.String()), slog.String("version", osVersion))
+	rc := c.clone()
+	go func() {
+		defer func() {
+			statKeyCacheMu.Lock()
+			delete(statKeyRefreshes, osVersion)
+			statKeyCacheMu.Unlock()
+		}()
+		err := rc.Connect(ctx)
+		var keys []statKeyInfo
+		if err == nil {
+			keys, err = rc.listStatKeys(ctx)
+		}
+		if err == nil && rc.OSVersion != osVersion {
+			err = fmt.Errorf("cluster was upgraded to OneFS %s", rc.OSVersion)
+		}
+		if err == nil {
+			err = cache.save(&statKeyCacheFile{OSVersion: osVersion, Fetched: time.Now(), Keys: keys})
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Warn("unable to refresh stat key cache", slog.String("cluster", c.String()), slog.String("version", osVersion), slog.String("error", err.Error()))
+		}
+	}()
+}
+
+// runStatCache implements the stat-cache subcommand and returns the exit status
+func runStatCache(args []string) int {
+	flags := flag.NewFlagSet("stat-cache", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %s stat-cache [options] list
+       %s stat-cache [options] show <onefs version>
+       %s stat-cache [options] invalidate <onefs version>... | all
+
+Inspect or invalidate the stat metadata cache.
+
+`, os.Args[0], os.Args[0], os.Args[0])
+		flags.PrintDefaults()
+	}
+	configFileName := flags.String("config-file", "idic.toml", "pathname of config file, used for the cache settings if -dir is not set")
+	dir := flags.String("dir", "", "cache directory (default from the [stat_cache] section of the config file)")
+	match := flags.String("match", "", "only show keys whose names match this regular expression")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	sc := statCacheConfig{Enabled: true, Directory: *dir, TTL: defaultStatCacheTTL}
+	if *dir == "" {
+		conf, err := readConfig(*configFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "stat-cache: %v\n", err)
+			return 1
+		}
+		sc = conf.StatCache
+	}
+	cache := &statKeyCache{dir: sc.Directory, ttl: time.Duration(sc.TTL) * time.Second}
+
+	var err error
+	switch cmd, versions := flags.Arg(0), flags.Args()[1:]; {
+	case cmd == "list" && len(versions) == 0:
+		err = cache.writeList(os.Stdout, time.Now())
+	case cmd == "show" && len(versions) == 1:
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(*match); err == nil {
+			var cf *statKeyCacheFile
+			if cf, err = cache.load(versions[0]); err == nil {
+				err = writeStatKeysTable(os.Stdout, filterStatKeys(cf.Keys, re, ""))
+			}
+		}
+	case cmd == "invalidate" && len(versions) > 0:
+		err = cache.invalidateVersions(os.Stdout, versions)
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stat-cache: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// writeList writes a summary of the cache entries
+func (sc *statKeyCache) writeList(w io.Writer, now time.Time) error {
+	entries, err := sc.list()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tFETCHED\tKEYS\tINVALID\tEXPIRED")
+	for _, cf := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%v\n", cf.OSVersion, cf.Fetched.Format(time.RFC3339), len(cf.Keys), len(cf.Invalid), cf.expired(sc.ttl, now))
+	}
+	return tw.Flush()
+}
+
+// invalidateVersions removes the cache entries for the given OneFS releases,
+// or every entry if versions is "all"
+func (sc *statKeyCache) invalidateVersions(w io.Writer, versions []string) error {
+	if len(versions) == 1 && versions[0] == "all" {
+		entries, err := sc.list()
+		if err != nil {
+			return err
+		}
+		versions = nil
+		for _, cf := range entries {
+			versions = append(versions, cf.OSVersion)
+		}
+	}
+	for _, v := range versions {
+		if err := sc.invalidate(v); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("no cache entry for OneFS %s", v)
+			}
+			return err
+		}
+		fmt.Fprintf(w, "invalidated stat key cache for OneFS %s\n", v)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatKeyCache_VersionMismatch(t *testing.T) {
+	cache := &statKeyCache{dir: t.TempDir()}
+	if err := cache.save(&statKeyCacheFile{OSVersion: "9.5/0", Keys: []statKeyInfo{{Key: "a"}}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cf, err := cache.load("9.5/0")
+	if err != nil || len(cf.Keys) != 1 {
+		t.Fatalf("expected cached keys, got %+v, %v", cf, err)
+	}
+	// a release whose sanitized name collides must not use the entry
+	if _, err := cache.load("9.5_0"); err == nil {
+		t.Errorf("expected version mismatch error")
+	}
+}
+
+func TestStatKeyMetadata_RefreshesExpiredEntry(t *testing.T) {
+	setMemoryBackend()
+	var listings, lookups atomic.Int32
+	c := newStatKeysServer(t, &listings, &lookups)
+	sc := statCacheConfig{Enabled: true, Directory: t.TempDir(), TTL: 60}
+	cache := newStatKeyCache(sc)
+	stale := &statKeyCacheFile{
+		OSVersion: c.OSVersion,
+		Fetched:   time.Now().Add(-time.Hour),
+		Keys:      []statKeyInfo{{Key: "node.ifs.bytes.out", Units: "stale"}},
+	}
+	if err := cache.save(stale); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the stale entry is used straight away
+	sg := map[string]statGroup{"g": {stats: []string{"node.ifs.bytes.out"}}}
+	sd := c.fetchStatDetails(t.Context(), sg, sc)
+	if sd["node.ifs.bytes.out"].units != "stale" {
+		t.Errorf("expected the expired entry to be used, got %+v", sd["node.ifs.bytes.out"])
+	}
+
+	// and refreshed in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cf, err := cache.load(c.OSVersion)
+		if err == nil && !cf.expired(cache.ttl, time.Now()) {
+			if cf.Keys[0].Units != "bytes" {
+				t.Errorf("expected refreshed metadata, got %+v", cf.Keys[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cache entry was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if listings.Load() != 1 {
+		t.Errorf("expected one background listing, got %d", listings.Load())
+	}
+}
+
+func TestStatKeyCache_ListAndInvalidate(t *testing.T) {
+	cache := &statKeyCache{dir: t.TempDir(), ttl: time.Hour}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, cf := range []*statKeyCacheFile{
+		{OSVersion: "9.7.0.0", Fetched: now.Add(-2 * time.Hour), Keys: []statKeyInfo{{Key: "a"}}, Invalid: []string{"b"}},
+		{OSVersion: "9.11.0.0", Fetched: now},
+	} {
+		if err := cache.save(cf); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	var sb strings.Builder
+	if err := cache.writeList(&sb, now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "9.11.0.0") || !strings.HasSuffix(lines[2], "true") {
+		t.Errorf("unexpected listing:\n%s", sb.String())
+	}
+
+	if err := cache.invalidateVersions(&sb, []string{"9.5.0.0"}); err == nil {
+		t.Errorf("expected error invalidating a missing entry")
+	}
+	if err := cache.invalidateVersions(&sb, []string{"all"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries, _ := cache.list(); len(entries) != 0 {
+		t.Errorf("expected every entry to be invalidated, got %d", len(entries))
+	}
+}
+
+func TestStatCache_DisabledByDefault(t *testing.T) {
+	// the default directory is relative to the working directory, which may
+	// not be writable, e.g. under systemd
+	if sc := defaultConfig().StatCache; sc.Enabled || sc.Directory != defaultStatCacheDirectory {
+		t.Errorf("expected the stat cache to be disabled by default, got %+v", sc)
+	}
+}
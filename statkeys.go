@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// statKeysPath is the statistics keys listing endpoint
+const statKeysPath = "/platform/1/statistics/keys"
+
+// statKeysPageSize is the number of keys requested per page of the listing
+const statKeysPageSize = 1000
+
+// statKeyInfo is the API-provided metadata for a single stat key, as returned
+// by the statistics keys listing
+type statKeyInfo struct {
+	Key            string  `json:"key"`
+	Description    string  `json:"description"`
+	Units          string  `json:"units"`
+	Scope          string  `json:"scope"`
+	Type           string  `json:"type"`
+	Aggregation    string  `json:"aggregation_type"`
+	UpdateInterval float64 `json:"update_interval"` // 0 == on-demand
+}
+
+// statKeysResponse is the JSON returned by the statistics keys listing
+type statKeysResponse struct {
+	Keys []struct {
+		Key             string `json:"key"`
+		Description     string `json:"description"`
+		Units           string `json:"units"`
+		Scope           string `json:"scope"`
+		Type            string `json:"type"`
+		AggregationType string `json:"aggregation_type"`
+		Policies        []struct {
+			Interval   float64 `json:"interval"`
+			Persistent bool    `json:"persistent"`
+		} `json:"policies"`
+	} `json:"keys"`
+	Resume *string `json:"resume"`
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// parseStatKeys parses one page of the statistics keys listing, returning
+// the keys and the token to resume the listing (empty on the last page)
+func parseStatKeys(res []byte) ([]statKeyInfo, string, error) {
+	var r statKeysResponse
+	if err := json.Unmarshal(res, &r); err != nil {
+		return nil, "", fmt.Errorf("unable to parse stat keys listing: %w", err)
+	}
+	if len(r.Errors) > 0 {
+		return nil, "", fmt.Errorf("stat keys listing returned error code %s, message %s", r.Errors[0].Code, r.Errors[0].Message)
+	}
+	keys := make([]statKeyInfo, 0, len(r.Keys))
+	for _, k := range r.Keys {
+		info := statKeyInfo{
+			Key:         k.Key,
+			Description: k.Description,
+			Units:       k.Units,
+			Scope:       k.Scope,
+			Type:        k.Type,
+			Aggregation: k.AggregationType,
+		}
+		// we only want the current update interval, not the historical ones
+		for _, pol := range k.Policies {
+			if !pol.Persistent {
+				info.UpdateInterval = pol.Interval
+				break
+			}
+		}
+		keys = append(keys, info)
+	}
+	var resume string
+	if r.Resume != nil {
+		resume = *r.Resume
+	}
+	return keys, resume, nil
+}
+
+// listStatKeys returns the metadata for every queryable stat key on the cluster
+func (c *Cluster) listStatKeys(ctx context.Context) ([]statKeyInfo, error) {
+	var all []statKeyInfo
+	path := statKeysPath + "?limit=" + strconv.Itoa(statKeysPageSize)
+	for {
+		resp, err := c.restGet(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list stat keys: %w", err)
+		}
+		keys, resume, err := parseStatKeys(resp)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, keys...)
+		if resume == "" {
+			return all, nil
+		}
+		// resume cannot be combined with other query arguments
+		path = statKeysPath + "?resume=" + url.QueryEscape(resume)
+	}
+}
+
+// keyInfo converts the collector's metadata for the stat back to the listing form
+func (d statDetail) keyInfo(key string) statKeyInfo {
+	return statKeyInfo{
+		Key:            key,
+		Description:    d.description,
+		Units:          d.units,
+		Scope:          d.scope,
+		Type:           d.datatype,
+		Aggregation:    d.aggType,
+		UpdateInterval: d.updateIntvl,
+	}
+}
+
+// detail converts the listing metadata to the form used by the collector
+func (k statKeyInfo) detail() statDetail {
+	return statDetail{
+		valid:       true,
+		description: k.Description,
+		units:       k.Units,
+		scope:       k.Scope,
+		datatype:    k.Type,
+		aggType:     k.Aggregation,
+		updateIntvl: k.UpdateInterval,
+	}
+}
+
+// indexStatKeys returns the keys indexed by name
+func indexStatKeys(keys []statKeyInfo) map[string]statKeyInfo {
+	m := make(map[string]statKeyInfo, len(keys))
+	for _, k := range keys {
+		m[k.Key] = k
+	}
+	return m
+}
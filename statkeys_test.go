@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newStatKeysServer returns a fake cluster serving the stat keys listing
+// and the per-key detail endpoint for node.disk.count only
+func newStatKeysServer(t *testing.T, listings *atomic.Int32, lookups *atomic.Int32) *Cluster {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == configPath:
+			_, _ = w.Write([]byte(`{"name":"Test","onefs_version":{"version":"9.11.0.0"}}`))
+		case r.URL.Path == statKeysPath && r.URL.RawQuery == "limit=1000":
+			listings.Add(1)
+			_, _ = w.Write([]byte(statKeysPage2))
+		case r.URL.Path == statInfoPath+"node.disk.count":
+			lookups.Add(1)
+			_, _ = w.Write([]byte(`{"keys":[{"key":"node.disk.count","description":"Disks","units":"none","scope":"node","type":"int32","aggregation_type":"last","policies":null}]}`))
+		case strings.HasPrefix(r.URL.Path, statInfoPath):
+			lookups.Add(1)
+			http.NotFound(w, r)
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return &Cluster{
+		AuthInfo:   AuthInfo{Username: "user", Password: "pass"},
+		AuthType:   authtypeBasic,
+		Hostname:   u.Hostname(),
+		Port:       port,
+		OSVersion:  "9.11.0.0",
+		baseURL:    srv.URL,
+		client:     srv.Client(),
+		maxRetries: 1,
+	}
+}
+
+func TestFetchStatDetails_BulkWithFallback(t *testing.T) {
+	setMemoryBackend()
+	var listings, lookups atomic.Int32
+	c := newStatKeysServer(t, &listings, &lookups)
+	sg := map[string]statGroup{"g": {stats: []string{"node.ifs.bytes.out", "node.disk.count", "node.no.such.stat"}}}
+	sc := statCacheConfig{Enabled: true, Directory: t.TempDir()}
+
+	sd := c.fetchStatDetails(t.Context(), sg, sc)
+	if d := sd["node.ifs.bytes.out"]; !d.valid || d.updateIntvl != 5 || d.units != "bytes" {
+		t.Errorf("expected listed stat metadata, got %+v", d)
+	}
+	if d := sd["node.disk.count"]; !d.valid || d.datatype != "int32" {
+		t.Errorf("expected stat missing from the listing to be looked up, got %+v", d)
+	}
+	if sd["node.no.such.stat"].valid {
+		t.Errorf("expected unknown stat to be invalid")
+	}
+	if listings.Load() != 1 || lookups.Load() != 2 {
+		t.Errorf("expected 1 listing and 2 individual lookups, got %d and %d", listings.Load(), lookups.Load())
+	}
+
+	// a second cluster on the same release uses the cache, including the
+	// results of the individual lookups
+	sd = c.fetchStatDetails(t.Context(), sg, sc)
+	if listings.Load() != 1 || lookups.Load() != 2 {
+		t.Errorf("expected the cache to be used, got %d listings and %d lookups", listings.Load(), lookups.Load())
+	}
+	if !sd["node.disk.count"].valid || sd["node.no.such.stat"].valid {
+		t.Errorf("expected cached validity, got %+v", sd)
+	}
+	if !sd["node.ifs.bytes.out"].valid {
+		t.Errorf("expected cached stat metadata")
+	}
+}
+
+func TestFetchStatDetails_CacheDisabled(t *testing.T) {
+	setMemoryBackend()
+	var listings, lookups atomic.Int32
+	c := newStatKeysServer(t, &listings, &lookups)
+	sg := map[string]statGroup{"g": {stats: []string{"node.ifs.bytes.out"}}}
+	dir := t.TempDir()
+	c.fetchStatDetails(t.Context(), sg, statCacheConfig{Directory: dir})
+	c.fetchStatDetails(t.Context(), sg, statCacheConfig{Directory: dir})
+	if listings.Load() != 2 {
+		t.Errorf("expected every fetch to list the keys, got %d listings", listings.Load())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected no cache files, got %v", entries)
+	}
+}
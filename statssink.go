@@ -1,6 +1,9 @@
 package main
 
-import "context"
+import (
+	"context"
+	"log/slog"
+)
 
 // DBWriter defines an interface to write OneFS stats to a persistent store/database
 type DBWriter interface {
@@ -9,3 +12,36 @@ type DBWriter interface {
 	// Write an array of points to the sink
 	WritePoints(ctx context.Context, points []Point) error
 }
+
+// DBCloser is an optional interface implemented by DBWriters that buffer
+// points or hold connections. Close flushes any pending points and releases
+// resources; it is called when collection for the cluster stops (e.g., on
+// shutdown or config reload).
+type DBCloser interface {
+	Close() error
+}
+
+// wrappedWriter is embedded by the DBWriters that wrap another back end's
+// writer, and passes Close on to the wrapped writer
+type wrappedWriter struct {
+	DBWriter
+}
+
+// Close closes the wrapped writer if it implements DBCloser
+func (w wrappedWriter) Close() error {
+	if c, ok := w.DBWriter.(DBCloser); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// closeDBWriter closes the writer if it implements DBCloser
+func closeDBWriter(cluster string, ss DBWriter) {
+	c, ok := ss.(DBCloser)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		log.Warn("error closing back end", slog.String("cluster", cluster), slog.String("error", err.Error()))
+	}
+}
@@ -37,7 +37,7 @@ func TestDecodeProtocolSummaryStat_WithNode(t *testing.T) {
 		TimeMin:         100.0,
 		TimeStandardDev: 300.0,
 	}
-	fields, tags := decodeProtocolSummaryStat("clusterA", item)
+	fields, tags := decodeProtocolSummaryStat("clusterA", nil, item)
 
 	// 5 tags: cluster, class, operation, protocol, node
 	if len(tags) != 5 {
@@ -82,7 +82,7 @@ func TestDecodeProtocolSummaryStat_WithoutNode(t *testing.T) {
 		Operation: "smb2_write",
 		Protocol:  "smb2",
 	}
-	fields, tags := decodeProtocolSummaryStat("clusterB", item)
+	fields, tags := decodeProtocolSummaryStat("clusterB", nil, item)
 
 	// 4 tags: cluster, class, operation, protocol (no node)
 	if len(tags) != 4 {
@@ -129,7 +129,7 @@ func TestDecodeClientSummaryStat_WithNodeAndUser(t *testing.T) {
 			Type string `json:"type"`
 		}{ID: "UID:1000", Name: "alice", Type: "user"},
 	}
-	fields, tags := decodeClientSummaryStat("clusterC", item)
+	fields, tags := decodeClientSummaryStat("clusterC", nil, item)
 
 	// 11 tags: cluster, class, local_addr, local_name, protocol, remote_addr, remote_name, node, user_id, user_name, user_type
 	if len(tags) != 11 {
@@ -172,7 +172,7 @@ func TestDecodeClientSummaryStat_WithoutNodeOrUser(t *testing.T) {
 		RemoteName: "winclient.example.com",
 		User:       nil,
 	}
-	fields, tags := decodeClientSummaryStat("clusterD", item)
+	fields, tags := decodeClientSummaryStat("clusterD", nil, item)
 
 	// 7 tags: cluster, class, local_addr, local_name, protocol, remote_addr, remote_name
 	if len(tags) != 7 {
@@ -211,7 +211,7 @@ func TestDecodeDriveSummaryStat(t *testing.T) {
 		XfersIn:          25.0,
 		XfersOut:         50.0,
 	}
-	fields, tags := decodeDriveSummaryStat("clusterE", item)
+	fields, tags := decodeDriveSummaryStat("clusterE", nil, item)
 
 	// 3 tags: cluster, drive_id, type
 	if len(tags) != 3 {
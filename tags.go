@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Extra tags are stamped on every point from a cluster, e.g. to record the
+// site, datacenter, environment or owner of the cluster. A tags table in
+// [global] applies to every cluster, and a tags table in a [[cluster]]
+// stanza adds to it, overriding global tags of the same name:
+//
+//	tags = { site = "ams1", env = "prod", owner = "$env:OWNER" }
+//
+// As with passwords, a value of the form $env:VAR is read from the
+// environment. The placeholders {cluster}, {hostname} and {onefs_version}
+// are replaced by the cluster's name, configured hostname and OneFS release
+// once the collector has connected to the cluster. The names of the tags the
+// collector sets itself, and the Prometheus instance_label_name, are reserved,
+// since the collector's values would silently replace the configured ones.
+
+// reservedTagNames are the tags set by the stat and summary stat decoders,
+// including the string fields of the protocol, heat and event stats, and the
+// labels of the self-metrics, which are pushed as gostats.* points
+var reservedTagNames = []string{
+	"cluster", "node", "devid", "degraded",
+	"class", "class_name", "operation", "op_name", "event_name", "protocol", "path", "lin",
+	"local_addr", "local_name", "remote_addr", "remote_name", "user_id", "user_name", "user_type",
+	"drive_id", "type",
+	// the labels of the pushed self-metrics
+	"backend", "bucket", "limiter", "reason", "result", "stat",
+}
+
+// tagNameRegex matches tag names that are valid for every back end,
+// including Prometheus label names
+var tagNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// tagPlaceholderRegex matches the placeholders in a tag value
+var tagPlaceholderRegex = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// tagPlaceholders are the placeholders that may be used in tag values
+var tagPlaceholders = []string{"cluster", "hostname", "onefs_version"}
+
+// validateTags checks the names and values of a tags table. labels are the
+// Prometheus instance label names, which the tags must not use either.
+func validateTags(tags map[string]string, labels []string) error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(tags)) {
+		switch {
+		case !tagNameRegex.MatchString(name) || strings.HasPrefix(name, "__"):
+			errs = append(errs, fmt.Errorf("invalid tag name %q", name))
+		case slices.Contains(reservedTagNames, name):
+			errs = append(errs, fmt.Errorf("tag name %q is reserved", name))
+		case slices.Contains(labels, name):
+			errs = append(errs, fmt.Errorf("tag name %q is the Prometheus instance_label_name", name))
+		}
+		for _, m := range tagPlaceholderRegex.FindAllStringSubmatch(tags[name], -1) {
+			if !slices.Contains(tagPlaceholders, m[1]) {
+				errs = append(errs, fmt.Errorf("tag %s: unknown placeholder %s", name, m[0]))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateClusterTags checks the global and per-cluster tags tables
+func validateClusterTags(config *tomlConfig) error {
+	var errs []error
+	labels := instanceLabelNames(config)
+	if err := validateTags(config.Global.Tags, labels); err != nil {
+		errs = append(errs, fmt.Errorf("[global] tags: %w", err))
+	}
+	for _, cl := range config.Clusters {
+		if err := validateTags(cl.Tags, labels); err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: tags: %w", cl.Hostname, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// instanceLabelNames returns the instance_label_name of the [prometheus]
+// stanza and of the Prometheus [[backend]] instances
+func instanceLabelNames(config *tomlConfig) []string {
+	var labels []string
+	if l := config.Prometheus.InstanceLabelName; l != nil && *l != "" {
+		labels = append(labels, *l)
+	}
+	for _, b := range config.Backends {
+		if b.Prometheus != nil && b.Prometheus.InstanceLabelName != nil && *b.Prometheus.InstanceLabelName != "" {
+			labels = append(labels, *b.Prometheus.InstanceLabelName)
+		}
+	}
+	return labels
+}
+
+// clusterTags returns the extra tags of the cluster, with the values read
+// from the environment where required but the placeholders not yet expanded
+func clusterTags(cc clusterConf, gc globalConfig) (ptTags, error) {
+	if len(gc.Tags) == 0 && len(cc.Tags) == 0 {
+		return nil, nil
+	}
+	tags := make(ptTags, len(gc.Tags)+len(cc.Tags))
+	maps.Copy(tags, gc.Tags)
+	maps.Copy(tags, cc.Tags)
+	for name, value := range tags {
+		v, err := secretFromEnv(value)
+		if err != nil {
+			return nil, fmt.Errorf("tag %s: %w", name, err)
+		}
+		tags[name] = v
+	}
+	return tags, nil
+}
+
+// expandTags returns the tags with the placeholders replaced by the
+// cluster's details
+func expandTags(tags ptTags, c *Cluster) ptTags {
+	if len(tags) == 0 {
+		return nil
+	}
+	r := strings.NewReplacer("{cluster}", c.ClusterName, "{hostname}", c.Hostname, "{onefs_version}", c.OSVersion)
+	expanded := make(ptTags, len(tags))
+	for name, value := range tags {
+		expanded[name] = r.Replace(value)
+	}
+	return expanded
+}
+
+// baseTags returns the tags every point from the cluster starts with: the
+// extra tags and the cluster name
+func baseTags(cluster string, extra ptTags) ptTags {
+	tags := make(ptTags, len(extra)+1)
+	maps.Copy(tags, extra)
+	tags["cluster"] = cluster
+	return tags
+}
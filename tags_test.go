@@ -0,0 +1,186 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateTags(t *testing.T) {
+	if err := validateTags(map[string]string{"site": "ams1", "env_name": "{cluster}-{onefs_version}"}, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err := validateTags(map[string]string{"node": "x", "1st": "x", "__meta": "x", "owner": "{owner}"}, nil)
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 4 {
+		t.Errorf("expected 4 errors, got %v", err)
+	}
+	// tags set by the decoders and the Prometheus instance label would be overwritten
+	err = validateTags(map[string]string{"op_name": "x", "drive_id": "x", "type": "x", "user_id": "x", "isilon_cluster": "x", "site": "x",
+		"backend": "x", "result": "x", "reason": "x", "limiter": "x"}, []string{"isilon_cluster"})
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 9 || !strings.Contains(err.Error(), `"isilon_cluster" is the Prometheus instance_label_name`) {
+		t.Errorf("expected 9 errors, got %v", err)
+	}
+}
+
+func TestInstanceLabelNames(t *testing.T) {
+	conf := defaultConfig()
+	if labels := instanceLabelNames(&conf); len(labels) != 0 {
+		t.Errorf("expected no instance labels by default, got %v", labels)
+	}
+	conf.Prometheus.InstanceLabelName = ptr("isilon_cluster")
+	conf.Backends = []backendConfig{
+		{Name: "prom2", Type: promPluginName, Prometheus: &prometheusConfig{InstanceLabelName: ptr("onefs")}},
+		{Name: "prom3", Type: promPluginName, Prometheus: &prometheusConfig{InstanceLabelName: ptr("")}},
+		{Name: "file2", Type: filePluginName},
+	}
+	if labels := instanceLabelNames(&conf); !slices.Equal(labels, []string{"isilon_cluster", "onefs"}) {
+		t.Errorf("unexpected instance labels %v", labels)
+	}
+}
+
+func TestClusterTags(t *testing.T) {
+	t.Setenv("GOSTATS_TEST_OWNER", "storage-team")
+	gc := globalConfig{Tags: map[string]string{"site": "ams1", "env": "prod"}}
+	cc := clusterConf{Hostname: "cluster1", Tags: map[string]string{"env": "test", "owner": "$env:GOSTATS_TEST_OWNER"}}
+	tags, err := clusterTags(cc, gc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := ptTags{"site": "ams1", "env": "test", "owner": "storage-team"}
+	if !maps.Equal(tags, want) {
+		t.Errorf("expected %v, got %v", want, tags)
+	}
+	if gc.Tags["env"] != "prod" {
+		t.Errorf("expected the global tags to be left unchanged")
+	}
+
+	cc.Tags["owner"] = "$env:GOSTATS_TEST_NOSUCH"
+	if _, err := clusterTags(cc, gc); err == nil || !strings.Contains(err.Error(), "GOSTATS_TEST_NOSUCH") {
+		t.Errorf("expected an unset variable error, got %v", err)
+	}
+	if tags, err := clusterTags(clusterConf{}, globalConfig{}); tags != nil || err != nil {
+		t.Errorf("expected no tags, got %v, %v", tags, err)
+	}
+}
+
+func TestExtraTags_Connect(t *testing.T) {
+	setMemoryBackend()
+	_, c := newSimCluster(t, 1)
+	c.tagConf = ptTags{"site": "ams1", "id": "{cluster}@{hostname}", "release": "onefs-{onefs_version}"}
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+	want := ptTags{"site": "ams1", "id": "simcluster@" + c.Hostname, "release": "onefs-9.11.0.0"}
+	if !maps.Equal(c.tags, want) {
+		t.Errorf("expected %v, got %v", want, c.tags)
+	}
+	if clone := c.clone(); !maps.Equal(clone.tags, want) {
+		t.Errorf("expected the clone to keep the tags, got %v", clone.tags)
+	}
+}
+
+func TestDecodeStat_ExtraTags(t *testing.T) {
+	setMemoryBackend()
+	node := 2
+	stat := StatResult{Devid: 3, Node: &node, Key: "node.cpu.user.avg", Value: 12.5}
+	extra := ptTags{"site": "ams1", "cluster": "other", "node": "other"}
+	_, ta, err := decodeStat("clusterA", extra, stat, true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := ptTags{"cluster": "clusterA", "node": "2", "devid": "3", "degraded": "false", "site": "ams1"}
+	if len(ta) != 1 || !maps.Equal(ta[0], want) {
+		t.Errorf("expected the extra tags under the built-in tags, got %v", ta)
+	}
+	if extra["cluster"] != "other" {
+		t.Errorf("expected the extra tags to be left unchanged")
+	}
+
+	_, tags := decodeDriveSummaryStat("clusterA", ptTags{"site": "ams1"}, SummaryStatsDriveItem{DriveID: "1:1", Type: "SSD"})
+	if tags["site"] != "ams1" || tags["cluster"] != "clusterA" || tags["drive_id"] != "1:1" {
+		t.Errorf("expected the extra tags on summary stats, got %v", tags)
+	}
+}
+
+func TestCheckConfig_Tags(t *testing.T) {
+	setMemoryBackend()
+	path := writeTestConfig(t, `[global]
+version = "v0.39"
+stats_processor = "discard"
+active_stat_groups = ["cpu"]
+tags = { site = "ams1", cluster = "x", protocol = "x" }
+
+[[cluster]]
+hostname = "cluster1"
+username = "user"
+password = "pass"
+tags = { env = "{environment}" }
+
+[[cluster]]
+hostname = "cluster2"
+username = "user"
+password = "pass"
+tags = { owner = "$env:GOSTATS_TEST_NOSUCH" }
+
+[[cluster]]
+hostname = "cluster3"
+username = "user"
+password = "pass"
+tags = { isilon_cluster = "x" }
+
+[prometheus]
+instance_label_name = "isilon_cluster"
+
+[[statgroup]]
+name = "cpu"
+update_interval = "*"
+stats = ["node.cpu.user.avg"]
+`)
+	cc, conf := checkConfig(path)
+	if conf == nil {
+		t.Fatalf("expected the config to parse, got %+v", cc.problems)
+	}
+	for _, want := range []struct {
+		line int
+		msg  string
+	}{
+		{5, `tag name "cluster" is reserved`},
+		{5, `tag name "protocol" is reserved`},
+		{11, "unknown placeholder {environment}"},
+		{17, "GOSTATS_TEST_NOSUCH"},
+		{23, `tag name "isilon_cluster" is the Prometheus instance_label_name`},
+	} {
+		if !problemAt(cc, want.line, severityError, want.msg) {
+			t.Errorf("expected error %q at line %d, got %+v", want.msg, want.line, cc.problems)
+		}
+	}
+	if len(cc.problems) != 4 {
+		t.Errorf("expected 4 problems, got %+v", cc.problems)
+	}
+}
+
+func TestReservedTagNames_SelfMetrics(t *testing.T) {
+	families, err := selfRegistry.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, mf := range families {
+		if !strings.HasPrefix(mf.GetName(), selfMetricsNamespace+"_") {
+			continue // runtime metrics have no cluster label and are not pushed
+		}
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() != "cluster" && !slices.Contains(reservedTagNames, lp.GetName()) {
+					t.Errorf("%s: self-metric label %q is not a reserved tag name", mf.GetName(), lp.GetName())
+				}
+			}
+		}
+	}
+}